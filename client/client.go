@@ -3,8 +3,12 @@ package gnatt
 import (
 	"errors"
 	. "github.com/alsm/gnatt/packets"
+	"github.com/pion/dtls/v2"
+	"github.com/tarm/serial"
+	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"sync"
 )
 
@@ -36,29 +40,105 @@ type SNClient struct {
 	PredefinedTopics          map[string]uint16
 	PredefinedMessageHandlers map[uint16]MessageHandler
 	DefaultMessageHandler     MessageHandler
-	MessageIds                mids
-	will                      Will
-	suTokens                  map[int]Token
-	conn                      net.Conn
-	incoming                  chan Message
-	outgoing                  chan *MessageAndToken
-	stop                      chan struct{}
-	state                     byte
+	// MTU is the largest packet the client sends or receives, PUBLISHes
+	// that would be larger fail with ErrPacketTooLarge.
+	MTU int
+	// ProtocolVersion is the version of MQTT-SN to connect with,
+	// VERSION_1_2 unless set to VERSION_2_0 before Connect.
+	ProtocolVersion byte
+	// SessionExpiry is the number of seconds a v2.0 session is asked
+	// to outlive its connection, once connected it is the number the
+	// gateway granted.
+	SessionExpiry uint32
+	// AuthMethod, if set, has a v2.0 client send an AUTH with AuthData
+	// after its CONNECT, eg "PLAIN" with "\x00user\x00password".
+	AuthMethod string
+	AuthData   []byte
+	MessageIds mids
+	will       Will
+	suTokens   map[int]Token
+	conn       io.ReadWriteCloser
+	stream     bool
+	incoming   chan Message
+	outgoing   chan *MessageAndToken
+	stop       chan struct{}
+	state      byte
 }
 
+// NewClient connects to the gateway at server, which is one of
+// "udp://host:port", "tcp://host:port" or "serial:///dev/ttyUSB0?baud=9600".
+// A URI without a scheme is taken to be udp.
 func NewClient(server string, clientid string) (*SNClient, error) {
-	c := &SNClient{}
-	c.ClientId = clientid
 	serverURI, err := url.Parse(server)
 	if err != nil {
 		ERROR.Println(err.Error())
 		return nil, err
 	}
-	c.conn, err = net.Dial("udp", serverURI.Host)
+	var conn io.ReadWriteCloser
+	var stream bool
+	switch serverURI.Scheme {
+	case "udp", "":
+		conn, err = net.Dial("udp", serverURI.Host)
+	case "tcp":
+		conn, err = net.Dial("tcp", serverURI.Host)
+		stream = true
+	case "serial":
+		baud := 9600
+		if b := serverURI.Query().Get("baud"); b != "" {
+			if baud, err = strconv.Atoi(b); err != nil {
+				ERROR.Println(err.Error())
+				return nil, err
+			}
+		}
+		conn, err = serial.OpenPort(&serial.Config{Name: serverURI.Path, Baud: baud})
+		stream = true
+	default:
+		err = errors.New("Unsupported scheme: " + serverURI.Scheme)
+	}
+	if err != nil {
+		ERROR.Println(err.Error())
+		return nil, err
+	}
+	return newClient(conn, stream, clientid), nil
+}
+
+// NewDTLSClient connects to a gateway listening for DTLS on server,
+// "dtls://host:port". config holds the client's certificate or its
+// pre-shared key, in which case the identity sent in the handshake
+// should be clientid.
+func NewDTLSClient(server string, clientid string, config *dtls.Config) (*SNClient, error) {
+	serverURI, err := url.Parse(server)
+	if err != nil {
+		ERROR.Println(err.Error())
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", serverURI.Host)
+	if err != nil {
+		ERROR.Println(err.Error())
+		return nil, err
+	}
+	conn, err := dtls.Dial("udp", raddr, config)
 	if err != nil {
 		ERROR.Println(err.Error())
 		return nil, err
 	}
+	return newClient(conn, false, clientid), nil
+}
+
+// NewStreamClient talks to a gateway over a byte stream that is already
+// open, such as a pseudo-terminal or one end of a net.Pipe. Packets on
+// the stream are delimited by their length headers.
+func NewStreamClient(rw io.ReadWriteCloser, clientid string) *SNClient {
+	return newClient(rw, true, clientid)
+}
+
+func newClient(conn io.ReadWriteCloser, stream bool, clientid string) *SNClient {
+	c := &SNClient{}
+	c.ClientId = clientid
+	c.conn = conn
+	c.stream = stream
+	c.MTU = 1500
+	c.ProtocolVersion = VERSION_1_2
 	c.RegisteredTopics = make(map[string]uint16)
 	c.MessageHandlers = make(map[uint16]MessageHandler)
 	c.PredefinedTopics = make(map[string]uint16)
@@ -72,7 +152,7 @@ func NewClient(server string, clientid string) (*SNClient, error) {
 	go c.send()
 	go c.handle()
 
-	return c, nil
+	return c
 }
 
 func (c *SNClient) setState(s byte) {
@@ -86,13 +166,39 @@ func (c *SNClient) Connect() *ConnectToken {
 	ct := newToken(CONNECT).(*ConnectToken)
 	c.suTokens[CONNECT] = ct
 	cp := NewMessage(CONNECT).(*ConnectMessage)
+	cp.ProtocolId = c.ProtocolVersion
 	cp.CleanSession = true
 	cp.ClientId = []byte(c.ClientId)
 	cp.Duration = 30
 	if c.will.Topic != "" {
 		cp.Will = true
 	}
+	var ap *AuthMessage
+	if c.ProtocolVersion >= VERSION_2_0 {
+		cp.SessionExpiry = c.SessionExpiry
+		cp.MaxPacketSize = uint16(c.MTU)
+		if c.MTU > MaxPacketSize {
+			cp.MaxPacketSize = MaxPacketSize
+		}
+		if c.AuthMethod != "" {
+			cp.Auth = true
+			ap = NewAuthMessage(RC_CONTINUE_AUTH, []byte(c.AuthMethod), c.AuthData)
+		}
+	}
+	if err := cp.Validate(); err != nil {
+		ct.fail(err)
+		return ct
+	}
+	if ap != nil {
+		if err := ap.Validate(); err != nil {
+			ct.fail(err)
+			return ct
+		}
+	}
 	cp.Write(c.conn)
+	if ap != nil {
+		ap.Write(c.conn)
+	}
 	return ct
 }
 
@@ -148,10 +254,20 @@ func (c *SNClient) SubscribePredefined(topicid uint16, qos byte, mh MessageHandl
 func (c *SNClient) Publish(topic string, qos byte, retain bool, data []byte) *PublishToken {
 	t := newToken(PUBLISH).(*PublishToken)
 	p := NewMessage(PUBLISH).(*PublishMessage)
-	p.TopicId = c.RegisteredTopics[topic]
+	if id, ok := c.RegisteredTopics[topic]; ok || c.ProtocolVersion < VERSION_2_0 {
+		p.TopicId = id
+	} else {
+		// v2.0 can name a topic that was never registered in full
+		p.TopicIdType = 0x03
+		p.TopicName = []byte(topic)
+	}
 	p.Qos = qos
 	p.Retain = retain
 	p.Data = data
+	if p.Size() > c.MTU {
+		t.fail(ErrPacketTooLarge)
+		return t
+	}
 	c.outgoing <- &MessageAndToken{m: p, t: t}
 	return t
 }
@@ -164,6 +280,41 @@ func (c *SNClient) PublishPredefined(topicid uint16, qos byte, retain bool, data
 	p.Qos = qos
 	p.Retain = retain
 	p.Data = data
+	if p.Size() > c.MTU {
+		t.fail(ErrPacketTooLarge)
+		return t
+	}
+	c.outgoing <- &MessageAndToken{m: p, t: t}
+	return t
+}
+
+// PublishQoSMinusOne publishes without connecting first, the token
+// completes once the PUBLISH is sent as there is no acknowledgement.
+// topic must be a 2 character short topic name or one of the
+// PredefinedTopics, or with v2.0 any topic name.
+func (c *SNClient) PublishQoSMinusOne(topic string, retain bool, data []byte) *PublishToken {
+	t := newToken(PUBLISH).(*PublishToken)
+	p := NewMessage(PUBLISH).(*PublishMessage)
+	if id, ok := c.PredefinedTopics[topic]; ok {
+		p.TopicIdType = 0x01
+		p.TopicId = id
+	} else if len(topic) == 2 {
+		p.TopicIdType = 0x02
+		p.TopicId = uint16(topic[0])<<8 | uint16(topic[1])
+	} else if c.ProtocolVersion >= VERSION_2_0 {
+		p.TopicIdType = 0x03
+		p.TopicName = []byte(topic)
+	} else {
+		t.fail(ErrInvalidTopicId)
+		return t
+	}
+	p.Qos = QOS_MINUS_ONE
+	p.Retain = retain
+	p.Data = data
+	if p.Size() > c.MTU {
+		t.fail(ErrPacketTooLarge)
+		return t
+	}
 	c.outgoing <- &MessageAndToken{m: p, t: t}
 	return t
 }
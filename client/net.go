@@ -10,10 +10,19 @@ func (c *SNClient) receive() {
 
 	DEBUG.Println(NET, "started receive()")
 	for {
-		if m, err = ReadPacket(c.conn); err != nil {
+		m, err = c.readPacket()
+		if err != nil {
+			// a bad datagram is dropped, but on a stream it means
+			// packets can no longer be told apart, unless it was only
+			// too large
+			if (!c.stream && malformed(err)) || err == ErrPacketTooLarge {
+				ERROR.Println(NET, "dropping malformed packet:", err)
+				continue
+			}
 			break
 		}
-		DEBUG.Println(NET, "Received", MessageNames[m.MessageType()])
+		DEBUG.Println(NET, "Received", m)
+		c.trace("received", m)
 		c.incoming <- m
 	}
 
@@ -26,22 +35,78 @@ func (c *SNClient) receive() {
 	return
 }
 
+// readPacket reads the next packet, of at most c.MTU bytes. A new
+// buffer is used every time as the message refers to it.
+func (c *SNClient) readPacket() (Message, error) {
+	if c.stream {
+		frame, err := ReadFrame(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) > c.MTU {
+			return nil, ErrPacketTooLarge
+		}
+		return DecodePacket(frame)
+	}
+	// a byte over the MTU shows a datagram was truncated to fit
+	packet := make([]byte, c.MTU+1)
+	n, err := c.conn.Read(packet)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	if n > c.MTU {
+		return nil, ErrPacketTooLarge
+	}
+	return DecodePacket(packet[:n])
+}
+
+func malformed(err error) bool {
+	switch err {
+	case ErrTruncated, ErrBadLength, ErrUnknownType, ErrInvalidFlags, ErrBadEncapsulation:
+		return true
+	}
+	return false
+}
+
 func (c *SNClient) send() {
 	DEBUG.Println(NET, "started send()")
 	for {
 		mt := <-c.outgoing
-		DEBUG.Println(NET, "sending message", MessageNames[mt.m.MessageType()])
+		DEBUG.Println(NET, "sending message", mt.m)
+		var mid uint16
 		switch mt.m.MessageType() {
 		case REGISTER:
-			mt.m.(*RegisterMessage).MessageId = c.MessageIds.getId(mt.t)
+			mid = c.MessageIds.getId(mt.t)
+			mt.m.(*RegisterMessage).MessageId = mid
 		case PUBLISH:
-			mt.m.(*PublishMessage).MessageId = c.MessageIds.getId(mt.t)
+			// nothing answers a QoS -1 PUBLISH
+			if mt.m.(*PublishMessage).Qos != QOS_MINUS_ONE {
+				mid = c.MessageIds.getId(mt.t)
+				mt.m.(*PublishMessage).MessageId = mid
+			}
 		case SUBSCRIBE:
-			mt.m.(*SubscribeMessage).MessageId = c.MessageIds.getId(mt.t)
+			mid = c.MessageIds.getId(mt.t)
+			mt.m.(*SubscribeMessage).MessageId = mid
 		case UNSUBSCRIBE:
-			mt.m.(*UnsubscribeMessage).MessageId = c.MessageIds.getId(mt.t)
+			mid = c.MessageIds.getId(mt.t)
+			mt.m.(*UnsubscribeMessage).MessageId = mid
+		}
+		// bad messages are caught here rather than by the gateway
+		if err := mt.m.Validate(); err != nil {
+			ERROR.Println(NET, "not sending", mt.m, err)
+			if mid != 0 {
+				c.MessageIds.freeId(mid)
+			}
+			if mt.t != nil {
+				mt.t.fail(err)
+			}
+			continue
 		}
 		mt.m.Write(c.conn)
+		c.trace("sent", mt.m)
+		if p, ok := mt.m.(*PublishMessage); ok && p.Qos == QOS_MINUS_ONE && mt.t != nil {
+			mt.t.flowComplete()
+		}
 		if mt.m.MessageType() == DISCONNECT {
 			DEBUG.Println(NET, "Sent DISCONNECT, closing connection")
 			c.conn.Close()
@@ -55,10 +120,16 @@ func (c *SNClient) handle() {
 	for {
 		select {
 		case m := <-c.incoming:
-			DEBUG.Println(NET, "got message off <-incoming", MessageNames[m.MessageType()])
+			DEBUG.Println(NET, "got message off <-incoming", m)
 			switch m.MessageType() {
 			case CONNACK:
 				ca := m.(*ConnackMessage)
+				if ca.Version >= VERSION_2_0 {
+					c.SessionExpiry = ca.SessionExpiry
+					if len(ca.AssignedClientId) > 0 {
+						c.ClientId = string(ca.AssignedClientId)
+					}
+				}
 				c.setState(CONNECTED)
 				ct := c.suTokens[CONNECT].(*ConnectToken)
 				ct.ReturnCode = ca.ReturnCode
@@ -13,7 +13,9 @@ type MessageAndToken struct {
 type Token interface {
 	Wait()
 	WaitTimeout(time.Duration)
+	Error() error
 	flowComplete()
+	fail(error)
 }
 
 type baseToken struct {
@@ -42,10 +44,21 @@ func (b *baseToken) WaitTimeout(d time.Duration) {
 	}
 }
 
+// Error is set if the flow failed without reaching the gateway.
+func (b *baseToken) Error() error {
+	return b.err
+}
+
 func (b *baseToken) flowComplete() {
 	close(b.complete)
 }
 
+// fail completes a flow that could not be started.
+func (b *baseToken) fail(err error) {
+	b.err = err
+	b.flowComplete()
+}
+
 func newToken(tType byte) Token {
 	switch tType {
 	case CONNECT:
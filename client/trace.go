@@ -1,11 +1,19 @@
 package gnatt
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
+	"log/slog"
+
+	"github.com/alsm/gnatt/logging"
+	. "github.com/alsm/gnatt/packets"
 )
 
+// Log is the client's structured logger, set by SetLogger along with
+// ERROR, CRITICAL, WARN and DEBUG, which may also be set on their own.
 var (
+	Log      = logging.Discard
 	ERROR    *log.Logger
 	CRITICAL *log.Logger
 	WARN     *log.Logger
@@ -31,3 +39,21 @@ func init() {
 	WARN = log.New(ioutil.Discard, "", 0)
 	DEBUG = log.New(ioutil.Discard, "", 0)
 }
+
+// SetLogger has the client log to l.
+func SetLogger(l *slog.Logger) {
+	Log = l
+	ERROR = logging.Printf(l, slog.LevelError)
+	CRITICAL = logging.Printf(l, slog.LevelError+4)
+	WARN = logging.Printf(l, slog.LevelWarn)
+	DEBUG = logging.Printf(l, slog.LevelDebug)
+}
+
+// trace logs m, sent or received, at debug. Only the clients being
+// traced are logged unless the level is debug.
+func (c *SNClient) trace(what string, m Message) {
+	if !Log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	Log.Debug(what, append([]any{logging.ClientId, c.ClientId}, logging.Packet(m)...)...)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	G "github.com/alsm/gnatt/gateway/gate"
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The forwarder relays MQTT-SN between wireless nodes attached over a
+// serial line, or connecting over TCP, and a gateway's UDP port. Each
+// node's packets are encapsulated with the node's address as its
+// wireless node id, which the gateway uses to tell the nodes apart.
+func main() {
+	var gateway, transport, device, listen string
+	var baud int
+
+	flag.StringVar(&gateway, "gateway", "localhost:1883", "MQTT-SN gateway UDP address")
+	flag.StringVar(&transport, "transport", "serial", "Link to the nodes, serial or tcp")
+	flag.StringVar(&device, "serial-device", "/dev/ttyUSB0", "Serial device of the radio")
+	flag.IntVar(&baud, "serial-baud", 9600, "Baud rate of the serial device")
+	flag.StringVar(&listen, "listen", ":1884", "TCP address nodes connect to")
+	flag.Parse()
+
+	G.InitLogger(os.Stdout, os.Stderr)
+
+	var nodes G.Transport
+	switch transport {
+	case "serial":
+		nodes = G.NewSerialTransport(device, baud)
+	case "tcp":
+		nodes = G.NewTCPTransport(listen)
+	default:
+		G.ERROR.Fatalf("Unknown transport \"%s\"\n", transport)
+	}
+	if err := nodes.Listen(); err != nil {
+		G.ERROR.Fatal(err)
+	}
+	defer nodes.Close()
+
+	gwaddr, err := net.ResolveUDPAddr("udp", gateway)
+	if err != nil {
+		G.ERROR.Fatal(err)
+	}
+	gw, err := net.DialUDP("udp", nil, gwaddr)
+	if err != nil {
+		G.ERROR.Fatal(err)
+	}
+	defer gw.Close()
+
+	G.INFO.Printf("forwarding between %s and %s\n", nodes.LocalAddr(), gwaddr)
+	go toGateway(nodes, gw)
+	go toNodes(gw, nodes)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+}
+
+func toGateway(nodes G.Transport, gw *net.UDPConn) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := nodes.Receive(buffer)
+		if err != nil {
+			G.ERROR.Println(err)
+			return
+		}
+		packet, err := Encapsulate(0x00, []byte(from.String()), buffer[:n])
+		if err != nil {
+			G.ERROR.Printf("dropping packet from %s: %v\n", from, err)
+			continue
+		}
+		if _, err = gw.Write(packet); err != nil {
+			G.ERROR.Println(err)
+		}
+	}
+}
+
+func toNodes(gw *net.UDPConn, nodes G.Transport) {
+	buffer := make([]byte, 1500)
+	for {
+		n, err := gw.Read(buffer)
+		if err != nil {
+			G.ERROR.Println(err)
+			return
+		}
+		_, node, inner, err := Decapsulate(buffer[:n])
+		if err != nil {
+			G.ERROR.Printf("dropping packet from the gateway: %v\n", err)
+			continue
+		}
+		if err = nodes.Send(inner, G.StreamAddr(node)); err != nil {
+			G.ERROR.Printf("sending to %s: %v\n", node, err)
+		}
+	}
+}
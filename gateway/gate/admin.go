@@ -0,0 +1,345 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alsm/gnatt/logging"
+	. "github.com/alsm/gnatt/packets"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// The admin API is JSON over HTTP, served when the config has an
+// AdminAddress:
+//
+//	GET  /clients                    every client, sorted by address
+//	GET  /clients/<id>               a client with its registrations and subscriptions
+//	POST /clients/<id>/disconnect    send the client a DISCONNECT
+//	POST /clients/<id>/publish       send the client an AdminPublish
+//	GET  /topics                     the registered and predefined topic ids
+//	GET  /topics/tree                the clients subscribed to each topic filter
+//	GET  /events[?client=<id>]       a stream of Events, one JSON object per line
+//	GET  /trace                      the ids of the clients whose packets are traced
+//	PUT  /trace/<id>                 trace the packets of a client, connected or not
+//	DELETE /trace/<id>               stop tracing a client
+//	POST /config/reload              read the config again, giving a ReloadResult
+//
+// Clients are named by their ClientId, escaped as a path segment.
+
+// ClientInfo describes a client for the admin API.
+type ClientInfo struct {
+	ClientId  string    `json:"clientId"`
+	Address   string    `json:"address"`
+	Listener  string    `json:"listener,omitempty"`
+	State     string    `json:"state"`
+	Version   byte      `json:"version"`
+	KeepAlive uint16    `json:"keepAlive"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// only filled in for a single client
+	Registrations map[uint16]string `json:"registrations,omitempty"`
+	Subscriptions []string          `json:"subscriptions,omitempty"`
+}
+
+// AdminPublish is the body of a request to publish to a client.
+type AdminPublish struct {
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload string `json:"payload"`
+}
+
+// TopicRegistry is the topic ids known to a gateway.
+type TopicRegistry struct {
+	Registered map[uint16]string `json:"registered"`
+	Predefined map[uint16]string `json:"predefined"`
+}
+
+// administered is what a gateway offers the admin API.
+type administered interface {
+	clientList() *Clients
+	registry() TopicRegistry
+	// subscriptions returns the ids of the clients subscribed to
+	// each topic filter.
+	subscriptions() map[string][]string
+	subscriptionsOf(c SNClient) []string
+	disconnectClient(c SNClient)
+	publishTo(c SNClient, msg MQTT.Message) error
+	eventHub() *eventHub
+	ReloadConfig() (ReloadResult, error)
+}
+
+func (c *Client) info() ClientInfo {
+	state := c.State()
+	defer c.RUnlock()
+	c.RLock()
+	return ClientInfo{
+		ClientId:  c.ClientId,
+		Address:   c.AddrString(),
+		Listener:  c.endpoint().name,
+		State:     state.String(),
+		Version:   c.Version,
+		KeepAlive: uint16(c.keepAlive / time.Second),
+		LastSeen:  c.lastSeen,
+	}
+}
+
+func (c *Client) registrations() map[uint16]string {
+	defer c.RUnlock()
+	c.RLock()
+	r := make(map[uint16]string, len(c.registeredTopics))
+	for id, topic := range c.registeredTopics {
+		r[id] = topic
+	}
+	return r
+}
+
+type adminHandler struct {
+	g administered
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	switch {
+	case path == "clients":
+		h.get(w, r, h.clients)
+	case path == "topics":
+		h.get(w, r, func() (interface{}, error) { return h.g.registry(), nil })
+	case path == "events":
+		h.events(w, r)
+	case path == "topics/tree":
+		h.get(w, r, func() (interface{}, error) { return h.g.subscriptions(), nil })
+	case path == "config/reload":
+		h.reload(w, r)
+	case path == "trace":
+		h.get(w, r, func() (interface{}, error) { return logging.Traced(), nil })
+	case strings.HasPrefix(path, "trace/"):
+		escaped := strings.TrimPrefix(path, "trace/")
+		id, err := url.PathUnescape(escaped)
+		if err != nil || id == "" || strings.Contains(escaped, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.trace(w, r, id)
+	case strings.HasPrefix(path, "clients/"):
+		segments := strings.Split(strings.TrimPrefix(path, "clients/"), "/")
+		id, err := url.PathUnescape(segments[0])
+		if err != nil || len(segments) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+		action := ""
+		if len(segments) == 2 {
+			action = segments[1]
+		}
+		h.client(w, r, id, action)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h adminHandler) clients() (interface{}, error) {
+	all := h.g.clientList().All()
+	infos := make([]ClientInfo, 0, len(all))
+	for _, client := range all {
+		if c := clientOf(client); c != nil {
+			infos = append(infos, c.info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
+	return infos, nil
+}
+
+// find returns the client with id, there may be more than one if a
+// client has reconnected from a new address, the first by address
+// is returned.
+func (h adminHandler) find(id string) SNClient {
+	var found SNClient
+	for _, client := range h.g.clientList().All() {
+		c := clientOf(client)
+		if c == nil || c.ClientId != id {
+			continue
+		}
+		if found == nil || c.AddrString() < found.AddrString() {
+			found = client
+		}
+	}
+	return found
+}
+
+func (h adminHandler) client(w http.ResponseWriter, r *http.Request, id, action string) {
+	client := h.find(id)
+	if client == nil {
+		writeJSON(w, http.StatusNotFound, ErrNoSuchClient)
+		return
+	}
+	switch action {
+	case "":
+		h.get(w, r, func() (interface{}, error) {
+			info := clientOf(client).info()
+			info.Registrations = clientOf(client).registrations()
+			info.Subscriptions = h.g.subscriptionsOf(client)
+			return info, nil
+		})
+	case "disconnect":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		INFO.Printf("admin disconnecting \"%s\"\n", client)
+		h.g.disconnectClient(client)
+		w.WriteHeader(http.StatusNoContent)
+	case "publish":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var p AdminPublish
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, err := ValidateTopicName(p.Topic); err != nil {
+			writeJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if p.Qos > 2 {
+			writeJSON(w, http.StatusBadRequest, ErrInvalidQos)
+			return
+		}
+		INFO.Printf("admin publishing to \"%s\" on \"%s\"\n", client, p.Topic)
+		if err := h.g.publishTo(client, adminMessage{p}); err != nil {
+			writeJSON(w, http.StatusConflict, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h adminHandler) trace(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodPut:
+		INFO.Printf("admin tracing \"%s\"\n", id)
+		logging.Trace(id, true)
+	case http.MethodDelete:
+		INFO.Printf("admin no longer tracing \"%s\"\n", id)
+		logging.Trace(id, false)
+	default:
+		methodNotAllowed(w, http.MethodPut+", "+http.MethodDelete)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h adminHandler) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	INFO.Println("admin reloading the config")
+	result, err := h.g.ReloadConfig()
+	if err != nil {
+		ERROR.Println("not reloading the config:", err)
+		writeJSON(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// events streams events until the client goes away or the gateway
+// shuts down.
+func (h adminHandler) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	client := r.URL.Query().Get("client")
+	events, stop := h.g.eventHub().watch(64)
+	defer stop()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if client != "" && e.ClientId != client {
+				continue
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func (h adminHandler) get(w http.ResponseWriter, r *http.Request, f func() (interface{}, error)) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	v, err := f()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+}
+
+// writeJSON writes v as the response, an error is written as
+// {"error": "..."}.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = map[string]string{"error": err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ERROR.Println("error writing admin response:", err)
+	}
+}
+
+func serveAdmin(addr string, g administered) (*httpServer, error) {
+	s, err := serveHTTP(addr, adminHandler{g})
+	if s != nil {
+		INFO.Printf("serving the admin API on %s\n", s.url())
+	}
+	return s, err
+}
+
+// adminMessage is a publish injected through the admin API, it looks
+// to the gateway like a message from the broker.
+type adminMessage struct {
+	p AdminPublish
+}
+
+func (m adminMessage) Duplicate() bool   { return false }
+func (m adminMessage) Qos() byte         { return m.p.Qos }
+func (m adminMessage) Retained() bool    { return m.p.Retain }
+func (m adminMessage) Topic() string     { return m.p.Topic }
+func (m adminMessage) MessageID() uint16 { return 0 }
+func (m adminMessage) Payload() []byte   { return []byte(m.p.Payload) }
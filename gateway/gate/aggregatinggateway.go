@@ -1,11 +1,12 @@
 package gateway
 
 import (
-	"bytes"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"net"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
@@ -14,91 +15,263 @@ import (
 )
 
 type AGateway struct {
-	mqttclient *MQTT.Client
-	stopsig    chan os.Signal
-	port       int
+	upstream  Upstream
+	link      brokerLink
+	listeners []*listener
+	stopping  atomic.Bool
+	// replaced when the config is reloaded
+	config     atomic.Pointer[GatewayConfig]
 	tIndex     topicNames
-	tTree      *TopicTree
-	clients    Clients
-	handler    MQTT.MessageHandler
-}
-
-func NewAGateway(gc *GatewayConfig, stopsig chan os.Signal) *AGateway {
-	MQTT.WARN = log.New(os.Stdout, "", 0)
-	MQTT.DEBUG = log.New(os.Stdout, "", 0)
-	MQTT.CRITICAL = log.New(os.Stdout, "", 0)
-	MQTT.ERROR = log.New(os.Stdout, "", 0)
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(gc.mqttbroker)
-	if gc.mqttuser != "" {
-		opts.SetUsername(gc.mqttuser)
-	}
-	if gc.mqttpassword != "" {
-		opts.SetPassword(gc.mqttpassword)
-	}
-	if gc.mqttclientid != "" {
-		opts.SetClientID(gc.mqttclientid)
-	}
-	if gc.mqtttimeout > 0 {
-		opts.SetKeepAlive(time.Duration(gc.mqtttimeout))
+	predefined *predefinedTopics
+	// sources allowed to publish at QoS -1
+	qosMinusOne *addrList
+	tTree       *TopicTree
+	clients     Clients
+	metrics     *Metrics
+	metricsSrv  *httpServer
+	adminSrv    *httpServer
+	events      *eventHub
+	presence    *presence
+	// closed when the gateway stops, by Start if it fails
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func NewAGateway(gc *GatewayConfig) (*AGateway, error) {
+	if err := gc.Validate(); err != nil {
+		return nil, err
 	}
-	client := MQTT.NewClient(opts)
+	metrics := newMetrics(nil)
 	ag := &AGateway{
-		client,
-		stopsig,
-		gc.port,
-		topicNames{
+		upstream: gc.upstream(),
+		tIndex: topicNames{
 			sync.RWMutex{},
 			make(map[uint16]string),
 			0,
 		},
-		NewTopicTree(),
-		Clients{
+		predefined:  newPredefinedTopics(gc.PredefinedTopics),
+		qosMinusOne: newAddrList(gc.QosMinusOneAllow),
+		tTree:       NewTopicTree(),
+		clients: Clients{
 			sync.RWMutex{},
 			make(map[string]SNClient),
 		},
-		nil,
+		metrics: metrics,
+		events:  newEventHub(),
+		done:    make(chan struct{}),
+	}
+	metrics.clients = &ag.clients
+	config := *gc
+	ag.config.Store(&config)
+	ag.presence = newPresence(gc, metrics, ag.publishBroker)
+
+	return ag, nil
+}
+
+func (ag *AGateway) conf() *GatewayConfig {
+	return ag.config.Load()
+}
+
+func (ag *AGateway) Reload(gc *GatewayConfig) (ReloadResult, error) {
+	return reload(&ag.config, ag.listeners, ag.predefined, ag.qosMinusOne, gc)
+}
+
+func (ag *AGateway) ReloadConfig() (ReloadResult, error) {
+	gc, err := loadConfig(ag.conf())
+	if err != nil {
+		return ReloadResult{}, err
 	}
+	return ag.Reload(gc)
+}
+
+func (ag *AGateway) Clients() []ClientStatus {
+	return ag.clients.Status()
+}
+
+// Upstream returns what the gateway publishes to and subscribes to, the
+// broker unless the config says otherwise.
+func (ag *AGateway) Upstream() Upstream {
+	return ag.upstream
+}
+
+// Metrics returns the gateway's metrics, which are also served over
+// HTTP if the config has a MetricsAddress.
+func (ag *AGateway) Metrics() *Metrics {
+	return ag.metrics
+}
 
-	ag.handler = func(client *MQTT.Client, msg MQTT.Message) {
-		ag.distribute(msg)
+func (ag *AGateway) clientList() *Clients {
+	return &ag.clients
+}
+
+func (ag *AGateway) registry() TopicRegistry {
+	return TopicRegistry{ag.tIndex.snapshot(), ag.predefined.snapshot()}
+}
+
+func (ag *AGateway) subscriptions() map[string][]string {
+	return ag.tTree.Subscriptions()
+}
+
+func (ag *AGateway) subscriptionsOf(c SNClient) []string {
+	return ag.tTree.SubscriptionsOf(clientOf(c))
+}
+
+// The client keeps its subscriptions, as it does when it disconnects
+// itself.
+func (ag *AGateway) disconnectClient(c SNClient) {
+	client := clientOf(c)
+	client.disconnected(0)
+	if err := client.Write(disconnectFor(client, RC_ADMINISTRATIVE)); err != nil {
+		ERROR.Println(err)
+	}
+	ag.events.emit(newEvent(EventDisconnect, client, "", "admin"))
+	if ag.conf().OnDisconnect != nil {
+		ag.conf().OnDisconnect(client.ClientId, client.Address)
 	}
+}
 
-	return ag
+func (ag *AGateway) eventHub() *eventHub {
+	return ag.events
 }
 
-func (ag *AGateway) Port() int {
-	return ag.port
+func (ag *AGateway) publishTo(c SNClient, msg MQTT.Message) error {
+	client := clientOf(c)
+	if s := client.State(); !s.listening() && s != Asleep {
+		return ErrNotConnected
+	}
+	ag.publish(msg, client)
+	return nil
+}
+
+// Addr is the address of the gateway's first listener.
+func (ag *AGateway) Addr() net.Addr {
+	if len(ag.listeners) == 0 {
+		return nil
+	}
+	return ag.listeners[0].addr()
 }
 
-func (ag *AGateway) Start() {
-	go ag.awaitStop()
+// Connect to the broker and start listening for MQTT-SN clients.
+// ctx bounds how long starting may take, once Start has returned
+// the gateway runs until Shutdown is called.
+func (ag *AGateway) Start(ctx context.Context) error {
 	INFO.Println("Aggregating Gateway is starting")
-	if token := ag.mqttclient.Connect(); token.Wait() && token.Error() != nil {
-		ERROR.Println(token.Error())
-		return
+	handlers := UpstreamHandlers{
+		OnMessage: ag.distribute,
+		OnConnect: func() {
+			ag.metrics.linkUp(&ag.link)
+		},
+		OnConnectionLost: func(err error) {
+			ERROR.Println("lost the upstream connection:", err)
+			ag.metrics.linkLost(&ag.link)
+		},
+	}
+	if err := ag.upstream.Connect(ctx, handlers); err != nil {
+		ERROR.Println(err)
+		return err
 	}
+	var err error
+	if ag.metricsSrv, err = serveMetrics(ag.conf().MetricsAddress, ag.metrics); err != nil {
+		ERROR.Println(err)
+		ag.upstream.Disconnect()
+		return err
+	}
+	if ag.adminSrv, err = serveAdmin(ag.conf().AdminAddress, ag); err != nil {
+		ERROR.Println(err)
+		ag.metricsSrv.stop(ctx)
+		ag.upstream.Disconnect()
+		return err
+	}
+	ag.presence.start(ag.events)
+	go watchLost(&ag.clients, ag.events, ag.done)
+	ls, err := startListeners(ag.conf(), ag, ag.metrics)
+	if err != nil {
+		ERROR.Println(err)
+		ag.stop()
+		ag.events.close()
+		ag.adminSrv.stop(ctx)
+		ag.metricsSrv.stop(ctx)
+		ag.upstream.Disconnect()
+		return err
+	}
+	ag.listeners = ls
 	INFO.Println("Aggregating Gateway is started")
-	listen(ag)
+	return nil
 }
 
-// This does NOT WORK on Windows using Cygwin, however
-// it does work using cmd.exe
-func (ag *AGateway) awaitStop() {
-	<-ag.stopsig
+// Shutdown stops the gateway: messages from the broker are no longer
+// distributed, outstanding REGISTERs are given until ctx is done to
+// complete and flush their queues, then the listener is stopped, every
+// client is sent a DISCONNECT and the broker connection is closed.
+// Whatever is still queued when ctx is done is dropped.
+func (ag *AGateway) Shutdown(ctx context.Context) error {
+	if ag.stopping.Swap(true) {
+		return nil
+	}
 	INFO.Println("Aggregating Gateway is stopping")
-	ag.mqttclient.Disconnect(500)
-	time.Sleep(500) //give broker some time to process DISCONNECT
+
+	err := ag.drain(ctx)
+	if lerr := stopListeners(ctx, ag.listeners); err == nil {
+		err = lerr
+	}
+	clients := ag.clients.All()
+	for _, client := range clients {
+		if n := client.(*Client).DiscardPending(); n > 0 {
+			ERROR.Printf("dropped %d pending messages for \"%s\"\n", n, client)
+		}
+	}
+	disconnectClients(clients)
+	closeListeners(ag.listeners)
+	// the broker hears that the clients are gone before the gateway is
+	ag.stop()
+	emitShutdown(clients, ag.events)
+	ag.events.close()
+	ag.presence.wait(ctx)
+	ag.upstream.Disconnect()
+	ag.metrics.linkDown(&ag.link)
+	if merr := ag.metricsSrv.stop(ctx); err == nil {
+		err = merr
+	}
+	if aerr := ag.adminSrv.stop(ctx); err == nil {
+		err = aerr
+	}
 	INFO.Println("Aggregating Gateway is stopped")
+	return err
+}
 
-	// TODO: cleanly close down other goroutines
+// stop closes done, which both a failed Start and the Shutdown after
+// it do.
+func (ag *AGateway) stop() {
+	ag.doneOnce.Do(func() { close(ag.done) })
+}
 
-	os.Exit(0)
+// Wait for every client's pending publishes to be flushed.
+func (ag *AGateway) drain(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		for _, client := range ag.clients.All() {
+			pending += client.(*Client).PendingCount()
+		}
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (ag *AGateway) distribute(msg MQTT.Message) {
 	topic := msg.Topic()
-	INFO.Printf("AG distributing a msg for topic \"%s\"\n", topic)
+	if ag.stopping.Load() {
+		DEBUG.Printf("AG is stopping, not distributing msg for topic \"%s\"\n", topic)
+		return
+	}
+	DEBUG.Printf("AG distributing a msg for topic \"%s\"\n", topic)
 
 	// collect a list of clients to which msg should be
 	// published
@@ -113,46 +286,93 @@ func (ag *AGateway) distribute(msg MQTT.Message) {
 	}
 }
 
+// predefinedId is the predefined topic id of a broker topic to client.
+func (ag *AGateway) predefinedId(topic string, client *Client) (uint16, bool) {
+	if topic, ok := client.endpoint().clientTopic(topic); ok {
+		return ag.predefined.getId(topic)
+	}
+	return 0, false
+}
+
 func (ag *AGateway) publish(msg MQTT.Message, client *Client) {
-	INFO.Printf("publish to client \"%s\"... ", client.ClientId)
-	topicid := ag.tIndex.getId(msg.Topic())
+	DEBUG.Printf("publish to client \"%s\"... ", client.ClientId)
+	if keepForSleeper(client, msg, ag.metrics) {
+		return
+	}
+	if s := client.State(); !s.listening() {
+		DEBUG.Printf("not publishing to client \"%s\", it is %v\n", client.ClientId, s)
+		ag.metrics.brokerMessage("dropped")
+		return
+	}
+	// the topic id is the same size whichever kind it is
+	if size := NewPublishMessage(0, 0x00, msg.Payload(), 0, 0, false, false).Size(); size > ag.conf().MTU {
+		ERROR.Printf("not publishing to client \"%s\": %v\n", client.ClientId, ErrPacketTooLarge)
+		ag.metrics.brokerMessage("dropped")
+		return
+	}
+	if topicid, ok := ag.predefinedId(msg.Topic(), client); ok {
+		pm := NewPublishMessage(topicid, 0x01, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
+		if err := client.Write(pm); err != nil {
+			ERROR.Println(err)
+			ag.metrics.brokerMessage("dropped")
+		} else {
+			ag.metrics.brokerMessage("delivered")
+			DEBUG.Printf("published a message to \"%s\" on predefined id %d\n", client, topicid)
+		}
+		return
+	}
+	// a topic first seen through a wildcard subscription has no id yet
+	topicid := ag.tIndex.assignId(msg.Topic())
 	// topicidtype := byte(0x00) // todo: pre-defined (1) and shortname (2)
 	// msgid := uint16(0x00) // todo: what should this be??
 	pm := NewPublishMessage(topicid, 0x00, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
 
 	if client.Registered(topicid) {
-		INFO.Printf("client \"%s\" already registered to %d, publish ahoy!\n", client, topicid)
+		DEBUG.Printf("client \"%s\" already registered to %d, publish ahoy!\n", client, topicid)
 		if err := client.Write(pm); err != nil {
 			ERROR.Println(err)
+			ag.metrics.brokerMessage("dropped")
 		} else {
-			INFO.Printf("published a message to \"%s\"\n", client)
+			ag.metrics.brokerMessage("delivered")
+			DEBUG.Printf("published a message to \"%s\"\n", client)
 		}
+		return
+	}
+	ag.metrics.brokerMessage("queued")
+	if client.AddPendingMessage(pm) {
+		DEBUG.Printf("client \"%s\" is not registered to %d, must REGISTER first\n", client, topicid)
+		client.SendRegister(topicid, msg.Topic(), ag.conf().RegisterTimeout, ag.conf().RegisterRetries)
 	} else {
-		INFO.Printf("client \"%s\" is not registered to %d, must REGISTER first\n", client, topicid)
-		rm := NewRegisterMessage(topicid, 0x00, []byte(msg.Topic()))
-		client.AddPendingMessage(pm)
-		if err := client.Write(rm); err != nil {
-			ERROR.Printf("error writing REGISTER to \"%s\"\n", client)
-		} else {
-			INFO.Printf("sent REGISTER to \"%s\" for %d (%d bytes)\n", client, topicid, rm.Length)
-		}
+		DEBUG.Printf("client \"%s\" is not registered to %d, queued behind pending REGISTER\n", client, topicid)
 	}
 }
 
-func (ag *AGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *net.UDPAddr) {
-	INFO.Printf("OnPacket!  - bytes: %s\n", string(buffer[0:nbytes]))
-
-	buf := bytes.NewBuffer(buffer)
-	rawmsg, _ := ReadPacket(buf)
-	INFO.Printf("rawmsg.MessageType(): %s\n", rawmsg.MessageType())
+func (ag *AGateway) OnPacket(nbytes int, buffer []byte, con Transport, addr net.Addr) {
+	d := decoders.Get().(*Decoder)
+	defer decoders.Put(d)
+	if rawmsg, ok := decodeFrom(d, ag.metrics, buffer[:nbytes], addr); ok {
+		ag.handle(rawmsg, con, addr)
+	}
+}
 
+func (ag *AGateway) handle(rawmsg Message, con Transport, addr net.Addr) {
+	traceReceived(&ag.clients, rawmsg, addr)
+	if !checkState(&ag.clients, rawmsg, con, addr) {
+		ag.metrics.reject("state")
+		ag.events.emit(addrEvent(EventReject, addr, "", MessageNames[rawmsg.MessageType()]))
+		return
+	}
 	switch msg := rawmsg.(type) {
+	case *EncapsulatedMessage:
+		ag.handle_ENCAPSULATED(msg, con, addr)
 	case *AdvertiseMessage:
 		ag.handle_ADVERTISE(msg, addr)
 	case *SearchGwMessage:
-		ag.handle_SEARCHGW(msg, addr)
+		ag.handle_SEARCHGW(msg, con, addr)
 	case *GwInfoMessage:
 		ag.handle_GWINFO(msg, addr)
+	case *AuthMessage:
+		ag.handle_AUTH(msg, con, addr)
 	case *ConnectMessage:
 		ag.handle_CONNECT(msg, con, addr)
 	case *ConnackMessage:
@@ -170,7 +390,7 @@ func (ag *AGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *
 	case *RegackMessage:
 		ag.handle_REGACK(msg, addr)
 	case *PublishMessage:
-		ag.handle_PUBLISH(msg, addr)
+		ag.handle_PUBLISH(msg, con, addr)
 	case *PubackMessage:
 		ag.handle_PUBACK(msg, addr)
 	case *PubcompMessage:
@@ -184,7 +404,7 @@ func (ag *AGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *
 	case *SubackMessage:
 		ag.handle_SUBACK(msg, addr)
 	case *UnsubscribeMessage:
-		ag.handle_UNSUBSCRIBE(msg, addr)
+		ag.handle_UNSUBSCRIBE(msg, con, addr)
 	case *UnsubackMessage:
 		ag.handle_UNSUBACK(msg, addr)
 	case *PingreqMessage:
@@ -206,232 +426,399 @@ func (ag *AGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *
 	}
 }
 
-func (ag *AGateway) handle_ADVERTISE(m *AdvertiseMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_ADVERTISE(m *AdvertiseMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_SEARCHGW(m *SearchGwMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_SEARCHGW(m *SearchGwMessage, c Transport, r net.Addr) {
+	answerSearch(c, r)
 }
 
-func (ag *AGateway) handle_GWINFO(m *GwInfoMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_GWINFO(m *GwInfoMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_CONNECT(m *ConnectMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// Handle the message inside as if it came straight from the node,
+// replies to it are encapsulated and go back through the forwarder.
+func (ag *AGateway) handle_ENCAPSULATED(m *EncapsulatedMessage, c Transport, r net.Addr) {
+	ag.handle(m.Message, forwardingTransport{c}, NewForwardedAddr(r, m.WirelessNodeId))
+}
+
+func (ag *AGateway) handle_CONNECT(m *ConnectMessage, c Transport, r net.Addr) {
 
-	if clientid, e := validateClientId(m.ClientId); e != nil {
+	if !supportsVersion(ag.conf().ProtocolVersions, m.ProtocolId) {
+		ERROR.Printf("refusing %v, protocol version %d not supported\n", r, m.ProtocolId)
+		if ioerr := NewClient(string(m.ClientId), c, r).Write(connackFor(m, RC_UNSUPPORTED_VERSION, 0)); ioerr != nil {
+			ERROR.Println(ioerr)
+		}
+		return
+	}
+	if m.Auth {
+		// every client shares the gateway's own broker connection, so
+		// there is nothing for a client to authenticate as
+		ERROR.Printf("refusing %v, aggregating gateways don't authenticate clients\n", r)
+		if ioerr := NewClient(string(m.ClientId), c, r).Write(connackFor(m, RC_BAD_AUTH_METHOD, 0)); ioerr != nil {
+			ERROR.Println(ioerr)
+		}
+		return
+	}
+	id, ok := checkIdentity(c, r, m.ClientId)
+	if !ok || !checkListener(c, r) {
+		if ioerr := NewClient(string(id), c, r).Write(connackFor(m, RC_NOT_AUTHORIZED, 0)); ioerr != nil {
+			ERROR.Println(ioerr)
+		}
+		return
+	}
+	assigned := len(id) == 0 && m.ProtocolId >= VERSION_2_0
+	if assigned {
+		id = []byte(assignClientId())
+	}
+	if clientid, e := validateClientId(id); e != nil {
 		ERROR.Println(e)
 	} else {
-		INFO.Printf("clientid: %s\n", clientid)
-		INFO.Printf("remoteaddr: %s\n", r)
-		INFO.Printf("will: %v\n", m.Will)
+		DEBUG.Printf("clientid: %s\n", clientid)
+		DEBUG.Printf("remoteaddr: %s\n", r)
+		DEBUG.Printf("will: %v\n", m.Will)
 
 		if m.Will {
 			// todo: do something about that
 		}
 
 		client := NewClient(clientid, c, r)
-		ag.clients.AddClient(client)
+		client.Version = m.ProtocolId
+		if max := ag.conf().MaxClients; max > 0 && ag.clients.GetClient(r) == nil && ag.clients.Len() >= max {
+			ERROR.Printf("refusing \"%s\", already %d clients connected\n", clientid, max)
+			if ioerr := client.Write(connackFor(m, REJ_CONGESTION, 0)); ioerr != nil {
+				ERROR.Println(ioerr)
+			}
+			return
+		}
+		// a v2.0 client that doesn't start clean carries on with the
+		// session it had, along with the topic aliases it registered
+		if old, ok := ag.clients.GetClient(r).(*Client); ok && m.ProtocolId >= VERSION_2_0 && !m.CleanSession && old.ClientId == clientid {
+			client = old
+			client.setVersion(m.ProtocolId)
+		} else {
+			if old, ok := ag.clients.GetClient(r).(*Client); ok {
+				// the retransmissions of the client being replaced
+				// would go out with message ids the new one never saw
+				old.DiscardPending()
+			}
+			ag.clients.AddClient(client)
+		}
+		client.connected(time.Duration(m.Duration) * time.Second)
 
-		ca := NewMessage(CONNACK).(*ConnackMessage) // todo: 0 ?
-		ca.ReturnCode = 0
+		ca := connackFor(m, ACCEPTED, m.SessionExpiry)
+		if assigned {
+			ca.AssignedClientId = id
+		}
 		if ioerr := client.Write(ca); ioerr != nil {
 			ERROR.Println(ioerr)
 		} else {
-			INFO.Println("CONNACK was sent")
+			DEBUG.Println("CONNACK was sent")
+			ag.events.emit(newEvent(EventConnect, client, "", ""))
+			if ag.conf().OnConnect != nil {
+				ag.conf().OnConnect(clientid, r)
+			}
 		}
 	}
 }
 
-func (ag *AGateway) handle_CONNACK(m *ConnackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// Clients that asked to authenticate were already refused when they
+// CONNECTed.
+func (ag *AGateway) handle_AUTH(m *AuthMessage, c Transport, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLTOPICREQ(m *WillTopicReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_CONNACK(m *ConnackMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLTOPIC(m *WillTopicMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLTOPICREQ(m *WillTopicReqMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLMSGREQ(m *WillMsgReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLTOPIC(m *WillTopicMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLMSG(m *WillMsgMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLMSGREQ(m *WillMsgReqMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_REGISTER(m *RegisterMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	topic := string(m.TopicName)
-	INFO.Printf("msg id: %d\n", m.MessageId)
-	INFO.Printf("topic name: %s\n", topic)
+func (ag *AGateway) handle_WILLMSG(m *WillMsgMessage, r net.Addr) {
+}
 
-	var topicid uint16
-	if !ag.tIndex.containsTopic(topic) {
-		topicid = ag.tIndex.putTopic(topic)
-	} else {
-		topicid = ag.tIndex.getId(topic)
-	}
+func (ag *AGateway) handle_REGISTER(m *RegisterMessage, c Transport, r net.Addr) {
+	topic := endpointOf(c).brokerTopic(string(m.TopicName))
+	DEBUG.Printf("msg id: %d\n", m.MessageId)
+	DEBUG.Printf("topic name: %s\n", topic)
+
+	topicid := ag.tIndex.assignId(topic)
 
 	client := ag.clients.GetClient(r).(*Client)
 	client.Register(topicid, topic)
+	ag.events.emit(newEvent(EventRegister, client, topic, ""))
 
-	INFO.Printf("ag topicid: %d\n", topicid)
+	DEBUG.Printf("ag topicid: %d\n", topicid)
 
 	ra := NewRegackMessage(topicid, m.MessageId, 0)
-	INFO.Printf("ra.MsgId: %d\n", ra.MessageId)
+	DEBUG.Printf("ra.MsgId: %d\n", ra.MessageId)
 
 	if err := client.Write(ra); err != nil {
 		ERROR.Println(err)
 	} else {
-		INFO.Println("REGACK sent")
+		DEBUG.Println("REGACK sent")
 	}
 }
 
-func (ag *AGateway) handle_REGACK(m *RegackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_REGACK(m *RegackMessage, r net.Addr) {
 	// the gateway sends a register when there is a message
 	// that needs to be published, so we do that now
 	topicid := m.TopicId
 	client := ag.clients.GetClient(r).(*Client)
-	pm := client.FetchPendingMessage(topicid)
-	if pm == nil {
-		ERROR.Printf("no pending message for %s id %d\n", client, topicid)
-	} else {
+	pms, rtt, ok := client.RegisterAcked(topicid, m.MessageId, m.ReturnCode == ACCEPTED)
+	if !ok {
+		ERROR.Printf("unexpected REGACK from %s for id %d (msg id %d)\n", client, topicid, m.MessageId)
+		return
+	}
+	ag.metrics.registerRTT.observe(rtt)
+	if m.ReturnCode != ACCEPTED {
+		ERROR.Printf("%s rejected REGISTER for %d (rc %d), discarded %d pending messages\n", client, topicid, m.ReturnCode, len(pms))
+		return
+	}
+	for _, pm := range pms {
 		if err := client.Write(pm); err != nil {
 			ERROR.Println(err)
 		} else {
-			INFO.Printf("published a pending message to \"%s\"\n", client)
+			DEBUG.Printf("published a pending message to \"%s\"\n", client)
 		}
 	}
 }
 
-func (ag *AGateway) handle_PUBLISH(m *PublishMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_PUBLISH(m *PublishMessage, c Transport, r net.Addr) {
+
+	DEBUG.Printf("m.TopicId: %d\n", m.TopicId)
+	DEBUG.Printf("m.Data: %s\n", string(m.Data))
+
+	if m.Qos == QOS_MINUS_ONE {
+		if topic := qosMinusOneTopic(m, c, r, ag.qosMinusOne, ag.predefined); topic != "" {
+			ag.events.emit(addrEvent(EventPublish, r, topic, qosDetail(m.Qos)))
+			ag.publishMQTT(topic, ag.conf().QosMinusOneMQTTQos, m)
+		}
+		return
+	}
+	client, ok := ag.clients.GetClient(r).(*Client)
+	if !ok {
+		ERROR.Printf("dropping %v from %v: not connected\n", m, r)
+		return
+	}
+	topic := publishTopic(m, client, &ag.tIndex, ag.predefined)
+	if topic == "" {
+		ERROR.Printf("unknown topic id %d (type %d)\n", m.TopicId, m.TopicIdType)
+		rejectPublish(client, m, REJ_INVALID_TID)
+		return
+	}
+	if !client.endpoint().mayPublish(topic) {
+		ERROR.Printf("\"%s\" may not publish to \"%s\"\n", client, topic)
+		rejectPublish(client, m, REJ_NOT_SUPORTED)
+		return
+	}
 
-	INFO.Printf("m.TopicId: %d\n", m.TopicId)
-	INFO.Printf("m.Data: %s\n", string(m.Data))
+	ag.events.emit(newEvent(EventPublish, client, topic, qosDetail(m.Qos)))
+	ag.publishMQTT(topic, m.Qos, m)
+}
 
-	topic := ag.tIndex.getTopic(m.TopicId)
+// publishBroker publishes for the gateway itself. The presence calls it
+// from one goroutine, so a client's states reach the upstream in order.
+func (ag *AGateway) publishBroker(topic string, qos byte, retain bool, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	if err := ag.upstream.Publish(ctx, topic, qos, retain, payload); err != nil {
+		ERROR.Printf("Error publishing to \"%s\": %v\n", topic, err)
+	}
+}
 
-	// TODO: what should the MQTT-QoS be set as? In case of MQTTSN-QoS -1 ?
-	if token := ag.mqttclient.Publish(topic, m.Qos, m.Retain, m.Data); token.WaitTimeout(2000) && token.Error() != nil {
-		ERROR.Println("Error publishing message", token.Error())
+// Publish m's payload upstream at qos.
+func (ag *AGateway) publishMQTT(topic string, qos byte, m *PublishMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	var err error
+	ag.metrics.brokerPublish(func() bool {
+		err = ag.upstream.Publish(ctx, topic, qos, m.Retain, append([]byte(nil), m.Data...))
+		return err == nil
+	})
+	if err != nil {
+		ERROR.Println("Error publishing message", err)
+		return
 	}
-	INFO.Println("Message Published")
+	DEBUG.Println("Message Published")
 }
 
-func (ag *AGateway) handle_PUBACK(m *PubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_PUBACK(m *PubackMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_PUBCOMP(m *PubcompMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_PUBCOMP(m *PubcompMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_PUBREC(m *PubrecMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_PUBREC(m *PubrecMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_PUBREL(m *PubrelMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_PUBREL(m *PubrelMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_SUBSCRIBE(m *SubscribeMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	INFO.Printf("m.TopicIdType: %d\n", m.TopicIdType)
-	topic := string(m.TopicName)
+func (ag *AGateway) handle_SUBSCRIBE(m *SubscribeMessage, c Transport, r net.Addr) {
+	DEBUG.Printf("m.TopicIdType: %d\n", m.TopicIdType)
+	e := endpointOf(c)
+	topic := e.brokerTopic(string(m.TopicName))
 	var topicid uint16
 	if m.TopicIdType == 0 {
-		INFO.Printf("m.TopicName: %s\n", topic)
+		DEBUG.Printf("m.TopicName: %s\n", topic)
 		if !ContainsWildcard(topic) {
-			topicid = ag.tIndex.getId(topic)
-			if topicid == 0 {
-				topicid = ag.tIndex.putTopic(topic)
+			topicid = ag.tIndex.assignId(topic)
+		}
+		// a wildcard has no topic id, the SUBACK carries 0x0000 and
+		// each topic it matches is REGISTERed when first published
+	} else if m.TopicIdType == 0x01 {
+		topicid = m.TopicId
+		if topic = ag.predefined.getTopic(topicid); topic == "" {
+			ERROR.Printf("unknown predefined topic id %d\n", topicid)
+			suba := NewSubackMessage(topicid, m.MessageId, m.Qos, REJ_INVALID_TID)
+			if err := ag.clients.GetClient(r).Write(suba); err != nil {
+				ERROR.Println(err)
 			}
-		} else {
-			// todo: if topic contains wildcard, something about REGISTER
-			// at a later time, but send topic id 0x0000 for now
+			return
 		}
-	} // todo: other topic id types
+		topic = e.brokerTopic(topic)
+	} // todo: short topic names
 
 	client := ag.clients.GetClient(r).(*Client)
+	if !e.maySubscribe(topic) {
+		ERROR.Printf("\"%s\" may not subscribe to \"%s\"\n", client, topic)
+		if err := client.Write(NewSubackMessage(0, m.MessageId, m.Qos, REJ_NOT_SUPORTED)); err != nil {
+			ERROR.Println(err)
+		}
+		return
+	}
 	if first, err := ag.tTree.AddSubscription(client, topic); err != nil {
-		INFO.Println("error adding subscription: %v\n", err)
+		DEBUG.Printf("error adding subscription: %v\n", err)
 		// todo: suback an error message?
 	} else {
 		if first {
-			INFO.Println("first subscriber of subscription, subscribbing via MQTT")
-			if token := ag.mqttclient.Subscribe(topic, 2, ag.handler); token.WaitTimeout(2000) && token.Error() != nil {
-				ERROR.Println("Error subscribing,", token.Error())
+			DEBUG.Println("first subscriber of subscription, subscribbing via MQTT")
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+			err := ag.upstream.Subscribe(ctx, topic, 2)
+			cancel()
+			if err != nil {
+				// forget it so the next subscriber tries upstream again
+				ERROR.Println("Error subscribing,", err)
+				ag.tTree.removeSubscription(client, topic)
+				rc := byte(REJ_CONGESTION)
+				if errors.Is(err, ErrNoWebhookPoll) {
+					rc = REJ_NOT_SUPORTED
+				}
+				if err := client.Write(NewSubackMessage(0, m.MessageId, m.Qos, rc)); err != nil {
+					ERROR.Println(err)
+				}
+				return
 			}
 		}
 		// AG is subscribed at this point
-		client.Register(topicid, topic)
-		suba := NewSubackMessage(topicid, m.MessageId, m.Qos, 0)
-		var buf bytes.Buffer
-		suba.Write(&buf)
-		if nbytes, err := c.WriteToUDP(buf.Bytes(), r); err != nil {
+		if m.TopicIdType == 0x00 && topicid != 0 {
+			client.Register(topicid, topic)
+		}
+		ag.events.emit(newEvent(EventSubscribe, client, topic, qosDetail(m.Qos)))
+		if err := client.Write(NewSubackMessage(topicid, m.MessageId, m.Qos, 0)); err != nil {
 			ERROR.Println(err)
-		} else {
-			INFO.Printf("SUBACK sent %d bytes\n", nbytes)
 		}
 	}
 }
 
-func (ag *AGateway) handle_SUBACK(m *SubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_SUBACK(m *SubackMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_UNSUBSCRIBE(m *UnsubscribeMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// The gateway unsubscribes upstream when the last of the subscribers
+// of a topic unsubscribes.
+func (ag *AGateway) handle_UNSUBSCRIBE(m *UnsubscribeMessage, c Transport, r net.Addr) {
+	e := endpointOf(c)
+	var topic string
+	if m.TopicIdType == 0x00 {
+		topic = e.brokerTopic(string(m.TopicName))
+	} else if m.TopicIdType == 0x01 {
+		if topic = ag.predefined.getTopic(m.TopicId); topic != "" {
+			topic = e.brokerTopic(topic)
+		}
+	}
+	client := ag.clients.GetClient(r).(*Client)
+	if topic == "" {
+		ERROR.Printf("unknown topic id %d (type %d)\n", m.TopicId, m.TopicIdType)
+	} else if last, err := ag.tTree.removeSubscription(client, topic); err != nil {
+		DEBUG.Printf("error removing subscription: %v\n", err)
+	} else if last {
+		DEBUG.Println("last subscriber of subscription, unsubscribing upstream")
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		if err := ag.upstream.Unsubscribe(ctx, topic); err != nil {
+			ERROR.Println("Error unsubscribing,", err)
+		}
+		cancel()
+	}
+	// UNSUBACKed whether or not it was subscribed
+	ua := NewMessage(UNSUBACK).(*UnsubackMessage)
+	ua.MessageId = m.MessageId
+	if err := client.Write(ua); err != nil {
+		ERROR.Println(err)
+	}
 }
 
-func (ag *AGateway) handle_UNSUBACK(m *UnsubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_UNSUBACK(m *UnsubackMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_PINGREQ(m *PingreqMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	resp := NewMessage(PINGRESP)
-
-	var buf bytes.Buffer
-	resp.Write(&buf)
-
-	if nbytes, err := c.WriteToUDP(buf.Bytes(), r); err != nil {
+// A PINGREQ from a client that is asleep wakes it to be sent what was
+// kept for it, the PINGRESP after that sends it back to sleep.
+func (ag *AGateway) handle_PINGREQ(m *PingreqMessage, c Transport, r net.Addr) {
+	client := ag.clients.GetClient(r).(*Client)
+	if client.awake(true) {
+		ag.events.emit(newEvent(EventWake, client, "", ""))
+		defer func() {
+			client.awake(false)
+			ag.events.emit(newEvent(EventSleep, client, "", ""))
+		}()
+		for _, msg := range client.takeAsleep() {
+			ag.publish(msg, client)
+		}
+		// the publishes queued behind a REGISTER go once it is REGACKed
+		conf := ag.conf()
+		if !client.waitRegistered(conf.RegisterTimeout * time.Duration(conf.RegisterRetries+1)) {
+			ERROR.Printf("\"%s\" is going back to sleep with REGISTERs unanswered\n", client)
+		}
+	}
+	if err := client.Write(NewMessage(PINGRESP)); err != nil {
 		ERROR.Println(err)
-	} else {
-		INFO.Printf("PINGRESP sent %d bytes\n", nbytes)
 	}
 }
 
-func (ag *AGateway) handle_PINGRESP(m *PingrespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_PINGRESP(m *PingrespMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_DISCONNECT(m *DisconnectMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	INFO.Printf("duration: %d\n", m.Duration)
-	// todo: cleanup the client
+// A DISCONNECT with a duration puts the client to sleep, it keeps its
+// registrations and subscriptions either way.
+func (ag *AGateway) handle_DISCONNECT(m *DisconnectMessage, r net.Addr) {
+	client := ag.clients.GetClient(r).(*Client)
+	client.disconnected(time.Duration(m.Duration) * time.Second)
+	if err := client.Write(disconnectFor(client, ACCEPTED)); err != nil {
+		ERROR.Println(err)
+	}
+	if m.Duration > 0 {
+		ag.events.emit(newEvent(EventSleep, client, "", fmt.Sprintf("%ds", m.Duration)))
+		return
+	}
+	ag.events.emit(newEvent(EventDisconnect, client, "", ""))
+	if ag.conf().OnDisconnect != nil {
+		ag.conf().OnDisconnect(client.ClientId, r)
+	}
 }
 
-func (ag *AGateway) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLTOPICRESP(m *WillTopicRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLTOPICRESP(m *WillTopicRespMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLMSGUPD(m *WillMsgUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLMSGUPD(m *WillMsgUpdateMessage, r net.Addr) {
 }
 
-func (ag *AGateway) handle_WILLMSGRESP(m *WillMsgRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) handle_WILLMSGRESP(m *WillMsgRespMessage, r net.Addr) {
 }
@@ -1,49 +1,109 @@
 package gateway
 
 import (
-	"bytes"
 	"net"
 	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 
 	. "github.com/alsm/gnatt/packets"
 )
 
 type SNClient interface {
 	AddrString() string
+	Write(Message) error
+}
+
+// A REGISTER sent by the gateway that is waiting for its REGACK.
+type pendingRegister struct {
+	messageId uint16
+	topic     string
+	retries   int
+	timer     *time.Timer
+	// when it was last sent
+	sent time.Time
 }
 
 type Client struct {
 	sync.RWMutex
 	ClientId         string
-	Conn             *net.UDPConn
-	Address          *net.UDPAddr
+	Conn             Transport
+	Address          net.Addr
 	registeredTopics map[uint16]string
-	pendingMessages  map[uint16]*PublishMessage
+	pendingMessages  map[uint16][]*PublishMessage
+	pendingRegisters map[uint16]*pendingRegister
+	nextMessageId    uint16
+	// Version is the protocol version the client connected with.
+	Version byte
+	// the client's state, with the keep alive and sleep duration that
+	// say when it is lost
+	state     ClientState
+	keepAlive time.Duration
+	sleep     time.Duration
+	lastSeen  time.Time
+	// an EventLost has been emitted for the client
+	lostReported bool
+	// broker messages kept for the client while it is asleep
+	asleepMessages []MQTT.Message
 }
 
-func NewClient(ClientId string, Conn *net.UDPConn, Address *net.UDPAddr) *Client {
-	INFO.Printf("NewClient, id: \"%s\"\n", ClientId)
+func NewClient(ClientId string, Conn Transport, Address net.Addr) *Client {
+	DEBUG.Printf("NewClient, id: \"%s\"\n", ClientId)
 	return &Client{
 		sync.RWMutex{},
 		ClientId,
 		Conn,
 		Address,
 		make(map[uint16]string),
-		make(map[uint16]*PublishMessage),
+		make(map[uint16][]*PublishMessage),
+		make(map[uint16]*pendingRegister),
+		0,
+		VERSION_1_2,
+		Disconnected,
+		0,
+		0,
+		time.Time{},
+		false,
+		nil,
 	}
 }
 
 func (c *Client) Write(m Message) error {
-	var buf bytes.Buffer
-	m.Write(&buf)
-	_, e := c.Conn.WriteToUDP(buf.Bytes(), c.Address)
-	return e
+	c.traceSent(m)
+	bp := sendBuffers.Get().(*[]byte)
+	defer sendBuffers.Put(bp)
+	*bp = m.AppendTo((*bp)[:0])
+	return sendMessage(c.Conn, m, *bp, c.Address)
+}
+
+// Transports are done with a packet once Send returns, so the buffers
+// messages are encoded into can be shared.
+var sendBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1500)
+		return &b
+	},
+}
+
+// version returns the protocol version the client last connected with.
+func (c *Client) version() byte {
+	defer c.RUnlock()
+	c.RLock()
+	return c.Version
+}
+
+// setVersion changes the version of a client others may be reading.
+func (c *Client) setVersion(v byte) {
+	defer c.Unlock()
+	c.Lock()
+	c.Version = v
 }
 
 func (c *Client) Register(topicId uint16, topic string) {
 	defer c.Unlock()
 	c.Lock()
-	INFO.Printf("client %s registered topicId %d\n", c.ClientId, topicId)
+	DEBUG.Printf("client %s registered topicId %d\n", c.ClientId, topicId)
 	c.registeredTopics[topicId] = topic
 }
 
@@ -54,18 +114,159 @@ func (c *Client) Registered(topicId uint16) bool {
 	return ok
 }
 
-func (c *Client) AddPendingMessage(p *PublishMessage) {
+// Queue a publish until the REGISTER for its topic id has been
+// acknowledged. Return true if this is the first message queued
+// for that topic id, meaning a REGISTER must be sent.
+func (c *Client) AddPendingMessage(p *PublishMessage) bool {
 	defer c.Unlock()
 	c.Lock()
-	c.pendingMessages[p.TopicId] = p
+	queue := c.pendingMessages[p.TopicId]
+	c.pendingMessages[p.TopicId] = append(queue, p)
+	return len(queue) == 0
 }
 
-func (c *Client) FetchPendingMessage(topicId uint16) *PublishMessage {
+// Send a REGISTER for topicId and keep retransmitting it every
+// timeout until a REGACK arrives or retries is exhausted, in which
+// case the queued publishes for topicId are discarded.
+func (c *Client) SendRegister(topicId uint16, topic string, timeout time.Duration, retries int) {
+	c.Lock()
+	if pr, ok := c.pendingRegisters[topicId]; ok {
+		pr.timer.Stop()
+	}
+	c.nextMessageId++
+	if c.nextMessageId == 0 {
+		c.nextMessageId = 1
+	}
+	pr := &pendingRegister{
+		messageId: c.nextMessageId,
+		topic:     topic,
+	}
+	c.pendingRegisters[topicId] = pr
+	pr.sent = time.Now()
+	pr.timer = time.AfterFunc(timeout, func() {
+		c.retryRegister(topicId, pr, timeout, retries)
+	})
+	c.Unlock()
+
+	c.writeRegister(topicId, pr)
+}
+
+func (c *Client) retryRegister(topicId uint16, pr *pendingRegister, timeout time.Duration, retries int) {
+	c.Lock()
+	if c.pendingRegisters[topicId] != pr {
+		// acknowledged or superseded in the meantime
+		c.Unlock()
+		return
+	}
+	if pr.retries >= retries {
+		delete(c.pendingRegisters, topicId)
+		discarded := len(c.pendingMessages[topicId])
+		delete(c.pendingMessages, topicId)
+		c.Unlock()
+		ERROR.Printf("no REGACK from \"%s\" for %d after %d retries, discarded %d pending messages\n", c, topicId, retries, discarded)
+		return
+	}
+	pr.retries++
+	attempt := pr.retries + 1
+	pr.sent = time.Now()
+	pr.timer.Reset(timeout)
+	c.Unlock()
+
+	DEBUG.Printf("retransmitting REGISTER to \"%s\" for %d (attempt %d)\n", c, topicId, attempt)
+	c.writeRegister(topicId, pr)
+}
+
+func (c *Client) writeRegister(topicId uint16, pr *pendingRegister) {
+	// the client knows the topic by its name under the mount
+	topic, _ := c.endpoint().clientTopic(pr.topic)
+	rm := NewRegisterMessage(topicId, pr.messageId, []byte(topic))
+	if err := c.Write(rm); err != nil {
+		ERROR.Printf("error writing REGISTER to \"%s\"\n", c)
+	} else {
+		DEBUG.Printf("sent REGISTER to \"%s\" for %d (%d bytes)\n", c, topicId, rm.Length)
+	}
+}
+
+// Complete the outstanding REGISTER for topicId and hand back the
+// publishes queued behind it. If the REGISTER was accepted the topic
+// is registered in the same step, so that no publish can queue up
+// behind a REGISTER that has already completed. The time since the
+// REGISTER was last sent is returned along with them. Return false if
+// there was no REGISTER outstanding with a matching message id.
+func (c *Client) RegisterAcked(topicId, messageId uint16, accepted bool) ([]*PublishMessage, time.Duration, bool) {
 	defer c.Unlock()
 	c.Lock()
-	pm := c.pendingMessages[topicId]
+	pr, ok := c.pendingRegisters[topicId]
+	if !ok || pr.messageId != messageId {
+		return nil, 0, false
+	}
+	pr.timer.Stop()
+	delete(c.pendingRegisters, topicId)
+	if accepted {
+		DEBUG.Printf("client %s registered topicId %d\n", c.ClientId, topicId)
+		c.registeredTopics[topicId] = pr.topic
+	}
+	pms := c.pendingMessages[topicId]
 	delete(c.pendingMessages, topicId)
-	return pm
+	return pms, time.Since(pr.sent), true
+}
+
+// Return the number of publishes waiting on a REGACK.
+func (c *Client) PendingCount() int {
+	n, _ := c.queueDepth()
+	return n
+}
+
+// waitRegistered waits up to d for the client to answer the REGISTERs
+// it has been sent, reporting whether it did.
+func (c *Client) waitRegistered(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for {
+		c.RLock()
+		n := len(c.pendingRegisters)
+		c.RUnlock()
+		if n == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Return the number of publishes waiting on a REGACK and the number of
+// REGISTERs they are waiting on.
+func (c *Client) queueDepth() (int, int) {
+	defer c.RUnlock()
+	c.RLock()
+	n := 0
+	for _, pms := range c.pendingMessages {
+		n += len(pms)
+	}
+	return n, len(c.pendingRegisters)
+}
+
+// Abandon all outstanding REGISTERs and drop the publishes queued
+// behind them, returning how many were dropped.
+func (c *Client) DiscardPending() int {
+	defer c.Unlock()
+	c.Lock()
+	return c.discardPending()
+}
+
+// discardPending is DiscardPending, c must be locked.
+func (c *Client) discardPending() int {
+	for _, pr := range c.pendingRegisters {
+		pr.timer.Stop()
+	}
+	n := 0
+	for _, pms := range c.pendingMessages {
+		n += len(pms)
+	}
+	c.pendingRegisters = make(map[uint16]*pendingRegister)
+	c.pendingMessages = make(map[uint16][]*PublishMessage)
+	return n
 }
 
 func (c *Client) AddrString() string {
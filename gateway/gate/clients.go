@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"net"
+	"sort"
 	"sync"
 )
 
@@ -11,7 +12,7 @@ type Clients struct {
 	clients map[string]SNClient
 }
 
-func (c *Clients) GetClient(addr *net.UDPAddr) SNClient {
+func (c *Clients) GetClient(addr net.Addr) SNClient {
 	defer c.RUnlock()
 	c.RLock()
 	return c.clients[addr.String()]
@@ -25,7 +26,7 @@ func (c *Clients) AddClient(client SNClient) bool {
 	defer c.Unlock()
 	c.Lock()
 	addr := client.AddrString()
-	INFO.Println("AddClient(%s - %s)", client, addr)
+	DEBUG.Printf("AddClient(%s - %s)\n", client, addr)
 	isNew := false
 	if c.clients[addr] == nil {
 		isNew = true
@@ -36,9 +37,50 @@ func (c *Clients) AddClient(client SNClient) bool {
 	return isNew
 }
 
+func (c *Clients) Len() int {
+	defer c.RUnlock()
+	c.RLock()
+	return len(c.clients)
+}
+
+// Return a snapshot of all the clients
+func (c *Clients) All() []SNClient {
+	defer c.RUnlock()
+	c.RLock()
+	all := make([]SNClient, 0, len(c.clients))
+	for _, client := range c.clients {
+		all = append(all, client)
+	}
+	return all
+}
+
 func (c *Clients) RemoveClient(id string) {
 	defer c.Unlock()
 	c.Lock()
-	INFO.Println("RemoveClient(%s)", id)
+	DEBUG.Printf("RemoveClient(%s)\n", id)
 	delete(c.clients, id)
 }
+
+// ClientStatus describes a client for monitoring.
+type ClientStatus struct {
+	ClientId string
+	Address  string
+	State    ClientState
+	// the tenant whose client it is, if the gateway has tenants
+	Tenant string
+}
+
+// Return the status of every client, sorted by address
+func (c *Clients) Status() []ClientStatus {
+	all := c.All()
+	status := make([]ClientStatus, 0, len(all))
+	for _, client := range all {
+		if base := clientOf(client); base != nil {
+			status = append(status, ClientStatus{ClientId: base.ClientId, Address: base.AddrString(), State: base.State()})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Address < status[j].Address
+	})
+	return status
+}
@@ -3,57 +3,648 @@ package gateway
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/alsm/gnatt/logging"
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Mode selects how a gateway connects its clients to the broker.
+type Mode int
+
+const (
+	// Transparent gateways give every client its own broker connection.
+	Transparent Mode = iota
+	// Aggregating gateways share one broker connection between all clients.
+	Aggregating
 )
 
+// BrokerConfig describes the connection to the MQTT broker.
+type BrokerConfig struct {
+	// URI of the broker, including the transport, eg "tcp://localhost:1883".
+	URI string
+	// Username and Password are only sent if Username is set.
+	Username string
+	Password string
+	// ClientId of the aggregating gateway's own connection. Transparent
+	// gateways connect with the ClientId of each MQTT-SN client, and use
+	// this one for the connection that carries QoS -1 PUBLISHes.
+	ClientId string
+	// KeepAlive of the broker connection, 0 leaves the client default.
+	KeepAlive time.Duration
+}
+
+// WebhookConfig, with a URL, has an aggregating gateway send its
+// clients' messages to an HTTP endpoint rather than the broker, see
+// WebhookUpstream.
+type WebhookConfig struct {
+	URL string
+	// PollURL, if set, is fetched every PollInterval for the messages
+	// to the clients' subscriptions, without it clients cannot
+	// subscribe.
+	PollURL      string
+	PollInterval time.Duration
+}
+
+// PresenceConfig says what the gateway tells the broker about its
+// clients. Each client's state is published to
+// "$SYS/gnatt/<GatewayId>/clients/<client id>/state" when one of Events
+// happens to it, and the gateway's stats to "$SYS/gnatt/<GatewayId>/stats"
+// every StatsInterval.
+type PresenceConfig struct {
+	// GatewayId names the gateway in the topics, it defaults to the
+	// broker ClientId or, failing that, the host name.
+	GatewayId string
+	// Events are the types of Event that are published: connect,
+	// disconnect, sleep, wake and lost.
+	Events []string
+	// Retain the published states, so that the broker always knows
+	// the last state of every client.
+	Retain bool
+	// StatsInterval of 0 publishes no stats.
+	StatsInterval time.Duration
+}
+
+// LogConfig says what the gateway logs and how.
+type LogConfig struct {
+	// Level is the least severe level logged, info by default. Debug
+	// traces every packet.
+	Level slog.Level
+	// Format is "text", the default, or "json".
+	Format string
+	// Trace the packets of these clients whatever the level, more can
+	// be traced at runtime through the admin API.
+	Trace []string
+}
+
+// SerialConfig describes a serial device carrying MQTT-SN packets.
+type SerialConfig struct {
+	Device string
+	Baud   int
+}
+
+// ListenerConfig is one of the places a gateway takes clients from.
+// A listener can be a gateway of its own to its clients: it answers
+// SEARCHGW with its own GatewayId, its clients' topics are mounted
+// under a topic of its own on the broker, and they are held to its
+// ACL profile.
+type ListenerConfig struct {
+	// Name identifies the listener in the config and to the admin API.
+	Name string
+	// Network is "udp" (the default), "udp4", "udp6", "dtls", "tcp" or
+	// "serial".
+	Network string
+	// Address is the "host:port" of udp, dtls and tcp listeners, IPv6
+	// hosts in brackets, eg "[fe80::1%eth0]:1883", and the device of a
+	// serial listener.
+	Address string
+	// Baud of a serial listener, 9600 by default.
+	Baud int
+	// Multicast, if set, is a multicast group a udp listener joins on
+	// Interface, or the system's default interface, at the port of
+	// Address, eg "ff02::1" or "225.1.1.1". The listener then takes
+	// packets to its port on every local address. ADVERTISE is sent to
+	// the group every Advertise, if that is set.
+	Multicast string
+	Interface string
+	Advertise time.Duration
+	// GatewayId is the MQTT-SN gateway id in the GWINFOs and
+	// ADVERTISEs the listener sends.
+	GatewayId byte
+	// Mount, if set, is the topic that the topics of the listener's
+	// clients are under on the broker, so that a client's "a/b" is
+	// "<Mount>/a/b" to the broker.
+	Mount string
+	// ACL names the ACLProfile the listener's clients are held to, the
+	// clients of a listener without one may do anything.
+	ACL string
+	// Transport, if set, is used instead of listening on Address.
+	Transport Transport
+}
+
+// An ACLProfile limits who may connect to a listener and what its
+// clients may do. Topics are matched as the clients name them, before
+// the listener's Mount.
+type ACLProfile struct {
+	// Allow lists where clients may connect from, like
+	// QosMinusOneAllow, every address may if it is empty.
+	Allow []string
+	// Publish and Subscribe are the topic filters that clients may
+	// publish to and subscribe within, any topic if they are empty.
+	Publish   []string
+	Subscribe []string
+}
+
+// A TenantConfig is the config of a gateway run alongside others in
+// one process. Tenants share nothing but the process's logging, each
+// has its own listeners, broker connection, topics, ACLs and limits.
+type TenantConfig struct {
+	Name string
+	// File the tenant's config is read from, relative to the file
+	// naming it, when Config isn't set.
+	File   string
+	Config *GatewayConfig
+}
+
+// minMTU fits a PUBLISH with a single byte of payload.
+const minMTU = 8
+
+// GatewayConfig holds every setting of a gateway. It can be filled in
+// from Go code, starting from NewGatewayConfig, or read from a file with
+// ParseConfigFile. Validate reports whether the settings are usable,
+// Check reports every problem with them.
 type GatewayConfig struct {
-	aggregating  bool
-	port         int
-	mqttbroker   string
-	mqttuser     string
-	mqttpassword string
-	mqttclientid string
-	mqtttimeout  int
+	Mode Mode
+	// Network is the kind of link clients use: "udp" (the default),
+	// "dtls", "tcp" or "serial".
+	Network string
+	// ListenAddress is the "host:port" that MQTT-SN clients send to over
+	// udp, dtls or tcp, a port of 0 picks a free port.
+	ListenAddress string
+	// Serial is the device used when Network is "serial".
+	Serial SerialConfig
+	// DTLS holds the keys used when Network is "dtls".
+	DTLS DTLSConfig
+	// Transport, if set, is used instead of listening on ListenAddress.
+	Transport Transport
+	// Listeners, if any, replace the listener of Network and
+	// ListenAddress, which is gateway 1 to its clients. ACLs are the
+	// profiles the listeners name.
+	Listeners []ListenerConfig
+	ACLs      map[string]ACLProfile
+	Broker    BrokerConfig
+	// Webhook, or Upstream if it is set, replaces the broker of an
+	// aggregating gateway.
+	Webhook  WebhookConfig
+	Upstream Upstream
+	// PredefinedTopics maps topic ids that clients know ahead of time
+	// to their topic names.
+	PredefinedTopics map[uint16]string
+
+	// Limits
+	// MaxClients is the number of clients that may be connected at
+	// once, 0 means no limit.
+	MaxClients int
+	// RegisterTimeout is how long the gateway waits for a REGACK before
+	// retransmitting a REGISTER, which it does RegisterRetries times.
+	RegisterTimeout time.Duration
+	RegisterRetries int
+	// MTU is the largest packet, in bytes, that the gateway receives or
+	// sends. Larger packets from clients are dropped and PUBLISHes from
+	// the broker that would be larger are not passed on.
+	MTU int
+	// ProtocolVersions are the versions of MQTT-SN that clients may
+	// connect with, as sent in the ProtocolId of a CONNECT.
+	ProtocolVersions []byte
+	// QoS -1 PUBLISHes, which need no connection, are taken from any
+	// address unless QosMinusOneAllow lists the ones they may come
+	// from, as IPs, CIDR blocks or, for transports without IP
+	// addresses, the address as the transport gives it. They are
+	// published to the broker at QosMinusOneMQTTQos.
+	QosMinusOneAllow   []string
+	QosMinusOneMQTTQos byte
+	// MetricsAddress, if set, is where the gateway's metrics are
+	// served over HTTP, at /metrics. Like AdminAddress it is either
+	// "host:port" or "unix:" and the path of a socket.
+	MetricsAddress string
+	// AdminAddress, if set, is where the admin API is served, either
+	// "host:port" or "unix:" and the path of a socket. It lets anyone
+	// who can reach it disconnect clients and publish to them, so it
+	// belongs on localhost.
+	AdminAddress string
+	Presence     PresenceConfig
+	Log          LogConfig
+	// Tenants, if any, are each run as a gateway of their own, and
+	// every other option but Log is ignored. The tenants log as Log
+	// says, whatever their own configs say.
+	Tenants []TenantConfig
+
+	// Hooks, called when a client has connected or disconnected.
+	OnConnect    func(clientId string, addr net.Addr)
+	OnDisconnect func(clientId string, addr net.Addr)
+	// Load, if set, reads the config again when the gateway is told to
+	// reload it, by default the file it was read from is read again.
+	Load func() (*GatewayConfig, error)
+
+	// where the options were set, when read from a file
+	file    string
+	sources map[string]source
+}
+
+// A source is the line that set an option, and the option's name in
+// the file.
+type source struct {
+	line int
+	name string
+}
+
+// NewGatewayConfig returns a transparent gateway configuration with
+// every setting at its default.
+func NewGatewayConfig() *GatewayConfig {
+	return &GatewayConfig{
+		Network:          "udp",
+		ListenAddress:    ":1883",
+		Serial:           SerialConfig{Baud: 9600},
+		DTLS:             DTLSConfig{PSK: make(map[string][]byte)},
+		Webhook:          WebhookConfig{PollInterval: defaultPollInterval},
+		PredefinedTopics: make(map[uint16]string),
+		RegisterTimeout:  10 * time.Second,
+		RegisterRetries:  3,
+		MTU:              1500,
+		ProtocolVersions: []byte{VERSION_1_2, VERSION_2_0},
+	}
+}
+
+// Validate returns the first problem found with the configuration,
+// or nil if a gateway can be created from it.
+func (gc *GatewayConfig) Validate() error {
+	if problems := gc.problems(); len(problems) > 0 {
+		return problems[0].Err
+	}
+	return nil
+}
+
+// Check returns every problem with the configuration as ConfigErrors,
+// with the lines of the file that set the options at fault, or nil if
+// a gateway can be created from it.
+func (gc *GatewayConfig) Check() error {
+	problems := gc.problems()
+	for i := range problems {
+		if problems[i].File != "" {
+			// a tenant's, from the tenant's file
+			continue
+		}
+		if src, ok := gc.sources[problems[i].Key]; ok {
+			problems[i].File, problems[i].Line, problems[i].Key = gc.file, src.line, src.name
+		}
+	}
+	return problems.err()
+}
+
+// problems are named by the option that sets the value at fault.
+func (gc *GatewayConfig) problems() ConfigErrors {
+	var p ConfigErrors
+	add := func(key string, err error) {
+		p = append(p, ConfigError{Key: key, Err: err})
+	}
+	if len(gc.Tenants) > 0 {
+		return append(p, gc.tenantProblems()...)
+	}
+	if gc.Mode != Transparent && gc.Mode != Aggregating {
+		add("mode", ErrInvalidModeSpecified)
+	}
+	if gc.Transport == nil && len(gc.Listeners) == 0 {
+		switch gc.Network {
+		case "udp", "udp4", "udp6", "":
+			if _, err := net.ResolveUDPAddr(udpNetwork(gc.Network), gc.ListenAddress); err != nil {
+				add("listen", ErrInvalidListenAddress)
+			}
+		case "dtls":
+			if _, err := net.ResolveUDPAddr("udp", gc.ListenAddress); err != nil {
+				add("listen", ErrInvalidListenAddress)
+			}
+			if err := gc.DTLS.validate(); err != nil {
+				add("dtls-cert", err)
+			}
+		case "tcp":
+			if _, err := net.ResolveTCPAddr("tcp", gc.ListenAddress); err != nil {
+				add("listen", ErrInvalidListenAddress)
+			}
+		case "serial":
+			if gc.Serial.Device == "" || gc.Serial.Baud <= 0 {
+				add("serial-device", ErrInvalidSerialDevice)
+			}
+		default:
+			add("transport", ErrInvalidNetwork)
+		}
+	}
+	names := make(map[string]bool)
+	for _, lc := range gc.Listeners {
+		if lc.Name == "" || names[lc.Name] {
+			add("listener", ErrInvalidListener)
+		}
+		names[lc.Name] = true
+		if lc.Transport == nil {
+			switch lc.Network {
+			case "udp", "udp4", "udp6", "dtls", "":
+				if _, err := net.ResolveUDPAddr(udpNetwork(lc.Network), lc.Address); err != nil {
+					add("listener", ErrInvalidListenAddress)
+				}
+				if lc.Network != "dtls" {
+					break
+				}
+				if err := gc.DTLS.validate(); err != nil {
+					add("dtls-cert", err)
+				}
+			case "tcp":
+				if _, err := net.ResolveTCPAddr("tcp", lc.Address); err != nil {
+					add("listener", ErrInvalidListenAddress)
+				}
+			case "serial":
+				if lc.Address == "" || lc.Baud < 0 {
+					add("listener", ErrInvalidSerialDevice)
+				}
+			default:
+				add("listener-network", ErrInvalidNetwork)
+			}
+		}
+		plainUDP := lc.Network == "" || strings.HasPrefix(lc.Network, "udp")
+		if ip := net.ParseIP(lc.Multicast); lc.Multicast != "" && (ip == nil || !ip.IsMulticast() || !plainUDP) {
+			add("listener-multicast", ErrInvalidMulticastGroup)
+		}
+		if lc.Advertise < 0 {
+			add("listener-advertise", ErrNegativeValue)
+		} else if lc.Advertise > 0 && (lc.Advertise < time.Second || lc.Advertise > 0xFFFF*time.Second) {
+			// the ADVERTISE carries it in whole seconds
+			add("listener-advertise", ErrInvalidAdvertise)
+		} else if lc.Advertise > 0 && lc.Multicast == "" {
+			add("listener-advertise", ErrNoMulticastGroup)
+		}
+		if _, err := ValidateTopicName(lc.Mount); lc.Mount != "" && err != nil {
+			add("listener-mount", ErrInvalidMount)
+		}
+		if _, ok := gc.ACLs[lc.ACL]; lc.ACL != "" && !ok {
+			add("listener-acl", ErrUnknownACLProfile)
+		}
+	}
+	for _, acl := range gc.ACLs {
+		for _, filter := range acl.Publish {
+			if _, err := ValidateTopicFilter(filter); err != nil {
+				add("acl-publish", err)
+			}
+		}
+		for _, filter := range acl.Subscribe {
+			if _, err := ValidateTopicFilter(filter); err != nil {
+				add("acl-subscribe", err)
+			}
+		}
+	}
+	if gc.Webhook.URL != "" || gc.Upstream != nil {
+		if gc.Mode != Aggregating {
+			add("webhook-url", ErrUpstreamNotAggregating)
+		}
+	} else if _, err := checkURI(gc.Broker.URI); err != nil {
+		add("mqtt-broker", err)
+	}
+	if gc.Webhook.PollURL != "" {
+		if gc.Webhook.URL == "" {
+			add("webhook-poll-url", ErrNoWebhookURL)
+		}
+		if gc.Webhook.PollInterval <= 0 {
+			add("webhook-poll-interval", ErrNotPositive)
+		}
+	}
+	if gc.Broker.KeepAlive < 0 {
+		add("mqtt-timeout", ErrNegativeValue)
+	}
+	for id, topic := range gc.PredefinedTopics {
+		if id == 0x0000 || id == 0xFFFF {
+			add("predefined-topic", ErrInvalidPredefinedTopicId)
+		} else if _, err := ValidateTopicName(topic); err != nil {
+			add("predefined-topic", err)
+		}
+	}
+	if gc.MaxClients < 0 {
+		add("max-clients", ErrNegativeValue)
+	}
+	if gc.RegisterRetries < 0 {
+		add("register-retries", ErrNegativeValue)
+	}
+	if gc.RegisterTimeout <= 0 {
+		add("register-timeout", ErrNotPositive)
+	}
+	if gc.MTU < minMTU || gc.MTU > MaxPacketSize {
+		add("mtu", ErrInvalidMTU)
+	}
+	if len(gc.ProtocolVersions) == 0 {
+		add("protocol-versions", ErrInvalidProtocolVersion)
+	}
+	for _, v := range gc.ProtocolVersions {
+		if v != VERSION_1_2 && v != VERSION_2_0 {
+			add("protocol-versions", ErrInvalidProtocolVersion)
+			break
+		}
+	}
+	if gc.QosMinusOneMQTTQos > 2 {
+		add("qos-1-mqtt-qos", ErrInvalidQos)
+	}
+	if strings.ContainsAny(gc.Presence.GatewayId, "/+#") {
+		add("gateway-id", ErrInvalidGatewayId)
+	}
+	for _, e := range gc.Presence.Events {
+		if _, ok := presenceStates[e]; !ok {
+			add("presence-events", ErrInvalidPresenceEvent)
+			break
+		}
+	}
+	if gc.Presence.StatsInterval < 0 {
+		add("stats-interval", ErrNegativeValue)
+	}
+	if gc.Log.Format != "" && logging.CheckFormat(gc.Log.Format) != nil {
+		add("log-format", ErrInvalidLogFormat)
+	}
+	return p
+}
+
+// listeners are the Listeners, or the listener of Network and
+// ListenAddress.
+func (gc *GatewayConfig) listeners() []ListenerConfig {
+	if len(gc.Listeners) > 0 {
+		return gc.Listeners
+	}
+	address := gc.ListenAddress
+	if gc.Network == "serial" {
+		address = gc.Serial.Device
+	}
+	return []ListenerConfig{{
+		Network:   gc.Network,
+		Address:   address,
+		Baud:      gc.Serial.Baud,
+		GatewayId: 1,
+		Transport: gc.Transport,
+	}}
+}
+
+func (lc *ListenerConfig) transport(dtls DTLSConfig) (Transport, error) {
+	if lc.Transport != nil {
+		return lc.Transport, nil
+	}
+	switch lc.Network {
+	case "dtls":
+		config, err := dtls.dtlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		return NewDTLSTransport(lc.Address, config), nil
+	case "tcp":
+		return NewTCPTransport(lc.Address), nil
+	case "serial":
+		baud := lc.Baud
+		if baud == 0 {
+			baud = 9600
+		}
+		return NewSerialTransport(lc.Address, baud), nil
+	}
+	return NewMulticastUDPTransport(udpNetwork(lc.Network), lc.Address, lc.Multicast, lc.Interface), nil
 }
 
-func (gc *GatewayConfig) IsAggregating() bool {
-	return gc.aggregating
+// udpNetwork is the network a udp or dtls listener listens on.
+func udpNetwork(network string) string {
+	if network == "udp4" || network == "udp6" {
+		return network
+	}
+	return "udp"
 }
 
+// ParseConfigFile reads a configuration file, as TOML if its name
+// ends in ".toml" and otherwise as lines of "key value". ${NAME} in a
+// value is replaced by the environment variable NAME. Every problem
+// found is returned, as ConfigErrors.
 func ParseConfigFile(file string) (*GatewayConfig, error) {
-	gc := &GatewayConfig{}
-	if bytes, rerr := ioutil.ReadFile(file); rerr != nil {
-		return nil, rerr
+	gc, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return gc, nil
+}
+
+// CheckConfigFile returns every problem with a configuration file, both
+// those that stop it being read and those Check finds, or nil if a
+// gateway can be created from it.
+func CheckConfigFile(file string) error {
+	gc, err := readConfigFile(file)
+	problems, ok := err.(ConfigErrors)
+	if err != nil && !ok {
+		return err
+	}
+	if cerr := gc.Check(); cerr != nil {
+		for _, p := range cerr.(ConfigErrors) {
+			// an option that could not be set is reported once
+			if !problems.has(p.File, p.Key) {
+				problems = append(problems, p)
+			}
+		}
+	}
+	// problems with options left at their defaults have no line
+	sort.SliceStable(problems, func(i, j int) bool {
+		li, lj := problems[i].Line, problems[j].Line
+		return li != 0 && (lj == 0 || li < lj)
+	})
+	return problems.err()
+}
+
+func readConfigFile(file string) (*GatewayConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	gc := NewGatewayConfig()
+	gc.file = file
+	if strings.HasSuffix(file, ".toml") {
+		err = gc.parseTOML(string(data))
 	} else {
-		if perr := gc.parseConfig(string(bytes)); perr != nil {
-			return nil, perr
+		err = gc.parseConfig(string(data))
+	}
+	if len(gc.Tenants) == 0 {
+		return gc, err
+	}
+	problems, _ := err.(ConfigErrors)
+	return gc, append(problems, gc.readTenants()...).err()
+}
+
+// readTenants reads the config file of each tenant, the problems with
+// them are in the tenants' files.
+func (gc *GatewayConfig) readTenants() ConfigErrors {
+	var problems ConfigErrors
+	for i := range gc.Tenants {
+		t := &gc.Tenants[i]
+		if t.Config != nil || t.File == "" {
+			continue
+		}
+		file := t.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(gc.file), file)
+		}
+		tc, err := readConfigFile(file)
+		if tc == nil {
+			problems = append(problems, ConfigError{File: gc.file, Key: "tenant " + t.Name, Err: err})
+			continue
+		}
+		if tp, ok := err.(ConfigErrors); ok {
+			problems = append(problems, tp...)
 		}
+		t.Config = tc
 	}
-	return gc, nil
+	return problems
+}
+
+// tenantProblems are the problems with the tenants, the tenants'
+// problems have the files and lines they were found at.
+func (gc *GatewayConfig) tenantProblems() ConfigErrors {
+	var p ConfigErrors
+	names := make(map[string]bool)
+	for _, t := range gc.Tenants {
+		switch {
+		case t.Name == "" || names[t.Name]:
+			p = append(p, ConfigError{Key: "tenant", Err: ErrInvalidTenant})
+		case t.Config == nil:
+			// reported by readTenants too, if its file couldn't be read
+			p = append(p, ConfigError{File: gc.file, Key: "tenant " + t.Name, Err: ErrNoTenantConfig})
+		case len(t.Config.Tenants) > 0:
+			p = append(p, ConfigError{File: t.Config.file, Key: "tenant", Err: ErrNestedTenants})
+		default:
+			if err := t.Config.Check(); err != nil {
+				for _, tp := range err.(ConfigErrors) {
+					// options left at their defaults are the tenant's too
+					if tp.File == "" {
+						tp.File = t.Config.file
+					}
+					if tp.File == "" {
+						tp.Key = t.Name + ":" + tp.Key
+					}
+					p = append(p, tp)
+				}
+			}
+		}
+		names[t.Name] = true
+	}
+	if gc.Log.Format != "" && logging.CheckFormat(gc.Log.Format) != nil {
+		p = append(p, ConfigError{Key: "log-format", Err: ErrInvalidLogFormat})
+	}
+	return p
 }
 
 func (gc *GatewayConfig) parseConfig(config string) error {
 	scanner := bufio.NewScanner(bytes.NewReader([]byte(config)))
 	scanner.Split(bufio.ScanLines)
 
+	var errs ConfigErrors
 	var lineno int
 	for scanner.Scan() {
 		line := scanner.Text()
 		lineno++
-		if k, v, e := gc.parseLine(line); e != nil {
-			return e
-		} else if k == "" && v == "" {
-			// skipping comment or blank line
-		} else {
-			if e = gc.setOption(k, v); e != nil {
-				ERROR.Printf("Error in configuration on line %d\n", lineno)
-				return e
+		k, v, e := gc.parseLine(line)
+		if e == nil && k != "" {
+			if v, e = expandEnv(v); e == nil {
+				e = gc.set(k, k, v, lineno)
 			}
 		}
+		if e != nil {
+			errs = append(errs, ConfigError{File: gc.file, Line: lineno, Key: k, Err: e})
+		}
 	}
-	return nil
+	return errs.err()
 }
 
 func (gc *GatewayConfig) parseLine(line string) (string, string, error) {
@@ -64,31 +655,222 @@ func (gc *GatewayConfig) parseLine(line string) (string, string, error) {
 	fields := strings.Fields(line)
 	if len(fields) == 1 {
 		ERROR.Printf("Missing value for config option: \"%s\"", fields[0])
-		return "", "", ErrMissingValueForConfigOption
+		return fields[0], "", ErrMissingValueForConfigOption
 	} else if len(fields) > 2 {
 		ERROR.Printf("Too many values supplied for config option: \"%s\"", fields[0])
-		return "", "", ErrTooManyValuesForConfigOption
+		return fields[0], "", ErrTooManyValuesForConfigOption
 	}
 	return fields[0], fields[1], nil
 }
 
+// set the option key, called name in the file, from line.
+func (gc *GatewayConfig) set(key, name, value string, line int) error {
+	if gc.sources == nil {
+		gc.sources = make(map[string]source)
+	}
+	gc.sources[key] = source{line, name}
+	return gc.setOption(key, value)
+}
+
+// expandEnv replaces ${NAME} in value with the environment variable
+// NAME, which must be set, and ${NAME:-default} with NAME or, if it is
+// unset or empty, default.
+func expandEnv(value string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "${")
+		if i < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		j := strings.IndexByte(value[i:], '}')
+		if j < 0 {
+			return "", ErrUnterminatedVariable
+		}
+		name := value[i+2 : i+j]
+		v, set := os.LookupEnv(name)
+		if n, def, ok := strings.Cut(name, ":-"); ok {
+			if v = os.Getenv(n); v == "" {
+				v = def
+			}
+		} else if !set {
+			return "", fmt.Errorf("%w: %s", ErrUnsetVariable, name)
+		}
+		b.WriteString(value[:i])
+		b.WriteString(v)
+		value = value[i+j+1:]
+	}
+}
+
+// A ConfigError is a problem with one option of a configuration.
+type ConfigError struct {
+	File string
+	// Line is 0 if the option was not set from a file.
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:", e.Line)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Key != "" {
+		b.WriteString(e.Key + ": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are every problem found with a configuration, one per
+// line.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, ce := range e {
+		lines[i] = ce.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, ce := range e {
+		errs[i] = ce
+	}
+	return errs
+}
+
+func (e ConfigErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e ConfigErrors) has(file, key string) bool {
+	for _, ce := range e {
+		if ce.File == file && ce.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (gc *GatewayConfig) setOption(key, value string) error {
 	var e error
+	var n int
 	switch key {
 	case "mode":
-		gc.aggregating, e = checkMode(value)
+		gc.Mode, e = checkMode(value)
 	case "port":
-		gc.port, e = checkNum("port", value)
+		n, e = checkNum("port", value)
+		gc.ListenAddress = port2str(n)
+	case "listen":
+		gc.ListenAddress = value
+	case "transport":
+		gc.Network, e = checkNetwork(value)
+	case "serial-device":
+		gc.Serial.Device = value
+	case "serial-baud":
+		gc.Serial.Baud, e = checkNum("serial-baud", value)
+	case "dtls-cert":
+		gc.DTLS.CertFile = value
+	case "dtls-key":
+		gc.DTLS.KeyFile = value
+	case "dtls-ca":
+		gc.DTLS.CAFile = value
+	case "dtls-psk":
+		e = gc.addPSK(value)
 	case "mqtt-broker":
-		gc.mqttbroker, e = checkURI(value)
+		gc.Broker.URI, e = checkURI(value)
 	case "mqtt-user":
-		gc.mqttuser = value
+		gc.Broker.Username = value
 	case "mqtt-password":
-		gc.mqttpassword = value
+		gc.Broker.Password = value
 	case "mqtt-clientid":
-		gc.mqttclientid = value
+		gc.Broker.ClientId = value
 	case "mqtt-timeout":
-		gc.mqtttimeout, e = checkNum("mqtt-timeout", value)
+		n, e = checkNum("mqtt-timeout", value)
+		gc.Broker.KeepAlive = time.Duration(n) * time.Second
+	case "webhook-url":
+		gc.Webhook.URL, e = checkWebhookURL(value)
+	case "webhook-poll-url":
+		gc.Webhook.PollURL, e = checkWebhookURL(value)
+	case "webhook-poll-interval":
+		n, e = checkNum("webhook-poll-interval", value)
+		gc.Webhook.PollInterval = time.Duration(n) * time.Second
+	case "predefined-topic":
+		e = gc.addPredefinedTopic(value)
+	case "max-clients":
+		gc.MaxClients, e = checkNum("max-clients", value)
+	case "register-timeout":
+		n, e = checkNum("register-timeout", value)
+		gc.RegisterTimeout = time.Duration(n) * time.Second
+	case "register-retries":
+		gc.RegisterRetries, e = checkNum("register-retries", value)
+	case "mtu":
+		gc.MTU, e = checkNum("mtu", value)
+	case "protocol-versions":
+		gc.ProtocolVersions, e = checkVersions(value)
+	case "metrics-listen":
+		gc.MetricsAddress = value
+	case "admin-listen":
+		gc.AdminAddress = value
+	case "gateway-id":
+		gc.Presence.GatewayId = value
+	case "presence-events":
+		gc.Presence.Events = strings.Split(value, ",")
+	case "presence-retain":
+		var b bool
+		if b, e = checkBool("presence-retain", value); e == nil {
+			gc.Presence.Retain = b
+		}
+	case "stats-interval":
+		n, e = checkNum("stats-interval", value)
+		gc.Presence.StatsInterval = time.Duration(n) * time.Second
+	case "log-level":
+		var l slog.Level
+		if l, e = checkLevel(value); e == nil {
+			gc.Log.Level = l
+		}
+	case "log-format":
+		gc.Log.Format = value
+	case "log-trace":
+		gc.Log.Trace = append(gc.Log.Trace, value)
+	case "listener", "listener-network", "listener-baud", "listener-multicast", "listener-interface",
+		"listener-advertise", "listener-gateway-id", "listener-mount", "listener-acl":
+		e = gc.setListenerOption(key, value)
+	case "acl-allow", "acl-publish", "acl-subscribe":
+		e = gc.addACL(key, value)
+	case "tenant":
+		name, file, ok := strings.Cut(value, ":")
+		if !ok || name == "" || file == "" {
+			ERROR.Printf("Invalid tenant, must be \"<name>:<config file>\": \"%s\"", value)
+			return ErrInvalidTenant
+		}
+		gc.Tenants = append(gc.Tenants, TenantConfig{Name: name, File: file})
+	case "qos-1-allow":
+		gc.QosMinusOneAllow = append(gc.QosMinusOneAllow, value)
+	case "qos-1-mqtt-qos":
+		if n, e = checkNum("qos-1-mqtt-qos", value); e == nil && (n < 0 || n > 2) {
+			ERROR.Printf("Invalid value specified for \"qos-1-mqtt-qos\": \"%s\"", value)
+			e = ErrInvalidQos
+		} else if e == nil {
+			gc.QosMinusOneMQTTQos = byte(n)
+		}
 	default:
 		ERROR.Printf("Unknown config option: \"%s\"", key)
 		return ErrUnknownConfigOption
@@ -96,11 +878,121 @@ func (gc *GatewayConfig) setOption(key, value string) error {
 	return e
 }
 
+// value is "<topicid>:<topic name>"
+func (gc *GatewayConfig) addPredefinedTopic(value string) error {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		ERROR.Printf("Invalid predefined topic, must be \"<id>:<topic>\": \"%s\"", value)
+		return ErrInvalidPredefinedTopic
+	}
+	id, e := checkNum("predefined-topic", value[:i])
+	if e != nil {
+		return e
+	}
+	if id <= 0 || id >= 0xFFFF {
+		ERROR.Printf("Invalid predefined topic id: \"%s\"", value[:i])
+		return ErrInvalidPredefinedTopicId
+	}
+	gc.PredefinedTopics[uint16(id)] = value[i+1:]
+	return nil
+}
+
+// value is "<listener name>:<value>", the first option naming a
+// listener adds it.
+func (gc *GatewayConfig) setListenerOption(key, value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		ERROR.Printf("Invalid value specified for \"%s\", must be \"<listener>:<value>\": \"%s\"", key, value)
+		return ErrInvalidListener
+	}
+	lc := gc.listener(name)
+	var e error
+	var n int
+	switch key {
+	case "listener":
+		lc.Address = v
+	case "listener-network":
+		lc.Network, e = checkNetwork(v)
+	case "listener-baud":
+		lc.Baud, e = checkNum(key, v)
+	case "listener-multicast":
+		lc.Multicast = v
+	case "listener-interface":
+		lc.Interface = v
+	case "listener-advertise":
+		n, e = checkNum(key, v)
+		lc.Advertise = time.Duration(n) * time.Second
+	case "listener-gateway-id":
+		if n, e = checkNum(key, v); e == nil && (n < 0 || n > 0xFF) {
+			ERROR.Printf("Invalid value specified for \"%s\": \"%s\"", key, v)
+			e = ErrInvalidListenerGatewayId
+		} else if e == nil {
+			lc.GatewayId = byte(n)
+		}
+	case "listener-mount":
+		lc.Mount = v
+	case "listener-acl":
+		lc.ACL = v
+	}
+	return e
+}
+
+// listener returns the listener called name, adding it if need be.
+// Listeners read from a file are gateway 1 unless they say otherwise.
+func (gc *GatewayConfig) listener(name string) *ListenerConfig {
+	for i := range gc.Listeners {
+		if gc.Listeners[i].Name == name {
+			return &gc.Listeners[i]
+		}
+	}
+	gc.Listeners = append(gc.Listeners, ListenerConfig{Name: name, Network: "udp", GatewayId: 1})
+	return &gc.Listeners[len(gc.Listeners)-1]
+}
+
+// value is "<profile>:<address or topic filter>"
+func (gc *GatewayConfig) addACL(key, value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		ERROR.Printf("Invalid value specified for \"%s\", must be \"<profile>:<value>\": \"%s\"", key, value)
+		return ErrInvalidACLProfile
+	}
+	if gc.ACLs == nil {
+		gc.ACLs = make(map[string]ACLProfile)
+	}
+	acl := gc.ACLs[name]
+	switch key {
+	case "acl-allow":
+		acl.Allow = append(acl.Allow, v)
+	case "acl-publish":
+		acl.Publish = append(acl.Publish, v)
+	case "acl-subscribe":
+		acl.Subscribe = append(acl.Subscribe, v)
+	}
+	gc.ACLs[name] = acl
+	return nil
+}
+
+// value is "<identity>:<hex encoded key>"
+func (gc *GatewayConfig) addPSK(value string) error {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 {
+		ERROR.Printf("Invalid pre-shared key, must be \"<identity>:<hex key>\": \"%s\"", value)
+		return ErrInvalidPSK
+	}
+	key, e := hex.DecodeString(value[i+1:])
+	if e != nil || len(key) == 0 {
+		ERROR.Printf("Invalid pre-shared key for \"%s\", must be hex", value[:i])
+		return ErrInvalidPSK
+	}
+	gc.DTLS.PSK[value[:i]] = key
+	return nil
+}
+
 func checkURI(value string) (string, error) {
-	if value[0:6] != "tcp://" &&
-		value[0:6] != "ssl://" &&
-		value[0:6] != "tls://" &&
-		value[0:7] != "tcps://" {
+	if !strings.HasPrefix(value, "tcp://") &&
+		!strings.HasPrefix(value, "ssl://") &&
+		!strings.HasPrefix(value, "tls://") &&
+		!strings.HasPrefix(value, "tcps://") {
 		ERROR.Printf("Invalid URI, must specify transport (ex: \"tcp://\"): \"%s\"", value)
 		return "", ErrNoTransportSpecified
 	}
@@ -109,18 +1001,52 @@ func checkURI(value string) (string, error) {
 	return value, nil
 }
 
-func checkMode(value string) (bool, error) {
-	var isAggregating bool
+func checkWebhookURL(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		ERROR.Printf("Invalid webhook URL, must be http:// or https://: \"%s\"", value)
+		return "", ErrInvalidWebhookURL
+	}
+	return value, nil
+}
+
+func checkMode(value string) (Mode, error) {
 	switch value {
 	case "aggregating":
-		isAggregating = true
+		return Aggregating, nil
 	case "transparent":
-		isAggregating = false
+		return Transparent, nil
 	default:
 		ERROR.Printf("Invalid value specified for \"mode\": \"%s\"", value)
-		return false, ErrInvalidModeSpecified
+		return Transparent, ErrInvalidModeSpecified
+	}
+}
+
+func checkNetwork(value string) (string, error) {
+	switch value {
+	case "udp", "udp4", "udp6", "dtls", "tcp", "serial":
+		return value, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"transport\": \"%s\"", value)
+		return "", ErrInvalidNetwork
 	}
-	return isAggregating, nil
+}
+
+// value is a comma separated list, eg "1.2,2.0"
+func checkVersions(value string) ([]byte, error) {
+	var versions []byte
+	for _, v := range strings.Split(value, ",") {
+		switch v {
+		case "1.2":
+			versions = append(versions, VERSION_1_2)
+		case "2.0":
+			versions = append(versions, VERSION_2_0)
+		default:
+			ERROR.Printf("Invalid value specified for \"protocol-versions\": \"%s\"", v)
+			return nil, ErrInvalidProtocolVersion
+		}
+	}
+	return versions, nil
 }
 
 func checkNum(label, value string) (int, error) {
@@ -131,3 +1057,23 @@ func checkNum(label, value string) (int, error) {
 		return p, nil
 	}
 }
+
+func checkLevel(value string) (slog.Level, error) {
+	l, err := logging.ParseLevel(value)
+	if err != nil {
+		ERROR.Printf("Invalid value specified for \"log-level\" (not debug, info, warn or error): \"%s\"", value)
+		return 0, ErrInvalidLogLevel
+	}
+	return l, nil
+}
+
+func checkBool(label, value string) (bool, error) {
+	switch value {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	}
+	ERROR.Printf("Invalid value specified for \"%s\" (not true or false): \"%s\"", label, value)
+	return false, ErrNotABool
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// A TOML config groups the options of the flat config into sections,
+// eg "mqtt-broker" is "uri" in [broker]. A list sets an option once for
+// each item, or for the options that take a comma separated list, once
+// for them all.
+//
+//	mode = "aggregating"
+//	protocol-versions = ["1.2", "2.0"]
+//
+//	[broker]
+//	uri = "tcp://localhost:1883"
+//	password = "${BROKER_PASSWORD}"
+//
+//	[predefined-topics]
+//	1 = "sensors/temperature"
+//
+//	[listener.radio1]
+//	network = "udp6"
+//	address = "[::]:1883"
+//	mount = "radio1"
+//
+// [tenants] names the config file of each tenant, like predefined
+// topics name their topics.
+//
+// Listeners and ACL profiles have a section each, named after them,
+// whose options are set as "<name>:<value>".
+//
+// Values are strings, numbers, booleans and lists of them. ${NAME} is
+// expanded in strings in double quotes, single quotes keep the string
+// as it is.
+var tomlOptions = map[string]string{
+	"mode":                  "mode",
+	"listen":                "listen",
+	"port":                  "port",
+	"transport":             "transport",
+	"max-clients":           "max-clients",
+	"mtu":                   "mtu",
+	"protocol-versions":     "protocol-versions",
+	"register-timeout":      "register-timeout",
+	"register-retries":      "register-retries",
+	"metrics-listen":        "metrics-listen",
+	"admin-listen":          "admin-listen",
+	"broker.uri":            "mqtt-broker",
+	"broker.user":           "mqtt-user",
+	"broker.password":       "mqtt-password",
+	"broker.client-id":      "mqtt-clientid",
+	"broker.keep-alive":     "mqtt-timeout",
+	"webhook.url":           "webhook-url",
+	"webhook.poll-url":      "webhook-poll-url",
+	"webhook.poll-interval": "webhook-poll-interval",
+	"serial.device":         "serial-device",
+	"serial.baud":           "serial-baud",
+	"dtls.cert":             "dtls-cert",
+	"dtls.key":              "dtls-key",
+	"dtls.ca":               "dtls-ca",
+	"dtls.psk":              "dtls-psk",
+	"qos-1.allow":           "qos-1-allow",
+	"qos-1.mqtt-qos":        "qos-1-mqtt-qos",
+	"presence.gateway-id":   "gateway-id",
+	"presence.events":       "presence-events",
+	"presence.retain":       "presence-retain",
+	"presence.interval":     "stats-interval",
+	"log.level":             "log-level",
+	"log.format":            "log-format",
+	"log.trace":             "log-trace",
+}
+
+// The options of [listener.<name>] and [acl.<name>].
+var tomlNamedOptions = map[string]string{
+	"listener.address":    "listener",
+	"listener.network":    "listener-network",
+	"listener.baud":       "listener-baud",
+	"listener.multicast":  "listener-multicast",
+	"listener.interface":  "listener-interface",
+	"listener.advertise":  "listener-advertise",
+	"listener.gateway-id": "listener-gateway-id",
+	"listener.mount":      "listener-mount",
+	"listener.acl":        "listener-acl",
+	"acl.allow":           "acl-allow",
+	"acl.publish":         "acl-publish",
+	"acl.subscribe":       "acl-subscribe",
+}
+
+// Options given a list as a single comma separated value, the other
+// options that take lists are set once for each item.
+var (
+	tomlJoined   = map[string]bool{"protocol-versions": true, "presence-events": true}
+	tomlRepeated = map[string]bool{"dtls-psk": true, "qos-1-allow": true, "log-trace": true,
+		"acl-allow": true, "acl-publish": true, "acl-subscribe": true}
+)
+
+// Their keys are topic ids and tenant names, rather than options.
+const (
+	predefinedSection = "predefined-topics"
+	tenantsSection    = "tenants"
+)
+
+func tomlSection(name string) bool {
+	if name == predefinedSection || name == tenantsSection {
+		return true
+	}
+	if kind, named, ok := strings.Cut(name, "."); ok {
+		return named != "" && (kind == "listener" || kind == "acl")
+	}
+	for option := range tomlOptions {
+		if strings.HasPrefix(option, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTOML walks the document with go-toml's parser, rather than
+// unmarshalling it, for the line each option is on and whether its
+// strings are in single quotes. A syntax error ends the walk.
+func (gc *GatewayConfig) parseTOML(config string) error {
+	var errs ConfigErrors
+	fail := func(line int, name string, err error) {
+		errs = append(errs, ConfigError{File: gc.file, Line: line, Key: name, Err: err})
+	}
+	var p unstable.Parser
+	p.Reset([]byte(config))
+	seen := make(map[string]bool)
+	var table []string
+	skip := false
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table:
+			var line int
+			table, line = tomlKey(&p, e)
+			name := strings.Join(table, ".")
+			// the options of a bad section would each be unknown
+			if skip = !tomlSection(name); skip {
+				fail(line, name, ErrUnknownConfigSection)
+			}
+		case unstable.ArrayTable:
+			key, line := tomlKey(&p, e)
+			table, skip = nil, true
+			fail(line, strings.Join(key, "."), ErrUnknownConfigSection)
+		case unstable.KeyValue:
+			if skip {
+				continue
+			}
+			key, line := tomlKey(&p, e)
+			key = append(append([]string(nil), table...), key...)
+			section, option := strings.Join(key[:len(key)-1], "."), key[len(key)-1]
+			name := strings.Join(key, ".")
+			values, list, err := tomlValue(&p, e.Value())
+			switch {
+			case err != nil:
+				fail(line, name, err)
+			case seen[name]:
+				fail(line, name, ErrDuplicateConfigOption)
+			case section != "" && !tomlSection(section):
+				fail(line, name, ErrUnknownConfigOption)
+			default:
+				seen[name] = true
+				if err = gc.setTOML(section, option, name, values, list, line); err != nil {
+					fail(line, name, err)
+				}
+			}
+		}
+	}
+	if err := p.Error(); err != nil {
+		line, key := 0, ""
+		var pe *unstable.ParserError
+		if errors.As(err, &pe) {
+			if len(pe.Highlight) > 0 {
+				line = p.Shape(p.Range(pe.Highlight)).Start.Line
+			}
+			key = strings.Join(pe.Key, ".")
+		}
+		fail(line, key, fmt.Errorf("%w: %s", ErrInvalidTOML, err))
+	}
+	return errs.err()
+}
+
+// tomlKey is the parts of the dotted key of e, and the line it is on.
+func tomlKey(p *unstable.Parser, e *unstable.Node) (key []string, line int) {
+	it := e.Key()
+	for it.Next() {
+		if line == 0 {
+			line = p.Shape(it.Node().Raw).Start.Line
+		}
+		key = append(key, string(it.Node().Data))
+	}
+	return key, line
+}
+
+func (gc *GatewayConfig) setTOML(section, key, name string, values []string, list bool, line int) error {
+	if section == predefinedSection || section == tenantsSection {
+		if list {
+			return ErrUnexpectedList
+		}
+		option := "predefined-topic"
+		if section == tenantsSection {
+			option = "tenant"
+		}
+		return gc.set(option, name, key+":"+values[0], line)
+	}
+	option, ok := tomlOptions[name]
+	prefix := ""
+	if kind, named, found := strings.Cut(section, "."); found {
+		option, ok = tomlNamedOptions[kind+"."+key]
+		prefix = named + ":"
+	}
+	if !ok {
+		return ErrUnknownConfigOption
+	}
+	switch {
+	case !list:
+		return gc.set(option, name, prefix+values[0], line)
+	case tomlJoined[option]:
+		return gc.set(option, name, prefix+strings.Join(values, ","), line)
+	case !tomlRepeated[option]:
+		return ErrUnexpectedList
+	}
+	for _, v := range values {
+		if err := gc.set(option, name, prefix+v, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tomlValue is the value of v, or the values of the list it is, as the
+// strings the options are set with.
+func tomlValue(p *unstable.Parser, v *unstable.Node) (values []string, list bool, err error) {
+	if v.Kind != unstable.Array {
+		value, err := tomlScalar(p, v)
+		return []string{value}, false, err
+	}
+	it := v.Children()
+	for it.Next() {
+		value, err := tomlScalar(p, it.Node())
+		if err != nil {
+			return nil, true, err
+		}
+		values = append(values, value)
+	}
+	return values, true, nil
+}
+
+// tomlScalar is the string, number or boolean v.
+func tomlScalar(p *unstable.Parser, v *unstable.Node) (string, error) {
+	switch v.Kind {
+	case unstable.String:
+		if p.Raw(v.Raw)[0] == '\'' {
+			return string(v.Data), nil
+		}
+		return expandEnv(string(v.Data))
+	case unstable.Bool, unstable.Integer, unstable.Float:
+		return string(v.Data), nil
+	}
+	return "", ErrInvalidConfigValue
+}
@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+// DTLSTransport carries MQTT-SN over UDP secured with DTLS 1.2. Each
+// client completes a handshake, with a certificate or a pre-shared key,
+// and then has a connection of its own, much like the TCP kind of
+// StreamTransport, except that every read is one whole packet.
+type DTLSTransport struct {
+	*StreamTransport
+}
+
+// NewDTLSTransport returns a transport that accepts DTLS clients on
+// the UDP "host:port" address.
+func NewDTLSTransport(address string, config *dtls.Config) *DTLSTransport {
+	s := newStreamTransport(address)
+	s.listen = func() (net.Listener, error) {
+		laddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		return dtls.Listen("udp", laddr, config)
+	}
+	s.readPacket = readDatagram
+	s.releasePacket = releaseDatagram
+	return &DTLSTransport{s}
+}
+
+// PeerIdentity returns the pre-shared key identity the client at a
+// completed its handshake with, ok is false if it used a certificate.
+func (d *DTLSTransport) PeerIdentity(a net.Addr) (identity string, ok bool) {
+	rw, ok := d.conn(a)
+	if !ok {
+		return "", false
+	}
+	conn, ok := rw.(*dtls.Conn)
+	if !ok {
+		return "", false
+	}
+	id := conn.ConnectionState().IdentityHint
+	return string(id), len(id) > 0
+}
+
+// DTLS keeps the packet boundaries, so one read is one packet. It is
+// read into a buffer that goes back to datagramBuffers once Receive
+// has copied the packet out.
+func readDatagram(r io.Reader) ([]byte, error) {
+	bp := datagramBuffers.Get().(*[]byte)
+	n, err := r.Read(*bp)
+	if err != nil {
+		datagramBuffers.Put(bp)
+		return nil, err
+	}
+	return (*bp)[:n], nil
+}
+
+func releaseDatagram(b []byte) {
+	b = b[:cap(b)]
+	datagramBuffers.Put(&b)
+}
+
+var datagramBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 1500)
+		return &b
+	},
+}
+
+// DTLSConfig secures the link to clients when Network is "dtls". The
+// gateway needs a certificate, pre-shared keys, or both.
+type DTLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate and key the
+	// gateway presents to clients using certificate cipher suites.
+	CertFile string
+	KeyFile  string
+	// Certificates are presented as well as the one in CertFile.
+	Certificates []tls.Certificate
+	// CAFile, if set, holds the PEM encoded CAs that sign the client
+	// certificates, and clients using a certificate suite must have one.
+	CAFile string
+	// PSK maps each client's pre-shared key identity to its key. A
+	// client that connects with a pre-shared key must use its identity
+	// as its ClientId.
+	PSK map[string][]byte
+	// HandshakeTimeout bounds how long a client may take to complete
+	// its handshake, 0 means 10 seconds.
+	HandshakeTimeout time.Duration
+}
+
+func (dc *DTLSConfig) validate() error {
+	if (dc.CertFile == "") != (dc.KeyFile == "") {
+		return ErrInvalidDTLSConfig
+	}
+	if dc.CertFile == "" && len(dc.Certificates) == 0 && len(dc.PSK) == 0 {
+		return ErrInvalidDTLSConfig
+	}
+	for _, key := range dc.PSK {
+		if len(key) == 0 {
+			return ErrInvalidPSK
+		}
+	}
+	if dc.HandshakeTimeout < 0 {
+		return ErrNegativeValue
+	}
+	return nil
+}
+
+var (
+	certificateSuites = []dtls.CipherSuiteID{
+		dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		dtls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		dtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		dtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	}
+	// CCM_8 is what most constrained devices implement
+	pskSuites = []dtls.CipherSuiteID{
+		dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_PSK_WITH_AES_128_CCM,
+		dtls.TLS_PSK_WITH_AES_128_CCM_8,
+	}
+)
+
+// Load the certificates and build the configuration for the listener.
+func (dc *DTLSConfig) dtlsConfig() (*dtls.Config, error) {
+	timeout := dc.HandshakeTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	config := &dtls.Config{
+		Certificates:         append([]tls.Certificate(nil), dc.Certificates...),
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), timeout)
+		},
+	}
+	if dc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(dc.CertFile, dc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if dc.CAFile != "" {
+		pem, err := ioutil.ReadFile(dc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidDTLSConfig
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = dtls.RequireAndVerifyClientCert
+	}
+	if len(dc.PSK) > 0 {
+		keys := make(map[string][]byte, len(dc.PSK))
+		for identity, key := range dc.PSK {
+			keys[identity] = key
+		}
+		config.PSK = func(identity []byte) ([]byte, error) {
+			if key, ok := keys[string(identity)]; ok {
+				return key, nil
+			}
+			ERROR.Printf("unknown PSK identity \"%s\"\n", identity)
+			return nil, ErrUnknownPSKIdentity
+		}
+	}
+	if len(config.Certificates) > 0 {
+		config.CipherSuites = append(config.CipherSuites, certificateSuites...)
+	}
+	if config.PSK != nil {
+		config.CipherSuites = append(config.CipherSuites, pskSuites...)
+	}
+	return config, nil
+}
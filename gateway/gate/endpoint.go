@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// An endpoint is what the clients of one listener see of the gateway:
+// the gateway id it answers to, the topic its clients' topics are
+// mounted under and the ACL profile they are held to.
+type endpoint struct {
+	name      string
+	gatewayId byte
+	allow     *addrList
+	// the mount and the ACL profile's topics, replaced on a reload
+	lock sync.RWMutex
+	// the Mount and a "/", or ""
+	mount     string
+	publish   []string
+	subscribe []string
+}
+
+// The endpoint of clients that arrive on a transport the gateway
+// didn't listen on itself.
+var defaultEndpoint = &endpoint{gatewayId: 1, allow: newAddrList(nil)}
+
+func newEndpoint(lc ListenerConfig, acls map[string]ACLProfile) *endpoint {
+	e := &endpoint{
+		name:      lc.Name,
+		gatewayId: lc.GatewayId,
+		allow:     newAddrList(nil),
+	}
+	e.replace(lc, acls)
+	return e
+}
+
+// replace the mount and ACL profile, when the config is reloaded.
+func (e *endpoint) replace(lc ListenerConfig, acls map[string]ACLProfile) {
+	acl := acls[lc.ACL]
+	var mount string
+	if lc.Mount != "" {
+		mount = strings.TrimSuffix(lc.Mount, "/") + "/"
+	}
+	e.allow.replace(acl.Allow)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.mount, e.publish, e.subscribe = mount, acl.Publish, acl.Subscribe
+}
+
+// brokerTopic is the broker's name for a topic of the endpoint's
+// clients.
+func (e *endpoint) brokerTopic(topic string) string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.mount + topic
+}
+
+// clientTopic is the clients' name for a broker topic, ok is false if
+// the topic isn't under the mount.
+func (e *endpoint) clientTopic(topic string) (string, bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return strings.CutPrefix(topic, e.mount)
+}
+
+// mayPublish reports whether the endpoint's clients may publish to
+// the broker topic.
+func (e *endpoint) mayPublish(topic string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	topic, ok := strings.CutPrefix(topic, e.mount)
+	return ok && allowedBy(e.publish, topic)
+}
+
+// maySubscribe reports whether the endpoint's clients may subscribe to
+// the broker topic filter.
+func (e *endpoint) maySubscribe(filter string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	filter, ok := strings.CutPrefix(filter, e.mount)
+	return ok && allowedBy(e.subscribe, filter)
+}
+
+// An empty list of filters allows every topic.
+func allowedBy(filters []string, topic string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if covers(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// A listenerTransport is the transport of one of the gateway's
+// listeners, it takes the listener's endpoint to the clients that
+// arrive on it.
+type listenerTransport struct {
+	Transport
+	*endpoint
+}
+
+func (t listenerTransport) PeerIdentity(a net.Addr) (string, bool) {
+	if it, ok := t.Transport.(IdentityTransport); ok {
+		return it.PeerIdentity(a)
+	}
+	return "", false
+}
+
+// endpointOf returns the endpoint of the listener that t belongs to.
+func endpointOf(t Transport) *endpoint {
+	switch t := t.(type) {
+	case listenerTransport:
+		return t.endpoint
+	case forwardingTransport:
+		return endpointOf(t.Transport)
+	}
+	return defaultEndpoint
+}
+
+func (c *Client) endpoint() *endpoint {
+	return endpointOf(c.Conn)
+}
+
+// checkListener checks that a client may connect from a through the
+// listener of c.
+func checkListener(c Transport, a net.Addr) bool {
+	if e := endpointOf(c); !e.allow.contains(a) {
+		ERROR.Printf("refusing %v, not allowed to connect to listener \"%s\"\n", a, e.name)
+		return false
+	}
+	return true
+}
+
+// answerSearch sends a client searching for a gateway the GWINFO of
+// the listener it searched on.
+func answerSearch(c Transport, a net.Addr) {
+	gi := NewMessage(GWINFO).(*GwInfoMessage)
+	gi.GatewayId = endpointOf(c).gatewayId
+	if err := NewClient("", c, a).Write(gi); err != nil {
+		ERROR.Println(err)
+	}
+}
+
+// startListeners listens, for g, on every listener of gc. If one of
+// them fails the ones already started are closed.
+func startListeners(gc *GatewayConfig, g Gateway, metrics *Metrics) ([]*listener, error) {
+	var ls []*listener
+	for _, lc := range gc.listeners() {
+		l, err := listenOn(lc, gc, g, metrics)
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func listenOn(lc ListenerConfig, gc *GatewayConfig, g Gateway, metrics *Metrics) (*listener, error) {
+	t, err := lc.transport(gc.DTLS)
+	if err != nil {
+		return nil, err
+	}
+	l, err := listen(listenerTransport{countingTransport{t, metrics}, newEndpoint(lc, gc.ACLs)}, g, gc.MTU)
+	if err != nil {
+		return nil, err
+	}
+	if gt, ok := t.(grouped); ok && lc.Advertise > 0 {
+		go l.advertise(lc.GatewayId, gt.Group(), lc.Advertise)
+	}
+	return l, nil
+}
+
+// Stop every listener, giving up when ctx is done.
+func stopListeners(ctx context.Context, ls []*listener) error {
+	var err error
+	for _, l := range ls {
+		if lerr := l.stop(ctx); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+func closeListeners(ls []*listener) {
+	for _, l := range ls {
+		l.close()
+	}
+}
+
+// A grouped transport joins a multicast group.
+type grouped interface {
+	Group() net.Addr
+}
+
+// advertise sends an ADVERTISE for gateway id to group every
+// interval, until the listener stops.
+func (l *listener) advertise(id byte, group net.Addr, interval time.Duration) {
+	am := NewMessage(ADVERTISE).(*AdvertiseMessage)
+	am.GatewayId = id
+	am.Duration = uint16(interval / time.Second)
+	packet := am.AppendTo(nil)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := l.transport.Send(packet, group); err != nil {
+			ERROR.Printf("advertising to %v: %v\n", group, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+	}
+}
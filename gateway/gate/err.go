@@ -12,11 +12,56 @@ var (
 	ErrNoTransportSpecified         = errors.New("Missing transport")
 	ErrInvalidModeSpecified         = errors.New("Invalid mode")
 	ErrNotANumber                   = errors.New("Not a number")
+	ErrNegativeValue                = errors.New("Value cannot be negative")
+	ErrNotPositive                  = errors.New("Value must be positive")
+	ErrInvalidListenAddress         = errors.New("Invalid listen address")
+	ErrInvalidNetwork               = errors.New("Invalid transport")
+	ErrInvalidSerialDevice          = errors.New("Invalid serial device")
+	ErrInvalidPredefinedTopic       = errors.New("Invalid predefined topic")
+	ErrInvalidPredefinedTopicId     = errors.New("Invalid predefined topic id")
+	ErrInvalidDTLSConfig            = errors.New("DTLS needs a certificate and key, or pre-shared keys")
+	ErrInvalidPSK                   = errors.New("Invalid pre-shared key")
+	ErrInvalidMTU                   = errors.New("MTU must be between 8 and 65535")
+	ErrInvalidProtocolVersion       = errors.New("Invalid protocol version")
+	ErrInvalidGatewayId             = errors.New("Gateway id cannot contain '/', '+' or '#'")
+	ErrInvalidPresenceEvent         = errors.New("Invalid presence event")
+	ErrNotABool                     = errors.New("Not true or false")
+	ErrInvalidLogLevel              = errors.New("Invalid log level")
+	ErrInvalidLogFormat             = errors.New("Invalid log format")
+	ErrUnknownConfigSection         = errors.New("Unknown config section")
+	ErrDuplicateConfigOption        = errors.New("Config option set twice")
+	ErrInvalidConfigValue           = errors.New("Invalid value, strings must be quoted")
+	ErrInvalidTOML                  = errors.New("Invalid TOML")
+	ErrUnexpectedList               = errors.New("Config option does not take a list")
+	ErrUnsetVariable                = errors.New("Environment variable not set")
+	ErrUnterminatedVariable         = errors.New("Missing '}' after '${'")
+	ErrNoConfigFile                 = errors.New("The config was not read from a file")
+	ErrInvalidListener              = errors.New("Invalid listener, must be \"<name>:<value>\" with a name of its own")
+	ErrInvalidListenerGatewayId     = errors.New("Listener gateway id must be between 0 and 255")
+	ErrInvalidMulticastGroup        = errors.New("Multicast group must be a multicast IP, on a udp listener")
+	ErrNoMulticastGroup             = errors.New("Advertising needs a multicast group")
+	ErrInvalidAdvertise             = errors.New("Advertise must be between 1 and 65535 seconds")
+	ErrInvalidMount                 = errors.New("Mount must be a topic name")
+	ErrUnknownACLProfile            = errors.New("Unknown ACL profile")
+	ErrInvalidACLProfile            = errors.New("Invalid ACL profile entry, must be \"<profile>:<value>\"")
+	ErrInvalidTenant                = errors.New("Invalid tenant, must be \"<name>:<config file>\" with a name of its own")
+	ErrNoTenantConfig               = errors.New("Tenant has no config")
+	ErrNestedTenants                = errors.New("A tenant cannot have tenants")
+	ErrInvalidWebhookURL            = errors.New("Webhook URL must be http:// or https://")
+	ErrNoWebhookURL                 = errors.New("Polling a webhook needs a webhook URL")
+	ErrUpstreamNotAggregating       = errors.New("Only aggregating gateways have an upstream other than the broker")
 
 	/* Protocol Errors */
 	ErrZeroLengthClientID = errors.New("Zero-length clientID is invalid")
 	ErrClientIDTooLong    = errors.New("ClientID too long")
 
+	/* Transport Errors */
+	ErrTransportStopped   = errors.New("Transport stopped receiving")
+	ErrUnknownPSKIdentity = errors.New("Unknown pre-shared key identity")
+
+	/* Upstream Errors */
+	ErrNoWebhookPoll = errors.New("Subscribing through a webhook needs a poll URL")
+
 	/* Topic Errors */
 	ErrTopicFilterEmptyString     = errors.New("TopicFilter cannot be empty string")
 	ErrTopicFilterInvalidWildcard = errors.New("TopicFilter contains invalid wildcard")
@@ -27,6 +72,11 @@ var (
 	ErrNoSuchSubscriptionExists = errors.New("Subscription does not exist")
 	ErrNoSubscribers            = errors.New("No subscribers")
 	ErrClientNotSubscribed      = errors.New("Client not subscribed")
+
+	/* Admin API Errors */
+	ErrNoSuchClient     = errors.New("No such client")
+	ErrNotConnected     = errors.New("Client not connected")
+	ErrMethodNotAllowed = errors.New("Method not allowed")
 )
 
 func chkerr(e error) {
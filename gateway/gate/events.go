@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Types of Event
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventSleep      = "sleep"
+	EventWake       = "wake"
+	EventLost       = "lost"
+	EventRegister   = "register"
+	EventSubscribe  = "subscribe"
+	EventPublish    = "publish"
+	EventReject     = "reject"
+)
+
+// An Event is something a client did, or had done to it, as streamed
+// by the admin API.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	ClientId string    `json:"clientId,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Topic    string    `json:"topic,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	// KeepAlive of the client, in seconds
+	KeepAlive uint16 `json:"keepAlive,omitempty"`
+}
+
+func newEvent(typ string, c *Client, topic, detail string) Event {
+	c.RLock()
+	keepAlive := uint16(c.keepAlive / time.Second)
+	c.RUnlock()
+	return Event{time.Now(), typ, c.ClientId, c.AddrString(), topic, detail, keepAlive}
+}
+
+// addrEvent is an event for whoever is at a, who may not be a client.
+func addrEvent(typ string, a net.Addr, topic, detail string) Event {
+	return Event{Time: time.Now(), Type: typ, Address: a.String(), Topic: topic, Detail: detail}
+}
+
+func qosDetail(qos byte) string {
+	if qos == QOS_MINUS_ONE {
+		return "qos -1"
+	}
+	return fmt.Sprintf("qos %d", qos)
+}
+
+// An eventHub hands each event to everyone watching. A watcher that
+// falls behind misses events rather than holding up the gateway.
+type eventHub struct {
+	sync.Mutex
+	watchers map[chan Event]struct{}
+	closed   bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{watchers: make(map[chan Event]struct{})}
+}
+
+func (h *eventHub) emit(e Event) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watch returns a channel of the events from now on, which is closed
+// by stop or when the hub is closed. Up to size events are held for a
+// watcher before it starts to miss them.
+func (h *eventHub) watch(size int) (events <-chan Event, stop func()) {
+	h.Lock()
+	defer h.Unlock()
+	ch := make(chan Event, size)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.watchers[ch] = struct{}{}
+	return ch, func() {
+		h.Lock()
+		defer h.Unlock()
+		if _, ok := h.watchers[ch]; ok {
+			delete(h.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every watch, the gateway is going away.
+func (h *eventHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.watchers {
+		delete(h.watchers, ch)
+		close(ch)
+	}
+	h.closed = true
+}
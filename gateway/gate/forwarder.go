@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"net"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// ForwardedAddr is a wireless node that the gateway reaches through a
+// forwarder, by encapsulating the packets to it.
+type ForwardedAddr struct {
+	Forwarder net.Addr
+	NodeId    []byte
+	str       string
+}
+
+func NewForwardedAddr(forwarder net.Addr, nodeId []byte) *ForwardedAddr {
+	return &ForwardedAddr{
+		Forwarder: forwarder,
+		NodeId:    append([]byte(nil), nodeId...),
+		str:       forwarder.String() + "/" + hex.EncodeToString(nodeId),
+	}
+}
+
+func (a *ForwardedAddr) Network() string {
+	return a.Forwarder.Network()
+}
+
+// Every node behind a forwarder has an address of its own, so that
+// they are told apart as clients.
+func (a *ForwardedAddr) String() string {
+	return a.str
+}
+
+// forwardingTransport sends packets for a ForwardedAddr to its
+// forwarder, encapsulated, and everything else as it is.
+type forwardingTransport struct {
+	Transport
+}
+
+func (f forwardingTransport) Send(b []byte, to net.Addr) error {
+	fa, ok := to.(*ForwardedAddr)
+	if !ok {
+		return f.Transport.Send(b, to)
+	}
+	packet, err := Encapsulate(0x00, fa.NodeId, b)
+	if err != nil {
+		return err
+	}
+	return f.Transport.Send(packet, fa.Forwarder)
+}
@@ -1,11 +1,44 @@
 package gateway
 
 import (
+	"context"
 	"net"
 )
 
+// A Gateway is started with Start, which returns once the gateway is
+// connected and listening, and runs until Shutdown is called. Neither
+// ever exits the process, so a Gateway can be embedded in a larger
+// program.
 type Gateway interface {
-	Start()
-	Port() int
-	OnPacket(int, []byte, *net.UDPConn, *net.UDPAddr)
+	Start(context.Context) error
+	Shutdown(context.Context) error
+	// Addr is the address the gateway is listening on, nil until
+	// it has been started.
+	Addr() net.Addr
+	OnPacket(int, []byte, Transport, net.Addr)
+	// Clients returns the state of every client the gateway knows.
+	Clients() []ClientStatus
+	// Reload applies the options of gc that can be changed while the
+	// gateway runs, and names those that need a restart.
+	Reload(gc *GatewayConfig) (ReloadResult, error)
+	// ReloadConfig reads the config again and reloads it.
+	ReloadConfig() (ReloadResult, error)
+}
+
+// New validates gc and creates a gateway of the configured Mode, or
+// one for each of its Tenants.
+func New(gc *GatewayConfig) (Gateway, error) {
+	var g Gateway
+	var err error
+	if len(gc.Tenants) > 0 {
+		g, err = NewMultiGateway(gc)
+	} else if gc.Mode == Aggregating {
+		g, err = NewAGateway(gc)
+	} else {
+		g, err = NewTGateway(gc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
 }
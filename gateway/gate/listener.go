@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A listener feeds the packets arriving on a Transport to a Gateway.
+// Stopping the listener only stops the reads, the transport stays
+// open so the gateway can still write to its clients while it shuts
+// down.
+type listener struct {
+	transport Transport
+	mtu       int
+	// Receive buffers are reused once the packet in them has been
+	// handled, handlers must copy anything they keep hold of.
+	buffers  sync.Pool
+	stopping atomic.Bool
+	handlers sync.WaitGroup
+	done     chan struct{}
+}
+
+// listen reads packets of up to mtu bytes from t, dropping any that
+// are larger.
+func listen(t Transport, g Gateway, mtu int) (*listener, error) {
+	if err := t.Listen(); err != nil {
+		return nil, err
+	}
+	l := &listener{
+		transport: t,
+		mtu:       mtu,
+		done:      make(chan struct{}),
+	}
+	// a byte over the mtu, so that datagram transports, which truncate
+	// packets to fit, show the packets that are too large
+	l.buffers.New = func() interface{} {
+		b := make([]byte, mtu+1)
+		return &b
+	}
+	go l.serve(g)
+	return l, nil
+}
+
+func (l *listener) serve(g Gateway) {
+	defer close(l.done)
+	for {
+		bp := l.buffers.Get().(*[]byte)
+		buffer := *bp
+		n, remote, err := l.transport.Receive(buffer)
+		if err == nil && n > l.mtu {
+			err = ErrPacketTooLarge
+		}
+		if err != nil {
+			l.buffers.Put(bp)
+			if l.stopping.Load() || errors.Is(err, ErrTransportStopped) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == ErrPacketTooLarge {
+				ERROR.Printf("dropping packet from %v: %v\n", remote, err)
+			} else {
+				ERROR.Println(err)
+			}
+			continue
+		}
+		l.handlers.Add(1)
+		go func() {
+			defer l.handlers.Done()
+			defer l.buffers.Put(bp)
+			g.OnPacket(n, buffer, l.transport, remote)
+		}()
+	}
+}
+
+// Stop receiving packets and wait for the ones already received to be
+// handled, or for ctx to be done.
+func (l *listener) stop(ctx context.Context) error {
+	l.stopping.Store(true)
+	l.transport.StopReceiving()
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return wait(ctx, &l.handlers)
+}
+
+func (l *listener) addr() net.Addr {
+	if l == nil {
+		return nil
+	}
+	return l.transport.LocalAddr()
+}
+
+func (l *listener) close() error {
+	return l.transport.Close()
+}
+
+// Wait for wg, giving up when ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
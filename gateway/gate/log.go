@@ -1,16 +1,90 @@
 package gateway
 
 import (
+	"context"
 	"io"
 	"log"
+	"log/slog"
+	"net"
+
+	"github.com/alsm/gnatt/logging"
+	. "github.com/alsm/gnatt/packets"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 )
 
+// Log is the gateway's structured logger, DEBUG, INFO and ERROR write
+// to it at their levels for code that logs with Printf.
 var (
+	Log   *slog.Logger
+	DEBUG *log.Logger
 	INFO  *log.Logger
 	ERROR *log.Logger
 )
 
+// Gateways embedded in other programs stay quiet unless InitLogger
+// or SetLogger is called.
+func init() {
+	SetLogger(logging.Discard)
+}
+
+// InitLogger logs text at info and above, errors to errorHandle and
+// the rest to infoHandle.
 func InitLogger(infoHandle, errorHandle io.Writer) {
-	INFO = log.New(infoHandle, "INFO:  ", log.Ldate|log.Ltime)
-	ERROR = log.New(errorHandle, "ERROR: ", log.Ldate|log.Ltime)
+	SetLogger(slog.New(logging.NewHandler(logging.Options{Out: infoHandle, ErrOut: errorHandle})))
+}
+
+// SetLogger has the gateway, and the MQTT clients it connects to
+// brokers with, log to l.
+func SetLogger(l *slog.Logger) {
+	Log = l
+	DEBUG = logging.Printf(l, slog.LevelDebug)
+	INFO = logging.Printf(l, slog.LevelInfo)
+	ERROR = logging.Printf(l, slog.LevelError)
+	MQTT.DEBUG = DEBUG
+	MQTT.WARN = logging.Printf(l, slog.LevelWarn)
+	MQTT.ERROR = ERROR
+	MQTT.CRITICAL = ERROR
+}
+
+// NewLogger makes the logger lc asks for, writing to out and errors to
+// errOut, and traces the clients it lists. Its level changes when a
+// gateway's config is reloaded.
+func NewLogger(lc LogConfig, out, errOut io.Writer) *slog.Logger {
+	logLevel.Set(lc.Level)
+	for _, id := range lc.Trace {
+		logging.Trace(id, true)
+	}
+	return slog.New(logging.NewHandler(logging.Options{
+		Out:    out,
+		ErrOut: errOut,
+		Format: lc.Format,
+		Level:  &logLevel,
+	}))
+}
+
+func tracing() bool {
+	return Log.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// traceReceived logs m, from a, at debug. Only the clients being
+// traced are logged unless the level is debug.
+func traceReceived(clients *Clients, m Message, a net.Addr) {
+	if !tracing() {
+		return
+	}
+	var id string
+	if cm, ok := m.(*ConnectMessage); ok {
+		id = string(cm.ClientId)
+	} else if c := clientOf(clients.GetClient(a)); c != nil {
+		id = c.ClientId
+	}
+	Log.Debug("received", append([]any{logging.ClientId, id, logging.Addr, a.String()}, logging.Packet(m)...)...)
+}
+
+func (c *Client) traceSent(m Message) {
+	if !tracing() {
+		return
+	}
+	Log.Debug("sent", append([]any{logging.ClientId, c.ClientId, logging.Addr, c.AddrString()}, logging.Packet(m)...)...)
 }
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// MemoryAddr identifies a peer of a MemoryTransport.
+type MemoryAddr string
+
+func (a MemoryAddr) Network() string {
+	return "memory"
+}
+
+func (a MemoryAddr) String() string {
+	return string(a)
+}
+
+type memoryPacket struct {
+	data []byte
+	from MemoryAddr
+}
+
+// MemoryTransport is a Transport that never leaves the process, it
+// is meant for tests and for clients living in the same program as
+// the gateway. Peers connect to it with Dial. Like UDP, packets sent
+// to a peer that is not keeping up are dropped.
+type MemoryTransport struct {
+	sync.Mutex
+	name     MemoryAddr
+	incoming chan memoryPacket
+	peers    map[MemoryAddr]*MemoryConn
+	stop     chan struct{}
+	stopOnce sync.Once
+	closed   chan struct{}
+	closer   sync.Once
+}
+
+func NewMemoryTransport(name string) *MemoryTransport {
+	return &MemoryTransport{
+		name:     MemoryAddr(name),
+		incoming: make(chan memoryPacket, 64),
+		peers:    make(map[MemoryAddr]*MemoryConn),
+		stop:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (m *MemoryTransport) Listen() error {
+	return nil
+}
+
+func (m *MemoryTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-m.incoming:
+		return copy(b, p.data), p.from, nil
+	case <-m.stop:
+		return 0, nil, ErrTransportStopped
+	case <-m.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (m *MemoryTransport) Send(b []byte, to net.Addr) error {
+	m.Lock()
+	peer, ok := m.peers[MemoryAddr(to.String())]
+	m.Unlock()
+	if !ok {
+		return errors.New("no such memory peer: " + to.String())
+	}
+	select {
+	case <-m.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case peer.incoming <- append([]byte(nil), b...):
+	default:
+	}
+	return nil
+}
+
+func (m *MemoryTransport) StopReceiving() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	return nil
+}
+
+func (m *MemoryTransport) Close() error {
+	m.closer.Do(func() { close(m.closed) })
+	return nil
+}
+
+func (m *MemoryTransport) LocalAddr() net.Addr {
+	return m.name
+}
+
+// Dial returns a new peer of the transport, known to the gateway by name.
+func (m *MemoryTransport) Dial(name string) *MemoryConn {
+	c := &MemoryConn{
+		transport: m,
+		addr:      MemoryAddr(name),
+		incoming:  make(chan []byte, 64),
+		closed:    make(chan struct{}),
+	}
+	m.Lock()
+	m.peers[c.addr] = c
+	m.Unlock()
+	return c
+}
+
+// MemoryConn is a peer's end of a MemoryTransport, each Read and
+// Write carries exactly one packet.
+type MemoryConn struct {
+	transport *MemoryTransport
+	addr      MemoryAddr
+	incoming  chan []byte
+	closed    chan struct{}
+	closer    sync.Once
+}
+
+// Write sends one packet to the gateway.
+func (c *MemoryConn) Write(b []byte) (int, error) {
+	select {
+	case c.transport.incoming <- memoryPacket{append([]byte(nil), b...), c.addr}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.transport.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// Read receives one packet from the gateway.
+func (c *MemoryConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.incoming:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *MemoryConn) Close() error {
+	c.closer.Do(func() {
+		close(c.closed)
+		c.transport.Lock()
+		delete(c.transport.peers, c.addr)
+		c.transport.Unlock()
+	})
+	return nil
+}
+
+func (c *MemoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,480 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Metrics counts what a gateway does, and is served over HTTP in the
+// Prometheus text format when GatewayConfig.MetricsAddress is set.
+type Metrics struct {
+	packetsIn      typeCounter
+	packetsOut     typeCounter
+	decodeErrors   counterVec
+	rejected       counterVec
+	returnCodes    counterVec
+	brokerMessages counterVec
+
+	registerRTT     histogram
+	publishLatency  histogram
+	brokerLinks     atomic.Int64
+	brokerInflight  atomic.Int64
+	brokerLinkDrops atomic.Uint64
+
+	// clients is read when the metrics are written
+	clients *Clients
+}
+
+func newMetrics(clients *Clients) *Metrics {
+	return &Metrics{
+		registerRTT:    newHistogram(),
+		publishLatency: newHistogram(),
+		clients:        clients,
+	}
+}
+
+// A counterVec is a counter for each set of label values.
+type counterVec struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+// labels is the rendered label set, eg `type="PUBLISH"`
+func (c *counterVec) inc(labels string) {
+	c.Lock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[labels]++
+	c.Unlock()
+}
+
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+	s := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		s[k] = v
+	}
+	return s
+}
+
+func (c *counterVec) total() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	var n uint64
+	for _, v := range c.counts {
+		n += v
+	}
+	return n
+}
+
+// A typeCounter counts packets by message type.
+type typeCounter struct {
+	counts [256]atomic.Uint64
+}
+
+func (c *typeCounter) inc(msgType byte) {
+	c.counts[msgType].Add(1)
+}
+
+// snapshot is the counts by the label of their type, as counterVec's.
+func (c *typeCounter) snapshot() map[string]uint64 {
+	s := make(map[string]uint64)
+	for t := range c.counts {
+		if n := c.counts[t].Load(); n > 0 {
+			s[typeLabels[t]] = n
+		}
+	}
+	return s
+}
+
+func (c *typeCounter) total() uint64 {
+	var n uint64
+	for t := range c.counts {
+		n += c.counts[t].Load()
+	}
+	return n
+}
+
+// Histogram buckets, in seconds, from a millisecond to half a minute.
+var buckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+type histogram struct {
+	sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() histogram {
+	return histogram{counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	h.Lock()
+	for i, b := range buckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+	h.Unlock()
+}
+
+func label(name, value string) string {
+	return fmt.Sprintf("%s=%q", name, value)
+}
+
+// The labels of each message type and return code, rendered once.
+var typeLabels, codeLabels = func() (types, codes [256]string) {
+	for i := range types {
+		b := byte(i)
+		if name, ok := MessageNames[b]; ok {
+			types[i] = label("type", name)
+		} else {
+			types[i] = label("type", fmt.Sprintf("0x%02x", b))
+		}
+		if name, ok := ReturnCodeNames[b]; ok {
+			codes[i] = label("code", name)
+		} else {
+			codes[i] = label("code", fmt.Sprintf("0x%02x", b))
+		}
+	}
+	return types, codes
+}()
+
+// packetType is the type of an encoded packet, ok is false if packet
+// is too short to have one.
+func packetType(packet []byte) (byte, bool) {
+	switch {
+	case len(packet) >= 4 && packet[0] == 0x01:
+		return packet[3], true
+	case len(packet) >= 2 && packet[0] != 0x01:
+		return packet[1], true
+	}
+	return 0, false
+}
+
+func (m *Metrics) received(packet []byte) {
+	if t, ok := packetType(packet); ok {
+		m.packetsIn.inc(t)
+	}
+}
+
+// sent counts a packet sent to a client, and rc, the return code of
+// the message in it, if it refuses something.
+func (m *Metrics) sent(packet []byte, rc byte) {
+	t, ok := packetType(packet)
+	if !ok {
+		return
+	}
+	m.packetsOut.inc(t)
+	if rc != ACCEPTED {
+		m.returnCodes.inc(typeLabels[t] + "," + codeLabels[rc])
+	}
+}
+
+// returnCode is the return code of m, ACCEPTED for the messages that
+// have none.
+func returnCode(m Message) byte {
+	switch m := m.(type) {
+	case *ConnackMessage:
+		return m.ReturnCode
+	case *RegackMessage:
+		return m.ReturnCode
+	case *PubackMessage:
+		return m.ReturnCode
+	case *SubackMessage:
+		return m.ReturnCode
+	case *DisconnectMessage:
+		return m.ReasonCode
+	}
+	return ACCEPTED
+}
+
+func (m *Metrics) decodeError(err error) {
+	m.decodeErrors.inc(label("error", err.Error()))
+}
+
+// reject counts a packet that decoded but was dropped, reason is
+// "invalid" or "state".
+func (m *Metrics) reject(reason string) {
+	m.rejected.inc(label("reason", reason))
+}
+
+// brokerPublish times publish, which publishes to the broker and
+// waits for it to complete, and counts it as in flight meanwhile.
+func (m *Metrics) brokerPublish(publish func() bool) bool {
+	m.brokerInflight.Add(1)
+	defer m.brokerInflight.Add(-1)
+	start := time.Now()
+	ok := publish()
+	m.publishLatency.observe(time.Since(start))
+	return ok
+}
+
+// brokerMessage counts a message from the broker by what became of it:
+// "delivered", "queued" behind a REGISTER, "kept" for a client that is
+// asleep or "dropped".
+func (m *Metrics) brokerMessage(outcome string) {
+	m.brokerMessages.inc(label("outcome", outcome))
+}
+
+// A brokerLink is one broker connection, up or not as far as the
+// metrics go.
+type brokerLink struct {
+	up atomic.Bool
+}
+
+func (m *Metrics) linkUp(l *brokerLink) {
+	if !l.up.Swap(true) {
+		m.brokerLinks.Add(1)
+	}
+}
+
+// linkDown counts l as closed, if it is up.
+func (m *Metrics) linkDown(l *brokerLink) {
+	if l.up.Swap(false) {
+		m.brokerLinks.Add(-1)
+	}
+}
+
+// linkLost counts l as closed and dropped, from the handler of its
+// lost connection.
+func (m *Metrics) linkLost(l *brokerLink) {
+	m.linkDown(l)
+	m.brokerLinkDrops.Add(1)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	counters := func(name, help string, c interface{ snapshot() map[string]uint64 }) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		s := c.snapshot()
+		keys := make([]string, 0, len(s))
+		for k := range s {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(cw, "%s{%s} %d\n", name, k, s[k])
+		}
+	}
+	gauge := func(name, help string, v int64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	hist := func(name, help string, h *histogram) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		h.Lock()
+		for i, b := range buckets {
+			fmt.Fprintf(cw, "%s_bucket{le=\"%g\"} %d\n", name, b, h.counts[i])
+		}
+		fmt.Fprintf(cw, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+		h.Unlock()
+	}
+
+	counters("gnatt_packets_received_total", "MQTT-SN packets received from clients, by message type.", &m.packetsIn)
+	counters("gnatt_packets_sent_total", "MQTT-SN packets sent to clients, by message type.", &m.packetsOut)
+	counters("gnatt_decode_errors_total", "Packets from clients that could not be decoded, by error.", &m.decodeErrors)
+	counters("gnatt_packets_rejected_total", "Packets from clients that were dropped, by reason.", &m.rejected)
+	counters("gnatt_return_codes_total", "Packets sent to clients refusing something, by message type and return code.", &m.returnCodes)
+	counters("gnatt_broker_messages_total", "Messages from the broker for clients, by outcome.", &m.brokerMessages)
+
+	states, queued, inflight := m.clientCounts()
+	fmt.Fprintf(cw, "# HELP gnatt_clients Clients known to the gateway, by state.\n# TYPE gnatt_clients gauge\n")
+	for s := range clientStateNames {
+		fmt.Fprintf(cw, "gnatt_clients{%s} %d\n", label("state", ClientState(s).String()), states[ClientState(s)])
+	}
+	gauge("gnatt_queued_messages", "Publishes to clients waiting on a REGACK.", queued)
+	gauge("gnatt_inflight_registers", "REGISTERs sent to clients waiting on a REGACK.", inflight)
+	hist("gnatt_register_rtt_seconds", "Time from sending a REGISTER to its REGACK.", &m.registerRTT)
+
+	gauge("gnatt_broker_links", "Open broker connections.", m.brokerLinks.Load())
+	counter("gnatt_broker_link_drops_total", "Broker connections that were lost.", m.brokerLinkDrops.Load())
+	gauge("gnatt_broker_inflight_publishes", "Publishes to the broker waiting to complete.", m.brokerInflight.Load())
+	hist("gnatt_broker_publish_seconds", "Time taken to publish to the broker.", &m.publishLatency)
+
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+	return cw.n, cw.err
+}
+
+// clientCounts returns the number of clients in each state, and the
+// publishes and REGISTERs waiting on REGACKs.
+func (m *Metrics) clientCounts() (states map[ClientState]int64, queued, inflight int64) {
+	states = make(map[ClientState]int64)
+	if m.clients == nil {
+		return states, 0, 0
+	}
+	for _, client := range m.clients.All() {
+		c := clientOf(client)
+		if c == nil {
+			continue
+		}
+		states[c.State()]++
+		q, r := c.queueDepth()
+		queued += int64(q)
+		inflight += int64(r)
+	}
+	return states, queued, inflight
+}
+
+// Stats is a summary of the metrics, as published to the broker.
+type Stats struct {
+	Time              time.Time        `json:"time"`
+	Clients           map[string]int64 `json:"clients"`
+	PacketsReceived   uint64           `json:"packetsReceived"`
+	PacketsSent       uint64           `json:"packetsSent"`
+	DecodeErrors      uint64           `json:"decodeErrors"`
+	Rejected          uint64           `json:"rejected"`
+	QueuedMessages    int64            `json:"queuedMessages"`
+	InflightRegisters int64            `json:"inflightRegisters"`
+	BrokerLinks       int64            `json:"brokerLinks"`
+}
+
+func (m *Metrics) stats() Stats {
+	states, queued, inflight := m.clientCounts()
+	s := Stats{
+		Time:              time.Now(),
+		Clients:           make(map[string]int64),
+		PacketsReceived:   m.packetsIn.total(),
+		PacketsSent:       m.packetsOut.total(),
+		DecodeErrors:      m.decodeErrors.total(),
+		Rejected:          m.rejected.total(),
+		QueuedMessages:    queued,
+		InflightRegisters: inflight,
+		BrokerLinks:       m.brokerLinks.Load(),
+	}
+	for state := range clientStateNames {
+		s.Clients[ClientState(state).String()] = states[ClientState(state)]
+	}
+	return s
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+func serveMetrics(addr string, m *Metrics) (*httpServer, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	s, err := serveHTTP(addr, mux)
+	if s != nil {
+		INFO.Printf("serving metrics on %s/metrics\n", s.url())
+	}
+	return s, err
+}
+
+// An httpServer serves the metrics or the admin API.
+type httpServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// serveHTTP serves h on addr, which is "host:port" or "unix:" and the
+// path of a Unix socket. No server is started when addr is "".
+func serveHTTP(addr string, h http.Handler) (*httpServer, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &httpServer{&http.Server{Handler: h}, l}
+	go s.server.Serve(l)
+	return s, nil
+}
+
+func (s *httpServer) addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// url is where the server can be reached, for logging.
+func (s *httpServer) url() string {
+	if s.addr().Network() == "unix" {
+		return "unix:" + s.addr().String()
+	}
+	return "http://" + s.addr().String()
+}
+
+// stop shuts the server down, a nil server is already stopped.
+func (s *httpServer) stop(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// A countingTransport counts the packets the gateway sends, it passes
+// on the identities of an IdentityTransport's peers.
+type countingTransport struct {
+	Transport
+	metrics *Metrics
+}
+
+func (t countingTransport) Send(b []byte, to net.Addr) error {
+	t.metrics.sent(b, ACCEPTED)
+	return t.Transport.Send(b, to)
+}
+
+// sendMessage sends b, the encoding of m, on t. A countingTransport
+// under t counts m's return code, which Send would have to decode b
+// for.
+func sendMessage(t Transport, m Message, b []byte, to net.Addr) error {
+	switch t := t.(type) {
+	case listenerTransport:
+		return sendMessage(t.Transport, m, b, to)
+	case countingTransport:
+		t.metrics.sent(b, returnCode(m))
+		return t.Transport.Send(b, to)
+	}
+	return t.Send(b, to)
+}
+
+func (t countingTransport) PeerIdentity(a net.Addr) (string, bool) {
+	if it, ok := t.Transport.(IdentityTransport); ok {
+		return it.PeerIdentity(a)
+	}
+	return "", false
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// The state a client is in after each type of event, only these events
+// are published.
+var presenceStates = map[string]ClientState{
+	EventConnect:    Active,
+	EventDisconnect: Disconnected,
+	EventSleep:      Asleep,
+	EventWake:       Awake,
+	EventLost:       Lost,
+}
+
+// PresenceState is what is published about a client when its state
+// changes.
+type PresenceState struct {
+	ClientId  string    `json:"clientId"`
+	Address   string    `json:"address"`
+	State     string    `json:"state"`
+	Event     string    `json:"event"`
+	KeepAlive uint16    `json:"keepAlive"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// A presence publishes the events the config asks for, and the stats,
+// to the broker.
+type presence struct {
+	prefix   string
+	events   map[string]bool
+	retain   bool
+	interval time.Duration
+	metrics  *Metrics
+	// publish sends payload to the broker, giving up after a timeout
+	publish func(topic string, qos byte, retain bool, payload []byte)
+	done    chan struct{}
+}
+
+// newPresence returns nil if there is nothing to publish.
+func newPresence(gc *GatewayConfig, metrics *Metrics, publish func(string, byte, bool, []byte)) *presence {
+	pc := gc.Presence
+	if len(pc.Events) == 0 && pc.StatsInterval == 0 {
+		return nil
+	}
+	id := pc.GatewayId
+	if id == "" {
+		id = topicLevel(gc.Broker.ClientId)
+	}
+	if id == "" {
+		host, _ := os.Hostname()
+		id = topicLevel(host)
+	}
+	p := &presence{
+		prefix:   "$SYS/gnatt/" + id,
+		events:   make(map[string]bool),
+		retain:   pc.Retain,
+		interval: pc.StatsInterval,
+		metrics:  metrics,
+		publish:  publish,
+		done:     make(chan struct{}),
+	}
+	for _, e := range pc.Events {
+		p.events[e] = true
+	}
+	return p
+}
+
+// topicLevel makes s usable as a single topic level.
+func topicLevel(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+// start publishing the events from hub until it is closed.
+func (p *presence) start(hub *eventHub) {
+	if p == nil {
+		return
+	}
+	// every client is disconnected at once when the gateway stops
+	events, _ := hub.watch(4096)
+	go p.run(events)
+}
+
+func (p *presence) run(events <-chan Event) {
+	defer close(p.done)
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if p.events[e.Type] {
+				p.state(e)
+			}
+		case <-tick:
+			p.stats()
+		}
+	}
+}
+
+func (p *presence) state(e Event) {
+	payload, err := json.Marshal(PresenceState{
+		ClientId:  e.ClientId,
+		Address:   e.Address,
+		State:     presenceStates[e.Type].String(),
+		Event:     e.Type,
+		KeepAlive: e.KeepAlive,
+		Reason:    e.Detail,
+		Time:      e.Time,
+	})
+	if err != nil {
+		ERROR.Println(err)
+		return
+	}
+	p.publish(p.prefix+"/clients/"+topicLevel(e.ClientId)+"/state", 1, p.retain, payload)
+}
+
+func (p *presence) stats() {
+	payload, err := json.Marshal(p.metrics.stats())
+	if err != nil {
+		ERROR.Println(err)
+		return
+	}
+	p.publish(p.prefix+"/stats", 0, p.retain, payload)
+}
+
+// wait until the events up to the hub being closed are published,
+// or ctx is done.
+func (p *presence) wait(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+	}
+}
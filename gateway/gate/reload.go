@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alsm/gnatt/logging"
+)
+
+// A ReloadResult names the options a reload changed, and the options
+// that changed but only take effect when the gateway is restarted.
+type ReloadResult struct {
+	Applied     []string `json:"applied"`
+	NeedRestart []string `json:"needRestart"`
+}
+
+// The options compared on a reload, those without apply need a
+// restart. Clients stay connected through a reload, and keep their
+// registrations and subscriptions.
+var reloadOptions = []struct {
+	name  string
+	value func(*GatewayConfig) interface{}
+	apply func(to, from *GatewayConfig)
+}{
+	{"predefined-topic", func(gc *GatewayConfig) interface{} { return gc.PredefinedTopics },
+		func(to, from *GatewayConfig) { to.PredefinedTopics = from.PredefinedTopics }},
+	{"qos-1-allow", func(gc *GatewayConfig) interface{} { return gc.QosMinusOneAllow },
+		func(to, from *GatewayConfig) { to.QosMinusOneAllow = from.QosMinusOneAllow }},
+	{"qos-1-mqtt-qos", func(gc *GatewayConfig) interface{} { return gc.QosMinusOneMQTTQos },
+		func(to, from *GatewayConfig) { to.QosMinusOneMQTTQos = from.QosMinusOneMQTTQos }},
+	{"max-clients", func(gc *GatewayConfig) interface{} { return gc.MaxClients },
+		func(to, from *GatewayConfig) { to.MaxClients = from.MaxClients }},
+	{"register-timeout", func(gc *GatewayConfig) interface{} { return gc.RegisterTimeout },
+		func(to, from *GatewayConfig) { to.RegisterTimeout = from.RegisterTimeout }},
+	{"register-retries", func(gc *GatewayConfig) interface{} { return gc.RegisterRetries },
+		func(to, from *GatewayConfig) { to.RegisterRetries = from.RegisterRetries }},
+	{"protocol-versions", func(gc *GatewayConfig) interface{} { return gc.ProtocolVersions },
+		func(to, from *GatewayConfig) { to.ProtocolVersions = from.ProtocolVersions }},
+	{"log-level", func(gc *GatewayConfig) interface{} { return gc.Log.Level },
+		func(to, from *GatewayConfig) { to.Log.Level = from.Log.Level }},
+	{"log-trace", func(gc *GatewayConfig) interface{} { return gc.Log.Trace },
+		func(to, from *GatewayConfig) { to.Log.Trace = from.Log.Trace }},
+	{"listener-mount", func(gc *GatewayConfig) interface{} {
+		return listenerValues(gc, func(lc ListenerConfig) string { return lc.Mount })
+	},
+		func(to, from *GatewayConfig) {
+			reloadListeners(to, from, func(to *ListenerConfig, from ListenerConfig) { to.Mount = from.Mount })
+		}},
+	{"listener-acl", func(gc *GatewayConfig) interface{} {
+		return listenerValues(gc, func(lc ListenerConfig) string { return lc.ACL })
+	},
+		func(to, from *GatewayConfig) {
+			reloadListeners(to, from, func(to *ListenerConfig, from ListenerConfig) { to.ACL = from.ACL })
+		}},
+	// after listener-acl, so that the profiles the listeners name are
+	// known
+	{"acl", func(gc *GatewayConfig) interface{} { return gc.ACLs },
+		func(to, from *GatewayConfig) { to.ACLs = reloadACLs(to, from) }},
+
+	{"mode", func(gc *GatewayConfig) interface{} { return gc.Mode }, nil},
+	{"transport", func(gc *GatewayConfig) interface{} { return gc.Network }, nil},
+	{"listen", func(gc *GatewayConfig) interface{} { return gc.ListenAddress }, nil},
+	{"serial-device", func(gc *GatewayConfig) interface{} { return gc.Serial.Device }, nil},
+	{"serial-baud", func(gc *GatewayConfig) interface{} { return gc.Serial.Baud }, nil},
+	{"dtls-cert", func(gc *GatewayConfig) interface{} { return gc.DTLS.CertFile }, nil},
+	{"dtls-key", func(gc *GatewayConfig) interface{} { return gc.DTLS.KeyFile }, nil},
+	{"dtls-ca", func(gc *GatewayConfig) interface{} { return gc.DTLS.CAFile }, nil},
+	{"dtls-psk", func(gc *GatewayConfig) interface{} { return gc.DTLS.PSK }, nil},
+	{"mqtt-broker", func(gc *GatewayConfig) interface{} { return gc.Broker.URI }, nil},
+	{"mqtt-user", func(gc *GatewayConfig) interface{} { return gc.Broker.Username }, nil},
+	{"mqtt-password", func(gc *GatewayConfig) interface{} { return gc.Broker.Password }, nil},
+	{"mqtt-clientid", func(gc *GatewayConfig) interface{} { return gc.Broker.ClientId }, nil},
+	{"mqtt-timeout", func(gc *GatewayConfig) interface{} { return gc.Broker.KeepAlive }, nil},
+	{"webhook-url", func(gc *GatewayConfig) interface{} { return gc.Webhook.URL }, nil},
+	{"webhook-poll-url", func(gc *GatewayConfig) interface{} { return gc.Webhook.PollURL }, nil},
+	{"webhook-poll-interval", func(gc *GatewayConfig) interface{} { return gc.Webhook.PollInterval }, nil},
+	{"listener", func(gc *GatewayConfig) interface{} { return listenerSetups(gc) }, nil},
+	{"mtu", func(gc *GatewayConfig) interface{} { return gc.MTU }, nil},
+	{"metrics-listen", func(gc *GatewayConfig) interface{} { return gc.MetricsAddress }, nil},
+	{"admin-listen", func(gc *GatewayConfig) interface{} { return gc.AdminAddress }, nil},
+	{"gateway-id", func(gc *GatewayConfig) interface{} { return gc.Presence.GatewayId }, nil},
+	{"presence-events", func(gc *GatewayConfig) interface{} { return gc.Presence.Events }, nil},
+	{"presence-retain", func(gc *GatewayConfig) interface{} { return gc.Presence.Retain }, nil},
+	{"stats-interval", func(gc *GatewayConfig) interface{} { return gc.Presence.StatsInterval }, nil},
+	{"log-format", func(gc *GatewayConfig) interface{} { return gc.Log.Format }, nil},
+}
+
+// listenerValues are the listeners' values of one of their options,
+// by listener name.
+func listenerValues(gc *GatewayConfig, value func(ListenerConfig) string) map[string]string {
+	values := make(map[string]string)
+	for _, lc := range gc.Listeners {
+		values[lc.Name] = value(lc)
+	}
+	return values
+}
+
+// listenerSetups are the listeners without their mounts and ACL
+// profiles, the rest of a listener only changes with a restart.
+func listenerSetups(gc *GatewayConfig) []ListenerConfig {
+	setups := make([]ListenerConfig, len(gc.Listeners))
+	for i, lc := range gc.Listeners {
+		lc.Mount, lc.ACL = "", ""
+		setups[i] = lc
+	}
+	return setups
+}
+
+// reloadListeners sets, with set, the listeners of to from the
+// listeners of the same name in from. Listeners that were added or
+// removed wait for a restart.
+func reloadListeners(to, from *GatewayConfig, set func(to *ListenerConfig, from ListenerConfig)) {
+	listeners := append([]ListenerConfig(nil), to.Listeners...)
+	for i := range listeners {
+		for _, lc := range from.Listeners {
+			if lc.Name == listeners[i].Name {
+				set(&listeners[i], lc)
+			}
+		}
+	}
+	to.Listeners = listeners
+}
+
+// reloadACLs are the ACL profiles of from, and those it dropped that
+// are still named by a listener of to, that is waiting for a restart
+// to go.
+func reloadACLs(to, from *GatewayConfig) map[string]ACLProfile {
+	acls := make(map[string]ACLProfile)
+	for name, acl := range from.ACLs {
+		acls[name] = acl
+	}
+	for _, lc := range to.Listeners {
+		if _, ok := acls[lc.ACL]; lc.ACL != "" && !ok {
+			acls[lc.ACL] = to.ACLs[lc.ACL]
+		}
+	}
+	return acls
+}
+
+// mergeConfig returns old with the reloadable options of gc.
+func mergeConfig(old, gc *GatewayConfig) (*GatewayConfig, ReloadResult) {
+	merged := *old
+	result := ReloadResult{Applied: []string{}, NeedRestart: []string{}}
+	for _, o := range reloadOptions {
+		if reflect.DeepEqual(o.value(old), o.value(gc)) {
+			continue
+		}
+		if o.apply == nil {
+			result.NeedRestart = append(result.NeedRestart, o.name)
+			continue
+		}
+		o.apply(&merged, gc)
+		result.Applied = append(result.Applied, o.name)
+	}
+	return &merged, result
+}
+
+// Reloads are one at a time, so that none is lost.
+var reloading sync.Mutex
+
+// reload checks gc and applies what can be reloaded of it to the
+// config of a running gateway, and to the endpoints of its listeners.
+func reload(config *atomic.Pointer[GatewayConfig], listeners []*listener, predefined *predefinedTopics, qosMinusOne *addrList, gc *GatewayConfig) (ReloadResult, error) {
+	if err := gc.Check(); err != nil {
+		return ReloadResult{}, err
+	}
+	reloading.Lock()
+	defer reloading.Unlock()
+	old := config.Load()
+	merged, result := mergeConfig(old, gc)
+	predefined.replace(merged.PredefinedTopics)
+	qosMinusOne.replace(merged.QosMinusOneAllow)
+	// the listeners were started in the order of the config's, which
+	// only a restart changes
+	for i, lc := range merged.listeners() {
+		if i < len(listeners) {
+			endpointOf(listeners[i].transport).replace(lc, merged.ACLs)
+		}
+	}
+	reloadLogging(old.Log, merged.Log)
+	config.Store(merged)
+	INFO.Printf("reloaded the config, changed %v, needing a restart %v\n", result.Applied, result.NeedRestart)
+	return result, nil
+}
+
+// loadConfig reads the config of a running gateway again, with its
+// Load function or from the file it was read from.
+func loadConfig(gc *GatewayConfig) (*GatewayConfig, error) {
+	if gc.Load != nil {
+		return gc.Load()
+	}
+	if gc.file == "" {
+		return nil, ErrNoConfigFile
+	}
+	return ParseConfigFile(gc.file)
+}
+
+// The level of loggers made by NewLogger, which a reload changes.
+var logLevel slog.LevelVar
+
+// reloadLogging changes the level, and the clients traced from the
+// config. Clients traced through the admin API stay traced.
+func reloadLogging(old, lc LogConfig) {
+	logLevel.Set(lc.Level)
+	still := make(map[string]bool)
+	for _, id := range lc.Trace {
+		still[id] = true
+	}
+	for _, id := range old.Trace {
+		if !still[id] {
+			logging.Trace(id, false)
+		}
+	}
+	for _, id := range lc.Trace {
+		logging.Trace(id, true)
+	}
+}
@@ -1,5 +1,18 @@
 package gateway
 
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
 func validateClientId(clientid []byte) (string, error) {
 	if len(clientid) == 0 {
 		ERROR.Println("zero length client id not allowed")
@@ -11,3 +24,260 @@ func validateClientId(clientid []byte) (string, error) {
 	}
 	return string(clientid), nil
 }
+
+// Packets are decoded by the goroutine handling them, each with a
+// Decoder of its own until the packet is handled.
+var decoders = sync.Pool{
+	New: func() interface{} {
+		return new(Decoder)
+	},
+}
+
+// decodeFrom decodes and validates a packet from a with d, counting it
+// in metrics. Packets that are malformed or invalid are dropped. The
+// message is d's, and only good until d decodes the next packet.
+func decodeFrom(d *Decoder, metrics *Metrics, packet []byte, a net.Addr) (Message, bool) {
+	metrics.received(packet)
+	m, err := d.Decode(packet)
+	if err != nil {
+		ERROR.Printf("dropping packet from %v: %v\n", a, err)
+		metrics.decodeError(err)
+		return nil, false
+	}
+	if err = m.Validate(); err != nil {
+		ERROR.Printf("dropping %v from %v: %v\n", m, a, err)
+		metrics.reject("invalid")
+		return nil, false
+	}
+	return m, true
+}
+
+// connackFor answers m in the layout of m's protocol version. v1.2
+// has no reason codes, so any failure beyond its own return codes is
+// sent to a v1.2 client as REJ_NOT_SUPORTED.
+func connackFor(m *ConnectMessage, rc byte, expiry uint32) *ConnackMessage {
+	ca := NewMessage(CONNACK).(*ConnackMessage)
+	ca.ReturnCode = rc
+	if m.ProtocolId >= VERSION_2_0 {
+		ca.Version = VERSION_2_0
+		if rc == ACCEPTED {
+			ca.SessionExpiry = expiry
+		}
+		return ca
+	}
+	if rc > REJ_NOT_SUPORTED {
+		ca.ReturnCode = REJ_NOT_SUPORTED
+	}
+	return ca
+}
+
+var assignedClientIds atomic.Uint64
+
+// assignClientId makes up a ClientId for a v2.0 client that connected
+// without one.
+func assignClientId() string {
+	return fmt.Sprintf("gnatt-%d", assignedClientIds.Add(1))
+}
+
+// Check that the gateway speaks the protocol version a client
+// connects with.
+func supportsVersion(versions []byte, version byte) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// The SASL PLAIN exchange is "authzid NUL authcid NUL passwd", the
+// authorization identity is ignored.
+func parsePlainAuth(data []byte) (string, string, bool) {
+	parts := bytes.SplitN(data, []byte{0x00}, 3)
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return string(parts[1]), string(parts[2]), true
+}
+
+// Check that a client that authenticated to the transport is using
+// its own identity as ClientId. A client that sent no ClientId is
+// given its identity.
+func checkIdentity(c Transport, a net.Addr, clientid []byte) ([]byte, bool) {
+	it, ok := c.(IdentityTransport)
+	if !ok {
+		return clientid, true
+	}
+	identity, ok := it.PeerIdentity(a)
+	if !ok {
+		return clientid, true
+	}
+	if len(clientid) == 0 {
+		return []byte(identity), true
+	}
+	if string(clientid) != identity {
+		ERROR.Printf("client %v authenticated as \"%s\" but connected as \"%s\"\n", a, identity, clientid)
+		return clientid, false
+	}
+	return clientid, true
+}
+
+// An addrList matches client addresses against IPs, CIDR blocks and,
+// for transports without IP addresses, addresses as the transport
+// names them.
+type addrList struct {
+	sync.RWMutex
+	nets  []*net.IPNet
+	names map[string]bool
+}
+
+func newAddrList(entries []string) *addrList {
+	l := &addrList{}
+	l.replace(entries)
+	return l
+}
+
+// replace the entries, when the config is reloaded.
+func (l *addrList) replace(entries []string) {
+	var nets []*net.IPNet
+	names := make(map[string]bool)
+	for _, e := range entries {
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			nets = append(nets, n)
+		} else if ip := net.ParseIP(e); ip != nil {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			names[e] = true
+		}
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.nets, l.names = nets, names
+}
+
+// An empty list matches every address. A node behind a forwarder
+// matches if the forwarder does.
+func (l *addrList) contains(a net.Addr) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.matches(a)
+}
+
+func (l *addrList) matches(a net.Addr) bool {
+	if len(l.nets) == 0 && len(l.names) == 0 {
+		return true
+	}
+	if l.names[a.String()] {
+		return true
+	}
+	if fa, ok := a.(*ForwardedAddr); ok {
+		return l.matches(fa.Forwarder)
+	}
+	host := a.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if l.names[host] {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// qosMinusOneTopic returns the broker topic of a QoS -1 PUBLISH from
+// a, which arrived on c, or "" if a isn't allowed to send it or the
+// topic isn't known. There is no session to have registered a topic
+// in, so only predefined ids, short names and v2.0 full names are used.
+func qosMinusOneTopic(m *PublishMessage, c Transport, a net.Addr, allow *addrList, predefined *predefinedTopics) string {
+	e := endpointOf(c)
+	if !allow.contains(a) || !e.allow.contains(a) {
+		ERROR.Printf("dropping %v from %v: not allowed to publish at QoS -1\n", m, a)
+		return ""
+	}
+	var topic string
+	switch m.TopicIdType {
+	case 0x01:
+		topic = predefined.getTopic(m.TopicId)
+	case 0x02:
+		topic = string([]byte{byte(m.TopicId >> 8), byte(m.TopicId)})
+	case 0x03:
+		topic = string(m.TopicName)
+	}
+	if topic == "" {
+		ERROR.Printf("dropping %v from %v: unknown topic\n", m, a)
+		return ""
+	}
+	if topic = e.brokerTopic(topic); !e.mayPublish(topic) {
+		ERROR.Printf("dropping %v from %v: not allowed to publish to \"%s\"\n", m, a, topic)
+		return ""
+	}
+	return topic
+}
+
+// rejectPublish answers a PUBLISH that won't be published with a
+// PUBACK of rc.
+func rejectPublish(client SNClient, m *PublishMessage, rc byte) {
+	pa := NewMessage(PUBACK).(*PubackMessage)
+	pa.TopicId = m.TopicId
+	pa.MessageId = m.MessageId
+	pa.ReturnCode = rc
+	if err := client.Write(pa); err != nil {
+		ERROR.Println(err)
+	}
+}
+
+// Wait for an MQTT token to complete, giving up when ctx is done.
+func waitToken(ctx context.Context, token MQTT.Token) error {
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// disconnectFor is a DISCONNECT in the layout of the client's protocol
+// version, rc is only sent to v2.0 clients.
+func disconnectFor(client SNClient, rc byte) *DisconnectMessage {
+	dm := NewMessage(DISCONNECT).(*DisconnectMessage)
+	if c := clientOf(client); c != nil && c.version() >= VERSION_2_0 {
+		dm.Version = VERSION_2_0
+		dm.ReasonCode = rc
+	}
+	return dm
+}
+
+// emitShutdown emits an EventDisconnect for each of clients that was
+// connected when the gateway shut down.
+func emitShutdown(clients []SNClient, events *eventHub) {
+	for _, client := range clients {
+		if c := clientOf(client); c != nil && c.State() != Disconnected {
+			events.emit(newEvent(EventDisconnect, c, "", "shutdown"))
+		}
+	}
+}
+
+// Tell every client that is still connected that the gateway is going
+// away.
+func disconnectClients(clients []SNClient) {
+	for _, client := range clients {
+		if s := clientOf(client).State(); s == Disconnected || s == Lost {
+			continue
+		}
+		dm := disconnectFor(client, RC_SERVER_UNAVAILABLE)
+		if err := client.Write(dm); err != nil {
+			ERROR.Printf("error writing DISCONNECT to %s: %v\n", client.AddrString(), err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package gateway
+
+import (
+	"net"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// ClientState is where a client is in the life cycle the MQTT-SN spec
+// gives clients: a CONNECT makes it active, a DISCONNECT with a
+// duration puts it to sleep, a PINGREQ wakes it to collect its
+// messages, and a client that goes quiet for longer than it said it
+// would is lost.
+type ClientState int
+
+const (
+	Disconnected ClientState = iota
+	Active
+	Asleep
+	Awake
+	Lost
+)
+
+var clientStateNames = [...]string{
+	Disconnected: "disconnected",
+	Active:       "active",
+	Asleep:       "asleep",
+	Awake:        "awake",
+	Lost:         "lost",
+}
+
+func (s ClientState) String() string {
+	if s < 0 || int(s) >= len(clientStateNames) {
+		return "unknown"
+	}
+	return clientStateNames[s]
+}
+
+// listening reports whether a client in state s is sent messages from
+// the broker. Those for a client that is asleep are kept until it
+// wakes, see keepAsleep.
+func (s ClientState) listening() bool {
+	return s == Active || s == Awake
+}
+
+// The most broker messages kept for a client while it is asleep, the
+// ones after are dropped.
+const maxAsleepMessages = 100
+
+// A client is taken to be lost once it has been quiet for this many
+// times its keep alive, or its sleep duration.
+const lostFactor = 1.5
+
+// accepts reports whether a client in state s may send m. A client the
+// gateway doesn't know is Disconnected.
+func (s ClientState) accepts(m Message) bool {
+	switch m := m.(type) {
+	case *ConnectMessage, *AuthMessage, *SearchGwMessage, *AdvertiseMessage, *GwInfoMessage, *EncapsulatedMessage:
+		return true
+	case *PublishMessage:
+		if m.Qos == QOS_MINUS_ONE {
+			return true
+		}
+		return s == Active
+	case *PingreqMessage, *DisconnectMessage:
+		return s != Disconnected && s != Lost
+	case *PubackMessage, *PubrecMessage, *PubrelMessage, *PubcompMessage, *RegackMessage:
+		// the replies to what the gateway sends a client while it is
+		// awake
+		return s == Active || s == Awake
+	}
+	return s == Active
+}
+
+// clientOf returns the Client underneath the clients a gateway keeps.
+func clientOf(c SNClient) *Client {
+	switch c := c.(type) {
+	case *Client:
+		return c
+	case *TClient:
+		return &c.Client
+	}
+	return nil
+}
+
+// checkState looks up the client m came from and checks that m is
+// allowed in the state it is in, which is Disconnected for a client
+// that isn't known. A client sending a message it may not is sent a
+// DISCONNECT, unless the message is itself a reply.
+func checkState(clients *Clients, m Message, c Transport, a net.Addr) bool {
+	client := clientOf(clients.GetClient(a))
+	state := Disconnected
+	if client != nil {
+		state = client.State()
+	}
+	if state.accepts(m) {
+		if client != nil {
+			client.seen()
+		}
+		return true
+	}
+	ERROR.Printf("dropping %v from %v: client is %v\n", m, a, state)
+	switch m.(type) {
+	case *ConnackMessage, *PubackMessage, *PubrecMessage, *PubrelMessage, *PubcompMessage,
+		*RegackMessage, *SubackMessage, *UnsubackMessage, *PingrespMessage,
+		*WillTopicReqMessage, *WillMsgReqMessage, *WillTopicRespMessage, *WillMsgRespMessage:
+		return false
+	}
+	if client == nil {
+		client = NewClient("", c, a)
+	}
+	if err := client.Write(disconnectFor(client, RC_PROTOCOL_ERROR)); err != nil {
+		ERROR.Println(err)
+	}
+	return false
+}
+
+// State returns the client's state, which becomes Lost once the client
+// has been quiet for too long.
+func (c *Client) State() ClientState {
+	c.Lock()
+	defer c.Unlock()
+	c.checkLost()
+	return c.state
+}
+
+// reportLost reports whether the client is lost and that hasn't been
+// reported before.
+func (c *Client) reportLost() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.checkLost() != Lost || c.lostReported {
+		return false
+	}
+	c.lostReported = true
+	return true
+}
+
+// checkLost moves the client to Lost if it has been quiet for too long,
+// c must be locked.
+func (c *Client) checkLost() ClientState {
+	var limit time.Duration
+	switch c.state {
+	case Active:
+		limit = c.keepAlive
+	case Asleep:
+		limit = c.sleep
+	}
+	if limit > 0 && time.Since(c.lastSeen) > time.Duration(float64(limit)*lostFactor) {
+		c.state = Lost
+	}
+	return c.state
+}
+
+// The client sent something the gateway accepted.
+func (c *Client) seen() {
+	c.Lock()
+	c.lastSeen = time.Now()
+	c.Unlock()
+}
+
+// connected makes the client active, keepAlive is the duration from
+// its CONNECT.
+func (c *Client) connected(keepAlive time.Duration) {
+	c.Lock()
+	c.state, c.keepAlive, c.lastSeen = Active, keepAlive, time.Now()
+	c.lostReported = false
+	c.asleepMessages = nil
+	c.Unlock()
+}
+
+// disconnected puts the client to sleep for duration, or disconnects
+// it when duration is 0. Either way the REGISTERs it has not answered
+// are abandoned, and the publishes queued behind them dropped, as are
+// the messages kept while it slept when it disconnects.
+func (c *Client) disconnected(duration time.Duration) {
+	c.Lock()
+	c.state, c.sleep, c.lastSeen = Disconnected, duration, time.Now()
+	if duration > 0 {
+		c.state = Asleep
+	}
+	n := c.discardPending()
+	if duration == 0 {
+		n += len(c.asleepMessages)
+		c.asleepMessages = nil
+	}
+	c.Unlock()
+	if n > 0 {
+		DEBUG.Printf("dropped %d pending messages for \"%s\"\n", n, c)
+	}
+}
+
+// awake moves an asleep client to Awake while it is answered, and back
+// to sleep again. It reports whether the client was asleep.
+func (c *Client) awake(awake bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	switch {
+	case awake && c.state == Asleep:
+		c.state = Awake
+		return true
+	case !awake && c.state == Awake:
+		c.state = Asleep
+		c.lastSeen = time.Now()
+		return true
+	}
+	return false
+}
+
+// keepAsleep keeps msg for the client to be sent when it next wakes,
+// if it is asleep. It reports whether the client is asleep, and whether
+// msg was kept.
+func (c *Client) keepAsleep(msg MQTT.Message) (asleep, kept bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.state != Asleep {
+		return false, false
+	}
+	if len(c.asleepMessages) >= maxAsleepMessages {
+		return true, false
+	}
+	c.asleepMessages = append(c.asleepMessages, msg)
+	return true, true
+}
+
+// takeAsleep returns the messages kept while the client was asleep,
+// which are no longer kept.
+func (c *Client) takeAsleep() []MQTT.Message {
+	c.Lock()
+	defer c.Unlock()
+	msgs := c.asleepMessages
+	c.asleepMessages = nil
+	return msgs
+}
+
+// keepForSleeper keeps msg for client if it is asleep, counting what
+// became of it, and reports whether the client was asleep.
+func keepForSleeper(client *Client, msg MQTT.Message, metrics *Metrics) bool {
+	asleep, kept := client.keepAsleep(msg)
+	switch {
+	case kept:
+		DEBUG.Printf("keeping a message for \"%s\" until it wakes\n", client)
+		metrics.brokerMessage("kept")
+	case asleep:
+		ERROR.Printf("dropping a message for \"%s\", %d are already kept while it sleeps\n", client, maxAsleepMessages)
+		metrics.brokerMessage("dropped")
+	}
+	return asleep
+}
+
+// How often watchLost looks for lost clients.
+const lostCheckInterval = time.Second
+
+// watchLost emits an EventLost for each client once it is found to be
+// lost, until stop is closed.
+func watchLost(clients *Clients, events *eventHub, stop <-chan struct{}) {
+	ticker := time.NewTicker(lostCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, client := range clients.All() {
+			if c := clientOf(client); c != nil && c.reportLost() {
+				ERROR.Printf("client \"%s\" is lost\n", c)
+				events.emit(newEvent(EventLost, c, "", ""))
+			}
+		}
+	}
+}
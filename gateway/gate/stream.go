@@ -0,0 +1,248 @@
+package gateway
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/tarm/serial"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// StreamAddr identifies one stream of a StreamTransport.
+type StreamAddr string
+
+func (a StreamAddr) Network() string {
+	return "stream"
+}
+
+func (a StreamAddr) String() string {
+	return string(a)
+}
+
+type streamPacket struct {
+	data []byte
+	from net.Addr
+}
+
+type stream struct {
+	sync.Mutex
+	rw io.ReadWriteCloser
+}
+
+// StreamTransport carries MQTT-SN over byte streams, such as serial
+// lines or TCP connections, using the packets' length headers to tell
+// where one packet ends and the next begins. Every stream is a single
+// peer. A TCP transport accepts a new stream for each connection, and
+// closes it on a bad frame. The other kinds are made of one stream
+// that is opened by Listen and skips past bad frames.
+type StreamTransport struct {
+	sync.Mutex
+	name       string
+	open       func() (io.ReadWriteCloser, error)
+	listen     func() (net.Listener, error)
+	readPacket func(io.Reader) ([]byte, error)
+	// if set, is given each packet from readPacket once it is received
+	releasePacket func([]byte)
+	ln            net.Listener
+	streams       map[string]*stream
+	incoming      chan streamPacket
+	stop          chan struct{}
+	stopOnce      sync.Once
+	closed        chan struct{}
+	closer        sync.Once
+}
+
+func newStreamTransport(name string) *StreamTransport {
+	return &StreamTransport{
+		name:       name,
+		readPacket: ReadFrame,
+		streams:    make(map[string]*stream),
+		incoming:   make(chan streamPacket, 64),
+		stop:       make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// NewStreamTransport returns a transport for a stream that is already
+// open, such as a pseudo-terminal or one end of a net.Pipe. name is
+// the address the peer at the other end is known by.
+func NewStreamTransport(name string, rw io.ReadWriteCloser) *StreamTransport {
+	s := newStreamTransport(name)
+	s.open = func() (io.ReadWriteCloser, error) {
+		return rw, nil
+	}
+	return s
+}
+
+// NewSerialTransport returns a transport for the serial device,
+// eg "/dev/ttyUSB0", running at baud.
+func NewSerialTransport(device string, baud int) *StreamTransport {
+	s := newStreamTransport(device)
+	s.open = func() (io.ReadWriteCloser, error) {
+		return serial.OpenPort(&serial.Config{Name: device, Baud: baud})
+	}
+	return s
+}
+
+// NewTCPTransport returns a transport that accepts TCP connections
+// on the "host:port" address, each connection being one peer.
+func NewTCPTransport(address string) *StreamTransport {
+	s := newStreamTransport(address)
+	s.listen = func() (net.Listener, error) {
+		return net.Listen("tcp", address)
+	}
+	return s
+}
+
+func (s *StreamTransport) Listen() error {
+	if s.open != nil {
+		rw, err := s.open()
+		if err != nil {
+			return err
+		}
+		s.add(s.name, rw)
+		return nil
+	}
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	go s.accept()
+	return nil
+}
+
+func (s *StreamTransport) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				// one peer failing, eg a DTLS handshake, should not
+				// stop the others from connecting
+				ERROR.Println(err)
+				continue
+			}
+		}
+		s.add(conn.RemoteAddr().String(), conn)
+	}
+}
+
+func (s *StreamTransport) add(name string, rw io.ReadWriteCloser) {
+	s.Lock()
+	s.streams[name] = &stream{rw: rw}
+	s.Unlock()
+	go s.read(name, rw)
+}
+
+func (s *StreamTransport) read(name string, rw io.ReadWriteCloser) {
+	from := StreamAddr(name)
+	for {
+		frame, err := s.readPacket(rw)
+		if errors.Is(err, ErrBadFrameLength) && s.open != nil {
+			// a stream that was opened, rather than accepted, is
+			// the only one there is, so skip the bad length and
+			// look for the next frame after it
+			ERROR.Printf("stream %s: %v, resynchronising\n", name, err)
+			continue
+		}
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				if err != io.EOF {
+					ERROR.Printf("stream %s: %v\n", name, err)
+				}
+			}
+			s.remove(name)
+			return
+		}
+		select {
+		case s.incoming <- streamPacket{frame, from}:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *StreamTransport) conn(a net.Addr) (io.ReadWriteCloser, bool) {
+	s.Lock()
+	defer s.Unlock()
+	st, ok := s.streams[a.String()]
+	if !ok {
+		return nil, false
+	}
+	return st.rw, true
+}
+
+func (s *StreamTransport) remove(name string) {
+	s.Lock()
+	if st, ok := s.streams[name]; ok {
+		st.rw.Close()
+		delete(s.streams, name)
+	}
+	s.Unlock()
+}
+
+func (s *StreamTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-s.incoming:
+		if s.releasePacket != nil {
+			defer s.releasePacket(p.data)
+		}
+		if len(p.data) > len(b) {
+			return 0, p.from, ErrPacketTooLarge
+		}
+		return copy(b, p.data), p.from, nil
+	case <-s.stop:
+		return 0, nil, ErrTransportStopped
+	case <-s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (s *StreamTransport) Send(b []byte, to net.Addr) error {
+	s.Lock()
+	st, ok := s.streams[to.String()]
+	s.Unlock()
+	if !ok {
+		return errors.New("no such stream: " + to.String())
+	}
+	st.Lock()
+	defer st.Unlock()
+	_, err := st.rw.Write(b)
+	return err
+}
+
+func (s *StreamTransport) StopReceiving() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+func (s *StreamTransport) Close() error {
+	s.closer.Do(func() {
+		close(s.closed)
+		if s.ln != nil {
+			s.ln.Close()
+		}
+		s.Lock()
+		for name, st := range s.streams {
+			st.rw.Close()
+			delete(s.streams, name)
+		}
+		s.Unlock()
+	})
+	return nil
+}
+
+func (s *StreamTransport) LocalAddr() net.Addr {
+	if s.ln != nil {
+		return s.ln.Addr()
+	}
+	return StreamAddr(s.name)
+}
@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A MultiGateway runs a gateway for each tenant of its config. The
+// tenants share nothing but the process, each has its own listeners,
+// broker connections, topic registry, subscriptions, ACLs and limits.
+type MultiGateway struct {
+	config  atomic.Pointer[GatewayConfig]
+	tenants []tenant
+	// reloads are one at a time, each tenant's gateway has its own
+	// reloads serialized by the package
+	reloading sync.Mutex
+}
+
+type tenant struct {
+	name    string
+	gateway Gateway
+}
+
+// A tenantReload is a tenant and the checked config it reloads with.
+type tenantReload struct {
+	tenant
+	config *GatewayConfig
+}
+
+func NewMultiGateway(gc *GatewayConfig) (*MultiGateway, error) {
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
+	m := &MultiGateway{}
+	config := *gc
+	m.config.Store(&config)
+	for _, t := range gc.Tenants {
+		g, err := New(m.tenantConfig(t))
+		if err != nil {
+			return nil, err
+		}
+		m.tenants = append(m.tenants, tenant{t.Name, g})
+	}
+	return m, nil
+}
+
+func (m *MultiGateway) conf() *GatewayConfig {
+	return m.config.Load()
+}
+
+// tenantConfig is the config t's gateway runs with, which logs as the
+// root config says, also when it is reloaded on its own.
+func (m *MultiGateway) tenantConfig(t TenantConfig) *GatewayConfig {
+	tc := *t.Config
+	tc.Log = m.conf().Log
+	tc.Load = func() (*GatewayConfig, error) {
+		gc, err := loadConfig(t.Config)
+		if err != nil {
+			return nil, err
+		}
+		gc.Log = m.conf().Log
+		return gc, nil
+	}
+	return &tc
+}
+
+// Tenant returns the gateway of the tenant called name, or nil.
+func (m *MultiGateway) Tenant(name string) Gateway {
+	for _, t := range m.tenants {
+		if t.name == name {
+			return t.gateway
+		}
+	}
+	return nil
+}
+
+// Start every tenant's gateway. If one of them fails the ones already
+// started are shut down.
+func (m *MultiGateway) Start(ctx context.Context) error {
+	for i, t := range m.tenants {
+		if err := t.gateway.Start(ctx); err != nil {
+			ERROR.Printf("tenant \"%s\": %v\n", t.name, err)
+			for _, started := range m.tenants[:i] {
+				started.gateway.Shutdown(ctx)
+			}
+			return err
+		}
+		INFO.Printf("tenant \"%s\" is started\n", t.name)
+	}
+	return nil
+}
+
+// Shutdown every tenant's gateway, returning the first error.
+func (m *MultiGateway) Shutdown(ctx context.Context) error {
+	var err error
+	for _, t := range m.tenants {
+		if terr := t.gateway.Shutdown(ctx); err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+// Addr is the address of the first tenant's first listener.
+func (m *MultiGateway) Addr() net.Addr {
+	if len(m.tenants) == 0 {
+		return nil
+	}
+	return m.tenants[0].gateway.Addr()
+}
+
+// The tenants listen for themselves, a MultiGateway receives nothing.
+func (m *MultiGateway) OnPacket(nbytes int, buffer []byte, c Transport, a net.Addr) {
+	ERROR.Printf("dropping a packet from %v, sent to no tenant\n", a)
+}
+
+// Clients returns every tenant's clients, sorted by tenant and then
+// by address.
+func (m *MultiGateway) Clients() []ClientStatus {
+	var status []ClientStatus
+	for _, t := range m.tenants {
+		for _, s := range t.gateway.Clients() {
+			s.Tenant = t.name
+			status = append(status, s)
+		}
+	}
+	sort.SliceStable(status, func(i, j int) bool {
+		return status[i].Tenant < status[j].Tenant
+	})
+	return status
+}
+
+// Reload reloads each tenant from its config in gc, the options of a
+// tenant are named "<tenant>:<option>". Tenants added or removed need
+// a restart. Every tenant's config is checked before any is applied.
+func (m *MultiGateway) Reload(gc *GatewayConfig) (ReloadResult, error) {
+	if err := gc.Check(); err != nil {
+		return ReloadResult{}, err
+	}
+	m.reloading.Lock()
+	defer m.reloading.Unlock()
+	var reloads []tenantReload
+	for _, tc := range gc.Tenants {
+		g := m.Tenant(tc.Name)
+		if g == nil {
+			continue
+		}
+		tgc := m.tenantConfig(tc)
+		tgc.Log = gc.Log
+		if err := tgc.Check(); err != nil {
+			return ReloadResult{}, err
+		}
+		reloads = append(reloads, tenantReload{tenant{tc.Name, g}, tgc})
+	}
+
+	old := m.conf()
+	merged, all := mergeConfig(old, gc)
+	merged.Log = gc.Log
+	m.config.Store(merged)
+	// of the root's own options only the logging counts
+	result := ReloadResult{}
+	result.Applied, _ = splitLogOptions(all.Applied)
+	result.NeedRestart, _ = splitLogOptions(all.NeedRestart)
+	for _, r := range reloads {
+		tr, err := r.gateway.Reload(r.config)
+		if err != nil {
+			return result, err
+		}
+		_, applied := splitLogOptions(tr.Applied)
+		_, needRestart := splitLogOptions(tr.NeedRestart)
+		for _, o := range applied {
+			result.Applied = append(result.Applied, r.name+":"+o)
+		}
+		for _, o := range needRestart {
+			result.NeedRestart = append(result.NeedRestart, r.name+":"+o)
+		}
+	}
+	if found := len(reloads); found != len(gc.Tenants) || found != len(m.tenants) {
+		result.NeedRestart = append(result.NeedRestart, "tenant")
+	}
+	reloadLogging(old.Log, gc.Log)
+	return result, nil
+}
+
+// splitLogOptions splits the logging options of names, which every
+// tenant shares, from the rest.
+func splitLogOptions(names []string) (logging, other []string) {
+	logging, other = []string{}, []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "log-") {
+			logging = append(logging, name)
+		} else {
+			other = append(other, name)
+		}
+	}
+	return logging, other
+}
+
+func (m *MultiGateway) ReloadConfig() (ReloadResult, error) {
+	gc, err := loadConfig(m.conf())
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	return m.Reload(gc)
+}
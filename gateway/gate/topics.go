@@ -3,6 +3,8 @@ package gateway
 import (
 	"strings"
 	"sync"
+
+	. "github.com/alsm/gnatt/packets"
 )
 
 // Topic Names and Topic Filters
@@ -23,13 +25,12 @@ import (
 //     Example:  a subscription to "foo/#" will match messages published to "foo".
 
 func ContainsWildcard(topic string) bool {
-	if len(topic) == 1 && (topic == "+" || topic == "#") {
-		return true
-	}
-	if len(topic) > 1 && (topic[len(topic)-2:] == "/#" || topic[len(topic)-2:] == "/+") {
-		return true
+	for _, level := range strings.Split(topic, "/") {
+		if level == "+" || level == "#" {
+			return true
+		}
 	}
-	return strings.Contains(topic, "/+/")
+	return false
 }
 
 func ValidateTopicFilter(topic string) ([]string, error) {
@@ -60,6 +61,27 @@ func ValidateTopicName(topic string) ([]string, error) {
 	return levels, nil
 }
 
+// covers reports whether every topic matched by topic, a name or a
+// filter, is matched by filter.
+func covers(filter, topic string) bool {
+	fl, tl := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fl {
+		switch {
+		case f == "#":
+			return true
+		case i == len(tl):
+			return false
+		case f == "+":
+			if tl[i] == "#" {
+				return false
+			}
+		case f != tl[i]:
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
 // This needs to be efficient for indexing by topicId.
 // However, it is necessary when adding a new topic to index
 // by topic name (to check if it already exists). We optimze
@@ -91,7 +113,7 @@ func (repo *topicNames) getId(topic string) uint16 {
 			break
 		}
 	}
-	INFO.Printf("get[%s] -> %d\n", topic, topicid)
+	DEBUG.Printf("get[%s] -> %d\n", topic, topicid)
 	return topicid
 }
 
@@ -100,7 +122,7 @@ func (repo *topicNames) getTopic(id uint16) string {
 	defer repo.RUnlock()
 	repo.RLock()
 	topic := repo.contents[id]
-	INFO.Printf("getTopic[%d] -> %s\n", id, topic)
+	DEBUG.Printf("getTopic[%d] -> %s\n", id, topic)
 	return topic
 }
 
@@ -110,6 +132,122 @@ func (repo *topicNames) putTopic(topic string) uint16 {
 	repo.Lock()
 	repo.next++
 	repo.contents[repo.next] = topic
-	INFO.Printf("put[%d] -> %s\n", repo.next, topic)
+	DEBUG.Printf("put[%d] -> %s\n", repo.next, topic)
 	return repo.next
 }
+
+// The id of topic, which is given the next id if it has none. O(n)
+func (repo *topicNames) assignId(topic string) uint16 {
+	defer repo.Unlock()
+	repo.Lock()
+	for id, topicVal := range repo.contents {
+		if topicVal == topic {
+			return id
+		}
+	}
+	repo.next++
+	repo.contents[repo.next] = topic
+	DEBUG.Printf("put[%d] -> %s\n", repo.next, topic)
+	return repo.next
+}
+
+// O(n)
+func (repo *topicNames) snapshot() map[uint16]string {
+	defer repo.RUnlock()
+	repo.RLock()
+	contents := make(map[uint16]string, len(repo.contents))
+	for id, topic := range repo.contents {
+		contents[id] = topic
+	}
+	return contents
+}
+
+// Topic ids that the clients and the gateway agree on ahead of time,
+// they are never REGISTERed.
+type predefinedTopics struct {
+	sync.RWMutex
+	byId   map[uint16]string
+	byName map[string]uint16
+}
+
+func newPredefinedTopics(topics map[uint16]string) *predefinedTopics {
+	p := &predefinedTopics{}
+	p.replace(topics)
+	return p
+}
+
+// replace the topics, when the config is reloaded.
+func (p *predefinedTopics) replace(topics map[uint16]string) {
+	byId := make(map[uint16]string)
+	byName := make(map[string]uint16)
+	for id, topic := range topics {
+		byId[id] = topic
+		byName[topic] = id
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.byId, p.byName = byId, byName
+}
+
+func (p *predefinedTopics) getTopic(id uint16) string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.byId[id]
+}
+
+func (p *predefinedTopics) getId(topic string) (uint16, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	id, ok := p.byName[topic]
+	return id, ok
+}
+
+// snapshot returns the topics by id, replace doesn't change the map.
+func (p *predefinedTopics) snapshot() map[uint16]string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.byId
+}
+
+// publishTopic is the broker topic a client's PUBLISH is for. MQTT-SN
+// v2.0 clients may name the topic in full, a topic id type that v1.2
+// reserves, and a topic alias is only good for the session of the
+// client that registered it. Topics are registered under the mount of
+// the client's listener, other topics are mounted here.
+func publishTopic(m *PublishMessage, client *Client, tIndex *topicNames, predefined *predefinedTopics) string {
+	e := client.endpoint()
+	switch {
+	case m.TopicIdType == 0x03 && client.version() < VERSION_2_0:
+		return ""
+	case m.TopicIdType == 0x03:
+		return e.brokerTopic(string(m.TopicName))
+	case m.TopicIdType == 0x00 && client.version() >= VERSION_2_0 && !client.Registered(m.TopicId):
+		return ""
+	case m.TopicIdType == 0x00:
+		// not a topic of another listener's clients
+		topic := tIndex.getTopic(m.TopicId)
+		if _, ok := e.clientTopic(topic); !ok {
+			return ""
+		}
+		return topic
+	}
+	if topic := resolveTopicId(m.TopicIdType, m.TopicId, tIndex, predefined); topic != "" {
+		return e.brokerTopic(topic)
+	}
+	return ""
+}
+
+// Return the topic name that a topic id of the given type refers
+// to, or "" if the topic id is not known.
+func resolveTopicId(idType byte, id uint16, tIndex *topicNames, predefined *predefinedTopics) string {
+	switch idType {
+	case 0x00:
+		return tIndex.getTopic(id)
+	case 0x01:
+		return predefined.getTopic(id)
+	case 0x02:
+		// short topic names are carried in the topic id field
+		return string([]byte{byte(id >> 8), byte(id)})
+	}
+	return ""
+}
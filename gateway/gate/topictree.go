@@ -1,6 +1,8 @@
 package gateway
 
 import (
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -50,7 +52,7 @@ func NewTopicTree() *TopicTree {
 func (tt *TopicTree) AddSubscription(client *Client, topic string) (bool, error) {
 	defer tt.Unlock()
 	tt.Lock()
-	INFO.Printf("AddSubscription(\"%s\", \"%s\")\n", client.ClientId, topic)
+	DEBUG.Printf("AddSubscription(\"%s\", \"%s\")\n", client.ClientId, topic)
 	if levels, e := ValidateTopicFilter(topic); e != nil {
 		return false, e
 	} else {
@@ -67,33 +69,40 @@ func (tt *TopicTree) AddSubscription(client *Client, topic string) (bool, error)
 // topic could contain wild cards, however we do only consider the literal
 // topic string - (wilds are not evaluated for this)
 func (tt *TopicTree) RemoveSubscription(s *Client, topic string) error {
+	_, err := tt.removeSubscription(s, topic)
+	return err
+}
+
+// removeSubscription is RemoveSubscription, also returning true if s
+// was the last subscriber of topic.
+func (tt *TopicTree) removeSubscription(s *Client, topic string) (bool, error) {
 	defer tt.Unlock()
 	tt.Lock()
 	if levels, e := ValidateTopicFilter(topic); e != nil {
-		return e
+		return false, e
 	} else {
 		n := tt.root
 		for _, level := range levels {
 			if n = n.children[level]; n == nil {
 				ERROR.Printf("no subscription exists \"%s\"\n", topic)
-				return ErrNoSuchSubscriptionExists
+				return false, ErrNoSuchSubscriptionExists
 			}
 		}
 		if len(n.clients) < 1 {
 			ERROR.Printf("no clients of subscription \"%s\"\n", topic)
-			return ErrNoSubscribers
+			return false, ErrNoSubscribers
 		}
 		for i := 0; i < len(n.clients); i++ {
 			if n.clients[i].ClientId == s.ClientId {
 				// inexpensive way of removing from a slice
 				n.clients[i] = n.clients[len(n.clients)-1]
 				n.clients = n.clients[0 : len(n.clients)-1]
-				INFO.Printf("deleted subscription of client \"%s\"\n", s.ClientId)
-				return nil
+				DEBUG.Printf("deleted subscription of client \"%s\"\n", s.ClientId)
+				return len(n.clients) == 0, nil
 			}
 		}
 		ERROR.Printf("client \"%s\" was not subscribed to \"%s\"\n", s.ClientId, topic)
-		return ErrClientNotSubscribed
+		return false, ErrClientNotSubscribed
 	}
 }
 
@@ -140,3 +149,47 @@ func subscribers(n *node, levels []string, clients *[]*Client) {
 		}
 	}
 }
+
+// Subscriptions returns the ids of the clients subscribed to each
+// topic filter in the tree.
+func (tt *TopicTree) Subscriptions() map[string][]string {
+	defer tt.RUnlock()
+	tt.RLock()
+	subs := make(map[string][]string)
+	walk(tt.root, nil, func(filter string, n *node) {
+		for _, c := range n.clients {
+			subs[filter] = append(subs[filter], c.ClientId)
+		}
+		sort.Strings(subs[filter])
+	})
+	return subs
+}
+
+// SubscriptionsOf returns the topic filters client is subscribed to,
+// sorted.
+func (tt *TopicTree) SubscriptionsOf(client *Client) []string {
+	defer tt.RUnlock()
+	tt.RLock()
+	var filters []string
+	walk(tt.root, nil, func(filter string, n *node) {
+		for _, c := range n.clients {
+			if c == client {
+				filters = append(filters, filter)
+				return
+			}
+		}
+	})
+	sort.Strings(filters)
+	return filters
+}
+
+// walk calls visit for every node below n that has clients, with the
+// topic filter leading to it.
+func walk(n *node, levels []string, visit func(string, *node)) {
+	if len(levels) > 0 && len(n.clients) > 0 {
+		visit(strings.Join(levels, "/"), n)
+	}
+	for level, child := range n.children {
+		walk(child, append(levels[:len(levels):len(levels)], level), visit)
+	}
+}
@@ -3,6 +3,7 @@ package gateway
 import (
 	"net"
 	"sync"
+	"time"
 
 	. "github.com/alsm/gnatt/packets"
 
@@ -12,74 +13,147 @@ import (
 type TClient struct {
 	Client
 	mqttClient *MQTT.Client
-	mqttBroker string
-	username   string
-	password   string
+	broker     BrokerConfig
+	// the topic filters subscribed to on the client's behalf
+	subscriptions []string
+	link          brokerLink
 }
 
 // Do not allow the creation of an MQTT-SN client if
 // a connection to the MQTT broker cannot be established
-func NewTClient(ClientId, Broker string, Connection *net.UDPConn, Address *net.UDPAddr) (*TClient, error) {
-	INFO.Println("NewTClient, id: %s", ClientId)
-	t := &TClient{
+func NewTClient(ClientId string, Broker BrokerConfig, Connection Transport, Address net.Addr) (*TClient, error) {
+	DEBUG.Printf("NewTClient, id: %s\n", ClientId)
+	t := newTClient(ClientId, Broker, Connection, Address)
+	if err := t.connectMQTT(ClientId); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newTClient is a TClient that isn't connected to the broker yet.
+func newTClient(ClientId string, Broker BrokerConfig, Connection Transport, Address net.Addr) *TClient {
+	return &TClient{
 		Client{
 			sync.RWMutex{},
 			ClientId,
 			Connection,
 			Address,
 			make(map[uint16]string),
-			make(map[uint16]*PublishMessage),
+			make(map[uint16][]*PublishMessage),
+			make(map[uint16]*pendingRegister),
+			0,
+			VERSION_1_2,
+			Disconnected,
+			0,
+			0,
+			time.Time{},
+			false,
+			nil,
 		},
 		nil,
 		Broker,
-		"",
-		"",
-	}
-	if err := t.connectMQTT(ClientId, Broker); err != nil {
-		return nil, err
+		nil,
+		brokerLink{},
 	}
-	return t, nil
 }
 
-func (t *TClient) connectMQTT(ClientId, Broker string) error {
+func (t *TClient) connectMQTT(ClientId string) error {
 	opts := MQTT.NewClientOptions()
-	opts.AddBroker(Broker)
+	opts.AddBroker(t.broker.URI)
 	opts.SetClientID(ClientId)
-	if t.username != "" {
-		opts.SetUsername(t.username)
-		opts.SetPassword(t.password)
+	if t.broker.Username != "" {
+		opts.SetUsername(t.broker.Username)
+		opts.SetPassword(t.broker.Password)
+	}
+	if t.broker.KeepAlive > 0 {
+		opts.SetKeepAlive(t.broker.KeepAlive)
 	}
 	t.mqttClient = MQTT.NewClient(opts)
 
 	if token := t.mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
-	INFO.Println("TClient connected to mqtt broker")
+	DEBUG.Println("TClient connected to mqtt broker")
 	return nil
 }
 
 func (t *TClient) disconnectMQTT() {
+	if t.mqttClient == nil {
+		// never connected
+		return
+	}
 	t.mqttClient.Disconnect(100)
 }
 
-func (t *TClient) subscribeMQTT(qos byte, topic string, tIndex *topicNames) {
+func (t *TClient) subscribeMQTT(qos byte, topic string, tIndex *topicNames, predefined *predefinedTopics, mtu int, metrics *Metrics) {
 	var handler MQTT.MessageHandler = func(client *MQTT.Client, msg MQTT.Message) {
-		INFO.Println("publish handler")
-
-		tid := tIndex.getId(msg.Topic())
-		// is topicid type always 0 coming out of tIndex ?
-		// todo: msgid is not always 0
-		pm := NewPublishMessage(tid, 0x00, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
-
-		if err := t.Write(pm); err != nil {
-			ERROR.Println(err)
+		DEBUG.Println("publish handler")
+		if keepForSleeper(&t.Client, msg, metrics) {
+			return
+		}
+		if err := t.deliver(msg, tIndex, predefined, mtu); err != nil {
+			metrics.brokerMessage("dropped")
 		} else {
-			INFO.Println("incoming mqtt published to mqtt-sn")
+			metrics.brokerMessage("delivered")
 		}
 	}
 
 	if token := t.mqttClient.Subscribe(topic, qos, handler); token.WaitTimeout(2000) && token.Error() != nil {
 		ERROR.Println("Error subscribing,", token.Error())
+		return
+	}
+	t.Lock()
+	t.subscriptions = append(t.subscriptions, topic)
+	t.Unlock()
+	DEBUG.Println(t.ClientId, "subscribed to", topic)
+}
+
+func (t *TClient) unsubscribeMQTT(topic string) {
+	if token := t.mqttClient.Unsubscribe(topic); token.WaitTimeout(2000) && token.Error() != nil {
+		ERROR.Println("Error unsubscribing,", token.Error())
+		return
+	}
+	t.Lock()
+	for i, filter := range t.subscriptions {
+		if filter == topic {
+			t.subscriptions = append(t.subscriptions[:i], t.subscriptions[i+1:]...)
+			break
+		}
 	}
-	INFO.Println(t.ClientId, "subscribed to", topic)
+	t.Unlock()
+	DEBUG.Println(t.ClientId, "unsubscribed from", topic)
+}
+
+// Subscriptions returns the topic filters subscribed to for the client.
+func (t *TClient) Subscriptions() []string {
+	defer t.RUnlock()
+	t.RLock()
+	return append([]string(nil), t.subscriptions...)
+}
+
+// deliver sends msg to the client as a PUBLISH, unless it is asleep.
+func (t *TClient) deliver(msg MQTT.Message, tIndex *topicNames, predefined *predefinedTopics, mtu int) error {
+	if s := t.State(); !s.listening() {
+		DEBUG.Printf("not publishing to client \"%s\", it is %v\n", t.ClientId, s)
+		return ErrNotConnected
+	}
+	tid, tidType := tIndex.getId(msg.Topic()), byte(0x00)
+	if topic, ok := t.endpoint().clientTopic(msg.Topic()); ok {
+		if id, ok := predefined.getId(topic); ok {
+			tid, tidType = id, 0x01
+		}
+	}
+	// todo: msgid is not always 0
+	pm := NewPublishMessage(tid, tidType, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
+	if pm.Size() > mtu {
+		ERROR.Printf("not publishing to client \"%s\": %v\n", t.ClientId, ErrPacketTooLarge)
+		return ErrPacketTooLarge
+	}
+
+	if err := t.Write(pm); err != nil {
+		ERROR.Println(err)
+		return err
+	}
+	DEBUG.Println("incoming mqtt published to mqtt-sn")
+	return nil
 }
@@ -1,74 +1,258 @@
 package gateway
 
 import (
-	"bytes"
+	"context"
+	"fmt"
 	"net"
-	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/alsm/gnatt/packets"
 
-	//MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 )
 
 type TGateway struct {
-	stopsig    chan os.Signal
-	port       int
-	mqttBroker string
+	listeners []*listener
+	stopping  atomic.Bool
+	// replaced when the config is reloaded
+	config     atomic.Pointer[GatewayConfig]
 	clients    Clients
 	tIndex     topicNames
-}
-
-func NewTGateway(gc *GatewayConfig, stopsig chan os.Signal) *TGateway {
+	predefined *predefinedTopics
+	// CONNECTs waiting on an AUTH, by client address
+	authLock    sync.Mutex
+	pendingAuth map[string]pendingConnect
+	// sources allowed to publish at QoS -1
+	qosMinusOne *addrList
+	// the gateway's own broker connection, for QoS -1 PUBLISHes and
+	// presence, opened when first needed
+	connLock   sync.Mutex
+	conn       *MQTT.Client
+	connLink   brokerLink
+	metrics    *Metrics
+	metricsSrv *httpServer
+	adminSrv   *httpServer
+	events     *eventHub
+	presence   *presence
+	// closed when the gateway stops, by Start if it fails
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func NewTGateway(gc *GatewayConfig) (*TGateway, error) {
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
 	t := &TGateway{
-		stopsig,
-		gc.port,
-		gc.mqttbroker,
-		Clients{
+		clients: Clients{
 			sync.RWMutex{},
 			make(map[string]SNClient),
 		},
-		topicNames{
+		tIndex: topicNames{
 			sync.RWMutex{},
 			make(map[uint16]string),
 			0,
 		},
+		predefined:  newPredefinedTopics(gc.PredefinedTopics),
+		pendingAuth: make(map[string]pendingConnect),
+		qosMinusOne: newAddrList(gc.QosMinusOneAllow),
+	}
+	config := *gc
+	t.config.Store(&config)
+	t.metrics = newMetrics(&t.clients)
+	t.events = newEventHub()
+	t.presence = newPresence(gc, t.metrics, t.publishBroker)
+	t.done = make(chan struct{})
+	return t, nil
+}
+
+func (t *TGateway) conf() *GatewayConfig {
+	return t.config.Load()
+}
+
+func (t *TGateway) Reload(gc *GatewayConfig) (ReloadResult, error) {
+	return reload(&t.config, t.listeners, t.predefined, t.qosMinusOne, gc)
+}
+
+func (t *TGateway) ReloadConfig() (ReloadResult, error) {
+	gc, err := loadConfig(t.conf())
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	return t.Reload(gc)
+}
+
+func (t *TGateway) Clients() []ClientStatus {
+	return t.clients.Status()
+}
+
+// Metrics returns the gateway's metrics, which are also served over
+// HTTP if the config has a MetricsAddress.
+func (t *TGateway) Metrics() *Metrics {
+	return t.metrics
+}
+
+func (t *TGateway) clientList() *Clients {
+	return &t.clients
+}
+
+func (t *TGateway) registry() TopicRegistry {
+	return TopicRegistry{t.tIndex.snapshot(), t.predefined.snapshot()}
+}
+
+func (t *TGateway) subscriptions() map[string][]string {
+	subs := make(map[string][]string)
+	for _, client := range t.clients.All() {
+		tclient := client.(*TClient)
+		for _, filter := range tclient.Subscriptions() {
+			subs[filter] = append(subs[filter], tclient.ClientId)
+		}
+	}
+	for _, ids := range subs {
+		sort.Strings(ids)
+	}
+	return subs
+}
+
+func (t *TGateway) subscriptionsOf(c SNClient) []string {
+	return c.(*TClient).Subscriptions()
+}
+
+func (t *TGateway) disconnectClient(c SNClient) {
+	tclient := c.(*TClient)
+	tclient.disconnected(0)
+	if err := tclient.Write(disconnectFor(tclient, RC_ADMINISTRATIVE)); err != nil {
+		ERROR.Println(err)
+	}
+	t.events.emit(newEvent(EventDisconnect, &tclient.Client, "", "admin"))
+	t.closeClient(tclient)
+}
+
+func (t *TGateway) eventHub() *eventHub {
+	return t.events
+}
+
+func (t *TGateway) publishTo(c SNClient, msg MQTT.Message) error {
+	tclient := c.(*TClient)
+	if s := tclient.State(); !s.listening() && s != Asleep {
+		return ErrNotConnected
+	}
+	if keepForSleeper(&tclient.Client, msg, t.metrics) {
+		return nil
 	}
-	return t
+	return tclient.deliver(msg, &t.tIndex, t.predefined, t.conf().MTU)
 }
 
-func (t *TGateway) Port() int {
-	return t.port
+// Addr is the address of the gateway's first listener.
+func (t *TGateway) Addr() net.Addr {
+	if len(t.listeners) == 0 {
+		return nil
+	}
+	return t.listeners[0].addr()
 }
 
-func (t *TGateway) Start() {
-	go t.awaitStop()
+// Start listening for MQTT-SN clients, each of which gets its own
+// broker connection when it CONNECTs. Once Start has returned the
+// gateway runs until Shutdown is called.
+func (t *TGateway) Start(ctx context.Context) error {
+	var err error
+	if t.metricsSrv, err = serveMetrics(t.conf().MetricsAddress, t.metrics); err != nil {
+		ERROR.Println(err)
+		return err
+	}
+	if t.adminSrv, err = serveAdmin(t.conf().AdminAddress, t); err != nil {
+		ERROR.Println(err)
+		t.metricsSrv.stop(ctx)
+		return err
+	}
+	t.presence.start(t.events)
+	go watchLost(&t.clients, t.events, t.done)
+	ls, err := startListeners(t.conf(), t, t.metrics)
+	if err != nil {
+		ERROR.Println(err)
+		t.stop()
+		t.events.close()
+		t.adminSrv.stop(ctx)
+		t.metricsSrv.stop(ctx)
+		return err
+	}
+	t.listeners = ls
 	INFO.Println("Transparent Gataway is started")
-	listen(t)
+	return nil
 }
 
-func (t *TGateway) awaitStop() {
-	<-t.stopsig
+// Shutdown stops the listener, waits until ctx is done for the packets
+// already received to be handled, then sends every client a DISCONNECT
+// and closes its broker connection.
+func (t *TGateway) Shutdown(ctx context.Context) error {
+	if t.stopping.Swap(true) {
+		return nil
+	}
+	INFO.Println("Transparent Gateway is stopping")
+	err := stopListeners(ctx, t.listeners)
+	clients := t.clients.All()
+	disconnectClients(clients)
+	for _, client := range clients {
+		client.(*TClient).disconnectMQTT()
+		t.metrics.linkDown(&client.(*TClient).link)
+	}
+	// the broker hears that the clients are gone before the gateway is
+	t.stop()
+	emitShutdown(clients, t.events)
+	t.events.close()
+	t.presence.wait(ctx)
+	t.connLock.Lock()
+	if t.conn != nil {
+		t.conn.Disconnect(100)
+		t.metrics.linkDown(&t.connLink)
+	}
+	t.connLock.Unlock()
+	closeListeners(t.listeners)
+	if merr := t.metricsSrv.stop(ctx); err == nil {
+		err = merr
+	}
+	if aerr := t.adminSrv.stop(ctx); err == nil {
+		err = aerr
+	}
 	INFO.Println("Transparent Gateway is stopped")
-	os.Exit(0)
+	return err
 }
 
-func (t *TGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *net.UDPAddr) {
-	INFO.Println("TG OnPacket!")
-	INFO.Printf("bytes: %s\n", string(buffer[0:nbytes]))
-
-	buf := bytes.NewBuffer(buffer)
-	rawmsg, _ := ReadPacket(buf)
+// stop closes done, which both a failed Start and the Shutdown after
+// it do.
+func (t *TGateway) stop() {
+	t.doneOnce.Do(func() { close(t.done) })
+}
 
-	INFO.Printf("rawmsg.MessageType(): %s\n", MessageNames[rawmsg.MessageType()])
+func (t *TGateway) OnPacket(nbytes int, buffer []byte, con Transport, addr net.Addr) {
+	d := decoders.Get().(*Decoder)
+	defer decoders.Put(d)
+	if rawmsg, ok := decodeFrom(d, t.metrics, buffer[:nbytes], addr); ok {
+		t.handle(rawmsg, con, addr)
+	}
+}
 
+func (t *TGateway) handle(rawmsg Message, con Transport, addr net.Addr) {
+	traceReceived(&t.clients, rawmsg, addr)
+	if !checkState(&t.clients, rawmsg, con, addr) {
+		t.metrics.reject("state")
+		t.events.emit(addrEvent(EventReject, addr, "", MessageNames[rawmsg.MessageType()]))
+		return
+	}
 	switch msg := rawmsg.(type) {
+	case *EncapsulatedMessage:
+		t.handle_ENCAPSULATED(msg, con, addr)
 	case *AdvertiseMessage:
 		t.handle_ADVERTISE(msg, addr)
 	case *SearchGwMessage:
-		t.handle_SEARCHGW(msg, addr)
+		t.handle_SEARCHGW(msg, con, addr)
 	case *GwInfoMessage:
 		t.handle_GWINFO(msg, addr)
+	case *AuthMessage:
+		t.handle_AUTH(msg, con, addr)
 	case *ConnectMessage:
 		t.handle_CONNECT(msg, con, addr)
 	case *ConnackMessage:
@@ -86,7 +270,7 @@ func (t *TGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *n
 	case *RegackMessage:
 		t.handle_REGACK(msg, addr)
 	case *PublishMessage:
-		t.handle_PUBLISH(msg, addr)
+		t.handle_PUBLISH(msg, con, addr)
 	case *PubackMessage:
 		t.handle_PUBACK(msg, addr)
 	case *PubcompMessage:
@@ -99,6 +283,8 @@ func (t *TGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *n
 		t.handle_SUBSCRIBE(msg, addr)
 	case *SubackMessage:
 		t.handle_SUBACK(msg, addr)
+	case *UnsubscribeMessage:
+		t.handle_UNSUBSCRIBE(msg, addr)
 	case *UnsubackMessage:
 		t.handle_UNSUBACK(msg, addr)
 	case *PingreqMessage:
@@ -118,197 +304,489 @@ func (t *TGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *n
 	}
 }
 
-func (t *TGateway) handle_ADVERTISE(m *AdvertiseMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+func (t *TGateway) handle_ADVERTISE(m *AdvertiseMessage, a net.Addr) {
+}
+
+func (t *TGateway) handle_SEARCHGW(m *SearchGwMessage, c Transport, a net.Addr) {
+	answerSearch(c, a)
 }
 
-func (t *TGateway) handle_SEARCHGW(m *SearchGwMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+func (t *TGateway) handle_GWINFO(m *GwInfoMessage, a net.Addr) {
 }
 
-func (t *TGateway) handle_GWINFO(m *GwInfoMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+// Handle the message inside as if it came straight from the node,
+// replies to it are encapsulated and go back through the forwarder.
+func (t *TGateway) handle_ENCAPSULATED(m *EncapsulatedMessage, c Transport, a net.Addr) {
+	t.handle(m.Message, forwardingTransport{c}, NewForwardedAddr(a, m.WirelessNodeId))
 }
 
-func (t *TGateway) handle_CONNECT(m *ConnectMessage, c *net.UDPConn, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-	INFO.Println(m.ProtocolId, m.Duration, m.ClientId)
-	if clientid, err := validateClientId(m.ClientId); err != nil {
+func (t *TGateway) handle_CONNECT(m *ConnectMessage, c Transport, a net.Addr) {
+	// a new CONNECT replaces any still waiting on its AUTH
+	t.authLock.Lock()
+	delete(t.pendingAuth, a.String())
+	t.authLock.Unlock()
+	if !supportsVersion(t.conf().ProtocolVersions, m.ProtocolId) {
+		ERROR.Printf("refusing %v, protocol version %d not supported\n", a, m.ProtocolId)
+		if err := NewClient(string(m.ClientId), c, a).Write(connackFor(m, RC_UNSUPPORTED_VERSION, 0)); err != nil {
+			ERROR.Println(err)
+		}
+		return
+	}
+	if m.Auth {
+		// hold on to the CONNECT until the client's AUTH gives the
+		// credentials to connect to the broker with, the packet it
+		// came in is about to be reused
+		pending := *m
+		pending.ClientId = append([]byte(nil), m.ClientId...)
+		if !t.holdForAuth(&pending, a, time.Now()) {
+			ERROR.Printf("refusing %v, already %d CONNECTs waiting on AUTH\n", a, maxPendingAuth)
+			if err := NewClient(string(m.ClientId), c, a).Write(connackFor(m, REJ_CONGESTION, 0)); err != nil {
+				ERROR.Println(err)
+			}
+		}
+		return
+	}
+	t.connect(m, c, a, t.conf().Broker)
+}
+
+// A CONNECT waits authTimeout for its AUTH, and no more than
+// maxPendingAuth wait at once.
+const (
+	authTimeout    = 10 * time.Second
+	maxPendingAuth = 1024
+)
+
+// A pendingConnect is a CONNECT waiting on an AUTH.
+type pendingConnect struct {
+	connect *ConnectMessage
+	expires time.Time
+}
+
+// holdForAuth keeps m until a's AUTH comes, or authTimeout passes. It
+// returns false, keeping nothing, if too many are already waiting.
+func (t *TGateway) holdForAuth(m *ConnectMessage, a net.Addr, now time.Time) bool {
+	t.authLock.Lock()
+	defer t.authLock.Unlock()
+	if len(t.pendingAuth) >= maxPendingAuth {
+		for addr, p := range t.pendingAuth {
+			if now.After(p.expires) {
+				delete(t.pendingAuth, addr)
+			}
+		}
+		if len(t.pendingAuth) >= maxPendingAuth {
+			return false
+		}
+	}
+	t.pendingAuth[a.String()] = pendingConnect{m, now.Add(authTimeout)}
+	return true
+}
+
+// takeAuth returns the CONNECT waiting on a's AUTH, if it hasn't
+// expired, and forgets it.
+func (t *TGateway) takeAuth(a net.Addr, now time.Time) (*ConnectMessage, bool) {
+	t.authLock.Lock()
+	defer t.authLock.Unlock()
+	p, ok := t.pendingAuth[a.String()]
+	delete(t.pendingAuth, a.String())
+	if !ok || now.After(p.expires) {
+		return nil, false
+	}
+	return p.connect, true
+}
+
+// Authenticate the CONNECT waiting on this AUTH. SASL PLAIN is the only
+// method, its username and password are used for the client's broker
+// connection.
+func (t *TGateway) handle_AUTH(m *AuthMessage, c Transport, a net.Addr) {
+	cm, ok := t.takeAuth(a, time.Now())
+	if !ok {
+		ERROR.Printf("unexpected AUTH from %v\n", a)
+		return
+	}
+	rc := byte(ACCEPTED)
+	if string(m.Method) != "PLAIN" {
+		rc = RC_BAD_AUTH_METHOD
+	}
+	user, password, ok := parsePlainAuth(m.Data)
+	if rc == ACCEPTED && !ok {
+		rc = RC_NOT_AUTHORIZED
+	}
+	if rc != ACCEPTED {
+		ERROR.Printf("refusing %v, authentication failed: %s\n", a, ReturnCodeNames[rc])
+		if err := NewClient(string(cm.ClientId), c, a).Write(connackFor(cm, rc, 0)); err != nil {
+			ERROR.Println(err)
+		}
+		return
+	}
+	broker := t.conf().Broker
+	broker.Username, broker.Password = user, password
+	t.connect(cm, c, a, broker)
+}
+
+// Connect the client to the broker with its own connection, using the
+// given credentials.
+func (t *TGateway) connect(m *ConnectMessage, c Transport, a net.Addr, broker BrokerConfig) {
+	DEBUG.Println(m.ProtocolId, m.Duration, m.ClientId)
+	id, ok := checkIdentity(c, a, m.ClientId)
+	if !ok || !checkListener(c, a) {
+		if err := NewClient(string(id), c, a).Write(connackFor(m, RC_NOT_AUTHORIZED, 0)); err != nil {
+			ERROR.Println(err)
+		}
+		return
+	}
+	assigned := len(id) == 0 && m.ProtocolId >= VERSION_2_0
+	if assigned {
+		id = []byte(assignClientId())
+	}
+	if clientid, err := validateClientId(id); err != nil {
 		ERROR.Println(err)
 	} else {
-		INFO.Printf("clientid: %s\n", clientid)
-		INFO.Printf("remoteaddr: %s\n", a)
-		INFO.Printf("will: %v\n", m.Will)
+		DEBUG.Printf("clientid: %s\n", clientid)
+		DEBUG.Printf("remoteaddr: %s\n", a)
+		DEBUG.Printf("will: %v\n", m.Will)
 		if m.Will {
 			// todo: will msg
 		}
-		if tClient, err := NewTClient(string(clientid), t.mqttBroker, c, a); err != nil {
+		if max := t.conf().MaxClients; max > 0 && t.clients.GetClient(a) == nil && t.clients.Len() >= max {
+			ERROR.Printf("refusing \"%s\", already %d clients connected\n", clientid, max)
+			if err := NewClient(clientid, c, a).Write(connackFor(m, REJ_CONGESTION, 0)); err != nil {
+				ERROR.Println(err)
+			}
+			return
+		}
+		if tClient, err := NewTClient(string(clientid), broker, c, a); err != nil {
 			ERROR.Println(err)
+			// v1.2 has no return code for this
+			if m.ProtocolId >= VERSION_2_0 {
+				if err = NewClient(clientid, c, a).Write(connackFor(m, RC_SERVER_UNAVAILABLE, 0)); err != nil {
+					ERROR.Println(err)
+				}
+			}
 		} else {
+			t.metrics.linkUp(&tClient.link)
+			tClient.setVersion(m.ProtocolId)
+			tClient.connected(time.Duration(m.Duration) * time.Second)
+			if old, ok := t.clients.GetClient(a).(*TClient); ok {
+				// the client being replaced takes its broker
+				// connection and its retransmissions with it
+				old.DiscardPending()
+				old.disconnectMQTT()
+				t.metrics.linkDown(&old.link)
+			}
 			t.clients.AddClient(tClient)
 
 			// establish connection to mqtt broker
 
-			ca := NewMessage(CONNACK).(*ConnackMessage)
-			ca.ReturnCode = 0
+			// the broker connection goes with the client, so there is
+			// no session left to resume once it disconnects
+			ca := connackFor(m, ACCEPTED, 0)
+			if assigned {
+				ca.AssignedClientId = id
+			}
 			if err = tClient.Write(ca); err != nil {
 				ERROR.Println(err)
 			} else {
-				INFO.Println("CONNACK was sent")
+				DEBUG.Println("CONNACK was sent")
+				t.events.emit(newEvent(EventConnect, &tClient.Client, "", ""))
+				if t.conf().OnConnect != nil {
+					t.conf().OnConnect(clientid, a)
+				}
 			}
 		}
 	}
 }
 
-func (t *TGateway) handle_CONNACK(m *ConnackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_CONNACK(m *ConnackMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLTOPICREQ(m *WillTopicReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLTOPICREQ(m *WillTopicReqMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLTOPIC(m *WillTopicMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLTOPIC(m *WillTopicMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLMSGREQ(m *WillMsgReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLMSGREQ(m *WillMsgReqMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLMSG(m *WillMsgMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLMSG(m *WillMsgMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_REGISTER(m *RegisterMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
-	topic := string(m.TopicName)
-	var topicid uint16
-	if !t.tIndex.containsTopic(topic) {
-		topicid = t.tIndex.putTopic(topic)
-	} else {
-		topicid = t.tIndex.getId(topic)
-	}
+func (t *TGateway) handle_REGISTER(m *RegisterMessage, c Transport, r net.Addr) {
+	topic := endpointOf(c).brokerTopic(string(m.TopicName))
+	topicid := t.tIndex.assignId(topic)
 
-	INFO.Printf("t topicid: %d\n", topicid)
+	DEBUG.Printf("t topicid: %d\n", topicid)
 
 	tclient := t.clients.GetClient(r).(*TClient)
 	tclient.Register(topicid, topic)
+	t.events.emit(newEvent(EventRegister, &tclient.Client, topic, ""))
 
 	ra := NewRegackMessage(topicid, m.MessageId, 0)
-	INFO.Printf("ra.Msgid: %d\n", ra.MessageId)
+	DEBUG.Printf("ra.Msgid: %d\n", ra.MessageId)
 
 	if err := tclient.Write(ra); err != nil {
 		ERROR.Println(err)
 	} else {
-		INFO.Println("REGACK sent")
+		DEBUG.Println("REGACK sent")
 	}
 }
 
-func (t *TGateway) handle_REGACK(m *RegackMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+func (t *TGateway) handle_REGACK(m *RegackMessage, a net.Addr) {
 }
 
-func (t *TGateway) handle_PUBLISH(m *PublishMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-	tclient := t.clients.GetClient(a).(*TClient)
+func (t *TGateway) handle_PUBLISH(m *PublishMessage, c Transport, a net.Addr) {
+	if m.Qos == QOS_MINUS_ONE {
+		t.publishQosMinusOne(m, c, a)
+		return
+	}
+	tclient, ok := t.clients.GetClient(a).(*TClient)
+	if !ok {
+		ERROR.Printf("dropping %v from %v: not connected\n", m, a)
+		return
+	}
 
-	topic := t.tIndex.getTopic(m.TopicId)
+	topic := publishTopic(m, &tclient.Client, &t.tIndex, t.predefined)
+	if topic == "" {
+		ERROR.Printf("unknown topic id %d (type %d)\n", m.TopicId, m.TopicIdType)
+		rejectPublish(tclient, m, REJ_INVALID_TID)
+		return
+	}
+	if !tclient.endpoint().mayPublish(topic) {
+		ERROR.Printf("\"%s\" may not publish to \"%s\"\n", tclient, topic)
+		rejectPublish(tclient, m, REJ_NOT_SUPORTED)
+		return
+	}
 
-	INFO.Println(topic, m.Qos, m.Retain, m.Data)
-	if token := tclient.mqttClient.Publish(topic, m.Qos, m.Retain, m.Data); token.WaitTimeout(2000) && token.Error() != nil {
+	t.events.emit(newEvent(EventPublish, &tclient.Client, topic, qosDetail(m.Qos)))
+	DEBUG.Println(topic, m.Qos, m.Retain, m.Data)
+	token := tclient.mqttClient.Publish(topic, m.Qos, m.Retain, append([]byte(nil), m.Data...))
+	if t.metrics.brokerPublish(func() bool { return token.WaitTimeout(2000) }) && token.Error() != nil {
 		ERROR.Println("Error publishing message", token.Error())
 		return
 	}
-	INFO.Println("PUBLISH published")
+	DEBUG.Println("PUBLISH published")
+}
+
+// QoS -1 PUBLISHes may come from clients without a broker connection
+// of their own, so they all go out on the gateway's.
+func (t *TGateway) publishQosMinusOne(m *PublishMessage, c Transport, a net.Addr) {
+	topic := qosMinusOneTopic(m, c, a, t.qosMinusOne, t.predefined)
+	if topic == "" {
+		return
+	}
+	t.events.emit(addrEvent(EventPublish, a, topic, qosDetail(m.Qos)))
+	conn, err := t.brokerConn()
+	if err != nil {
+		ERROR.Printf("dropping %v from %v: %v\n", m, a, err)
+		return
+	}
+
+	token := conn.Publish(topic, t.conf().QosMinusOneMQTTQos, m.Retain, append([]byte(nil), m.Data...))
+	if t.metrics.brokerPublish(func() bool { return token.WaitTimeout(2000) }) && token.Error() != nil {
+		ERROR.Println("Error publishing message", token.Error())
+		return
+	}
+	DEBUG.Println("PUBLISH published")
+}
+
+// brokerConn returns the gateway's own broker connection, which uses
+// the broker's ClientId, connecting it if need be.
+func (t *TGateway) brokerConn() (*MQTT.Client, error) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(t.conf().Broker.URI)
+	opts.SetClientID(t.conf().Broker.ClientId)
+	if t.conf().Broker.Username != "" {
+		opts.SetUsername(t.conf().Broker.Username)
+		opts.SetPassword(t.conf().Broker.Password)
+	}
+	if t.conf().Broker.KeepAlive > 0 {
+		opts.SetKeepAlive(t.conf().Broker.KeepAlive)
+	}
+	opts.SetConnectionLostHandler(func(_ *MQTT.Client, err error) {
+		ERROR.Println("lost the gateway's broker connection:", err)
+		t.metrics.linkLost(&t.connLink)
+	})
+	conn := MQTT.NewClient(opts)
+	if token := conn.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	t.conn = conn
+	t.metrics.linkUp(&t.connLink)
+	return conn, nil
+}
+
+// publishBroker publishes for the gateway itself, without waiting.
+func (t *TGateway) publishBroker(topic string, qos byte, retain bool, payload []byte) {
+	conn, err := t.brokerConn()
+	if err != nil {
+		ERROR.Printf("not publishing to \"%s\": %v\n", topic, err)
+		return
+	}
+	token := conn.Publish(topic, qos, retain, payload)
+	go func() {
+		if token.WaitTimeout(2000) && token.Error() != nil {
+			ERROR.Printf("Error publishing to \"%s\": %v\n", topic, token.Error())
+		}
+	}()
 }
 
-func (t *TGateway) handle_PUBACK(m *PubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_PUBACK(m *PubackMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_PUBCOMP(m *PubcompMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_PUBCOMP(m *PubcompMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_PUBREC(m *PubrecMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_PUBREC(m *PubrecMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_PUBREL(m *PubrelMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_PUBREL(m *PubrelMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_SUBSCRIBE(m *SubscribeMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_SUBSCRIBE(m *SubscribeMessage, r net.Addr) {
 	topic := ""
-	if m.TopicIdType == 0 { // todo: other topic id types, also use enum
-		topic = string(m.TopicName)
-	} else {
+	var topicid uint16
+	tclient := t.clients.GetClient(r).(*TClient)
+	e := tclient.endpoint()
+	switch m.TopicIdType { // todo: also use enum
+	case 0x00:
+		topic = e.brokerTopic(string(m.TopicName))
+	case 0x01:
+		topicid = m.TopicId
+		if topic = t.predefined.getTopic(topicid); topic == "" {
+			ERROR.Printf("unknown predefined topic id %d\n", topicid)
+			suba := NewSubackMessage(topicid, m.MessageId, m.Qos, REJ_INVALID_TID)
+			if err := tclient.Write(suba); err != nil {
+				ERROR.Println(err)
+			}
+			return
+		}
+		topic = e.brokerTopic(topic)
+	default:
 		ERROR.Println("other topic id types not supported yet")
 		topic = "not_implemented"
 	}
-	tclient := t.clients.GetClient(r).(*TClient)
-	INFO.Printf("subscribe, qos: %d, topic: %s\n", m.Qos, topic)
-	tclient.subscribeMQTT(m.Qos, topic, &t.tIndex)
+	if !e.maySubscribe(topic) {
+		ERROR.Printf("\"%s\" may not subscribe to \"%s\"\n", tclient, topic)
+		if err := tclient.Write(NewSubackMessage(0, m.MessageId, m.Qos, REJ_NOT_SUPORTED)); err != nil {
+			ERROR.Println(err)
+		}
+		return
+	}
+	DEBUG.Printf("subscribe, qos: %d, topic: %s\n", m.Qos, topic)
+	tclient.subscribeMQTT(m.Qos, topic, &t.tIndex, t.predefined, t.conf().MTU, t.metrics)
+	t.events.emit(newEvent(EventSubscribe, &tclient.Client, topic, qosDetail(m.Qos)))
 
-	suba := NewSubackMessage(0, m.MessageId, m.Qos, 0)
+	suba := NewSubackMessage(topicid, m.MessageId, m.Qos, 0)
 
 	if err := tclient.Write(suba); err != nil {
 		ERROR.Println(err)
 	} else {
-		INFO.Println("SUBACK sent")
+		DEBUG.Println("SUBACK sent")
 	}
 }
 
-func (t *TGateway) handle_SUBACK(m *SubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_SUBACK(m *SubackMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_UNSUBSCRIBE(m *UnsubscribeMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// The client's broker connection unsubscribes on its behalf.
+func (t *TGateway) handle_UNSUBSCRIBE(m *UnsubscribeMessage, r net.Addr) {
+	tclient := t.clients.GetClient(r).(*TClient)
+	e := tclient.endpoint()
+	var topic string
+	if m.TopicIdType == 0x00 {
+		topic = e.brokerTopic(string(m.TopicName))
+	} else if m.TopicIdType == 0x01 {
+		if topic = t.predefined.getTopic(m.TopicId); topic != "" {
+			topic = e.brokerTopic(topic)
+		}
+	}
+	if topic == "" {
+		ERROR.Printf("unknown topic id %d (type %d)\n", m.TopicId, m.TopicIdType)
+	} else {
+		DEBUG.Printf("unsubscribe, topic: %s\n", topic)
+		tclient.unsubscribeMQTT(topic)
+	}
+	// UNSUBACKed whether or not it was subscribed
+	ua := NewMessage(UNSUBACK).(*UnsubackMessage)
+	ua.MessageId = m.MessageId
+	if err := tclient.Write(ua); err != nil {
+		ERROR.Println(err)
+	}
 }
 
-func (t *TGateway) handle_UNSUBACK(m *UnsubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_UNSUBACK(m *UnsubackMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_PINGREQ(m *PingreqMessage, c *net.UDPConn, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+func (t *TGateway) handle_PINGREQ(m *PingreqMessage, c Transport, a net.Addr) {
 	tclient := t.clients.GetClient(a).(*TClient)
+	// a client that is asleep is woken to be sent what was kept for
+	// it, the PINGRESP after that sends it back to sleep
+	if tclient.awake(true) {
+		t.events.emit(newEvent(EventWake, &tclient.Client, "", ""))
+		defer func() {
+			tclient.awake(false)
+			t.events.emit(newEvent(EventSleep, &tclient.Client, "", ""))
+		}()
+		for _, msg := range tclient.takeAsleep() {
+			if err := tclient.deliver(msg, &t.tIndex, t.predefined, t.conf().MTU); err != nil {
+				t.metrics.brokerMessage("dropped")
+			} else {
+				t.metrics.brokerMessage("delivered")
+			}
+		}
+	}
 
 	resp := NewMessage(PINGRESP)
 
 	if err := tclient.Write(resp); err != nil {
 		ERROR.Println(err)
 	} else {
-		INFO.Println("PINGRESP sent")
+		DEBUG.Println("PINGRESP sent")
 	}
 }
 
-func (t *TGateway) handle_PINGRESP(m *PingrespMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+func (t *TGateway) handle_PINGRESP(m *PingrespMessage, a net.Addr) {
 }
 
-func (t *TGateway) handle_DISCONNECT(m *DisconnectMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_DISCONNECT(m *DisconnectMessage, r net.Addr) {
 	tclient := t.clients.GetClient(r).(*TClient)
+	tclient.disconnected(time.Duration(m.Duration) * time.Second)
+	if err := tclient.Write(disconnectFor(tclient, ACCEPTED)); err != nil {
+		ERROR.Println(err)
+	}
+	// a client going to sleep keeps its broker connection
+	if m.Duration > 0 {
+		t.events.emit(newEvent(EventSleep, &tclient.Client, "", fmt.Sprintf("%ds", m.Duration)))
+		return
+	}
+	t.events.emit(newEvent(EventDisconnect, &tclient.Client, "", ""))
+	t.closeClient(tclient)
+}
+
+// closeClient closes the broker connection of a client that has
+// disconnected and forgets it.
+func (t *TGateway) closeClient(tclient *TClient) {
 	tclient.disconnectMQTT()
-	t.clients.RemoveClient(tclient.ClientId)
+	t.metrics.linkDown(&tclient.link)
+	t.clients.RemoveClient(tclient.AddrString())
+	if t.conf().OnDisconnect != nil {
+		t.conf().OnDisconnect(tclient.ClientId, tclient.Address)
+	}
 }
 
-func (t *TGateway) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLTOPICRESP(m *WillTopicRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLTOPICRESP(m *WillTopicRespMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLMSGUPD(m *WillMsgUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLMSGUPD(m *WillMsgUpdateMessage, r net.Addr) {
 }
 
-func (t *TGateway) handle_WILLMSGRESP(m *WillMsgRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) handle_WILLMSGRESP(m *WillMsgRespMessage, r net.Addr) {
 }
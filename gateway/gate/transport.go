@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"net"
+)
+
+// A Transport carries MQTT-SN packets between the gateway and its
+// clients. The gateway never looks inside the addresses a Transport
+// hands out, it only gives them back to Send, so any kind of link
+// that can tell its peers apart can implement it.
+type Transport interface {
+	// Listen opens the transport, it is called once before anything else.
+	Listen() error
+	// Receive blocks until a packet arrives, copies it into b and
+	// returns its length and the peer that sent it.
+	Receive(b []byte) (int, net.Addr, error)
+	// Send writes one packet to a peer previously returned by Receive.
+	Send(b []byte, to net.Addr) error
+	// StopReceiving makes any blocked and all future Receive calls
+	// return ErrTransportStopped, while Send keeps working.
+	StopReceiving() error
+	// Close releases the transport, after which Send fails.
+	Close() error
+	// LocalAddr is the address the transport is listening on.
+	LocalAddr() net.Addr
+}
+
+// An IdentityTransport knows who its peers are, eg because they
+// authenticated with a DTLS pre-shared key. Such a peer must CONNECT
+// with its identity as its ClientId.
+type IdentityTransport interface {
+	Transport
+	// PeerIdentity returns the identity of the peer at a, ok is false
+	// if the peer did not authenticate as anyone in particular.
+	PeerIdentity(a net.Addr) (identity string, ok bool)
+}
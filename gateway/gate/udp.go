@@ -1,23 +1,108 @@
 package gateway
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 func port2str(port int) string {
 	return fmt.Sprintf(":%d", port)
 }
 
-func listen(g Gateway) {
-	address, err := net.ResolveUDPAddr("udp", port2str(g.Port()))
-	chkerr(err)
-	udpconn, err := net.ListenUDP("udp", address)
-	chkerr(err)
-	for {
-		buffer := make([]byte, 1024)
-		n, remote, err := udpconn.ReadFromUDP(buffer)
-		chkerr(err)
-		go g.OnPacket(n, buffer, udpconn, remote)
+// UDPTransport is the standard MQTT-SN transport, one datagram per packet.
+type UDPTransport struct {
+	network  string
+	address  string
+	group    string
+	ifname   string
+	conn     *net.UDPConn
+	stopping atomic.Bool
+}
+
+// NewUDPTransport returns a transport that will listen on the UDP
+// "host:port" address.
+func NewUDPTransport(address string) *UDPTransport {
+	return &UDPTransport{network: "udp", address: address}
+}
+
+// NewMulticastUDPTransport returns a transport that will listen on the
+// "host:port" address of network, "udp", "udp4" or "udp6". If group is
+// set the transport also joins that multicast group, at the same port,
+// on the interface named ifname or, if that is "", the system's
+// default. A multicast transport takes packets to its port on every
+// local address, whatever the host of address.
+func NewMulticastUDPTransport(network, address, group, ifname string) *UDPTransport {
+	return &UDPTransport{network: network, address: address, group: group, ifname: ifname}
+}
+
+func (u *UDPTransport) Listen() error {
+	address, err := net.ResolveUDPAddr(u.network, u.address)
+	if err != nil {
+		return err
+	}
+	if u.group == "" {
+		u.conn, err = net.ListenUDP(u.network, address)
+		return err
+	}
+	var ifi *net.Interface
+	if u.ifname != "" {
+		if ifi, err = net.InterfaceByName(u.ifname); err != nil {
+			return err
+		}
+	}
+	u.conn, err = net.ListenMulticastUDP(u.network, ifi, u.Group().(*net.UDPAddr))
+	return err
+}
+
+// Group is the multicast group the transport joins, nil if it joins
+// none.
+func (u *UDPTransport) Group() net.Addr {
+	if u.group == "" {
+		return nil
+	}
+	// the port listened on, once it has been picked
+	port := 0
+	if u.conn != nil {
+		port = u.conn.LocalAddr().(*net.UDPAddr).Port
+	} else if _, p, err := net.SplitHostPort(u.address); err == nil {
+		port, _ = strconv.Atoi(p)
 	}
+	return &net.UDPAddr{IP: net.ParseIP(u.group), Port: port, Zone: u.ifname}
+}
+
+func (u *UDPTransport) Receive(b []byte) (int, net.Addr, error) {
+	n, remote, err := u.conn.ReadFromUDP(b)
+	if err != nil {
+		if u.stopping.Load() {
+			return 0, nil, ErrTransportStopped
+		}
+		return 0, nil, err
+	}
+	return n, remote, nil
+}
+
+func (u *UDPTransport) Send(b []byte, to net.Addr) error {
+	addr, ok := to.(*net.UDPAddr)
+	if !ok {
+		return errors.New("not a UDP address: " + to.String())
+	}
+	_, err := u.conn.WriteToUDP(b, addr)
+	return err
+}
+
+func (u *UDPTransport) StopReceiving() error {
+	u.stopping.Store(true)
+	return u.conn.SetReadDeadline(time.Now())
+}
+
+func (u *UDPTransport) Close() error {
+	return u.conn.Close()
+}
+
+func (u *UDPTransport) LocalAddr() net.Addr {
+	return u.conn.LocalAddr()
 }
@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func adminRequest(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func Test_adminHandler(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.Mode = Aggregating
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	conn := mt.Dial("client")
+	c := NewClient("c/1", mt, conn.LocalAddr())
+	c.connected(0)
+	ag.clients.AddClient(c)
+	id := ag.tIndex.putTopic("a/b")
+	c.Register(id, "a/b")
+	_, err = ag.tTree.AddSubscription(c, "a/b")
+	eok(err, t)
+	h := adminHandler{ag}
+
+	w := adminRequest(h, "GET", "/clients", "")
+	var infos []ClientInfo
+	eok(json.Unmarshal(w.Body.Bytes(), &infos), t)
+	if w.Code != http.StatusOK || len(infos) != 1 || infos[0].ClientId != "c/1" || infos[0].State != "active" {
+		t.Fatalf("GET /clients gave %d %s", w.Code, w.Body)
+	}
+
+	w = adminRequest(h, "GET", "/clients/c%2F1", "")
+	var info ClientInfo
+	eok(json.Unmarshal(w.Body.Bytes(), &info), t)
+	if info.Registrations[id] != "a/b" || len(info.Subscriptions) != 1 || info.Subscriptions[0] != "a/b" {
+		t.Fatalf("GET /clients/c%%2F1 gave %d %s", w.Code, w.Body)
+	}
+
+	w = adminRequest(h, "GET", "/topics/tree", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"a/b":["c/1"]`) {
+		t.Fatalf("GET /topics/tree gave %d %s", w.Code, w.Body)
+	}
+
+	if w = adminRequest(h, "GET", "/clients/c2", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET for an unknown client gave %d", w.Code)
+	}
+	if w = adminRequest(h, "GET", "/clients/c%2F1/publish", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET of publish gave %d", w.Code)
+	}
+	if w = adminRequest(h, "POST", "/clients/c%2F1/publish", `{"topic":"a/#"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("publish to a topic filter gave %d", w.Code)
+	}
+
+	b := make([]byte, 64)
+	w = adminRequest(h, "POST", "/clients/c%2F1/publish", `{"topic":"a/b","payload":"hi"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("publish gave %d %s", w.Code, w.Body)
+	}
+	n, err := conn.Read(b)
+	eok(err, t)
+	m, err := DecodePacket(b[:n])
+	eok(err, t)
+	if pm, ok := m.(*PublishMessage); !ok || pm.TopicId != id || string(pm.Data) != "hi" {
+		t.Fatalf("client got %v, expected a PUBLISH", m)
+	}
+
+	if w = adminRequest(h, "POST", "/clients/c%2F1/disconnect", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("disconnect gave %d %s", w.Code, w.Body)
+	}
+	n, err = conn.Read(b)
+	eok(err, t)
+	m, err = DecodePacket(b[:n])
+	eok(err, t)
+	if _, ok := m.(*DisconnectMessage); !ok || c.State() != Disconnected {
+		t.Fatalf("client got %v and is %v", m, c.State())
+	}
+	if w = adminRequest(h, "POST", "/clients/c%2F1/publish", `{"topic":"a/b"}`); w.Code != http.StatusConflict {
+		t.Fatalf("publish to a disconnected client gave %d", w.Code)
+	}
+}
+
+func Test_GatewayConfig_AdminAddress(t *testing.T) {
+	gc := NewGatewayConfig()
+	eok(gc.setOption("admin-listen", "unix:/run/gnatt/admin.sock"), t)
+	if gc.AdminAddress != "unix:/run/gnatt/admin.sock" {
+		t.Fatalf("AdminAddress was %q", gc.AdminAddress)
+	}
+}
+
+func Test_serveAdmin_unix(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	s, err := serveAdmin("unix:"+path, g)
+	eok(err, t)
+	defer s.stop(context.Background())
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://admin/clients")
+	eok(err, t)
+	defer resp.Body.Close()
+	var infos []ClientInfo
+	eok(json.NewDecoder(resp.Body).Decode(&infos), t)
+	if resp.StatusCode != http.StatusOK || len(infos) != 0 {
+		t.Fatalf("GET /clients gave %s, %v", resp.Status, infos)
+	}
+}
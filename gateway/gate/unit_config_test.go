@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_expandEnv(t *testing.T) {
+	t.Setenv("GNATT_HOST", "broker")
+	t.Setenv("GNATT_EMPTY", "")
+	for in, want := range map[string]string{
+		"tcp://${GNATT_HOST}:1883":       "tcp://broker:1883",
+		"${GNATT_EMPTY}":                 "",
+		"${GNATT_EMPTY:-x}${GNATT_HOST}": "xbroker",
+		"${GNATT_UNSET:-localhost}":      "localhost",
+		"no variables":                   "no variables",
+	} {
+		if got, err := expandEnv(in); err != nil || got != want {
+			t.Errorf("expandEnv(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := expandEnv("${GNATT_UNSET}"); !errors.Is(err, ErrUnsetVariable) {
+		t.Errorf("unset variable gave %v", err)
+	}
+	if _, err := expandEnv("${GNATT_HOST"); err != ErrUnterminatedVariable {
+		t.Errorf("unterminated variable gave %v", err)
+	}
+}
+
+func Test_parseTOML(t *testing.T) {
+	t.Setenv("GNATT_PASSWORD", "secret")
+	gc := NewGatewayConfig()
+	eok(gc.parseTOML(`
+mode = "aggregating"   # comments may follow values
+port = 1884
+protocol-versions = ["1.2"]
+
+[broker]
+uri = "tcp://localhost:1883"
+password = "${GNATT_PASSWORD}"
+user = '${NOT_EXPANDED}'
+
+[predefined-topics]
+1 = "a/#b"
+
+[qos-1]
+allow = [
+    "10.0.0.0/8", # the sensors
+    "192.168.1.20",
+]
+
+[presence]
+events = ["connect", "lost"]
+retain = true
+interval = 30
+
+[log]
+trace = ["c1", "c2"]
+`), t)
+	switch {
+	case gc.Mode != Aggregating || gc.ListenAddress != ":1884" || len(gc.ProtocolVersions) != 1:
+		t.Fatalf("top level options were %v %s %v", gc.Mode, gc.ListenAddress, gc.ProtocolVersions)
+	case gc.Broker.Password != "secret" || gc.Broker.Username != "${NOT_EXPANDED}":
+		t.Fatalf("Broker was %+v", gc.Broker)
+	case gc.PredefinedTopics[1] != "a/#b":
+		t.Fatalf("PredefinedTopics were %v", gc.PredefinedTopics)
+	case len(gc.QosMinusOneAllow) != 2:
+		t.Fatalf("QosMinusOneAllow was %v", gc.QosMinusOneAllow)
+	case len(gc.Presence.Events) != 2 || !gc.Presence.Retain || gc.Presence.StatsInterval != 30*time.Second:
+		t.Fatalf("Presence was %+v", gc.Presence)
+	case len(gc.Log.Trace) != 2:
+		t.Fatalf("Log was %+v", gc.Log)
+	}
+	eok(gc.Check(), t)
+}
+
+func Test_parseTOML_errors(t *testing.T) {
+	gc := NewGatewayConfig()
+	err := gc.parseTOML(`mode = "aggregating"
+[nowhere]
+uri = "x"
+[broker]
+uri = "tcp://a:1883"
+uri = "tcp://b:1883"
+password = ["a", "b"]
+colour = "blue"
+born = 1979-05-27
+[log]
+level = "loud"
+[[listener]]
+address = ":1883"
+`)
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("parseTOML gave %v", err)
+	}
+	want := []ConfigError{
+		{Line: 2, Key: "nowhere", Err: ErrUnknownConfigSection},
+		{Line: 6, Key: "broker.uri", Err: ErrDuplicateConfigOption},
+		{Line: 7, Key: "broker.password", Err: ErrUnexpectedList},
+		{Line: 8, Key: "broker.colour", Err: ErrUnknownConfigOption},
+		{Line: 9, Key: "broker.born", Err: ErrInvalidConfigValue},
+		{Line: 11, Key: "log.level", Err: ErrInvalidLogLevel},
+		{Line: 12, Key: "listener", Err: ErrUnknownConfigSection},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got:\n%v", len(want), err)
+	}
+	for i, p := range problems {
+		if p.Line != want[i].Line || p.Key != want[i].Key || p.Err != want[i].Err {
+			t.Errorf("problem %d was %v, not %v", i, p, want[i])
+		}
+	}
+	if !errors.Is(err, ErrUnknownConfigSection) {
+		t.Errorf("ConfigErrors should unwrap to each problem")
+	}
+
+	// what comes after a syntax error is not read
+	err = NewGatewayConfig().parseTOML("[nowhere]\n\nmode = aggregating\nport = 0\n")
+	if problems, ok = err.(ConfigErrors); !ok || len(problems) != 2 {
+		t.Fatalf("parseTOML gave %v", err)
+	}
+	if p := problems[1]; p.Line != 3 || !errors.Is(p, ErrInvalidTOML) {
+		t.Errorf("the syntax error was %v", p)
+	}
+}
+
+func Test_CheckConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gw.cfg")
+	eok(os.WriteFile(file, []byte("mode aggregating\nmtu 2\n\nbogus 1\nmqtt-broker tcp://localhost:1883\nport\n"), 0600), t)
+
+	if _, err := ParseConfigFile(file); err == nil {
+		t.Fatalf("ParseConfigFile should fail")
+	}
+	problems, ok := CheckConfigFile(file).(ConfigErrors)
+	if !ok || len(problems) != 3 {
+		t.Fatalf("CheckConfigFile gave %v", problems)
+	}
+	// in the order of the file, including the problem found by Check
+	for i, want := range []ConfigError{{file, 2, "mtu", ErrInvalidMTU}, {file, 4, "bogus", ErrUnknownConfigOption}, {file, 6, "port", ErrMissingValueForConfigOption}} {
+		if problems[i] != want {
+			t.Errorf("problem %d was %v, not %v", i, problems[i], want)
+		}
+	}
+	if problems[0].Error() != file+":2: mtu: MTU must be between 8 and 65535" {
+		t.Errorf("problem was described as %q", problems[0].Error())
+	}
+
+	eok(os.WriteFile(file, []byte("mode aggregating\nmqtt-broker tcp://localhost:1883\n"), 0600), t)
+	eok(CheckConfigFile(file), t)
+}
@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+)
+
+// Start a DTLS transport on loopback and connect a client to it.
+func dtlsPair(t *testing.T, dc *DTLSConfig, client *dtls.Config) (*DTLSTransport, *dtls.Conn) {
+	server, err := dc.dtlsConfig()
+	eok(err, t)
+	dt := NewDTLSTransport("127.0.0.1:0", server)
+	eok(dt.Listen(), t)
+	conn, err := dtls.Dial("udp", dt.LocalAddr().(*net.UDPAddr), client)
+	if err != nil {
+		dt.Close()
+		t.Fatalf("Dial: %v", err)
+	}
+	return dt, conn
+}
+
+// Send one packet each way across the transport.
+func dtlsExchange(dt *DTLSTransport, conn *dtls.Conn, t *testing.T) net.Addr {
+	_, err := conn.Write([]byte{0x02, 0x16})
+	eok(err, t)
+	b := make([]byte, 16)
+	n, from, err := dt.Receive(b)
+	eok(err, t)
+	if n != 2 || b[1] != 0x16 {
+		t.Fatalf("gateway got % x", b[:n])
+	}
+	eok(dt.Send([]byte{0x02, 0x17}, from), t)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(b)
+	eok(err, t)
+	if n != 2 || b[1] != 0x17 {
+		t.Fatalf("client got % x", b[:n])
+	}
+	return from
+}
+
+func Test_DTLSTransport_Certificate(t *testing.T) {
+	cert, err := selfsign.GenerateSelfSignedWithDNS("localhost")
+	eok(err, t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	eok(err, t)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	dt, conn := dtlsPair(t, &DTLSConfig{Certificates: []tls.Certificate{cert}}, &dtls.Config{
+		RootCAs:              roots,
+		ServerName:           "localhost",
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	defer dt.Close()
+	defer conn.Close()
+
+	from := dtlsExchange(dt, conn, t)
+	if id, ok := dt.PeerIdentity(from); ok {
+		t.Fatalf("certificate client has identity %q", id)
+	}
+	if _, ok := checkIdentity(dt, from, []byte("anyone")); !ok {
+		t.Fatalf("certificate client refused its ClientId")
+	}
+}
+
+func Test_DTLSTransport_PSK(t *testing.T) {
+	dc := &DTLSConfig{PSK: map[string][]byte{"sensor1": {0xAB, 0xC1, 0x23}}}
+	dt, conn := dtlsPair(t, dc, &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return []byte{0xAB, 0xC1, 0x23}, nil
+		},
+		PSKIdentityHint:      []byte("sensor1"),
+		CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	defer dt.Close()
+	defer conn.Close()
+
+	from := dtlsExchange(dt, conn, t)
+	if id, ok := dt.PeerIdentity(from); !ok || id != "sensor1" {
+		t.Fatalf("PSK client has identity %q", id)
+	}
+	if _, ok := checkIdentity(dt, from, []byte("sensor1")); !ok {
+		t.Fatalf("PSK client refused its own ClientId")
+	}
+	if _, ok := checkIdentity(dt, from, []byte("sensor2")); ok {
+		t.Fatalf("PSK client allowed another ClientId")
+	}
+	if id, ok := checkIdentity(dt, from, nil); !ok || string(id) != "sensor1" {
+		t.Fatalf("PSK client without ClientId got %q", id)
+	}
+}
+
+func Test_DTLSTransport_UnknownPSK(t *testing.T) {
+	dc := &DTLSConfig{PSK: map[string][]byte{"sensor1": {0x01}}, HandshakeTimeout: time.Second}
+	server, err := dc.dtlsConfig()
+	eok(err, t)
+	dt := NewDTLSTransport("127.0.0.1:0", server)
+	eok(dt.Listen(), t)
+	defer dt.Close()
+
+	_, err = dtls.Dial("udp", dt.LocalAddr().(*net.UDPAddr), &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return []byte{0x01}, nil
+		},
+		PSKIdentityHint: []byte("intruder"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), time.Second)
+		},
+	})
+	enok(err, t)
+}
+
+func Test_DTLSConfig_parse(t *testing.T) {
+	gc := NewGatewayConfig()
+	eok(gc.parseConfig("transport dtls\ndtls-psk sensor1:0a0b0c\nmqtt-broker tcp://localhost:1883\n"), t)
+	if string(gc.DTLS.PSK["sensor1"]) != "\x0a\x0b\x0c" {
+		t.Fatalf("PSK was % x", gc.DTLS.PSK["sensor1"])
+	}
+	eok(gc.Validate(), t)
+
+	enok(gc.setOption("dtls-psk", "sensor2:xyz"), t)
+	enok(gc.setOption("dtls-psk", "nokey"), t)
+
+	gc = NewGatewayConfig()
+	gc.Network = "dtls"
+	gc.Broker.URI = "tcp://localhost:1883"
+	if gc.Validate() != ErrInvalidDTLSConfig {
+		t.Fatalf("DTLS without keys should not validate")
+	}
+	gc.DTLS.CertFile = "gateway.pem"
+	if gc.Validate() != ErrInvalidDTLSConfig {
+		t.Fatalf("DTLS certificate without key should not validate")
+	}
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_eventHub(t *testing.T) {
+	h := newEventHub()
+	events, stop := h.watch(64)
+	c := NewClient("c1", uConn{}, uAddr{})
+	h.emit(newEvent(EventConnect, c, "", ""))
+	if e := <-events; e.Type != EventConnect || e.ClientId != "c1" || e.Address != "none" {
+		t.Fatalf("watcher got %+v", e)
+	}
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatalf("stopped watch was not closed")
+	}
+	// a watcher that doesn't keep up doesn't hold up emit
+	_, stop = h.watch(64)
+	for i := 0; i < 100; i++ {
+		h.emit(newEvent(EventPublish, c, "a", ""))
+	}
+	stop()
+
+	events, _ = h.watch(64)
+	h.close()
+	if _, ok := <-events; ok {
+		t.Fatalf("watch was not closed with the hub")
+	}
+	if _, ok := <-func() <-chan Event { e, _ := h.watch(64); return e }(); ok {
+		t.Fatalf("watch of a closed hub was not closed")
+	}
+}
+
+func Test_adminHandler_events(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	s := httptest.NewServer(adminHandler{g})
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/events?client=c2")
+	eok(err, t)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /events gave %s", resp.Status)
+	}
+	g.events.emit(newEvent(EventConnect, NewClient("c1", uConn{}, uAddr{}), "", ""))
+	g.events.emit(newEvent(EventSubscribe, NewClient("c2", uConn{}, uAddr{}), "a/b", qosDetail(1)))
+	g.events.close()
+
+	lines := bufio.NewScanner(resp.Body)
+	var got []Event
+	for lines.Scan() {
+		var e Event
+		eok(json.Unmarshal(lines.Bytes(), &e), t)
+		got = append(got, e)
+	}
+	if len(got) != 1 || got[0].ClientId != "c2" || got[0].Topic != "a/b" || got[0].Detail != "qos 1" {
+		t.Fatalf("events for c2 were %+v", got)
+	}
+}
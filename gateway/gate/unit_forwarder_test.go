@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_forwardingTransport_Send(t *testing.T) {
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	fwd := mt.Dial("forwarder")
+
+	ft := forwardingTransport{mt}
+	node := NewForwardedAddr(fwd.LocalAddr(), []byte{0x01, 0x02})
+	if node.String() != "forwarder/0102" {
+		t.Fatalf("forwarded address is %q", node)
+	}
+	eok(ft.Send([]byte{0x02, PINGRESP}, node), t)
+
+	b := make([]byte, 16)
+	n, err := fwd.Read(b)
+	eok(err, t)
+	expected := []byte{0x05, ENCAPSULATED, 0x00, 0x01, 0x02, 0x02, PINGRESP}
+	if !bytes.Equal(b[:n], expected) {
+		t.Fatalf("forwarder got % x", b[:n])
+	}
+
+	// peers that are not behind a forwarder are sent to directly
+	eok(ft.Send([]byte{0x02, PINGRESP}, fwd.LocalAddr()), t)
+	n, err = fwd.Read(b)
+	eok(err, t)
+	if n != 2 {
+		t.Fatalf("direct peer got % x", b[:n])
+	}
+}
+
+func Test_TGateway_OnPacket_encapsulated(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.MaxClients = 1
+	g, err := NewTGateway(gc)
+	eok(err, t)
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	fwd := mt.Dial("forwarder")
+
+	// a client that is refused gets its CONNACK through the forwarder
+	g.clients.AddClient(NewClient("other", uConn{}, uAddr{}))
+	var connect bytes.Buffer
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte("node1")
+	eok(NewEncapsulatedMessage(0x00, []byte("n1"), cm).Write(&connect), t)
+	g.OnPacket(connect.Len(), connect.Bytes(), mt, fwd.LocalAddr())
+
+	b := make([]byte, 16)
+	n, err := fwd.Read(b)
+	eok(err, t)
+	_, node, inner, err := Decapsulate(b[:n])
+	eok(err, t)
+	if string(node) != "n1" || len(inner) != 3 || inner[1] != CONNACK || inner[2] != REJ_CONGESTION {
+		t.Fatalf("forwarder got % x", b[:n])
+	}
+
+	// packets that can't be decoded are dropped
+	g.OnPacket(2, []byte{0x02, 0x03}, mt, fwd.LocalAddr())
+	g.OnPacket(4, []byte{0x03, ENCAPSULATED, 0x00, 0x00}, mt, fwd.LocalAddr())
+}
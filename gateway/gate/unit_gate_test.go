@@ -1,8 +1,13 @@
 package gateway
 
 import (
+	"fmt"
+	"net"
 	"sync"
 	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
 )
 
 func new_topicNames() *topicNames {
@@ -91,3 +96,210 @@ func Test_topicName_get(t *testing.T) {
 		t.Errorf("topicName assigned same topic id to different topics")
 	}
 }
+
+func Test_TGateway_OnPacket_invalid(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.MaxClients = 1
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	g.clients.AddClient(NewClient("other", uConn{}, uAddr{}))
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	c := mt.Dial("client")
+
+	// an invalid protocol id gets no CONNACK at all
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte("c1")
+	cm.ProtocolId = 0x00
+	g.OnPacket(cm.Size(), cm.AppendTo(nil), mt, c.LocalAddr())
+	cm.ProtocolId = 0x01
+	g.OnPacket(cm.Size(), cm.AppendTo(nil), mt, c.LocalAddr())
+
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	eok(err, t)
+	m, err := DecodePacket(b[:n])
+	eok(err, t)
+	if ca, ok := m.(*ConnackMessage); !ok || ca.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("client got %v, expected the CONNACK for the valid CONNECT", m)
+	}
+}
+
+func Test_TGateway_CONNECT_version(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("protocol-versions", "1.2"), t)
+	g, err := NewTGateway(gc)
+	eok(err, t)
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	c := mt.Dial("client")
+
+	cm := &ConnectMessage{ProtocolId: VERSION_2_0, SessionExpiry: 60, ClientId: []byte("c1")}
+	g.OnPacket(cm.Size(), cm.AppendTo(nil), mt, c.LocalAddr())
+
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	eok(err, t)
+	m, err := DecodePacket(b[:n])
+	eok(err, t)
+	ca, ok := m.(*ConnackMessage)
+	if !ok || ca.Version != VERSION_2_0 || ca.ReturnCode != RC_UNSUPPORTED_VERSION || ca.SessionExpiry != 0 {
+		t.Fatalf("client got %v, expected a v2.0 CONNACK refusing the version", m)
+	}
+	if g.clients.Len() != 0 {
+		t.Fatalf("refused client was added")
+	}
+}
+
+func Test_GatewayConfig_ProtocolVersions(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("protocol-versions", "2.0,1.2"), t)
+	if string(gc.ProtocolVersions) != string([]byte{VERSION_2_0, VERSION_1_2}) {
+		t.Fatalf("ProtocolVersions was %v", gc.ProtocolVersions)
+	}
+	eok(gc.Validate(), t)
+	enok(gc.setOption("protocol-versions", "1.3"), t)
+	gc.ProtocolVersions = nil
+	if gc.Validate() != ErrInvalidProtocolVersion {
+		t.Fatalf("no protocol versions should not validate")
+	}
+}
+
+func Test_publishTopic_alias(t *testing.T) {
+	topics := new_topicNames()
+	id := topics.putTopic("a/b")
+	v1 := NewClient("v1", uConn{}, uAddr{})
+	v2 := NewClient("v2", uConn{}, uAddr{})
+	v2.Version = VERSION_2_0
+
+	pm := NewPublishMessage(id, 0x00, nil, 0, 0, false, false)
+	if publishTopic(pm, v1, topics, newPredefinedTopics(nil)) != "a/b" {
+		t.Fatalf("v1.2 topic ids are shared by every client")
+	}
+	if publishTopic(pm, v2, topics, newPredefinedTopics(nil)) != "" {
+		t.Fatalf("v2.0 topic alias used without registering it")
+	}
+	v2.Register(id, "a/b")
+	if publishTopic(pm, v2, topics, newPredefinedTopics(nil)) != "a/b" {
+		t.Fatalf("registered topic alias not resolved")
+	}
+	full := &PublishMessage{TopicIdType: 0x03, TopicName: []byte("c/d")}
+	if publishTopic(full, v2, topics, newPredefinedTopics(nil)) != "c/d" {
+		t.Fatalf("full topic name not resolved")
+	}
+	if publishTopic(full, v1, topics, newPredefinedTopics(nil)) != "" {
+		t.Fatalf("v1.2 client named a topic in full")
+	}
+}
+
+// A v2.0 client resuming its session takes over the Client it had,
+// while others may be reading its version.
+func Test_AGateway_resume_version(t *testing.T) {
+	ag, _, sc := startRegisterGateway(t, NewGatewayConfig())
+	client := ag.clients.GetClient(MemoryAddr("c1")).(*Client)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			client.info()
+			disconnectFor(client, ACCEPTED)
+		}
+	}()
+	sc.send(&ConnectMessage{ProtocolId: VERSION_2_0, SessionExpiry: 60, ClientId: []byte("c1")})
+	if ca, ok := sc.read().(*ConnackMessage); !ok || ca.ReturnCode != ACCEPTED {
+		t.Fatalf("CONNECT was answered with %v", ca)
+	}
+	<-done
+	if ag.clients.GetClient(MemoryAddr("c1")) != SNClient(client) || client.version() != VERSION_2_0 {
+		t.Fatalf("the session was not resumed as v2.0")
+	}
+}
+
+func Test_addrList_contains(t *testing.T) {
+	l := newAddrList([]string{"10.0.0.0/8", "192.168.1.7", "fd00::/8", "radio"})
+	for addr, allowed := range map[net.Addr]bool{
+		&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1883}:     true,
+		&net.UDPAddr{IP: net.ParseIP("192.168.1.7"), Port: 40000}: true,
+		&net.UDPAddr{IP: net.ParseIP("192.168.1.8"), Port: 40000}: false,
+		&net.UDPAddr{IP: net.ParseIP("fd12::1"), Port: 1883}:      true,
+		uAddr{}: false,
+		NewForwardedAddr(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, []byte{0x01}): true,
+		NewForwardedAddr(MemoryAddr("radio"), []byte{0x01}):                       true,
+	} {
+		if l.contains(addr) != allowed {
+			t.Fatalf("contains(%v) should be %v", addr, allowed)
+		}
+	}
+	if !newAddrList(nil).contains(uAddr{}) {
+		t.Fatalf("an empty list should allow every address")
+	}
+}
+
+func Test_TGateway_PUBLISH_unconnected(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("qos-1-allow", "10.0.0.0/8"), t)
+	enok(gc.setOption("qos-1-mqtt-qos", "3"), t)
+	g, err := NewTGateway(gc)
+	eok(err, t)
+
+	// neither reaches the broker, and an unknown address doesn't panic
+	from := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1883}
+	g.handle_PUBLISH(NewPublishMessage(1, 0x01, []byte("x"), QOS_MINUS_ONE, 0, false, false), uConn{}, from)
+	g.handle_PUBLISH(NewPublishMessage(1, 0x01, []byte("x"), 1, 1, false, false), uConn{}, from)
+	if g.conn != nil {
+		t.Fatalf("QoS -1 PUBLISH from a source not allowed was published")
+	}
+}
+
+// CONNECTs waiting on AUTH are capped, expire, and are forgotten when
+// their address CONNECTs again.
+func Test_TGateway_pendingAuth(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("protocol-versions", "2.0"), t)
+	g, err := NewTGateway(gc)
+	eok(err, t)
+
+	now := time.Now()
+	for i := 0; i < maxPendingAuth; i++ {
+		if !g.holdForAuth(&ConnectMessage{}, MemoryAddr(fmt.Sprint(i)), now) {
+			t.Fatalf("CONNECT %d was refused", i)
+		}
+	}
+	if g.holdForAuth(&ConnectMessage{}, MemoryAddr("one more"), now) {
+		t.Fatalf("more than %d CONNECTs were held", maxPendingAuth)
+	}
+	later := now.Add(authTimeout + time.Second)
+	if !g.holdForAuth(&ConnectMessage{}, MemoryAddr("one more"), later) {
+		t.Fatalf("expired CONNECTs were not dropped to make room")
+	}
+	if len(g.pendingAuth) != 1 {
+		t.Fatalf("%d CONNECTs still held", len(g.pendingAuth))
+	}
+	if _, ok := g.takeAuth(MemoryAddr("one more"), later.Add(authTimeout+time.Second)); ok {
+		t.Fatalf("an expired CONNECT was authenticated")
+	}
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	c := mt.Dial("client")
+	cm := &ConnectMessage{ProtocolId: VERSION_2_0, Auth: true, ClientId: []byte("c1")}
+	g.OnPacket(cm.Size(), cm.AppendTo(nil), mt, c.LocalAddr())
+	if len(g.pendingAuth) != 1 {
+		t.Fatalf("the CONNECT was not held for its AUTH")
+	}
+	cm = &ConnectMessage{ProtocolId: VERSION_1_2, ClientId: []byte("c1")}
+	g.OnPacket(cm.Size(), cm.AppendTo(nil), mt, c.LocalAddr())
+	if _, ok := g.takeAuth(c.LocalAddr(), time.Now()); ok {
+		t.Fatalf("a refused CONNECT left the one before it waiting on AUTH")
+	}
+}
@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A Transport that can't listen.
+type deafConn struct{ uConn }
+
+func (deafConn) Listen() error { return errors.New("deaf") }
+
+// A gateway whose Start failed can still be shut down, as often as
+// the caller likes.
+func Test_Shutdown_failed_Start(t *testing.T) {
+	for _, mode := range []Mode{Aggregating, Transparent} {
+		gc := NewGatewayConfig()
+		gc.Mode = mode
+		gc.Broker.URI = "tcp://localhost:1883"
+		if mode == Aggregating {
+			gc.Upstream = &stubUpstream{}
+		}
+		gc.Transport = deafConn{}
+		g, err := New(gc)
+		eok(err, t)
+		enok(g.Start(context.Background()), t)
+		eok(g.Shutdown(context.Background()), t)
+		eok(g.Shutdown(context.Background()), t)
+	}
+}
+
+// slowUpstream holds each Publish until it is released.
+type slowUpstream struct {
+	stubUpstream
+	publishing chan string
+	release    chan struct{}
+}
+
+func (u *slowUpstream) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	u.publishing <- topic
+	<-u.release
+	return nil
+}
+
+// Shutdown waits for the packets already received to be handled before
+// it tells the clients the gateway is going.
+func Test_AGateway_Shutdown_drain(t *testing.T) {
+	up := &slowUpstream{publishing: make(chan string, 1), release: make(chan struct{})}
+	gc := NewGatewayConfig()
+	gc.Mode = Aggregating
+	gc.Upstream = up
+	mt := NewMemoryTransport("gw")
+	gc.Transport = mt
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+	eok(ag.Start(context.Background()), t)
+
+	sc := snClient{t, mt.Dial("c1")}
+	sc.send(&ConnectMessage{ProtocolId: VERSION_1_2, ClientId: []byte("c1")})
+	sc.read()
+	sc.send(&RegisterMessage{MessageId: 1, TopicName: []byte("a/b")})
+	ra := sc.read().(*RegackMessage)
+	sc.send(NewPublishMessage(ra.TopicId, 0x00, []byte("1"), 0, 0, false, false))
+	if topic := <-up.publishing; topic != "a/b" {
+		t.Fatalf("published to %s", topic)
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- ag.Shutdown(context.Background()) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Shutdown returned %v while a PUBLISH was being handled", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if m := sc.readWithin(10 * time.Millisecond); m != nil {
+		t.Fatalf("client was sent %v before the PUBLISH was handled", m)
+	}
+	close(up.release)
+	eok(<-stopped, t)
+	if _, ok := sc.read().(*DisconnectMessage); !ok {
+		t.Fatalf("client was not sent a DISCONNECT")
+	}
+}
+
+// Only the clients still connected are sent a DISCONNECT, once however
+// often Shutdown is called.
+func Test_AGateway_Shutdown_disconnect(t *testing.T) {
+	gc := NewGatewayConfig()
+	ag, _, active := startRegisterGateway(t, gc)
+	gone := snClient{t, gc.Transport.(*MemoryTransport).Dial("c2")}
+	gone.send(&ConnectMessage{ProtocolId: VERSION_1_2, ClientId: []byte("c2")})
+	gone.read()
+	gone.send(&DisconnectMessage{})
+	gone.read()
+
+	eok(ag.Shutdown(context.Background()), t)
+	if _, ok := active.read().(*DisconnectMessage); !ok {
+		t.Fatalf("the connected client was not sent a DISCONNECT")
+	}
+	if m := gone.readWithin(50 * time.Millisecond); m != nil {
+		t.Fatalf("the disconnected client was sent %v", m)
+	}
+	eok(ag.Shutdown(context.Background()), t)
+	if m := active.readWithin(50 * time.Millisecond); m != nil {
+		t.Fatalf("a second Shutdown sent %v", m)
+	}
+}
+
+// Validate returns the first problem with a config.
+func Test_GatewayConfig_Validate(t *testing.T) {
+	for _, c := range []struct {
+		set func(gc *GatewayConfig)
+		err error
+	}{
+		{func(gc *GatewayConfig) {}, nil},
+		{func(gc *GatewayConfig) { gc.Mode = 7 }, ErrInvalidModeSpecified},
+		{func(gc *GatewayConfig) { gc.Network = "smoke" }, ErrInvalidNetwork},
+		{func(gc *GatewayConfig) { gc.ListenAddress = "nowhere:port" }, ErrInvalidListenAddress},
+		{func(gc *GatewayConfig) { gc.Network = "serial" }, ErrInvalidSerialDevice},
+		{func(gc *GatewayConfig) { gc.Broker.URI = "localhost:1883" }, ErrNoTransportSpecified},
+		{func(gc *GatewayConfig) { gc.Broker.KeepAlive = -1 }, ErrNegativeValue},
+		{func(gc *GatewayConfig) { gc.Upstream = &stubUpstream{} }, ErrUpstreamNotAggregating},
+		{func(gc *GatewayConfig) { gc.PredefinedTopics[0] = "a/b" }, ErrInvalidPredefinedTopicId},
+		{func(gc *GatewayConfig) { gc.MaxClients = -1 }, ErrNegativeValue},
+		{func(gc *GatewayConfig) { gc.RegisterRetries = -1 }, ErrNegativeValue},
+		{func(gc *GatewayConfig) { gc.RegisterTimeout = 0 }, ErrNotPositive},
+		{func(gc *GatewayConfig) { gc.QosMinusOneMQTTQos = 3 }, ErrInvalidQos},
+		{func(gc *GatewayConfig) { gc.Presence.StatsInterval = -time.Second }, ErrNegativeValue},
+	} {
+		gc := NewGatewayConfig()
+		gc.Broker.URI = "tcp://localhost:1883"
+		c.set(gc)
+		if err := gc.Validate(); err != c.err {
+			t.Errorf("%+v validated with %v, expected %v", gc, err, c.err)
+		}
+		if _, err := New(gc); err != c.err {
+			t.Errorf("New gave %v, expected %v", err, c.err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_covers(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a/+", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a/#", false},
+		{"a/+/c", "a/+/c", true},
+		{"a/b", "a/+", false},
+		{"#", "anything/at/all", true},
+	} {
+		if got := covers(c.filter, c.topic); got != c.want {
+			t.Errorf("covers(%q, %q) = %v", c.filter, c.topic, got)
+		}
+	}
+}
+
+func Test_parseConfig_listeners(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.parseConfig(`listener radio1:0.0.0.0:1883
+listener radio2:[::]:1884
+listener-network radio2:udp6
+listener-multicast radio2:ff02::1
+listener-interface radio2:wlan0
+listener-advertise radio2:900
+listener-gateway-id radio2:2
+listener-mount radio2:radio2/
+listener-acl radio2:sensors
+acl-allow sensors:fe80::/10
+acl-publish sensors:sensors/#
+acl-subscribe sensors:cmd/+
+`), t)
+	if len(gc.Listeners) != 2 {
+		t.Fatalf("Listeners were %+v", gc.Listeners)
+	}
+	if l := gc.Listeners[0]; l.Name != "radio1" || l.Network != "udp" || l.Address != "0.0.0.0:1883" || l.GatewayId != 1 {
+		t.Fatalf("radio1 was %+v", l)
+	}
+	l := gc.Listeners[1]
+	if l.Network != "udp6" || l.Address != "[::]:1884" || l.Multicast != "ff02::1" || l.Interface != "wlan0" ||
+		l.Advertise != 900*time.Second || l.GatewayId != 2 || l.Mount != "radio2/" || l.ACL != "sensors" {
+		t.Fatalf("radio2 was %+v", l)
+	}
+	if acl := gc.ACLs["sensors"]; len(acl.Allow) != 1 || len(acl.Publish) != 1 || len(acl.Subscribe) != 1 {
+		t.Fatalf("ACLs were %+v", gc.ACLs)
+	}
+	eok(gc.Check(), t)
+
+	enok(gc.setOption("listener", "no-address"), t)
+	enok(gc.setOption("listener-gateway-id", "radio1:256"), t)
+	enok(gc.setOption("acl-publish", ":a/b"), t)
+}
+
+func Test_GatewayConfig_listener_problems(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.Listeners = []ListenerConfig{
+		{Name: "a", Network: "tcp", Address: "localhost:1883", Multicast: "ff02::1"},
+		{Name: "b", Network: "udp", Address: ":1884", Multicast: "10.0.0.1", Mount: "a/#", ACL: "nobody"},
+		{Name: "c", Network: "udp", Address: ":1885", Advertise: time.Minute},
+		{Name: "c", Network: "sctp", Address: ":1886"},
+	}
+	gc.ACLs = map[string]ACLProfile{"bad": {Subscribe: []string{"a/#/b"}}}
+	want := map[string]bool{"listener": true, "listener-network": true, "listener-multicast": true,
+		"listener-mount": true, "listener-acl": true, "listener-advertise": true, "acl-subscribe": true}
+	found := make(map[string]bool)
+	for _, p := range gc.problems() {
+		if !want[p.Key] {
+			t.Errorf("unexpected problem %v", p)
+		}
+		found[p.Key] = true
+	}
+	if len(found) != len(want) {
+		t.Errorf("found problems with %v, not %v", found, want)
+	}
+
+	for _, d := range []time.Duration{time.Second / 2, 0x10000 * time.Second} {
+		gc.Listeners = []ListenerConfig{{Name: "a", Network: "udp", Address: ":1884", Multicast: "ff02::1", Advertise: d}}
+		gc.ACLs = nil
+		if p := gc.problems(); len(p) != 1 || p[0].Err != ErrInvalidAdvertise {
+			t.Errorf("Advertise %v gave %v", d, p)
+		}
+	}
+}
+
+func Test_parseTOML_listeners(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.parseTOML(`
+[listener.radio1]
+address = "[::1]:1883"
+network = "udp6"
+gateway-id = 7
+mount = "radio1"
+
+[acl.sensors]
+allow = ["10.0.0.0/8", "192.168.0.0/16"]
+publish = ["sensors/#"]
+
+[listener.radio2]
+address = ":1884"
+acl = "sensors"
+`), t)
+	if len(gc.Listeners) != 2 || gc.Listeners[0].GatewayId != 7 || gc.Listeners[0].Mount != "radio1" || gc.Listeners[1].ACL != "sensors" {
+		t.Fatalf("Listeners were %+v", gc.Listeners)
+	}
+	if len(gc.ACLs["sensors"].Allow) != 2 {
+		t.Fatalf("ACLs were %+v", gc.ACLs)
+	}
+	eok(gc.Check(), t)
+
+	err := NewGatewayConfig().parseTOML("[listener]\naddress = \":1\"\n[listener.x]\ncolour = \"blue\"\n")
+	problems, ok := err.(ConfigErrors)
+	if !ok || len(problems) != 2 || problems[0].Err != ErrUnknownConfigSection || problems[1].Err != ErrUnknownConfigOption {
+		t.Fatalf("parseTOML gave %v", err)
+	}
+}
+
+func Test_publishTopic_mount(t *testing.T) {
+	e := newEndpoint(ListenerConfig{Name: "radio1", Mount: "radio1"}, map[string]ACLProfile{})
+	client := NewClient("c1", listenerTransport{uConn{}, e}, uAddr{})
+	tIndex := new_topicNames()
+	predefined := newPredefinedTopics(map[uint16]string{1: "a/b"})
+
+	for _, c := range []struct {
+		m    *PublishMessage
+		want string
+	}{
+		{NewPublishMessage(1, 0x01, nil, 0, 0, false, false), "radio1/a/b"},
+		// v1.2 reserves full topic names
+		{&PublishMessage{TopicIdType: 0x03, TopicName: []byte("x/y")}, ""},
+		{NewPublishMessage(tIndex.putTopic("radio1/t"), 0x00, nil, 0, 0, false, false), "radio1/t"},
+		// registered by a client of another listener
+		{NewPublishMessage(tIndex.putTopic("radio2/t"), 0x00, nil, 0, 0, false, false), ""},
+	} {
+		if got := publishTopic(c.m, client, tIndex, predefined); got != c.want {
+			t.Errorf("publishTopic(%v) = %q, not %q", c.m, got, c.want)
+		}
+	}
+	v2 := NewClient("c2", listenerTransport{uConn{}, e}, uAddr{})
+	v2.Version = VERSION_2_0
+	full := &PublishMessage{TopicIdType: 0x03, TopicName: []byte("x/y")}
+	if got := publishTopic(full, v2, tIndex, predefined); got != "radio1/x/y" {
+		t.Errorf("publishTopic(%v) = %q, not %q", full, got, "radio1/x/y")
+	}
+	if topic, ok := e.clientTopic("radio1/a/b"); !ok || topic != "a/b" {
+		t.Errorf("clientTopic gave %q, %v", topic, ok)
+	}
+}
+
+func Test_endpoint_ACL(t *testing.T) {
+	acls := map[string]ACLProfile{"sensors": {
+		Allow:     []string{"10.0.0.0/8"},
+		Publish:   []string{"sensors/#"},
+		Subscribe: []string{"cmd/+"},
+	}}
+	e := newEndpoint(ListenerConfig{Mount: "radio1", ACL: "sensors"}, acls)
+	if !e.mayPublish("radio1/sensors/t") || e.mayPublish("radio1/cmd/t") || e.mayPublish("sensors/t") {
+		t.Errorf("mayPublish doesn't follow the profile")
+	}
+	if !e.maySubscribe("radio1/cmd/+") || e.maySubscribe("radio1/cmd/#") || e.maySubscribe("radio1/#") {
+		t.Errorf("maySubscribe doesn't follow the profile")
+	}
+
+	c := listenerTransport{uConn{}, e}
+	inside := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1883}
+	outside := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1883}
+	if !checkListener(c, inside) || checkListener(c, outside) {
+		t.Errorf("checkListener doesn't follow the profile")
+	}
+	// QoS -1 PUBLISHes are held to the profile too
+	predefined := newPredefinedTopics(map[uint16]string{1: "sensors/t", 2: "other"})
+	all := newAddrList(nil)
+	pm := NewPublishMessage(1, 0x01, nil, QOS_MINUS_ONE, 0, false, false)
+	if topic := qosMinusOneTopic(pm, c, inside, all, predefined); topic != "radio1/sensors/t" {
+		t.Errorf("QoS -1 PUBLISH was to %q", topic)
+	}
+	if topic := qosMinusOneTopic(pm, c, outside, all, predefined); topic != "" {
+		t.Errorf("QoS -1 PUBLISH from outside the profile was to %q", topic)
+	}
+	pm.TopicId = 2
+	if topic := qosMinusOneTopic(pm, c, inside, all, predefined); topic != "" {
+		t.Errorf("QoS -1 PUBLISH outside the profile's topics was to %q", topic)
+	}
+}
+
+// Each listener answers SEARCHGW as a gateway of its own, and holds
+// its clients to its own ACL profile.
+func Test_TGateway_listeners(t *testing.T) {
+	radio1, radio2 := NewMemoryTransport("radio1"), NewMemoryTransport("radio2")
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.Listeners = []ListenerConfig{
+		{Name: "radio1", GatewayId: 1, Transport: radio1},
+		{Name: "radio2", GatewayId: 2, Transport: radio2, ACL: "known"},
+	}
+	gc.ACLs = map[string]ACLProfile{"known": {Allow: []string{"sensor"}}}
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	eok(g.Start(context.Background()), t)
+	defer g.Shutdown(context.Background())
+	if g.Addr() != MemoryAddr("radio1") {
+		t.Fatalf("Addr was %v", g.Addr())
+	}
+
+	read := func(c *MemoryConn) Message {
+		b := make([]byte, 16)
+		n, err := c.Read(b)
+		eok(err, t)
+		m, err := DecodePacket(b[:n])
+		eok(err, t)
+		return m
+	}
+	search := NewMessage(SEARCHGW).(*SearchGwMessage)
+	search.Radius = 1
+	for id, mt := range map[byte]*MemoryTransport{1: radio1, 2: radio2} {
+		c := mt.Dial("searcher")
+		_, err = c.Write(search.AppendTo(nil))
+		eok(err, t)
+		if gi, ok := read(c).(*GwInfoMessage); !ok || gi.GatewayId != id {
+			t.Errorf("SEARCHGW on listener %d was answered with %v", id, gi)
+		}
+	}
+
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte("intruder")
+	c := radio2.Dial("intruder")
+	_, err = c.Write(cm.AppendTo(nil))
+	eok(err, t)
+	if ca, ok := read(c).(*ConnackMessage); !ok || ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("CONNECT from outside the profile was answered with %v", ca)
+	}
+	if g.clients.Len() != 0 {
+		t.Fatalf("refused client was added")
+	}
+}
+
+func Test_UDPTransport_udp6(t *testing.T) {
+	u := NewMulticastUDPTransport("udp6", "[::1]:0", "", "")
+	if err := u.Listen(); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer u.Close()
+	conn, err := net.DialUDP("udp6", nil, u.LocalAddr().(*net.UDPAddr))
+	eok(err, t)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	eok(err, t)
+	b := make([]byte, 16)
+	n, from, err := u.Receive(b)
+	eok(err, t)
+	if string(b[:n]) != "hello" || from.(*net.UDPAddr).IP.To4() != nil {
+		t.Fatalf("received %q from %v", b[:n], from)
+	}
+	if u.Group() != nil {
+		t.Fatalf("a transport without a group gave group %v", u.Group())
+	}
+}
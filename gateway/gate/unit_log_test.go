@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alsm/gnatt/logging"
+	. "github.com/alsm/gnatt/packets"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+func Test_GatewayConfig_Log(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("log-level", "debug"), t)
+	eok(gc.setOption("log-format", "json"), t)
+	eok(gc.setOption("log-trace", "c1"), t)
+	eok(gc.setOption("log-trace", "c2"), t)
+	if gc.setOption("log-level", "loud") != ErrInvalidLogLevel {
+		t.Fatalf("loud should not be a log level")
+	}
+	if gc.Log.Level != slog.LevelDebug || gc.Log.Format != "json" || len(gc.Log.Trace) != 2 {
+		t.Fatalf("Log was %+v", gc.Log)
+	}
+	eok(gc.Validate(), t)
+	gc.Log.Format = "xml"
+	if gc.Validate() != ErrInvalidLogFormat {
+		t.Fatalf("xml should not validate")
+	}
+}
+
+// The MQTT clients log through the gateway's logger, at its level.
+func Test_SetLogger_MQTT(t *testing.T) {
+	var out, errOut bytes.Buffer
+	defer SetLogger(logging.Discard)
+	defer logLevel.Set(slog.LevelInfo)
+	SetLogger(NewLogger(LogConfig{Level: slog.LevelWarn}, &out, &errOut))
+	MQTT.DEBUG.Println("quiet")
+	MQTT.WARN.Println("warned")
+	MQTT.CRITICAL.Println("failed")
+	if out.Len() != 0 || !strings.Contains(errOut.String(), "warned") || !strings.Contains(errOut.String(), "failed") {
+		t.Fatalf("the MQTT clients logged %q and %q", out.String(), errOut.String())
+	}
+}
+
+func Test_tracePackets(t *testing.T) {
+	var out bytes.Buffer
+	defer SetLogger(logging.Discard)
+	SetLogger(NewLogger(LogConfig{Format: "json", Trace: []string{"traced"}}, &out, io.Discard))
+	defer logging.Trace("traced", false)
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	clients := Clients{clients: make(map[string]SNClient)}
+	traced := NewClient("traced", mt, mt.Dial("traced").LocalAddr())
+	other := NewClient("other", mt, mt.Dial("other").LocalAddr())
+	clients.AddClient(traced)
+	clients.AddClient(other)
+
+	traceReceived(&clients, NewMessage(PINGREQ), other.Address)
+	eok(other.Write(NewMessage(PINGRESP)), t)
+	if out.Len() != 0 {
+		t.Fatalf("an untraced client was logged: %s", out.String())
+	}
+
+	traceReceived(&clients, NewPublishMessage(3, 0, []byte("x"), 0, 0, false, false), traced.Address)
+	eok(traced.Write(NewMessage(PINGRESP)), t)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", out.String())
+	}
+	var r map[string]interface{}
+	eok(json.Unmarshal([]byte(lines[0]), &r), t)
+	if r["msg"] != "received" || r[logging.ClientId] != "traced" || r[logging.MsgType] != "PUBLISH" || r[logging.TopicId] != float64(3) {
+		t.Fatalf("received record was %v", r)
+	}
+	eok(json.Unmarshal([]byte(lines[1]), &r), t)
+	if r["msg"] != "sent" || r[logging.MsgType] != "PINGRESP" {
+		t.Fatalf("sent record was %v", r)
+	}
+}
+
+func Test_adminHandler_trace(t *testing.T) {
+	h := adminHandler{}
+	defer logging.Trace("c/1", false)
+
+	if w := adminRequest(h, "PUT", "/trace/c%2F1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT /trace/c%%2F1 gave %d %s", w.Code, w.Body)
+	}
+	w := adminRequest(h, "GET", "/trace", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `["c/1"]` {
+		t.Fatalf("GET /trace gave %d %s", w.Code, w.Body)
+	}
+	if w := adminRequest(h, "POST", "/trace/c%2F1", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /trace/c%%2F1 gave %d", w.Code)
+	}
+	if w := adminRequest(h, "DELETE", "/trace/c%2F1", ""); w.Code != http.StatusNoContent || logging.IsTraced("c/1") {
+		t.Fatalf("DELETE /trace/c%%2F1 gave %d", w.Code)
+	}
+}
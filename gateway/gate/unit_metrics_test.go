@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_Metrics_packets(t *testing.T) {
+	m := newMetrics(nil)
+	pm := NewPublishMessage(1, 0x01, []byte("x"), 1, 1, false, false)
+	m.received(pm.AppendTo(nil))
+	m.received(pm.AppendTo(nil))
+	m.received([]byte{0x02})
+	ca := NewMessage(CONNACK).(*ConnackMessage)
+	m.sent(ca.AppendTo(nil), ca.ReturnCode)
+	ca.ReturnCode = REJ_CONGESTION
+	m.sent(ca.AppendTo(nil), ca.ReturnCode)
+	m.decodeError(ErrTruncated)
+	m.reject("state")
+
+	var b bytes.Buffer
+	_, err := m.WriteTo(&b)
+	eok(err, t)
+	for _, line := range []string{
+		`gnatt_packets_received_total{type="PUBLISH"} 2`,
+		`gnatt_packets_sent_total{type="CONNACK"} 2`,
+		`gnatt_return_codes_total{type="CONNACK",code="` + ReturnCodeNames[REJ_CONGESTION] + `"} 1`,
+		`gnatt_decode_errors_total{error="` + ErrTruncated.Error() + `"} 1`,
+		`gnatt_packets_rejected_total{reason="state"} 1`,
+		`gnatt_clients{state="active"} 0`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("metrics are missing %s", line)
+		}
+	}
+	if strings.Count(b.String(), "gnatt_return_codes_total{") != 1 {
+		t.Errorf("an accepted CONNACK was counted as a return code")
+	}
+}
+
+func Test_Metrics_clients(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	c := NewClient("c1", uConn{}, uAddr{})
+	c.connected(time.Minute)
+	g.clients.AddClient(c)
+	c.SendRegister(1, "a/b", time.Minute, 0)
+	c.AddPendingMessage(NewPublishMessage(1, 0x00, nil, 0, 0, false, false))
+	pms, rtt, ok := c.RegisterAcked(1, c.pendingRegisters[1].messageId, true)
+	chkb(ok, true, t)
+	if len(pms) != 1 || rtt < 0 {
+		t.Fatalf("RegisterAcked gave %d messages after %v", len(pms), rtt)
+	}
+	g.Metrics().registerRTT.observe(rtt)
+
+	var b bytes.Buffer
+	_, err = g.Metrics().WriteTo(&b)
+	eok(err, t)
+	for _, line := range []string{
+		`gnatt_clients{state="active"} 1`,
+		`gnatt_register_rtt_seconds_count 1`,
+		`gnatt_broker_links 0`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("metrics are missing %s", line)
+		}
+	}
+}
+
+func Test_serveMetrics(t *testing.T) {
+	s, err := serveMetrics("", newMetrics(nil))
+	eok(err, t)
+	if s != nil {
+		t.Fatalf("metrics served without an address")
+	}
+	eok(s.stop(context.Background()), t)
+
+	s, err = serveMetrics("127.0.0.1:0", newMetrics(nil))
+	eok(err, t)
+	defer s.stop(context.Background())
+	resp, err := http.Get("http://" + s.addr().String() + "/metrics")
+	eok(err, t)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("metrics request got %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+}
+
+func Test_countingTransport(t *testing.T) {
+	m := newMetrics(nil)
+	ct := countingTransport{uConn{}, m}
+	eok(ct.Send(NewMessage(PINGRESP).AppendTo(nil), uAddr{}), t)
+	if m.packetsOut.snapshot()[`type="PINGRESP"`] != 1 {
+		t.Fatalf("sent PINGRESP was not counted")
+	}
+	if _, ok := ct.PeerIdentity(uAddr{}); ok {
+		t.Fatalf("plain transport gave a peer identity")
+	}
+
+	// a client's messages have their return codes counted, through
+	// the listener's transport
+	c := NewClient("c1", listenerTransport{ct, defaultEndpoint}, uAddr{})
+	eok(c.Write(NewSubackMessage(0, 1, 0, REJ_INVALID_TID)), t)
+	eok(c.Write(NewSubackMessage(0, 2, 0, ACCEPTED)), t)
+	if m.packetsOut.snapshot()[`type="SUBACK"`] != 2 || m.returnCodes.snapshot()[`type="SUBACK",code="`+ReturnCodeNames[REJ_INVALID_TID]+`"`] != 1 || m.returnCodes.total() != 1 {
+		t.Fatalf("return codes were %v", m.returnCodes.snapshot())
+	}
+}
+
+func Benchmark_Metrics_sent(b *testing.B) {
+	m := newMetrics(nil)
+	packet := NewSubackMessage(0, 1, 0, ACCEPTED).AppendTo(nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.sent(packet, ACCEPTED)
+	}
+}
+
+func Test_GatewayConfig_MetricsAddress(t *testing.T) {
+	gc := NewGatewayConfig()
+	eok(gc.setOption("metrics-listen", ":9100"), t)
+	if gc.MetricsAddress != ":9100" {
+		t.Fatalf("MetricsAddress was %q", gc.MetricsAddress)
+	}
+}
+
+// Only a lost link is a drop, and a link is only closed once.
+func Test_Metrics_links(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Mode = Aggregating
+	up := &stubUpstream{}
+	gc.Upstream = up
+	gc.Transport = NewMemoryTransport("gw")
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+	eok(ag.Start(context.Background()), t)
+	m := ag.Metrics()
+	up.handlers.OnConnect()
+	up.handlers.OnConnectionLost(errors.New("gone"))
+	up.handlers.OnConnect()
+	up.handlers.OnConnectionLost(errors.New("gone again"))
+	eok(ag.Shutdown(context.Background()), t)
+	if links, drops := m.brokerLinks.Load(), m.brokerLinkDrops.Load(); links != 0 || drops != 2 {
+		t.Fatalf("%d links and %d drops after two losses and a shutdown", links, drops)
+	}
+
+	var l brokerLink
+	m.linkDown(&l)
+	m.linkUp(&l)
+	m.linkUp(&l)
+	if links := m.brokerLinks.Load(); links != 1 {
+		t.Fatalf("one link counted as %d", links)
+	}
+	m.linkDown(&l)
+	m.linkDown(&l)
+	if links, drops := m.brokerLinks.Load(), m.brokerLinkDrops.Load(); links != 0 || drops != 2 {
+		t.Fatalf("closing a link left %d links and %d drops", links, drops)
+	}
+}
@@ -0,0 +1,185 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+type published struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+type recordingBroker struct {
+	sync.Mutex
+	msgs []published
+}
+
+func (b *recordingBroker) publish(topic string, qos byte, retain bool, payload []byte) {
+	b.Lock()
+	b.msgs = append(b.msgs, published{topic, qos, retain, payload})
+	b.Unlock()
+}
+
+func Test_presence(t *testing.T) {
+	gc := NewGatewayConfig()
+	if newPresence(gc, newMetrics(nil), nil) != nil {
+		t.Fatalf("presence with nothing to publish")
+	}
+	gc.Broker.ClientId = "gw/1"
+	gc.Presence.Events = []string{EventConnect, EventLost}
+	gc.Presence.Retain = true
+	var b recordingBroker
+	p := newPresence(gc, newMetrics(nil), b.publish)
+	hub := newEventHub()
+	p.start(hub)
+
+	c := NewClient("c+1", uConn{}, uAddr{})
+	c.connected(time.Minute)
+	hub.emit(newEvent(EventConnect, c, "", ""))
+	hub.emit(newEvent(EventPublish, c, "a/b", qosDetail(1)))
+	hub.emit(newEvent(EventLost, c, "", ""))
+	hub.close()
+	p.wait(context.Background())
+
+	if len(b.msgs) != 2 {
+		t.Fatalf("published %d states, expected 2", len(b.msgs))
+	}
+	m := b.msgs[0]
+	if m.topic != "$SYS/gnatt/gw_1/clients/c_1/state" || m.qos != 1 || !m.retain {
+		t.Fatalf("published to %s at qos %d, retain %v", m.topic, m.qos, m.retain)
+	}
+	var s PresenceState
+	eok(json.Unmarshal(m.payload, &s), t)
+	if s.ClientId != "c+1" || s.State != "active" || s.Event != EventConnect || s.KeepAlive != 60 || s.Address != "none" {
+		t.Fatalf("published %+v", s)
+	}
+	eok(json.Unmarshal(b.msgs[1].payload, &s), t)
+	if s.State != "lost" {
+		t.Fatalf("lost client was published as %s", s.State)
+	}
+}
+
+func Test_presence_stats(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Presence.GatewayId = "gw"
+	gc.Presence.StatsInterval = 10 * time.Millisecond
+	var b recordingBroker
+	p := newPresence(gc, newMetrics(&Clients{clients: make(map[string]SNClient)}), b.publish)
+	hub := newEventHub()
+	p.start(hub)
+	time.Sleep(50 * time.Millisecond)
+	hub.close()
+	p.wait(context.Background())
+
+	b.Lock()
+	defer b.Unlock()
+	if len(b.msgs) == 0 || b.msgs[0].topic != "$SYS/gnatt/gw/stats" || b.msgs[0].retain {
+		t.Fatalf("stats were published as %+v", b.msgs)
+	}
+	var s Stats
+	eok(json.Unmarshal(b.msgs[0].payload, &s), t)
+	if _, ok := s.Clients["asleep"]; !ok {
+		t.Fatalf("stats were %s", b.msgs[0].payload)
+	}
+}
+
+func Test_Client_reportLost(t *testing.T) {
+	c := NewClient("c1", uConn{}, uAddr{})
+	c.connected(time.Second)
+	chkb(c.reportLost(), false, t)
+	c.lastSeen = time.Now().Add(-2 * time.Second)
+	// found by State first, it is still reported once
+	if c.State() != Lost {
+		t.Fatalf("quiet client is %v", c.State())
+	}
+	chkb(c.reportLost(), true, t)
+	chkb(c.reportLost(), false, t)
+	c.connected(time.Second)
+	c.lastSeen = time.Now().Add(-2 * time.Second)
+	chkb(c.reportLost(), true, t)
+}
+
+func Test_GatewayConfig_Presence(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("presence-events", "connect,disconnect,sleep,wake,lost"), t)
+	eok(gc.setOption("presence-retain", "true"), t)
+	eok(gc.setOption("stats-interval", "60"), t)
+	eok(gc.setOption("gateway-id", "gw1"), t)
+	enok(gc.setOption("presence-retain", "maybe"), t)
+	if len(gc.Presence.Events) != 5 || !gc.Presence.Retain || gc.Presence.StatsInterval != time.Minute {
+		t.Fatalf("Presence was %+v", gc.Presence)
+	}
+	eok(gc.Validate(), t)
+	gc.Presence.Events = []string{"publish"}
+	if gc.Validate() != ErrInvalidPresenceEvent {
+		t.Fatalf("publish events should not validate")
+	}
+	gc.Presence.Events = nil
+	gc.Presence.GatewayId = "gw/1"
+	if gc.Validate() != ErrInvalidGatewayId {
+		t.Fatalf("gateway id with a / should not validate")
+	}
+}
+
+// recordingUpstream takes its time over each publish, and records them.
+type recordingUpstream struct {
+	stubUpstream
+	recordingBroker
+}
+
+func (u *recordingUpstream) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	time.Sleep(10 * time.Millisecond)
+	u.publish(topic, qos, retain, payload)
+	return nil
+}
+
+// A client's states reach the upstream in order, the last of them
+// before Shutdown returns.
+func Test_AGateway_presence_order(t *testing.T) {
+	up := &recordingUpstream{}
+	mt := NewMemoryTransport("gw")
+	gc := NewGatewayConfig()
+	gc.Mode = Aggregating
+	gc.Upstream = up
+	gc.Transport = mt
+	gc.Presence.GatewayId = "gw"
+	gc.Presence.Events = []string{EventConnect, EventDisconnect}
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+	eok(ag.Start(context.Background()), t)
+
+	sc := snClient{t, mt.Dial("c1")}
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte("c1")
+	for i := 0; i < 3; i++ {
+		sc.send(cm)
+		sc.read()
+		sc.send(NewMessage(DISCONNECT))
+		sc.read()
+	}
+	sc.send(cm)
+	sc.read()
+	eok(ag.Shutdown(context.Background()), t)
+
+	up.Lock()
+	defer up.Unlock()
+	if len(up.msgs) != 8 {
+		t.Fatalf("published %d states, expected 8", len(up.msgs))
+	}
+	for i, m := range up.msgs {
+		var s PresenceState
+		eok(json.Unmarshal(m.payload, &s), t)
+		if exp := []string{EventConnect, EventDisconnect}[i%2]; s.Event != exp {
+			t.Fatalf("state %d was %s, expected %s", i, s.Event, exp)
+		}
+	}
+}
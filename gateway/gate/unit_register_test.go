@@ -0,0 +1,244 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// stubUpstream takes everything and hands its handlers to the test.
+// Subscribe fails with subscribeErr when it is set.
+type stubUpstream struct {
+	handlers     UpstreamHandlers
+	subscribes   int
+	subscribeErr error
+}
+
+func (u *stubUpstream) Connect(ctx context.Context, h UpstreamHandlers) error {
+	u.handlers = h
+	return nil
+}
+func (u *stubUpstream) Disconnect() {}
+func (u *stubUpstream) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	return nil
+}
+func (u *stubUpstream) Subscribe(ctx context.Context, filter string, qos byte) error {
+	u.subscribes++
+	return u.subscribeErr
+}
+func (u *stubUpstream) Unsubscribe(ctx context.Context, filter string) error { return nil }
+func (u *stubUpstream) Connected() bool                                      { return true }
+
+// deliver hands a message for topic to the gateway, as from the broker.
+func (u *stubUpstream) deliver(topic, payload string) {
+	u.handlers.OnMessage(webhookMessage{WebhookMessage{Topic: topic, Payload: []byte(payload)}})
+}
+
+// snClient is the test's end of a client of a gateway.
+type snClient struct {
+	t *testing.T
+	c *MemoryConn
+}
+
+func (sc snClient) send(m Message) {
+	if _, err := sc.c.Write(m.AppendTo(nil)); err != nil {
+		sc.t.Fatal(err)
+	}
+}
+
+func (sc snClient) read() Message {
+	m := sc.readWithin(time.Second)
+	if m == nil {
+		sc.t.Fatalf("nothing was sent to the client")
+	}
+	return m
+}
+
+// readWithin returns what the client is sent within d, or nil.
+func (sc snClient) readWithin(d time.Duration) Message {
+	select {
+	case b := <-sc.c.incoming:
+		m, err := DecodePacket(b)
+		eok(err, sc.t)
+		return m
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// startRegisterGateway starts an aggregating gateway on a stubUpstream,
+// with a client "c1" connected to it.
+func startRegisterGateway(t *testing.T, gc *GatewayConfig) (*AGateway, *stubUpstream, snClient) {
+	mt := NewMemoryTransport("gw")
+	up := &stubUpstream{}
+	gc.Mode = Aggregating
+	gc.Upstream = up
+	gc.Transport = mt
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+	eok(ag.Start(context.Background()), t)
+	t.Cleanup(func() { ag.Shutdown(context.Background()) })
+
+	sc := snClient{t, mt.Dial("c1")}
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte("c1")
+	sc.send(cm)
+	if ca, ok := sc.read().(*ConnackMessage); !ok || ca.ReturnCode != ACCEPTED {
+		t.Fatalf("CONNECT was answered with %v", ca)
+	}
+	return ag, up, sc
+}
+
+// A topic first seen through a wildcard subscription is given an id,
+// and REGISTERed before it is published on.
+func Test_AGateway_wildcard_register(t *testing.T) {
+	ag, up, sc := startRegisterGateway(t, NewGatewayConfig())
+	sc.send(&SubscribeMessage{MessageId: 1, TopicName: []byte("a/#")})
+	if sa, ok := sc.read().(*SubackMessage); !ok || sa.ReturnCode != ACCEPTED || sa.TopicId != 0 {
+		t.Fatalf("SUBSCRIBE was answered with %v", sa)
+	}
+	if ag.clients.GetClient(MemoryAddr("c1")).(*Client).Registered(0) {
+		t.Fatalf("the wildcard registered topic id 0")
+	}
+
+	up.deliver("a/b", "1")
+	rm, ok := sc.read().(*RegisterMessage)
+	if !ok || rm.TopicId == 0 || string(rm.TopicName) != "a/b" {
+		t.Fatalf("a new topic was sent %v", rm)
+	}
+	sc.send(&RegackMessage{TopicId: rm.TopicId, MessageId: rm.MessageId, ReturnCode: ACCEPTED})
+	if pm, ok := sc.read().(*PublishMessage); !ok || pm.TopicId != rm.TopicId || string(pm.Data) != "1" {
+		t.Fatalf("client was sent %v", pm)
+	}
+}
+
+// A client that goes away, to sleep, or is replaced by a new CONNECT is
+// sent no more REGISTERs, and what was queued behind them is dropped.
+func Test_AGateway_register_discarded(t *testing.T) {
+	for _, leave := range []Message{
+		&DisconnectMessage{},
+		&DisconnectMessage{Duration: 60},
+		&ConnectMessage{ProtocolId: VERSION_1_2, ClientId: []byte("c1"), CleanSession: true},
+	} {
+		gc := NewGatewayConfig()
+		gc.RegisterTimeout = 10 * time.Millisecond
+		ag, up, sc := startRegisterGateway(t, gc)
+		sc.send(&SubscribeMessage{MessageId: 1, TopicName: []byte("a/#")})
+		sc.read()
+		client := ag.clients.GetClient(MemoryAddr("c1")).(*Client)
+		up.deliver("a/b", "1")
+		if _, ok := sc.read().(*RegisterMessage); !ok {
+			t.Fatalf("no REGISTER was sent")
+		}
+		sc.send(leave)
+		sc.read()
+		if n := client.PendingCount(); n != 0 {
+			t.Errorf("%v left %d messages pending", leave, n)
+		}
+		if m := sc.readWithin(5 * gc.RegisterTimeout); m != nil {
+			t.Errorf("%v was followed by %v", leave, m)
+		}
+	}
+}
+
+// newRegisterClient is a client of mt, and the test's end of it.
+func newRegisterClient(t *testing.T) (*Client, snClient) {
+	mt := NewMemoryTransport("gw")
+	sc := snClient{t, mt.Dial("c1")}
+	return NewClient("c1", mt, MemoryAddr("c1")), sc
+}
+
+// Publishes queue per topic id, each queue behind its own REGISTER, and
+// are handed back in order when it is acknowledged.
+func Test_Client_register_queue(t *testing.T) {
+	c, sc := newRegisterClient(t)
+	pms := []*PublishMessage{
+		NewPublishMessage(1, 0x00, []byte("1"), 0, 0, false, false),
+		NewPublishMessage(2, 0x00, []byte("2"), 0, 0, false, false),
+		NewPublishMessage(1, 0x00, []byte("3"), 0, 0, false, false),
+	}
+	for i, first := range []bool{true, true, false} {
+		if c.AddPendingMessage(pms[i]) != first {
+			t.Fatalf("message %d was first for its topic id: %v", i, !first)
+		}
+	}
+	c.SendRegister(1, "a/b", time.Hour, 3)
+	c.SendRegister(2, "a/c", time.Hour, 3)
+	r1, ok := sc.read().(*RegisterMessage)
+	if !ok || r1.TopicId != 1 || string(r1.TopicName) != "a/b" {
+		t.Fatalf("the first REGISTER was %v", r1)
+	}
+	r2 := sc.read().(*RegisterMessage)
+	if r2.MessageId == r1.MessageId {
+		t.Fatalf("both REGISTERs had message id %d", r1.MessageId)
+	}
+	if n, registers := c.queueDepth(); n != 3 || registers != 2 {
+		t.Fatalf("%d messages were queued behind %d REGISTERs", n, registers)
+	}
+
+	if _, _, ok := c.RegisterAcked(1, r2.MessageId, true); ok {
+		t.Fatalf("a REGACK with the wrong message id was taken")
+	}
+	flushed, _, ok := c.RegisterAcked(1, r1.MessageId, true)
+	if !ok || len(flushed) != 2 || flushed[0] != pms[0] || flushed[1] != pms[2] {
+		t.Fatalf("the REGACK handed back %v", flushed)
+	}
+	if !c.Registered(1) || c.Registered(2) || c.PendingCount() != 1 {
+		t.Fatalf("the REGACK for 1 completed the wrong REGISTER")
+	}
+	if _, _, ok := c.RegisterAcked(1, r1.MessageId, true); ok {
+		t.Fatalf("a REGISTER was acknowledged twice")
+	}
+}
+
+// An unanswered REGISTER is sent again each timeout, with the same
+// message id, until the retries run out and its queue is dropped.
+func Test_Client_register_retransmit(t *testing.T) {
+	c, sc := newRegisterClient(t)
+	c.AddPendingMessage(NewPublishMessage(1, 0x00, nil, 0, 0, false, false))
+	c.SendRegister(1, "a/b", 10*time.Millisecond, 2)
+	first := sc.read().(*RegisterMessage)
+	for i := 0; i < 2; i++ {
+		if rm, ok := sc.read().(*RegisterMessage); !ok || rm.MessageId != first.MessageId || rm.TopicId != 1 {
+			t.Fatalf("retransmission %d was %v", i+1, rm)
+		}
+	}
+	if m := sc.readWithin(50 * time.Millisecond); m != nil {
+		t.Fatalf("sent %v after the retries ran out", m)
+	}
+	if n, registers := c.queueDepth(); n != 0 || registers != 0 {
+		t.Fatalf("%d messages were left behind %d REGISTERs", n, registers)
+	}
+	if _, _, ok := c.RegisterAcked(1, first.MessageId, true); ok || c.Registered(1) {
+		t.Fatalf("a REGACK after the retries ran out was taken")
+	}
+}
+
+// A rejected REGISTER drops its queue, the next message for the topic
+// is REGISTERed again.
+func Test_AGateway_register_rejected(t *testing.T) {
+	ag, up, sc := startRegisterGateway(t, NewGatewayConfig())
+	sc.send(&SubscribeMessage{MessageId: 1, TopicName: []byte("a/#")})
+	sc.read()
+	client := ag.clients.GetClient(MemoryAddr("c1")).(*Client)
+	up.deliver("a/b", "1")
+	rm := sc.read().(*RegisterMessage)
+	sc.send(&RegackMessage{TopicId: rm.TopicId, MessageId: rm.MessageId, ReturnCode: REJ_INVALID_TID})
+	if m := sc.readWithin(50 * time.Millisecond); m != nil {
+		t.Fatalf("a rejected REGISTER was followed by %v", m)
+	}
+	if client.PendingCount() != 0 || client.Registered(rm.TopicId) {
+		t.Fatalf("a rejected REGISTER left the topic registered or queued")
+	}
+	up.deliver("a/b", "2")
+	again, ok := sc.read().(*RegisterMessage)
+	if !ok || again.TopicId != rm.TopicId {
+		t.Fatalf("the next message was sent as %v", again)
+	}
+	sc.send(&RegackMessage{TopicId: again.TopicId, MessageId: again.MessageId, ReturnCode: ACCEPTED})
+	if pm, ok := sc.read().(*PublishMessage); !ok || string(pm.Data) != "2" {
+		t.Fatalf("client was sent %v", pm)
+	}
+}
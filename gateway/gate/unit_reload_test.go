@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alsm/gnatt/logging"
+	. "github.com/alsm/gnatt/packets"
+)
+
+func reloadTestConfig() *GatewayConfig {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	return gc
+}
+
+func Test_mergeConfig(t *testing.T) {
+	old := reloadTestConfig()
+	gc := reloadTestConfig()
+	gc.MaxClients = 10
+	gc.PredefinedTopics[1] = "a/b"
+	gc.ListenAddress = ":1884"
+	gc.Mode = Aggregating
+
+	merged, result := mergeConfig(old, gc)
+	if strings.Join(result.Applied, ",") != "predefined-topic,max-clients" {
+		t.Fatalf("Applied was %v", result.Applied)
+	}
+	if strings.Join(result.NeedRestart, ",") != "mode,listen" {
+		t.Fatalf("NeedRestart was %v", result.NeedRestart)
+	}
+	if merged.MaxClients != 10 || merged.PredefinedTopics[1] != "a/b" || merged.ListenAddress != ":1883" || merged.Mode != Transparent {
+		t.Fatalf("merged config was %+v", merged)
+	}
+
+	_, result = mergeConfig(old, reloadTestConfig())
+	if len(result.Applied) != 0 || len(result.NeedRestart) != 0 {
+		t.Fatalf("reloading the same config gave %+v", result)
+	}
+}
+
+func Test_TGateway_Reload(t *testing.T) {
+	gc := reloadTestConfig()
+	eok(gc.setOption("protocol-versions", "1.2"), t)
+	eok(gc.setOption("qos-1-allow", "10.0.0.0/8"), t)
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	g.clients.AddClient(NewClient("c1", uConn{}, uAddr{}))
+
+	gc = reloadTestConfig()
+	gc.PredefinedTopics[5] = "sensors/t"
+	gc.RegisterRetries = 7
+	gc.Log.Level = slog.LevelWarn
+	gc.Log.Trace = []string{"c1"}
+	defer logLevel.Set(slog.LevelInfo)
+	defer logging.Trace("c1", false)
+	result, err := g.Reload(gc)
+	eok(err, t)
+	if len(result.Applied) != 6 {
+		t.Fatalf("Applied was %v", result.Applied)
+	}
+	if !supportsVersion(g.conf().ProtocolVersions, VERSION_2_0) || g.conf().RegisterRetries != 7 {
+		t.Fatalf("config was not reloaded: %+v", g.conf())
+	}
+	if g.predefined.getTopic(5) != "sensors/t" || !g.qosMinusOne.contains(uAddr{}) {
+		t.Fatalf("predefined topics and qos -1 sources were not reloaded")
+	}
+	if logLevel.Level() != slog.LevelWarn || !logging.IsTraced("c1") {
+		t.Fatalf("logging was not reloaded")
+	}
+	if g.clients.Len() != 1 {
+		t.Fatalf("a reload dropped the clients")
+	}
+
+	// a bad config changes nothing
+	gc = reloadTestConfig()
+	gc.RegisterRetries = -1
+	if _, err = g.Reload(gc); err == nil || g.conf().RegisterRetries != 7 {
+		t.Fatalf("a bad config was reloaded: %v", err)
+	}
+}
+
+func Test_adminHandler_reload(t *testing.T) {
+	gc := reloadTestConfig()
+	gc.Mode = Aggregating
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+	h := adminHandler{ag}
+
+	if w := adminRequest(h, "POST", "/config/reload", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("reloading without a file gave %d %s", w.Code, w.Body)
+	}
+
+	ag.conf().Load = func() (*GatewayConfig, error) {
+		gc := reloadTestConfig()
+		gc.Mode = Aggregating
+		gc.MaxClients = 3
+		gc.MTU = 500
+		return gc, nil
+	}
+	w := adminRequest(h, "POST", "/config/reload", "")
+	var result ReloadResult
+	eok(json.Unmarshal(w.Body.Bytes(), &result), t)
+	if w.Code != http.StatusOK || len(result.Applied) != 1 || result.Applied[0] != "max-clients" || len(result.NeedRestart) != 1 || result.NeedRestart[0] != "mtu" {
+		t.Fatalf("POST /config/reload gave %d %s", w.Code, w.Body)
+	}
+	if ag.conf().MaxClients != 3 || ag.conf().MTU != 1500 {
+		t.Fatalf("config after reload was %+v", ag.conf())
+	}
+	if w := adminRequest(h, "GET", "/config/reload", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /config/reload gave %d", w.Code)
+	}
+}
+
+// Listener mounts and ACL profiles are reloaded into the running
+// listeners, the rest of a listener needs a restart.
+func Test_TGateway_Reload_listeners(t *testing.T) {
+	listenerConfig := func(mount string, publish ...string) *GatewayConfig {
+		gc := reloadTestConfig()
+		gc.Listeners = []ListenerConfig{{Name: "l1", GatewayId: 1, Transport: NewMemoryTransport("gw"), Mount: mount, ACL: "a"}}
+		gc.ACLs = map[string]ACLProfile{"a": {Publish: publish}}
+		return gc
+	}
+	gc := listenerConfig("m", "x/#")
+	g, err := NewTGateway(gc)
+	eok(err, t)
+	eok(g.Start(context.Background()), t)
+	defer g.Shutdown(context.Background())
+	e := endpointOf(g.listeners[0].transport)
+	if !e.mayPublish("m/x/1") {
+		t.Fatalf("the listener's ACL profile was not applied")
+	}
+
+	gc = listenerConfig("n", "y/#")
+	gc.Listeners[0].Transport = g.conf().Listeners[0].Transport
+	result, err := g.Reload(gc)
+	eok(err, t)
+	if strings.Join(result.Applied, ",") != "listener-mount,acl" || len(result.NeedRestart) != 0 {
+		t.Fatalf("reload gave %+v", result)
+	}
+	if e.mayPublish("m/x/1") || !e.mayPublish("n/y/1") || e.brokerTopic("t") != "n/t" {
+		t.Fatalf("the listener's mount and ACL profile were not reloaded")
+	}
+
+	gc = listenerConfig("n", "y/#")
+	gc.Listeners[0].Name = "l2"
+	gc.Listeners[0].ACL = ""
+	gc.ACLs = nil
+	result, err = g.Reload(gc)
+	eok(err, t)
+	if strings.Join(result.NeedRestart, ",") != "listener" || !e.mayPublish("n/y/1") || e.mayPublish("n/z") {
+		t.Fatalf("a listener waiting for a restart lost its ACL profile: %+v", result)
+	}
+}
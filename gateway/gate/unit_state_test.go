@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_ClientState_accepts(t *testing.T) {
+	publish := NewPublishMessage(1, 0x01, nil, 1, 1, false, false)
+	qosMinusOne := NewPublishMessage(1, 0x01, nil, QOS_MINUS_ONE, 0, false, false)
+	for _, c := range []struct {
+		state ClientState
+		m     Message
+		ok    bool
+	}{
+		{Disconnected, &ConnectMessage{}, true},
+		{Disconnected, publish, false},
+		{Disconnected, qosMinusOne, true},
+		{Disconnected, &PingreqMessage{}, false},
+		{Active, publish, true},
+		{Active, &SubscribeMessage{}, true},
+		{Asleep, publish, false},
+		{Asleep, &PingreqMessage{}, true},
+		{Asleep, &PubackMessage{}, false},
+		{Awake, &PubackMessage{}, true},
+		{Awake, &RegisterMessage{}, false},
+		{Lost, &DisconnectMessage{}, false},
+		{Lost, &ConnectMessage{}, true},
+	} {
+		if c.state.accepts(c.m) != c.ok {
+			t.Errorf("%v client sending %v, accepted should be %v", c.state, c.m, c.ok)
+		}
+	}
+}
+
+func Test_Client_State_transitions(t *testing.T) {
+	c := NewClient("c1", uConn{}, uAddr{})
+	if c.State() != Disconnected {
+		t.Fatalf("new client is %v", c.State())
+	}
+	c.connected(time.Minute)
+	if c.State() != Active {
+		t.Fatalf("connected client is %v", c.State())
+	}
+	c.disconnected(time.Minute)
+	if c.State() != Asleep {
+		t.Fatalf("client disconnected with a duration is %v", c.State())
+	}
+	chkb(c.awake(true), true, t)
+	if c.State() != Awake {
+		t.Fatalf("woken client is %v", c.State())
+	}
+	chkb(c.awake(false), true, t)
+	chkb(c.awake(false), false, t)
+
+	// quiet for longer than 1.5 times its sleep duration
+	c.lastSeen = time.Now().Add(-2 * time.Minute)
+	if c.State() != Lost {
+		t.Fatalf("client quiet past its sleep duration is %v", c.State())
+	}
+	c.connected(0)
+	c.lastSeen = time.Now().Add(-time.Hour)
+	if c.State() != Active {
+		t.Fatalf("client without a keep alive is %v", c.State())
+	}
+}
+
+func Test_TGateway_OnPacket_state(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	g, err := NewTGateway(gc)
+	eok(err, t)
+
+	mt := NewMemoryTransport("gw")
+	eok(mt.Listen(), t)
+	defer mt.Close()
+	c := mt.Dial("client")
+
+	// a PUBLISH from a client that never connected is refused
+	pm := NewPublishMessage(1, 0x01, []byte("x"), 1, 1, false, false)
+	g.OnPacket(pm.Size(), pm.AppendTo(nil), mt, c.LocalAddr())
+
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	eok(err, t)
+	m, err := DecodePacket(b[:n])
+	eok(err, t)
+	if _, ok := m.(*DisconnectMessage); !ok {
+		t.Fatalf("client got %v, expected a DISCONNECT", m)
+	}
+	if len(g.Clients()) != 0 {
+		t.Fatalf("unconnected client was added")
+	}
+}
+
+// Messages for a client that is asleep are kept until a PINGREQ wakes
+// it, and sent before its PINGRESP.
+func Test_AGateway_asleep_publish(t *testing.T) {
+	ag, up, sc := startRegisterGateway(t, NewGatewayConfig())
+	sc.send(&SubscribeMessage{MessageId: 1, TopicName: []byte("a/b")})
+	sc.read()
+	sc.send(&SubscribeMessage{MessageId: 2, TopicName: []byte("x/#")})
+	sc.read()
+	sc.send(&DisconnectMessage{Duration: 60})
+	sc.read()
+
+	up.deliver("a/b", "1")
+	client := ag.clients.GetClient(MemoryAddr("c1")).(*Client)
+	eok(ag.publishTo(client, webhookMessage{WebhookMessage{Topic: "a/b", Payload: []byte("2")}}), t)
+	up.deliver("x/y", "3")
+	if m := sc.readWithin(50 * time.Millisecond); m != nil {
+		t.Fatalf("a client that is asleep was sent %v", m)
+	}
+
+	sc.send(&PingreqMessage{})
+	var payloads []string
+	for {
+		switch m := sc.read().(type) {
+		case *PublishMessage:
+			payloads = append(payloads, string(m.Data))
+			continue
+		case *RegisterMessage:
+			// a topic the client hasn't seen is REGISTERed while it is awake
+			if string(m.TopicName) != "x/y" {
+				t.Fatalf("REGISTERed %s", m.TopicName)
+			}
+			sc.send(&RegackMessage{TopicId: m.TopicId, MessageId: m.MessageId})
+			continue
+		case *PingrespMessage:
+		default:
+			t.Fatalf("woken client was sent %v", m)
+		}
+		break
+	}
+	sort.Strings(payloads)
+	if strings.Join(payloads, ",") != "1,2,3" {
+		t.Fatalf("woken client was sent %v before its PINGRESP", payloads)
+	}
+	if m := sc.readWithin(50 * time.Millisecond); m != nil || client.State() != Asleep {
+		t.Fatalf("woken client was sent %v after its PINGRESP, and is %v", m, client.State())
+	}
+
+	// only so many are kept
+	for i := 0; i < maxAsleepMessages+1; i++ {
+		up.deliver("a/b", "")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(client.takeAsleep()); n != maxAsleepMessages {
+		t.Fatalf("kept %d messages", n)
+	}
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func tenantTestConfig(name string, id byte) *GatewayConfig {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.Listeners = []ListenerConfig{{Name: name, GatewayId: id, Transport: NewMemoryTransport(name)}}
+	return gc
+}
+
+func Test_ParseConfigFile_tenants(t *testing.T) {
+	dir := t.TempDir()
+	eok(os.Mkdir(filepath.Join(dir, "sub"), 0700), t)
+	file := filepath.Join(dir, "gw.toml")
+	eok(os.WriteFile(file, []byte("[tenants]\nacme = \"acme.toml\"\nglobex = \"sub/globex.cfg\"\n\n[log]\nlevel = \"warn\"\n"), 0600), t)
+	eok(os.WriteFile(filepath.Join(dir, "acme.toml"), []byte("mode = \"aggregating\"\nmax-clients = 5\n[broker]\nuri = \"tcp://acme:1883\"\n"), 0600), t)
+	eok(os.WriteFile(filepath.Join(dir, "sub", "globex.cfg"), []byte("mqtt-broker tcp://globex:1883\nport 1884\n"), 0600), t)
+
+	gc, err := ParseConfigFile(file)
+	eok(err, t)
+	if len(gc.Tenants) != 2 || gc.Tenants[0].Name != "acme" || gc.Tenants[1].Name != "globex" {
+		t.Fatalf("Tenants were %+v", gc.Tenants)
+	}
+	if acme := gc.Tenants[0].Config; acme == nil || acme.Mode != Aggregating || acme.MaxClients != 5 {
+		t.Fatalf("acme's config was %+v", acme)
+	}
+	if globex := gc.Tenants[1].Config; globex == nil || globex.ListenAddress != ":1884" {
+		t.Fatalf("globex's config was %+v", globex)
+	}
+	eok(gc.Check(), t)
+
+	enok(NewGatewayConfig().setOption("tenant", "no-file"), t)
+	enok(NewGatewayConfig().setOption("tenant", ":a.toml"), t)
+}
+
+// Each tenant's problems are in the tenant's file, even when two
+// tenants share one.
+func Test_CheckConfigFile_tenants(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gw.cfg")
+	a, b := filepath.Join(dir, "a.cfg"), filepath.Join(dir, "b.cfg")
+	eok(os.WriteFile(file, []byte("tenant a:a.cfg\ntenant b:b.cfg\ntenant c:missing.cfg\n"), 0600), t)
+	eok(os.WriteFile(a, []byte("mqtt-broker tcp://a:1883\nmtu 2\n"), 0600), t)
+	eok(os.WriteFile(b, []byte("mtu 2\nmqtt-broker tcp://b:1883\n"), 0600), t)
+
+	if _, err := ParseConfigFile(file); err == nil {
+		t.Fatalf("ParseConfigFile should fail")
+	}
+	problems, ok := CheckConfigFile(file).(ConfigErrors)
+	if !ok || len(problems) != 3 {
+		t.Fatalf("CheckConfigFile gave %v", problems)
+	}
+	for i, want := range []ConfigError{{b, 1, "mtu", ErrInvalidMTU}, {a, 2, "mtu", ErrInvalidMTU}, {File: file, Key: "tenant c"}} {
+		if p := problems[i]; p.File != want.File || p.Line != want.Line || p.Key != want.Key {
+			t.Errorf("problem %d was %v, not with %s:%d: %s", i, p, want.File, want.Line, want.Key)
+		}
+	}
+}
+
+func Test_GatewayConfig_tenant_problems(t *testing.T) {
+	nested := tenantTestConfig("n", 1)
+	nested.Tenants = []TenantConfig{{Name: "x", Config: tenantTestConfig("x", 1)}}
+	bad := tenantTestConfig("bad", 1)
+	bad.Broker.URI = ""
+	gc := NewGatewayConfig()
+	gc.Tenants = []TenantConfig{
+		{Name: "a", Config: tenantTestConfig("a", 1)},
+		{Name: "a", Config: tenantTestConfig("a", 1)},
+		{Name: "none"},
+		{Name: "nested", Config: nested},
+		{Name: "bad", Config: bad},
+	}
+	want := []ConfigError{
+		{Key: "tenant", Err: ErrInvalidTenant},
+		{Key: "tenant none", Err: ErrNoTenantConfig},
+		{Key: "tenant", Err: ErrNestedTenants},
+		{Key: "bad:mqtt-broker", Err: ErrNoTransportSpecified},
+	}
+	problems := gc.problems()
+	if len(problems) != len(want) {
+		t.Fatalf("problems were %v", problems)
+	}
+	for i, p := range problems {
+		if p != want[i] {
+			t.Errorf("problem %d was %v, not %v", i, p, want[i])
+		}
+	}
+}
+
+// Tenants answer as gateways of their own, and reload on their own.
+func Test_MultiGateway(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Tenants = []TenantConfig{
+		{Name: "acme", Config: tenantTestConfig("acme", 1)},
+		{Name: "globex", Config: tenantTestConfig("globex", 2)},
+	}
+	g, err := New(gc)
+	eok(err, t)
+	m, ok := g.(*MultiGateway)
+	if !ok {
+		t.Fatalf("New gave a %T", g)
+	}
+	eok(m.Start(context.Background()), t)
+	defer m.Shutdown(context.Background())
+	if m.Addr() != MemoryAddr("acme") {
+		t.Fatalf("Addr was %v", m.Addr())
+	}
+
+	search := NewMessage(SEARCHGW).(*SearchGwMessage)
+	search.Radius = 1
+	for i, tc := range gc.Tenants {
+		c := tc.Config.Listeners[0].Transport.(*MemoryTransport).Dial("searcher")
+		_, err = c.Write(search.AppendTo(nil))
+		eok(err, t)
+		b := make([]byte, 16)
+		n, err := c.Read(b)
+		eok(err, t)
+		m, err := DecodePacket(b[:n])
+		eok(err, t)
+		if gi, ok := m.(*GwInfoMessage); !ok || gi.GatewayId != byte(i+1) {
+			t.Errorf("SEARCHGW to %s was answered with %v", tc.Name, m)
+		}
+	}
+
+	c1 := newTClient("c1", gc.Tenants[1].Config.Broker, uConn{}, uAddr{})
+	m.Tenant("globex").(*TGateway).clients.AddClient(c1)
+	if clients := m.Clients(); len(clients) != 1 || clients[0].ClientId != "c1" || clients[0].Tenant != "globex" {
+		t.Fatalf("Clients were %+v", clients)
+	}
+	if m.Tenant("acme").(*TGateway).clients.Len() != 0 {
+		t.Fatalf("a client of globex is acme's too")
+	}
+
+	reloaded := NewGatewayConfig()
+	acme := *gc.Tenants[0].Config
+	acme.MaxClients = 10
+	reloaded.Tenants = []TenantConfig{
+		{Name: "acme", Config: &acme},
+		{Name: "initech", Config: tenantTestConfig("initech", 3)},
+	}
+	result, err := m.Reload(reloaded)
+	eok(err, t)
+	if strings.Join(result.Applied, ",") != "acme:max-clients" || strings.Join(result.NeedRestart, ",") != "tenant" {
+		t.Fatalf("reload gave %+v", result)
+	}
+	if m.Tenant("acme").(*TGateway).conf().MaxClients != 10 || m.Tenant("globex").(*TGateway).conf().MaxClients != 0 {
+		t.Fatalf("reload changed the wrong tenant")
+	}
+
+	// a tenant's bad config keeps the others from being reloaded too
+	acme.MaxClients = 20
+	globex := *gc.Tenants[1].Config
+	globex.MaxClients = -1
+	reloaded.Tenants = []TenantConfig{{Name: "acme", Config: &acme}, {Name: "globex", Config: &globex}}
+	if _, err := m.Reload(reloaded); err == nil {
+		t.Fatalf("reloaded a bad tenant config")
+	}
+	if m.Tenant("acme").(*TGateway).conf().MaxClients != 10 {
+		t.Fatalf("reload was applied to acme regardless")
+	}
+}
@@ -22,6 +22,8 @@ func Test_ContainsWildcard(t *testing.T) {
 		"a/+":     true,
 		"a/b/c/+": true,
 		"a/+/+/d": true,
+		"+/x":     true,
+		"+/+/x":   true,
 		"a/++/+d": false,
 		"#":       true,
 		"/#":      true,
@@ -32,7 +34,7 @@ func Test_ContainsWildcard(t *testing.T) {
 	for topic, exp := range topics {
 		res := ContainsWildcard(topic)
 		if res != exp {
-			t.Errorf("ContainsWildcard expected \"%s\", got \"%s\"", exp, res)
+			t.Errorf("ContainsWildcard expected \"%v\", got \"%v\"", exp, res)
 		}
 	}
 }
@@ -634,3 +634,23 @@ func Test_RemoveSubscription_rs3(t *testing.T) {
 	alen(0, elen(tt.SubscribersOf("/alpha/beta/gamma")), 16, t)
 	alen(0, elen(tt.SubscribersOf("/alpha")), 17, t)
 }
+
+func Test_TopicTree_Subscriptions(t *testing.T) {
+	c1 := NewClient("c1", uConn{}, uAddr{})
+	c2 := NewClient("c2", uConn{}, uAddr{})
+	tt := NewTopicTree()
+	for _, sub := range []struct {
+		c     *Client
+		topic string
+	}{{c1, "a/b"}, {c2, "a/b"}, {c1, "a/+/c"}, {c2, "/x"}, {c2, "#"}} {
+		_, e := tt.AddSubscription(sub.c, sub.topic)
+		eok(e, t)
+	}
+	subs := tt.Subscriptions()
+	if len(subs) != 4 || len(subs["a/b"]) != 2 || subs["a/b"][0] != "c1" || subs["/x"][0] != "c2" {
+		t.Fatalf("Subscriptions was %v", subs)
+	}
+	if f := tt.SubscriptionsOf(c1); len(f) != 2 || f[0] != "a/+/c" || f[1] != "a/b" {
+		t.Fatalf("SubscriptionsOf(c1) was %v", f)
+	}
+}
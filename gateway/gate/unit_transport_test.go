@@ -0,0 +1,211 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A Transport that goes nowhere, for tests that need a Client but
+// never write to it.
+type uConn struct{}
+
+func (uConn) Listen() error                         { return nil }
+func (uConn) Receive([]byte) (int, net.Addr, error) { return 0, nil, ErrTransportStopped }
+func (uConn) Send([]byte, net.Addr) error           { return nil }
+func (uConn) StopReceiving() error                  { return nil }
+func (uConn) Close() error                          { return nil }
+func (uConn) LocalAddr() net.Addr                   { return uAddr{} }
+
+type uAddr struct{}
+
+func (uAddr) Network() string { return "none" }
+func (uAddr) String() string  { return "none" }
+
+// Records the packets handed to it by a listener.
+type recordingGateway struct {
+	packets chan string
+}
+
+func (r *recordingGateway) Start(context.Context) error                 { return nil }
+func (r *recordingGateway) Shutdown(context.Context) error              { return nil }
+func (r *recordingGateway) Addr() net.Addr                              { return nil }
+func (r *recordingGateway) Clients() []ClientStatus                     { return nil }
+func (r *recordingGateway) Reload(*GatewayConfig) (ReloadResult, error) { return ReloadResult{}, nil }
+func (r *recordingGateway) ReloadConfig() (ReloadResult, error)         { return ReloadResult{}, nil }
+func (r *recordingGateway) OnPacket(n int, b []byte, t Transport, a net.Addr) {
+	r.packets <- a.String() + ":" + string(b[:n])
+	t.Send([]byte("ack"), a)
+}
+
+func Test_listen_MemoryTransport(t *testing.T) {
+	mt := NewMemoryTransport("gw")
+	g := &recordingGateway{make(chan string, 1)}
+	l, err := listen(mt, g, 1500)
+	eok(err, t)
+
+	c := mt.Dial("sensor1")
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case p := <-g.packets:
+		if p != "sensor1:hello" {
+			t.Fatalf("gateway got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("gateway got nothing")
+	}
+
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	eok(err, t)
+	if string(b[:n]) != "ack" {
+		t.Fatalf("peer got %q", b[:n])
+	}
+
+	eok(l.stop(context.Background()), t)
+	// sending still works once the listener has stopped
+	eok(mt.Send([]byte("bye"), c.LocalAddr()), t)
+	eok(l.close(), t)
+	if err = mt.Send([]byte("gone"), c.LocalAddr()); err == nil {
+		t.Fatalf("Send after close should fail")
+	}
+}
+
+func Test_listen_MTU(t *testing.T) {
+	mt := NewMemoryTransport("gw")
+	g := &recordingGateway{make(chan string, 2)}
+	l, err := listen(mt, g, 8)
+	eok(err, t)
+	defer l.close()
+
+	c := mt.Dial("sensor1")
+	// over the mtu, dropped
+	if _, err = c.Write([]byte("123456789")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err = c.Write([]byte("12345678")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case p := <-g.packets:
+		if p != "sensor1:12345678" {
+			t.Fatalf("gateway got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("gateway got nothing")
+	}
+}
+
+func Test_GatewayConfig_MTU(t *testing.T) {
+	gc := NewGatewayConfig()
+	gc.Broker.URI = "tcp://localhost:1883"
+	eok(gc.setOption("mtu", "256"), t)
+	if gc.MTU != 256 {
+		t.Fatalf("MTU was %d", gc.MTU)
+	}
+	eok(gc.Validate(), t)
+	for _, mtu := range []int{0, 7, 65536} {
+		gc.MTU = mtu
+		if gc.Validate() != ErrInvalidMTU {
+			t.Fatalf("MTU of %d should not validate", mtu)
+		}
+	}
+}
+
+func Test_StreamTransport_Pipe(t *testing.T) {
+	radio, gw := net.Pipe()
+	st := NewStreamTransport("radio", gw)
+	eok(st.Listen(), t)
+	defer st.Close()
+
+	// two packets written back to back arrive as two packets
+	go radio.Write([]byte{0x02, PINGREQ, 0x04, PUBCOMP, 0x00, 0x07})
+
+	b := make([]byte, 16)
+	n, from, err := st.Receive(b)
+	eok(err, t)
+	if from.String() != "radio" || n != 2 || b[1] != PINGREQ {
+		t.Fatalf("first packet from %s was % x", from, b[:n])
+	}
+	n, _, err = st.Receive(b)
+	eok(err, t)
+	if n != 4 || b[1] != PUBCOMP {
+		t.Fatalf("second packet was % x", b[:n])
+	}
+
+	go st.Send([]byte{0x02, PINGRESP}, from)
+	n, err = radio.Read(b)
+	eok(err, t)
+	if n != 2 || b[1] != PINGRESP {
+		t.Fatalf("radio got % x", b[:n])
+	}
+}
+
+// A bad length on a stream that was opened is skipped, not the end of
+// the stream.
+func Test_StreamTransport_resync(t *testing.T) {
+	radio, gw := net.Pipe()
+	st := NewStreamTransport("radio", gw)
+	eok(st.Listen(), t)
+	defer st.Close()
+
+	go radio.Write([]byte{0x00, 0x01, 0x00, 0x02, 0x02, PINGREQ})
+
+	b := make([]byte, 16)
+	n, _, err := st.Receive(b)
+	eok(err, t)
+	if n != 2 || b[1] != PINGREQ {
+		t.Fatalf("packet after the bad lengths was % x", b[:n])
+	}
+	if _, ok := st.conn(StreamAddr("radio")); !ok {
+		t.Fatalf("the stream was closed")
+	}
+}
+
+// A TCP peer that sends a bad length is disconnected.
+func Test_StreamTransport_TCP_bad_frame(t *testing.T) {
+	st := NewTCPTransport("127.0.0.1:0")
+	eok(st.Listen(), t)
+	defer st.Close()
+
+	conn, err := net.Dial("tcp", st.LocalAddr().String())
+	eok(err, t)
+	defer conn.Close()
+	conn.Write([]byte{0x00})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("the peer was not disconnected: %v", err)
+	}
+}
+
+func Test_StreamTransport_TCP(t *testing.T) {
+	st := NewTCPTransport("127.0.0.1:0")
+	eok(st.Listen(), t)
+	defer st.Close()
+
+	conn, err := net.Dial("tcp", st.LocalAddr().String())
+	eok(err, t)
+	defer conn.Close()
+	conn.Write([]byte{0x03, PINGREQ})
+	conn.Write([]byte{0x41})
+
+	b := make([]byte, 16)
+	n, from, err := st.Receive(b)
+	eok(err, t)
+	if n != 3 || string(b[2:n]) != "A" {
+		t.Fatalf("packet from %s was % x", from, b[:n])
+	}
+	eok(st.Send([]byte{0x02, PINGRESP}, from), t)
+	n, err = conn.Read(b)
+	eok(err, t)
+	if n != 2 || b[1] != PINGRESP {
+		t.Fatalf("client got % x", b[:n])
+	}
+}
@@ -0,0 +1,301 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// webhookServer records the messages POSTed to it, and answers polls
+// with the messages in messages.
+type webhookServer struct {
+	*httptest.Server
+	sync.Mutex
+	status   int
+	posted   []WebhookMessage
+	polls    [][]string
+	messages []WebhookMessage
+}
+
+func newWebhookServer() *webhookServer {
+	ws := &webhookServer{status: http.StatusOK}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer ws.Unlock()
+		ws.Lock()
+		if ws.status != http.StatusOK {
+			w.WriteHeader(ws.status)
+			return
+		}
+		switch r.URL.Path {
+		case "/up":
+			var m WebhookMessage
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ws.posted = append(ws.posted, m)
+		case "/down":
+			ws.polls = append(ws.polls, r.URL.Query()["filter"])
+			if len(ws.messages) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			json.NewEncoder(w).Encode(ws.messages)
+			ws.messages = nil
+		}
+	}))
+	return ws
+}
+
+func (ws *webhookServer) config() WebhookConfig {
+	return WebhookConfig{URL: ws.URL + "/up", PollURL: ws.URL + "/down", PollInterval: 10 * time.Millisecond}
+}
+
+func Test_WebhookUpstream(t *testing.T) {
+	ws := newWebhookServer()
+	defer ws.Close()
+	var lock sync.Mutex
+	var received []MQTT.Message
+	var ups, downs int
+	h := UpstreamHandlers{
+		OnMessage: func(m MQTT.Message) {
+			lock.Lock()
+			received = append(received, m)
+			lock.Unlock()
+		},
+		OnConnect:        func() { ups++ },
+		OnConnectionLost: func(error) { downs++ },
+	}
+	conf := ws.config()
+	conf.PollInterval = time.Hour
+	u := NewWebhookUpstream(conf)
+	eok(u.Connect(context.Background(), h), t)
+	defer u.Disconnect()
+	if !u.Connected() || ups != 1 || len(ws.polls) != 1 {
+		t.Fatalf("a webhook that answered its first poll is not connected")
+	}
+
+	eok(u.Publish(context.Background(), "a/b", 1, true, []byte("hi")), t)
+	if len(ws.posted) != 1 || ws.posted[0].Topic != "a/b" || ws.posted[0].Qos != 1 || !ws.posted[0].Retain || string(ws.posted[0].Payload) != "hi" {
+		t.Fatalf("POSTed %+v", ws.posted)
+	}
+
+	eok(u.Subscribe(context.Background(), "a/+", 0), t)
+	eok(u.Subscribe(context.Background(), "c/d", 2), t)
+	ws.messages = []WebhookMessage{{Topic: "a/b", Qos: 2, Payload: []byte("1")}, {Topic: "x/y"}, {Topic: "c/d", Qos: 1}}
+	eok(u.fetch(), t)
+	if len(ws.polls) != 2 || len(ws.polls[1]) != 2 || ws.polls[1][0] != "a/+" || ws.polls[1][1] != "c/d" {
+		t.Fatalf("polled with %v", ws.polls)
+	}
+	// the message that matches no subscription is dropped, the rest
+	// are at the QoS they were subscribed at
+	if len(received) != 2 || received[0].Topic() != "a/b" || received[0].Qos() != 0 || received[1].Qos() != 1 {
+		t.Fatalf("received %v", received)
+	}
+	eok(u.Unsubscribe(context.Background(), "a/+"), t)
+	eok(u.fetch(), t)
+	if len(ws.polls[2]) != 1 || ws.polls[2][0] != "c/d" {
+		t.Fatalf("polled with %v after unsubscribing", ws.polls[2])
+	}
+
+	ws.status = http.StatusServiceUnavailable
+	enok(u.Publish(context.Background(), "a/b", 0, false, nil), t)
+	if u.Connected() || downs != 1 {
+		t.Fatalf("a webhook answering 503 is still connected")
+	}
+	ws.status = http.StatusOK
+	eok(u.Publish(context.Background(), "a/b", 0, false, nil), t)
+	if !u.Connected() || ups != 2 {
+		t.Fatalf("a webhook answering again is not connected")
+	}
+
+	noPoll := NewWebhookUpstream(WebhookConfig{URL: ws.URL + "/up"})
+	if err := noPoll.Subscribe(context.Background(), "a/b", 0); !errors.Is(err, ErrNoWebhookPoll) {
+		t.Fatalf("subscribing without a poll URL gave %v", err)
+	}
+	eok(noPoll.Connect(context.Background(), h), t)
+	if noPoll.Connected() {
+		t.Fatalf("a webhook is connected before it has answered")
+	}
+	eok(noPoll.Publish(context.Background(), "a/b", 0, false, nil), t)
+	if !noPoll.Connected() {
+		t.Fatalf("a webhook that answered is not connected")
+	}
+}
+
+// Connect fails if the first poll does, a webhook without a poll
+// interval polls at the default one, and polling starts again when the
+// webhook is connected again.
+func Test_WebhookUpstream_Connect(t *testing.T) {
+	ws := newWebhookServer()
+	defer ws.Close()
+	h := UpstreamHandlers{OnMessage: func(MQTT.Message) {}, OnConnect: func() {}, OnConnectionLost: func(error) {}}
+
+	ws.status = http.StatusServiceUnavailable
+	u := NewWebhookUpstream(ws.config())
+	if err := u.Connect(context.Background(), h); err == nil || u.Connected() {
+		t.Fatalf("Connect to a webhook answering 503 gave %v", err)
+	}
+	ws.status = http.StatusOK
+
+	conf := ws.config()
+	conf.PollInterval = 0
+	if NewWebhookUpstream(conf).conf.PollInterval != defaultPollInterval {
+		t.Fatalf("a webhook without a poll interval was not given the default")
+	}
+
+	eok(u.Subscribe(context.Background(), "a/b", 0), t)
+	polled := func() int {
+		ws.Lock()
+		defer ws.Unlock()
+		return len(ws.polls)
+	}
+	for i := 0; i < 2; i++ {
+		eok(u.Connect(context.Background(), h), t)
+		n := polled()
+		for deadline := time.Now().Add(time.Second); polled() < n+2; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("connection %d was not polled", i+1)
+			}
+		}
+		u.Disconnect()
+	}
+}
+
+func Test_GatewayConfig_webhook(t *testing.T) {
+	gc := NewGatewayConfig()
+	eok(gc.parseConfig("mode aggregating\nwebhook-url https://ingest.example/sn\nwebhook-poll-url https://ingest.example/sn/down\nwebhook-poll-interval 30\n"), t)
+	if gc.Webhook.URL != "https://ingest.example/sn" || gc.Webhook.PollInterval != 30*time.Second {
+		t.Fatalf("Webhook was %+v", gc.Webhook)
+	}
+	// no broker is needed
+	eok(gc.Check(), t)
+	if _, ok := gc.upstream().(*WebhookUpstream); !ok {
+		t.Fatalf("upstream was %T", gc.upstream())
+	}
+
+	enok(NewGatewayConfig().setOption("webhook-url", "tcp://localhost:1883"), t)
+	enok(NewGatewayConfig().setOption("webhook-poll-url", "http://"), t)
+
+	gc.Mode = Transparent
+	if p := gc.problems(); len(p) != 1 || p[0].Err != ErrUpstreamNotAggregating {
+		t.Fatalf("a transparent gateway with a webhook had problems %v", p)
+	}
+	gc = NewGatewayConfig()
+	gc.Mode = Aggregating
+	gc.Broker.URI = "tcp://localhost:1883"
+	gc.Webhook.PollURL = "http://localhost/down"
+	gc.Webhook.PollInterval = 0
+	if p := gc.problems(); len(p) != 2 || p[0].Err != ErrNoWebhookURL || p[1].Err != ErrNotPositive {
+		t.Fatalf("a poll URL alone had problems %v", p)
+	}
+	if _, ok := NewGatewayConfig().upstream().(*MQTTUpstream); !ok {
+		t.Fatalf("the default upstream is not the broker")
+	}
+}
+
+// Clients of an aggregating gateway publish to, and subscribe through,
+// a webhook as they would the broker.
+func Test_AGateway_webhook(t *testing.T) {
+	ws := newWebhookServer()
+	defer ws.Close()
+	mt := NewMemoryTransport("gw")
+	gc := NewGatewayConfig()
+	gc.Mode = Aggregating
+	gc.Webhook = ws.config()
+	gc.Transport = mt
+	ag, err := NewAGateway(gc)
+	eok(err, t)
+	eok(ag.Start(context.Background()), t)
+	defer ag.Shutdown(context.Background())
+	if !ag.Upstream().Connected() {
+		t.Fatalf("the webhook is not connected")
+	}
+
+	c := mt.Dial("client")
+	send := func(m Message) {
+		_, err := c.Write(m.AppendTo(nil))
+		eok(err, t)
+	}
+	read := func() Message {
+		b := make([]byte, 64)
+		n, err := c.Read(b)
+		eok(err, t)
+		m, err := DecodePacket(b[:n])
+		eok(err, t)
+		return m
+	}
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte("c1")
+	send(cm)
+	if ca, ok := read().(*ConnackMessage); !ok || ca.ReturnCode != ACCEPTED {
+		t.Fatalf("CONNECT was answered with %v", ca)
+	}
+
+	send(&RegisterMessage{MessageId: 1, TopicName: []byte("up/t")})
+	ra, ok := read().(*RegackMessage)
+	if !ok {
+		t.Fatalf("REGISTER was answered with %v", ra)
+	}
+	send(NewPublishMessage(ra.TopicId, 0x00, []byte("reading"), 0, 0, false, false))
+
+	send(&SubscribeMessage{MessageId: 2, TopicName: []byte("down/t")})
+	if sa, ok := read().(*SubackMessage); !ok || sa.ReturnCode != ACCEPTED {
+		t.Fatalf("SUBSCRIBE was answered with %v", sa)
+	}
+	ws.Lock()
+	ws.messages = []WebhookMessage{{Topic: "down/t", Payload: []byte("command")}}
+	ws.Unlock()
+	if pm, ok := read().(*PublishMessage); !ok || string(pm.Data) != "command" {
+		t.Fatalf("client was sent %v", pm)
+	}
+	ws.Lock()
+	posted := ws.posted
+	ws.Unlock()
+	if len(posted) != 1 || posted[0].Topic != "up/t" || string(posted[0].Payload) != "reading" {
+		t.Fatalf("POSTed %+v", posted)
+	}
+
+	send(&UnsubscribeMessage{MessageId: 3, TopicName: []byte("down/t")})
+	if ua, ok := read().(*UnsubackMessage); !ok || ua.MessageId != 3 {
+		t.Fatalf("UNSUBSCRIBE was answered with %v", ua)
+	}
+	if filters, _ := ag.Upstream().(*WebhookUpstream).subscriptions(); len(filters) != 0 {
+		t.Fatalf("still subscribed upstream to %v", filters)
+	}
+}
+
+// A SUBSCRIBE the upstream refuses is rejected, and the next one tries
+// the upstream again.
+func Test_AGateway_subscribe_failed(t *testing.T) {
+	_, up, sc := startRegisterGateway(t, NewGatewayConfig())
+	up.subscribeErr = ErrNoWebhookPoll
+	sc.send(&SubscribeMessage{MessageId: 1, TopicName: []byte("a/b")})
+	if sa, ok := sc.read().(*SubackMessage); !ok || sa.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("SUBSCRIBE was answered with %v", sa)
+	}
+
+	up.subscribeErr = errors.New("broker went away")
+	sc.send(&SubscribeMessage{MessageId: 2, TopicName: []byte("a/b")})
+	if sa, ok := sc.read().(*SubackMessage); !ok || sa.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("SUBSCRIBE was answered with %v", sa)
+	}
+
+	up.subscribeErr = nil
+	sc.send(&SubscribeMessage{MessageId: 3, TopicName: []byte("a/b")})
+	if sa, ok := sc.read().(*SubackMessage); !ok || sa.ReturnCode != ACCEPTED {
+		t.Fatalf("SUBSCRIBE was answered with %v", sa)
+	}
+	if up.subscribes != 3 {
+		t.Fatalf("the upstream was asked to subscribe %d times, not 3", up.subscribes)
+	}
+}
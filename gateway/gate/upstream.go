@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// An Upstream is what an aggregating gateway publishes its clients'
+// messages to, and subscribes to on their behalf. By default it is the
+// MQTT broker of the config, GatewayConfig.Webhook makes it an HTTP
+// endpoint and GatewayConfig.Upstream can be any other backend.
+type Upstream interface {
+	// Connect connects to the backend, h is called for what happens
+	// to the connection and for each message for a subscription. The
+	// connection stays up, or is brought back, until Disconnect.
+	Connect(ctx context.Context, h UpstreamHandlers) error
+	Disconnect()
+	Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error
+	Subscribe(ctx context.Context, filter string, qos byte) error
+	Unsubscribe(ctx context.Context, filter string) error
+	// Connected reports whether the backend is reachable.
+	Connected() bool
+}
+
+// UpstreamHandlers are called by an Upstream, OnConnect each time it
+// connects and OnConnectionLost each time it loses the connection.
+type UpstreamHandlers struct {
+	OnMessage        func(MQTT.Message)
+	OnConnect        func()
+	OnConnectionLost func(error)
+}
+
+// How long the gateway waits for the upstream to take a message or a
+// subscription.
+const upstreamTimeout = 2 * time.Second
+
+// upstream is the Upstream that gc asks for.
+func (gc *GatewayConfig) upstream() Upstream {
+	switch {
+	case gc.Upstream != nil:
+		return gc.Upstream
+	case gc.Webhook.URL != "":
+		return NewWebhookUpstream(gc.Webhook)
+	}
+	return NewMQTTUpstream(gc.Broker)
+}
+
+// MQTTUpstream is an MQTT broker, the default Upstream.
+type MQTTUpstream struct {
+	opts    *MQTT.ClientOptions
+	client  *MQTT.Client
+	handler MQTT.MessageHandler
+}
+
+func NewMQTTUpstream(bc BrokerConfig) *MQTTUpstream {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(bc.URI)
+	if bc.Username != "" {
+		opts.SetUsername(bc.Username)
+	}
+	if bc.Password != "" {
+		opts.SetPassword(bc.Password)
+	}
+	if bc.ClientId != "" {
+		opts.SetClientID(bc.ClientId)
+	}
+	if bc.KeepAlive > 0 {
+		opts.SetKeepAlive(bc.KeepAlive)
+	}
+	return &MQTTUpstream{opts: opts}
+}
+
+func (u *MQTTUpstream) Connect(ctx context.Context, h UpstreamHandlers) error {
+	u.opts.SetOnConnectHandler(func(*MQTT.Client) {
+		h.OnConnect()
+	})
+	u.opts.SetConnectionLostHandler(func(_ *MQTT.Client, err error) {
+		h.OnConnectionLost(err)
+	})
+	u.handler = func(_ *MQTT.Client, msg MQTT.Message) {
+		h.OnMessage(msg)
+	}
+	u.client = MQTT.NewClient(u.opts)
+	return waitToken(ctx, u.client.Connect())
+}
+
+func (u *MQTTUpstream) Disconnect() {
+	u.client.Disconnect(250) //give broker some time to process DISCONNECT
+}
+
+func (u *MQTTUpstream) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	return waitToken(ctx, u.client.Publish(topic, qos, retain, payload))
+}
+
+func (u *MQTTUpstream) Subscribe(ctx context.Context, filter string, qos byte) error {
+	return waitToken(ctx, u.client.Subscribe(filter, qos, u.handler))
+}
+
+func (u *MQTTUpstream) Unsubscribe(ctx context.Context, filter string) error {
+	return waitToken(ctx, u.client.Unsubscribe(filter))
+}
+
+func (u *MQTTUpstream) Connected() bool {
+	return u.client != nil && u.client.IsConnected()
+}
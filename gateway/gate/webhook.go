@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A WebhookMessage is a message to or from a webhook, as JSON. The
+// payload is base64 encoded.
+type WebhookMessage struct {
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload []byte `json:"payload"`
+}
+
+// WebhookUpstream is an HTTP endpoint, for backends that don't speak
+// MQTT. Each message from the clients is POSTed to the URL. If there is
+// a PollURL it is fetched every PollInterval, with a "filter" parameter
+// for each subscription, for the messages to the subscribers: a JSON
+// array of WebhookMessages, or 204 if there are none. The webhook is
+// connected once a request gets an answer, and as long as its requests
+// get an answer other than a 5xx.
+type WebhookUpstream struct {
+	conf      WebhookConfig
+	client    *http.Client
+	handlers  UpstreamHandlers
+	connected atomic.Bool
+	// the subscriptions, and their QoS
+	lock    sync.Mutex
+	filters map[string]byte
+	// closed by Disconnect to stop the polling, nil when not polling
+	done chan struct{}
+}
+
+// The PollInterval of a WebhookConfig that has none.
+const defaultPollInterval = 10 * time.Second
+
+func NewWebhookUpstream(wc WebhookConfig) *WebhookUpstream {
+	if wc.PollInterval <= 0 {
+		wc.PollInterval = defaultPollInterval
+	}
+	return &WebhookUpstream{
+		conf:    wc,
+		client:  &http.Client{},
+		filters: make(map[string]byte),
+	}
+}
+
+// Connect polls the webhook, if it has a PollURL, and keeps polling if
+// it answers. Without one the webhook is connected once a message from
+// the clients has been POSTed.
+func (u *WebhookUpstream) Connect(ctx context.Context, h UpstreamHandlers) error {
+	u.handlers = h
+	if u.conf.PollURL == "" {
+		return nil
+	}
+	// with no subscriptions yet there is nothing to be had from the
+	// first poll but the answer
+	if _, err := u.get(ctx, nil); err != nil {
+		return err
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.done == nil {
+		u.done = make(chan struct{})
+		go u.poll(u.done)
+	}
+	return nil
+}
+
+func (u *WebhookUpstream) Disconnect() {
+	u.lock.Lock()
+	if u.done != nil {
+		close(u.done)
+		u.done = nil
+	}
+	u.lock.Unlock()
+	u.connected.Store(false)
+}
+
+func (u *WebhookUpstream) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	body, err := json.Marshal(WebhookMessage{topic, qos, retain, payload})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Subscriptions are only kept, to be sent with each poll.
+func (u *WebhookUpstream) Subscribe(ctx context.Context, filter string, qos byte) error {
+	if u.conf.PollURL == "" {
+		return ErrNoWebhookPoll
+	}
+	defer u.lock.Unlock()
+	u.lock.Lock()
+	u.filters[filter] = qos
+	return nil
+}
+
+func (u *WebhookUpstream) Unsubscribe(ctx context.Context, filter string) error {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+	delete(u.filters, filter)
+	return nil
+}
+
+func (u *WebhookUpstream) Connected() bool {
+	return u.connected.Load()
+}
+
+// do sends req, an answer other than a 2xx is an error.
+func (u *WebhookUpstream) do(req *http.Request) (*http.Response, error) {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		u.setConnected(err)
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+		if resp.StatusCode >= 500 {
+			u.setConnected(err)
+		}
+		return nil, err
+	}
+	u.setConnected(nil)
+	return resp, nil
+}
+
+// setConnected tells the handlers when the webhook comes and goes, err
+// is why it went.
+func (u *WebhookUpstream) setConnected(err error) {
+	if err == nil {
+		if !u.connected.Swap(true) {
+			u.handlers.OnConnect()
+		}
+	} else if u.connected.Swap(false) {
+		u.handlers.OnConnectionLost(err)
+	}
+}
+
+// subscriptions returns the filters, sorted, and their QoS.
+func (u *WebhookUpstream) subscriptions() ([]string, map[string]byte) {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+	filters := make([]string, 0, len(u.filters))
+	qos := make(map[string]byte, len(u.filters))
+	for f, q := range u.filters {
+		filters = append(filters, f)
+		qos[f] = q
+	}
+	sort.Strings(filters)
+	return filters, qos
+}
+
+// poll fetches every PollInterval until done is closed.
+func (u *WebhookUpstream) poll(done <-chan struct{}) {
+	ticker := time.NewTicker(u.conf.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := u.fetch(); err != nil {
+				ERROR.Println("polling the webhook:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// fetch gets the messages waiting for the subscriptions, and hands
+// each to the handlers at no more than the QoS it was subscribed at.
+func (u *WebhookUpstream) fetch() error {
+	filters, qos := u.subscriptions()
+	if len(filters) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), u.conf.PollInterval)
+	defer cancel()
+	messages, err := u.get(ctx, filters)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if _, err := ValidateTopicName(m.Topic); err != nil {
+			ERROR.Printf("dropping a message from the webhook to \"%s\": %v\n", m.Topic, err)
+			continue
+		}
+		subscribed, granted := false, byte(0)
+		for _, f := range filters {
+			if covers(f, m.Topic) {
+				subscribed = true
+				granted = max(granted, qos[f])
+			}
+		}
+		if subscribed {
+			m.Qos = min(m.Qos, granted)
+			u.handlers.OnMessage(webhookMessage{m})
+		}
+	}
+	return nil
+}
+
+// get polls the webhook for the messages waiting for filters.
+func (u *WebhookUpstream) get(ctx context.Context, filters []string) ([]WebhookMessage, error) {
+	pollURL, err := url.Parse(u.conf.PollURL)
+	if err != nil {
+		return nil, err
+	}
+	query := pollURL.Query()
+	query["filter"] = filters
+	pollURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pollURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var messages []WebhookMessage
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// webhookMessage is a message from a webhook, as the gateway sees
+// messages from the broker.
+type webhookMessage struct {
+	m WebhookMessage
+}
+
+func (m webhookMessage) Duplicate() bool   { return false }
+func (m webhookMessage) Qos() byte         { return m.m.Qos }
+func (m webhookMessage) Retained() bool    { return m.m.Retain }
+func (m webhookMessage) Topic() string     { return m.m.Topic }
+func (m webhookMessage) MessageID() uint16 { return 0 }
+func (m webhookMessage) Payload() []byte   { return m.m.Payload }
@@ -1,63 +1,170 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	G "github.com/alsm/gnatt/gateway/gate"
+	"github.com/alsm/gnatt/logging"
 )
 
 func main() {
-	var gateway G.Gateway
-	stopsig := registerSignals()
-	gatewayconf := setup()
+	stopsig, hup := registerSignals()
+
+	// config errors are logged before the config says how to log
+	G.InitLogger(os.Stdout, os.Stderr)
 
-	G.InitLogger(os.Stdout, os.Stderr) // todo: configurable
+	gatewayconf := setup()
+	G.SetLogger(G.NewLogger(gatewayconf.Log, os.Stdout, os.Stderr))
 
-	if gatewayconf.IsAggregating() {
+	if len(gatewayconf.Tenants) > 0 {
+		G.INFO.Printf("GNATT Gateway starting %d tenants\n", len(gatewayconf.Tenants))
+	} else if gatewayconf.Mode == G.Aggregating {
 		G.INFO.Println("GNATT Gateway starting in aggregating mode")
-		gateway = initAggregating(gatewayconf, stopsig)
 	} else {
 		G.INFO.Println("GNATT Gateway starting in transparent mode")
-		gateway = initTransparent(gatewayconf, stopsig)
+	}
+	gateway, err := G.New(gatewayconf)
+	if err != nil {
+		G.ERROR.Fatal(err)
 	}
 
-	gateway.Start()
+	if err := gateway.Start(context.Background()); err != nil {
+		G.ERROR.Fatal(err)
+	}
+
+	for {
+		select {
+		case <-hup:
+			G.INFO.Println("SIGHUP, reloading the config")
+			result, err := gateway.ReloadConfig()
+			if err != nil {
+				logConfig(err)
+				G.ERROR.Println("the config was not reloaded")
+			} else if len(result.NeedRestart) > 0 {
+				G.INFO.Printf("restart the gateway to change %s\n", strings.Join(result.NeedRestart, ", "))
+			}
+		case <-stopsig:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := gateway.Shutdown(ctx); err != nil {
+				G.ERROR.Println(err)
+			}
+			return
+		}
+	}
 }
 
 func setup() *G.GatewayConfig {
-	var configFile string
+	var configFile, logLevel, logFormat, trace string
 	var port int
+	var checkConfig bool
 
-	flag.StringVar(&configFile, "c", "", "Configuration File")
-	flag.IntVar(&port, "port", 0, "MQTT-G UDP Listening Port")
+	flag.StringVar(&configFile, "c", "", "Configuration File, flat or, if it ends in .toml, TOML")
+	flag.BoolVar(&checkConfig, "check-config", false, "Report every problem with the configuration file and exit")
+	flag.IntVar(&port, "port", 0, "Port to listen on (overrides the port of listen, for gateways without listeners or tenants)")
+	flag.StringVar(&logLevel, "log-level", "", "Least severe level logged, debug, info, warn or error (overrides log-level)")
+	flag.StringVar(&logFormat, "log-format", "", "Log as text or json (overrides log-format)")
+	flag.StringVar(&trace, "trace", "", "Comma separated ids of clients whose packets are logged at any level")
 	flag.Parse()
 
-	if configFile != "" {
-		if gc, err := G.ParseConfigFile(configFile); err != nil {
-			G.ERROR.Fatal(err)
-		} else {
-			return gc
+	if configFile != "" && checkConfig {
+		// the problems are listed once, not logged as they are found
+		G.SetLogger(logging.Discard)
+		if err := G.CheckConfigFile(configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		fmt.Printf("%s: OK\n", configFile)
+		os.Exit(0)
 	}
 
-	G.ERROR.Fatal("-configuration <file> must be specified")
-	return nil
+	if configFile == "" {
+		G.ERROR.Fatal("-configuration <file> must be specified")
+	}
+	var level slog.Level
+	var err error
+	if logLevel != "" {
+		if level, err = logging.ParseLevel(logLevel); err != nil {
+			G.ERROR.Fatal(err)
+		}
+	}
+	if logFormat != "" {
+		if err = logging.CheckFormat(logFormat); err != nil {
+			G.ERROR.Fatal(err)
+		}
+	}
+	// the flags win over the file, when it is reloaded too
+	load := func() (*G.GatewayConfig, error) {
+		gc, err := G.ParseConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if logLevel != "" {
+			gc.Log.Level = level
+		}
+		if logFormat != "" {
+			gc.Log.Format = logFormat
+		}
+		if trace != "" {
+			gc.Log.Trace = append(gc.Log.Trace, strings.Split(trace, ",")...)
+		}
+		if port != 0 {
+			if len(gc.Listeners) > 0 || len(gc.Tenants) > 0 {
+				return nil, errPortWithListeners
+			}
+			host, _, _ := net.SplitHostPort(gc.ListenAddress)
+			gc.ListenAddress = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		return gc, nil
+	}
+	gc, err := load()
+	if err == nil {
+		err = gc.Check()
+	}
+	if err != nil {
+		fatalConfig(err)
+	}
+	gc.Load = load
+	return gc
 }
 
-func initAggregating(c *G.GatewayConfig, stopsig chan os.Signal) *G.AGateway {
-	a := G.NewAGateway(c, stopsig)
-	return a
+// Each listener, and tenant, has its own address, there is no one port
+// to change.
+var errPortWithListeners = errors.New("-port cannot be used with listeners or tenants")
+
+// logConfig logs each problem with the configuration.
+func logConfig(err error) {
+	if problems, ok := err.(G.ConfigErrors); ok {
+		for _, p := range problems {
+			G.ERROR.Println(p)
+		}
+		return
+	}
+	G.ERROR.Println(err)
 }
 
-func initTransparent(c *G.GatewayConfig, stopsig chan os.Signal) *G.TGateway {
-	t := G.NewTGateway(c, stopsig)
-	return t
+func fatalConfig(err error) {
+	logConfig(err)
+	os.Exit(1)
 }
 
-func registerSignals() chan os.Signal {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	return c
+// registerSignals returns channels of the signals to stop on, and of
+// SIGHUP, to reload the config on.
+func registerSignals() (chan os.Signal, chan os.Signal) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	return stop, hup
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	G "github.com/alsm/gnatt/gateway/gate"
+)
+
+const usage = `gnatt-ctl talks to a running gateway's admin API.
+
+Usage: gnatt-ctl [flags] <command> [arguments]
+
+Commands:
+  clients                            list the clients
+  client <id>                        show a client, its registrations and subscriptions
+  subscriptions                      list the topic filters and their subscribers
+  topics                             list the registered and predefined topic ids
+  kick <id>                          disconnect a client
+  publish [-qos n] [-retain] <id> <topic> <payload>
+                                     send a client a PUBLISH
+  events [<id>]                      tail the gateway's events, of one client or all
+  trace [<id> on|off]                list the clients being traced, or trace one
+  reload                             have the gateway read its config again
+
+Flags:
+`
+
+func main() {
+	var admin string
+	var asJSON bool
+
+	flag.StringVar(&admin, "admin", "localhost:9101", "Admin API address, host:port or unix:<path>")
+	flag.BoolVar(&asJSON, "json", false, "Print JSON rather than tables")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := newCtl(admin, asJSON)
+	args := flag.Args()[1:]
+	var err error
+	switch flag.Arg(0) {
+	case "clients":
+		err = c.clients()
+	case "client":
+		err = c.withId(args, c.client)
+	case "subscriptions":
+		err = c.subscriptions()
+	case "topics":
+		err = c.topics()
+	case "kick":
+		err = c.withId(args, c.kick)
+	case "publish":
+		err = c.publish(args)
+	case "events":
+		err = c.events(args)
+	case "trace":
+		err = c.trace(args)
+	case "reload":
+		err = c.reload()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gnatt-ctl:", err)
+		os.Exit(1)
+	}
+}
+
+type ctl struct {
+	http   http.Client
+	asJSON bool
+	out    io.Writer
+}
+
+// newCtl makes a ctl for the admin API at addr, which is "host:port"
+// or "unix:" and the path of a socket.
+func newCtl(addr string, asJSON bool) *ctl {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	return &ctl{
+		http:   http.Client{Transport: &http.Transport{DialContext: dial}},
+		asJSON: asJSON,
+		out:    os.Stdout,
+	}
+}
+
+func (c *ctl) withId(args []string, f func(id string) error) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a client id")
+	}
+	return f(args[0])
+}
+
+func clientPath(id string) string {
+	return "/clients/" + url.PathEscape(id)
+}
+
+// do makes a request of the admin API and decodes the response into v,
+// if v isn't nil. An error response becomes an error.
+func (c *ctl) do(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://gateway"+path, r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *ctl) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *ctl) table(header string, rows func(w io.Writer)) error {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	rows(w)
+	return w.Flush()
+}
+
+func lastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
+
+func (c *ctl) clients() error {
+	var infos []G.ClientInfo
+	if err := c.do("GET", "/clients", nil, &infos); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(infos)
+	}
+	return c.table("CLIENT ID\tADDRESS\tSTATE\tVERSION\tKEEP ALIVE\tLAST SEEN", func(w io.Writer) {
+		for _, i := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%ds\t%s\n", i.ClientId, i.Address, i.State, i.Version, i.KeepAlive, lastSeen(i.LastSeen))
+		}
+	})
+}
+
+func (c *ctl) client(id string) error {
+	var info G.ClientInfo
+	if err := c.do("GET", clientPath(id), nil, &info); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(info)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Client ID:\t%s\n", info.ClientId)
+	fmt.Fprintf(w, "Address:\t%s\n", info.Address)
+	fmt.Fprintf(w, "State:\t%s\n", info.State)
+	fmt.Fprintf(w, "Version:\t%d\n", info.Version)
+	fmt.Fprintf(w, "Keep alive:\t%ds\n", info.KeepAlive)
+	fmt.Fprintf(w, "Last seen:\t%s\n", lastSeen(info.LastSeen))
+	fmt.Fprintln(w, "Registrations:")
+	for _, id := range sortedIds(info.Registrations) {
+		fmt.Fprintf(w, "  %d\t%s\n", id, info.Registrations[id])
+	}
+	fmt.Fprintln(w, "Subscriptions:")
+	for _, filter := range info.Subscriptions {
+		fmt.Fprintf(w, "  %s\n", filter)
+	}
+	return w.Flush()
+}
+
+func sortedIds(topics map[uint16]string) []uint16 {
+	ids := make([]uint16, 0, len(topics))
+	for id := range topics {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (c *ctl) subscriptions() error {
+	var subs map[string][]string
+	if err := c.do("GET", "/topics/tree", nil, &subs); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(subs)
+	}
+	filters := make([]string, 0, len(subs))
+	for filter := range subs {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	return c.table("TOPIC FILTER\tCLIENTS", func(w io.Writer) {
+		for _, filter := range filters {
+			fmt.Fprintf(w, "%s\t%s\n", filter, strings.Join(subs[filter], ", "))
+		}
+	})
+}
+
+func (c *ctl) topics() error {
+	var registry G.TopicRegistry
+	if err := c.do("GET", "/topics", nil, &registry); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(registry)
+	}
+	return c.table("ID\tKIND\tTOPIC", func(w io.Writer) {
+		for _, id := range sortedIds(registry.Predefined) {
+			fmt.Fprintf(w, "%d\tpredefined\t%s\n", id, registry.Predefined[id])
+		}
+		for _, id := range sortedIds(registry.Registered) {
+			fmt.Fprintf(w, "%d\tregistered\t%s\n", id, registry.Registered[id])
+		}
+	})
+}
+
+func (c *ctl) kick(id string) error {
+	return c.do("POST", clientPath(id)+"/disconnect", nil, nil)
+}
+
+func (c *ctl) publish(args []string) error {
+	var p G.AdminPublish
+	var qos int
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	fs.IntVar(&qos, "qos", 0, "QoS of the PUBLISH, 0, 1 or 2")
+	fs.BoolVar(&p.Retain, "retain", false, "Set the retain flag")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return fmt.Errorf("expected a client id, topic and payload")
+	}
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2")
+	}
+	p.Qos, p.Topic, p.Payload = byte(qos), fs.Arg(1), fs.Arg(2)
+	return c.do("POST", clientPath(fs.Arg(0))+"/publish", p, nil)
+}
+
+// trace turns tracing a client on or off, or lists the clients traced.
+func (c *ctl) trace(args []string) error {
+	switch {
+	case len(args) == 0:
+		var ids []string
+		if err := c.do("GET", "/trace", nil, &ids); err != nil {
+			return err
+		}
+		if c.asJSON {
+			return c.printJSON(ids)
+		}
+		for _, id := range ids {
+			fmt.Fprintln(c.out, id)
+		}
+		return nil
+	case len(args) == 2 && args[1] == "on":
+		return c.do("PUT", "/trace/"+url.PathEscape(args[0]), nil, nil)
+	case len(args) == 2 && args[1] == "off":
+		return c.do("DELETE", "/trace/"+url.PathEscape(args[0]), nil, nil)
+	}
+	return fmt.Errorf("expected a client id and on or off")
+}
+
+func (c *ctl) reload() error {
+	var result G.ReloadResult
+	if err := c.do("POST", "/config/reload", nil, &result); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(result)
+	}
+	if len(result.Applied) == 0 {
+		fmt.Fprintln(c.out, "Nothing to apply")
+	} else {
+		fmt.Fprintf(c.out, "Changed: %s\n", strings.Join(result.Applied, ", "))
+	}
+	if len(result.NeedRestart) > 0 {
+		fmt.Fprintf(c.out, "Restart the gateway to change: %s\n", strings.Join(result.NeedRestart, ", "))
+	}
+	return nil
+}
+
+// events prints events as they happen until interrupted.
+func (c *ctl) events(args []string) error {
+	path := "/events"
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most one client id")
+	} else if len(args) == 1 {
+		path += "?client=" + url.QueryEscape(args[0])
+	}
+	resp, err := c.http.Get("http://gateway" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if c.asJSON {
+			fmt.Fprintln(c.out, lines.Text())
+			continue
+		}
+		var e G.Event
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			return err
+		}
+		who := e.ClientId
+		if who == "" {
+			who = "-"
+		}
+		// events are printed as they come, so the columns are fixed
+		fmt.Fprintf(c.out, "%s  %-10s  %-16s  %-21s  %s  %s\n", e.Time.Format("15:04:05.000"), e.Type, who, e.Address, e.Topic, e.Detail)
+	}
+	return lines.Err()
+}
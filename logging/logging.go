@@ -0,0 +1,228 @@
+// Package logging is the leveled, structured logging shared by the
+// gateway and the client. Records are written by a Handler at or above
+// its level, and debug records about a traced client are written
+// whatever the level, so that one device can be followed without
+// turning on debug logging for all of them.
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Keys of the fields common to gateway and client records.
+const (
+	ClientId = "client_id"
+	MsgType  = "msg_type"
+	TopicId  = "topic_id"
+	Topic    = "topic"
+	Addr     = "addr"
+)
+
+// Formats a Handler can write.
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+var (
+	ErrUnknownLevel  = errors.New("unknown log level, must be debug, info, warn or error")
+	ErrUnknownFormat = errors.New("unknown log format, must be text or json")
+)
+
+// ParseLevel parses the name of a level, as in a config file or flag.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, ErrUnknownLevel
+}
+
+// CheckFormat returns an error if f isn't a format a Handler can write.
+func CheckFormat(f string) error {
+	switch f {
+	case Text, JSON:
+		return nil
+	}
+	return ErrUnknownFormat
+}
+
+// The clients traced, shared by every Handler.
+var (
+	traceLock sync.RWMutex
+	traced    = make(map[string]bool)
+	// tracing is len(traced), read without the lock on every record
+	tracing atomic.Int32
+)
+
+// Trace turns debug logging of clientId on or off.
+func Trace(clientId string, on bool) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	if on {
+		traced[clientId] = true
+	} else {
+		delete(traced, clientId)
+	}
+	tracing.Store(int32(len(traced)))
+}
+
+// Traced returns the ids of the clients being traced, sorted.
+func Traced() []string {
+	traceLock.RLock()
+	defer traceLock.RUnlock()
+	ids := make([]string, 0, len(traced))
+	for id := range traced {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// IsTraced reports whether clientId is being traced.
+func IsTraced(clientId string) bool {
+	if tracing.Load() == 0 {
+		return false
+	}
+	traceLock.RLock()
+	defer traceLock.RUnlock()
+	return traced[clientId]
+}
+
+// Options for a Handler. Records at warn and above go to ErrOut, if it
+// is set, and everything else to Out.
+type Options struct {
+	Out    io.Writer
+	ErrOut io.Writer
+	Format string
+	// Level may be a *slog.LevelVar to change it while running
+	Level slog.Leveler
+}
+
+// A Handler writes records at or above its level, and records below
+// it that have the client_id of a traced client.
+type Handler struct {
+	level slog.Leveler
+	out   slog.Handler
+	err   slog.Handler
+	// clientId is set by WithAttrs, for the records of one client
+	clientId string
+}
+
+// NewHandler returns a Handler writing as o says.
+func NewHandler(o Options) *Handler {
+	if o.Out == nil {
+		o.Out = io.Discard
+	}
+	if o.ErrOut == nil {
+		o.ErrOut = o.Out
+	}
+	if o.Level == nil {
+		o.Level = slog.LevelInfo
+	}
+	// the Handler does the filtering
+	ho := &slog.HandlerOptions{Level: slog.LevelDebug}
+	h := &Handler{level: o.Level}
+	if o.Format == JSON {
+		h.out, h.err = slog.NewJSONHandler(o.Out, ho), slog.NewJSONHandler(o.ErrOut, ho)
+	} else {
+		h.out, h.err = slog.NewTextHandler(o.Out, ho), slog.NewTextHandler(o.ErrOut, ho)
+	}
+	return h
+}
+
+func (h *Handler) Enabled(_ context.Context, l slog.Level) bool {
+	if l >= h.level.Level() {
+		return true
+	}
+	if h.clientId != "" {
+		return IsTraced(h.clientId)
+	}
+	return tracing.Load() > 0
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < h.level.Level() && !h.traced(r) {
+		return nil
+	}
+	if r.Level >= slog.LevelWarn {
+		return h.err.Handle(ctx, r)
+	}
+	return h.out.Handle(ctx, r)
+}
+
+func (h *Handler) traced(r slog.Record) bool {
+	if h.clientId != "" {
+		return IsTraced(h.clientId)
+	}
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == ClientId {
+			found = IsTraced(a.Value.String())
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	for _, a := range attrs {
+		if a.Key == ClientId {
+			c.clientId = a.Value.String()
+		}
+	}
+	c.out, c.err = h.out.WithAttrs(attrs), h.err.WithAttrs(attrs)
+	return &c
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.out, c.err = h.out.WithGroup(name), h.err.WithGroup(name)
+	return &c
+}
+
+// Printf returns a *log.Logger that writes to l at level, for code
+// logging with Printf and Println rather than fields.
+func Printf(l *slog.Logger, level slog.Level) *log.Logger {
+	return slog.NewLogLogger(l.Handler(), level)
+}
+
+// Discard is a logger that writes nothing.
+var Discard = slog.New(NewHandler(Options{Out: io.Discard, Level: slog.LevelError + 1}))
+
+// Packet returns the fields describing m, its msg_type and, if it has
+// one, topic_id.
+func Packet(m Message) []any {
+	fields := []any{MsgType, MessageNames[m.MessageType()]}
+	switch m := m.(type) {
+	case *PublishMessage:
+		return append(fields, TopicId, m.TopicId)
+	case *PubackMessage:
+		return append(fields, TopicId, m.TopicId)
+	case *RegisterMessage:
+		return append(fields, TopicId, m.TopicId)
+	case *RegackMessage:
+		return append(fields, TopicId, m.TopicId)
+	case *SubackMessage:
+		return append(fields, TopicId, m.TopicId)
+	}
+	return fields
+}
@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		if l, err := ParseLevel(s); err != nil || l != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", s, l, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err != ErrUnknownLevel {
+		t.Errorf("ParseLevel(\"loud\") gave %v", err)
+	}
+	if CheckFormat(JSON) != nil || CheckFormat("xml") != ErrUnknownFormat {
+		t.Error("CheckFormat")
+	}
+}
+
+func TestHandler_levels(t *testing.T) {
+	var out, errOut bytes.Buffer
+	l := slog.New(NewHandler(Options{Out: &out, ErrOut: &errOut, Level: slog.LevelInfo}))
+	l.Debug("hidden")
+	l.Info("shown")
+	l.Error("failed")
+	if strings.Contains(out.String(), "hidden") || !strings.Contains(out.String(), "shown") {
+		t.Errorf("out is %q", out.String())
+	}
+	if strings.Contains(out.String(), "failed") || !strings.Contains(errOut.String(), "failed") {
+		t.Errorf("errors went to %q and %q", out.String(), errOut.String())
+	}
+}
+
+func TestHandler_trace(t *testing.T) {
+	var out bytes.Buffer
+	l := slog.New(NewHandler(Options{Out: &out, Format: JSON}))
+	Trace("c1", true)
+	defer Trace("c1", false)
+	if ids := Traced(); len(ids) != 1 || ids[0] != "c1" || !IsTraced("c1") || IsTraced("c2") {
+		t.Fatalf("Traced() = %v", ids)
+	}
+
+	l.Debug("received", append([]any{ClientId, "c2"}, Packet(NewMessage(PINGREQ))...)...)
+	if out.Len() != 0 {
+		t.Fatalf("untraced client logged %q", out.String())
+	}
+	l.Debug("received", append([]any{ClientId, "c1"}, Packet(NewPublishMessage(7, 0, nil, 1, 1, false, false))...)...)
+	var r map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r[ClientId] != "c1" || r[MsgType] != "PUBLISH" || r[TopicId] != float64(7) {
+		t.Fatalf("traced record is %v", r)
+	}
+
+	out.Reset()
+	l.With(ClientId, "c1").Debug("with")
+	l.With(ClientId, "c2").Debug("without")
+	if !strings.Contains(out.String(), "with") || strings.Contains(out.String(), "without") {
+		t.Fatalf("With gave %q", out.String())
+	}
+
+	out.Reset()
+	Trace("c1", false)
+	l.Debug("received", ClientId, "c1")
+	if out.Len() != 0 {
+		t.Fatalf("client no longer traced logged %q", out.String())
+	}
+}
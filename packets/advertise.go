@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -14,17 +15,41 @@ func (a *AdvertiseMessage) MessageType() byte {
 	return ADVERTISE
 }
 
+func (a *AdvertiseMessage) String() string {
+	return fmt.Sprintf("ADVERTISE(gwid=%d duration=%d)", a.GatewayId, a.Duration)
+}
+
+func (a *AdvertiseMessage) MarshalJSON() ([]byte, error) {
+	type fields AdvertiseMessage
+	return marshalMessage(a, (*fields)(a))
+}
+
+func (a *AdvertiseMessage) Validate() error {
+	return nil
+}
+
+func (a *AdvertiseMessage) Size() int {
+	return 5
+}
+
+func (a *AdvertiseMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, a.Size(), ADVERTISE)
+	b = append(b, a.GatewayId)
+	return appendUint16(b, a.Duration)
+}
+
 func (a *AdvertiseMessage) Write(w io.Writer) error {
-	packet := a.Header.pack()
-	packet.WriteByte(ADVERTISE)
-	packet.WriteByte(a.GatewayId)
-	packet.Write(encodeUint16(a.Duration))
-	_, err := packet.WriteTo(w)
+	a.Header.Length = uint16(a.Size())
+	return writePacket(w, a)
+}
 
-	return err
+func (a *AdvertiseMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	a.GatewayId = f.readByte()
+	a.Duration = f.readUint16()
+	return f.end()
 }
 
-func (a *AdvertiseMessage) Unpack(b io.Reader) {
-	a.GatewayId = readByte(b)
-	a.Duration = readUint16(b)
+func (a *AdvertiseMessage) Unpack(b io.Reader) error {
+	return unpack(b, a)
 }
@@ -0,0 +1,94 @@
+package packets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// AuthMessage, new in MQTT-SN v2.0, carries an exchange of the
+// authentication Method named in it. The client sends one after a
+// CONNECT with Auth set, and the two sides trade them with
+// RC_CONTINUE_AUTH until the gateway answers with a CONNACK.
+type AuthMessage struct {
+	Header
+	ReasonCode byte
+	Method     []byte
+	Data       []byte
+}
+
+func NewAuthMessage(ReasonCode byte, Method, Data []byte) *AuthMessage {
+	return &AuthMessage{
+		ReasonCode: ReasonCode,
+		Method:     Method,
+		Data:       Data,
+	}
+}
+
+func (a *AuthMessage) MessageType() byte {
+	return AUTH
+}
+
+func (a *AuthMessage) String() string {
+	return fmt.Sprintf("AUTH(rc=%s method=%q len=%d)", returnCode(a.ReasonCode), a.Method, len(a.Data))
+}
+
+func (a *AuthMessage) MarshalJSON() ([]byte, error) {
+	type fields AuthMessage
+	return marshalMessage(a, struct {
+		*fields
+		Method text
+	}{(*fields)(a), a.Method})
+}
+
+func (a *AuthMessage) UnmarshalJSON(b []byte) error {
+	type fields AuthMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		Method *text
+	}{(*fields)(a), (*text)(&a.Method)})
+}
+
+func (a *AuthMessage) Validate() error {
+	switch a.ReasonCode {
+	case ACCEPTED, RC_CONTINUE_AUTH, RC_REAUTHENTICATE:
+	default:
+		return ErrInvalidReturnCode
+	}
+	if len(a.Method) == 0 || len(a.Method) > 0xFF || !utf8.Valid(a.Method) {
+		return ErrInvalidAuthMethod
+	}
+	return nil
+}
+
+func (a *AuthMessage) Size() int {
+	return packetLength(len(a.Method) + len(a.Data) + 4)
+}
+
+func (a *AuthMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, a.Size(), AUTH)
+	b = append(b, a.ReasonCode, byte(len(a.Method)))
+	b = append(b, a.Method...)
+	return append(b, a.Data...)
+}
+
+func (a *AuthMessage) Write(w io.Writer) error {
+	if len(a.Method) > 0xFF {
+		return ErrInvalidAuthMethod
+	}
+	a.Header.Length = uint16(a.Size())
+	return writePacket(w, a)
+}
+
+func (a *AuthMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	a.ReasonCode = f.readByte()
+	a.Method = f.readBytes(int(f.readByte()))
+	a.Data = f.rest()
+	return f.end()
+}
+
+func (a *AuthMessage) Unpack(b io.Reader) error {
+	return unpack(b, a)
+}
@@ -0,0 +1,31 @@
+package packets
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAuthMessage(t *testing.T) {
+	msg := NewMessage(AUTH).(*AuthMessage)
+
+	if assert.NotNil(t, msg, "New message should not be nil") {
+		assert.Equal(t, byte(AUTH), msg.MessageType(), "MessageType() should return AUTH")
+	}
+}
+
+func TestAuthRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	a := NewAuthMessage(RC_CONTINUE_AUTH, []byte("PLAIN"), []byte("\x00user\x00pass"))
+	if assert.NoError(t, a.Write(&b)) {
+		assert.Equal(t, []byte{0x13, AUTH, RC_CONTINUE_AUTH, 0x05, 'P', 'L', 'A', 'I', 'N'}, b.Bytes()[:9])
+	}
+
+	m, err := ReadPacket(&b)
+	if assert.NoError(t, err) {
+		r := m.(*AuthMessage)
+		assert.Equal(t, byte(RC_CONTINUE_AUTH), r.ReasonCode)
+		assert.Equal(t, []byte("PLAIN"), r.Method)
+		assert.Equal(t, []byte("\x00user\x00pass"), r.Data)
+	}
+}
@@ -1,27 +1,94 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
+// ConnackMessage is laid out by its Version. A v2.0 CONNACK carries
+// the SessionExpiry the gateway settled on and, if the client sent no
+// ClientId, the one it was given. Decoding tells the two apart by
+// length, a v1.2 CONNACK only has its ReturnCode.
 type ConnackMessage struct {
 	Header
-	ReturnCode byte
+	Version          byte
+	ReturnCode       byte
+	SessionExpiry    uint32
+	AssignedClientId []byte
 }
 
 func (c *ConnackMessage) MessageType() byte {
 	return CONNACK
 }
 
+func (c *ConnackMessage) String() string {
+	if c.Version >= VERSION_2_0 {
+		if len(c.AssignedClientId) == 0 {
+			return fmt.Sprintf("CONNACK(rc=%s expiry=%d)", returnCode(c.ReturnCode), c.SessionExpiry)
+		}
+		return fmt.Sprintf("CONNACK(rc=%s expiry=%d clientid=%q)", returnCode(c.ReturnCode), c.SessionExpiry, c.AssignedClientId)
+	}
+	return fmt.Sprintf("CONNACK(rc=%s)", returnCode(c.ReturnCode))
+}
+
+func (c *ConnackMessage) MarshalJSON() ([]byte, error) {
+	type fields ConnackMessage
+	return marshalMessage(c, struct {
+		*fields
+		AssignedClientId text
+	}{(*fields)(c), c.AssignedClientId})
+}
+
+func (c *ConnackMessage) UnmarshalJSON(b []byte) error {
+	type fields ConnackMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		AssignedClientId *text
+	}{(*fields)(c), (*text)(&c.AssignedClientId)})
+}
+
+func (c *ConnackMessage) Validate() error {
+	if err := validClientId(c.AssignedClientId); err != nil {
+		return err
+	}
+	return validReturnCode(c.ReturnCode)
+}
+
+func (c *ConnackMessage) Size() int {
+	if c.Version >= VERSION_2_0 {
+		return packetLength(len(c.AssignedClientId) + 7)
+	}
+	return 3
+}
+
+func (c *ConnackMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, c.Size(), CONNACK)
+	b = append(b, c.ReturnCode)
+	if c.Version < VERSION_2_0 {
+		return b
+	}
+	b = appendUint32(b, c.SessionExpiry)
+	return append(b, c.AssignedClientId...)
+}
+
 func (c *ConnackMessage) Write(w io.Writer) error {
-	packet := c.Header.pack()
-	packet.WriteByte(CONNACK)
-	packet.WriteByte(c.ReturnCode)
-	_, err := packet.WriteTo(w)
+	c.Header.Length = uint16(c.Size())
+	return writePacket(w, c)
+}
 
-	return err
+func (c *ConnackMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	c.ReturnCode = f.readByte()
+	c.Version, c.SessionExpiry, c.AssignedClientId = VERSION_1_2, 0, nil
+	if len(body) > 1 {
+		c.Version = VERSION_2_0
+		c.SessionExpiry = f.readUint32()
+		c.AssignedClientId = f.rest()
+	}
+	return f.end()
 }
 
-func (c *ConnackMessage) Unpack(b io.Reader) {
-	c.ReturnCode = readByte(b)
+func (c *ConnackMessage) Unpack(b io.Reader) error {
+	return unpack(b, c)
 }
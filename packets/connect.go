@@ -1,29 +1,82 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
+// ConnectMessage is laid out by its ProtocolId. MQTT-SN v2.0 moves the
+// flags, adds Auth, and follows the Duration (the keep alive) with the
+// SessionExpiry and MaxPacketSize, which v1.2 doesn't have.
 type ConnectMessage struct {
 	Header
 	Will         bool
 	CleanSession bool
-	ProtocolId   byte
-	Duration     uint16
-	ClientId     []byte
+	// Auth, v2.0 only, says an AUTH follows the CONNECT.
+	Auth          bool
+	ProtocolId    byte
+	Duration      uint16
+	SessionExpiry uint32
+	MaxPacketSize uint16
+	ClientId      []byte
 }
 
 func (c *ConnectMessage) MessageType() byte {
 	return CONNECT
 }
 
+func (c *ConnectMessage) String() string {
+	if c.ProtocolId >= VERSION_2_0 {
+		return fmt.Sprintf("CONNECT(clientid=%q proto=%d duration=%d expiry=%d maxsize=%d%s%s%s)", c.ClientId, c.ProtocolId,
+			c.Duration, c.SessionExpiry, c.MaxPacketSize, flag(c.CleanSession, "clean"), flag(c.Will, "will"), flag(c.Auth, "auth"))
+	}
+	return fmt.Sprintf("CONNECT(clientid=%q proto=%d duration=%d%s%s)", c.ClientId, c.ProtocolId, c.Duration,
+		flag(c.CleanSession, "clean"), flag(c.Will, "will"))
+}
+
+func (c *ConnectMessage) MarshalJSON() ([]byte, error) {
+	type fields ConnectMessage
+	return marshalMessage(c, struct {
+		*fields
+		ClientId text
+	}{(*fields)(c), c.ClientId})
+}
+
+func (c *ConnectMessage) UnmarshalJSON(b []byte) error {
+	type fields ConnectMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		ClientId *text
+	}{(*fields)(c), (*text)(&c.ClientId)})
+}
+
 func (c *ConnectMessage) decodeFlags(b byte) {
+	if c.ProtocolId >= VERSION_2_0 {
+		c.Auth = (b & V2_AUTHFLAG) == V2_AUTHFLAG
+		c.Will = (b & V2_WILLFLAG) == V2_WILLFLAG
+		c.CleanSession = (b & V2_CLEANSTART) == V2_CLEANSTART
+		return
+	}
+	c.Auth = false
 	c.Will = (b & WILLFLAG) == WILLFLAG
 	c.CleanSession = (b & CLEANSESSION) == CLEANSESSION
 }
 
 func (c *ConnectMessage) encodeFlags() byte {
 	var b byte
+	if c.ProtocolId >= VERSION_2_0 {
+		if c.Auth {
+			b |= V2_AUTHFLAG
+		}
+		if c.Will {
+			b |= V2_WILLFLAG
+		}
+		if c.CleanSession {
+			b |= V2_CLEANSTART
+		}
+		return b
+	}
 	if c.Will {
 		b |= WILLFLAG
 	}
@@ -33,23 +86,54 @@ func (c *ConnectMessage) encodeFlags() byte {
 	return b
 }
 
+// Validate doesn't check the ProtocolId beyond it being set, so that a
+// gateway can answer a version it doesn't speak.
+func (c *ConnectMessage) Validate() error {
+	if c.ProtocolId == 0x00 {
+		return ErrInvalidProtocolId
+	}
+	return validClientId(c.ClientId)
+}
+
+func (c *ConnectMessage) Size() int {
+	if c.ProtocolId >= VERSION_2_0 {
+		return packetLength(len(c.ClientId) + 12)
+	}
+	return packetLength(len(c.ClientId) + 6)
+}
+
+func (c *ConnectMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, c.Size(), CONNECT)
+	b = append(b, c.encodeFlags(), c.ProtocolId)
+	b = appendUint16(b, c.Duration)
+	if c.ProtocolId >= VERSION_2_0 {
+		b = appendUint32(b, c.SessionExpiry)
+		b = appendUint16(b, c.MaxPacketSize)
+	}
+	return append(b, c.ClientId...)
+}
+
 func (c *ConnectMessage) Write(w io.Writer) error {
-	c.Header.Length = uint16(len(c.ClientId) + 6)
-	packet := c.Header.pack()
-	packet.WriteByte(CONNECT)
-	packet.WriteByte(c.encodeFlags())
-	packet.WriteByte(c.ProtocolId)
-	packet.Write(encodeUint16(c.Duration))
-	packet.Write([]byte(c.ClientId))
-	_, err := packet.WriteTo(w)
-
-	return err
-}
-
-func (c *ConnectMessage) Unpack(b io.Reader) {
-	c.decodeFlags(readByte(b))
-	c.ProtocolId = readByte(b)
-	c.Duration = readUint16(b)
-	c.ClientId = make([]byte, c.Header.Length-6)
-	b.Read(c.ClientId)
+	c.Header.Length = uint16(c.Size())
+	return writePacket(w, c)
+}
+
+func (c *ConnectMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	// the flags are laid out by the protocol version that follows them
+	flags := f.readByte()
+	c.ProtocolId = f.readByte()
+	c.decodeFlags(flags)
+	c.Duration = f.readUint16()
+	c.SessionExpiry, c.MaxPacketSize = 0, 0
+	if c.ProtocolId >= VERSION_2_0 {
+		c.SessionExpiry = f.readUint32()
+		c.MaxPacketSize = f.readUint16()
+	}
+	c.ClientId = f.rest()
+	return f.end()
+}
+
+func (c *ConnectMessage) Unpack(b io.Reader) error {
+	return unpack(b, c)
 }
@@ -1,39 +1,122 @@
 package packets
 
 import (
-	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
+// DisconnectMessage is laid out by its Version. In v1.2 it may have the
+// Duration of a client going to sleep, in v2.0 a ReasonCode, which
+// may be followed by a SessionExpiry and a ReasonString. Decoding
+// tells them apart by length: only v1.2 has 2 bytes after the header.
 type DisconnectMessage struct {
 	Header
-	Duration uint16
+	Version       byte
+	Duration      uint16
+	ReasonCode    byte
+	SessionExpiry uint32
+	ReasonString  []byte
 }
 
 func (d *DisconnectMessage) MessageType() byte {
 	return DISCONNECT
 }
 
-func (d *DisconnectMessage) Write(w io.Writer) error {
-	var packet bytes.Buffer
+func (d *DisconnectMessage) String() string {
+	if d.Version >= VERSION_2_0 {
+		if len(d.ReasonString) == 0 {
+			return fmt.Sprintf("DISCONNECT(rc=%s expiry=%d)", returnCode(d.ReasonCode), d.SessionExpiry)
+		}
+		return fmt.Sprintf("DISCONNECT(rc=%s expiry=%d reason=%q)", returnCode(d.ReasonCode), d.SessionExpiry, d.ReasonString)
+	}
+	if d.Duration == 0 {
+		return "DISCONNECT"
+	}
+	return fmt.Sprintf("DISCONNECT(duration=%d)", d.Duration)
+}
+
+func (d *DisconnectMessage) MarshalJSON() ([]byte, error) {
+	type fields DisconnectMessage
+	return marshalMessage(d, struct {
+		*fields
+		ReasonString text
+	}{(*fields)(d), d.ReasonString})
+}
+
+func (d *DisconnectMessage) UnmarshalJSON(b []byte) error {
+	type fields DisconnectMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		ReasonString *text
+	}{(*fields)(d), (*text)(&d.ReasonString)})
+}
+
+func (d *DisconnectMessage) Validate() error {
+	if d.Version >= VERSION_2_0 {
+		return validReturnCode(d.ReasonCode)
+	}
+	return nil
+}
 
+func (d *DisconnectMessage) Size() int {
+	if d.Version >= VERSION_2_0 {
+		if d.SessionExpiry == 0 && len(d.ReasonString) == 0 {
+			return 3
+		}
+		return packetLength(len(d.ReasonString) + 7)
+	}
 	if d.Duration == 0 {
-		d.Header.Length = 2
-		packet = d.Header.pack()
-		packet.WriteByte(DISCONNECT)
-	} else {
-		d.Header.Length = 4
-		packet = d.Header.pack()
-		packet.WriteByte(DISCONNECT)
-		packet.Write(encodeUint16(d.Duration))
+		return 2
 	}
-	_, err := packet.WriteTo(w)
+	return 4
+}
 
-	return err
+func (d *DisconnectMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, d.Size(), DISCONNECT)
+	if d.Version >= VERSION_2_0 {
+		b = append(b, d.ReasonCode)
+		if d.SessionExpiry == 0 && len(d.ReasonString) == 0 {
+			return b
+		}
+		b = appendUint32(b, d.SessionExpiry)
+		return append(b, d.ReasonString...)
+	}
+	if d.Duration == 0 {
+		return b
+	}
+	return appendUint16(b, d.Duration)
 }
 
-func (d *DisconnectMessage) Unpack(b io.Reader) {
-	if d.Header.Length == 4 {
-		d.Duration = readUint16(b)
+func (d *DisconnectMessage) Write(w io.Writer) error {
+	d.Header.Length = uint16(d.Size())
+	return writePacket(w, d)
+}
+
+func (d *DisconnectMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	d.Version, d.Duration = VERSION_1_2, 0
+	d.ReasonCode, d.SessionExpiry, d.ReasonString = 0, 0, nil
+	switch len(body) {
+	case 0:
+	case 2:
+		// the duration is only there when the client is going to sleep
+		d.Duration = f.readUint16()
+	case 1:
+		d.Version = VERSION_2_0
+		d.ReasonCode = f.readByte()
+	default:
+		if len(body) < 5 {
+			return ErrBadLength
+		}
+		d.Version = VERSION_2_0
+		d.ReasonCode = f.readByte()
+		d.SessionExpiry = f.readUint32()
+		d.ReasonString = f.rest()
 	}
+	return f.end()
+}
+
+func (d *DisconnectMessage) Unpack(b io.Reader) error {
+	return unpack(b, d)
 }
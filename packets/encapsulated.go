@@ -0,0 +1,140 @@
+package packets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrBadEncapsulation = errors.New("Bad encapsulated message")
+
+// EncapsulatedMessage carries a message between a gateway and a
+// forwarder, on behalf of the wireless node the message is from or to.
+type EncapsulatedMessage struct {
+	Header
+	// Ctrl holds the broadcast radius in its 2 low bits.
+	Ctrl           byte
+	WirelessNodeId []byte
+	Message        Message
+}
+
+func NewEncapsulatedMessage(Ctrl byte, WirelessNodeId []byte, Message Message) *EncapsulatedMessage {
+	return &EncapsulatedMessage{
+		Header:         Header{MessageType: ENCAPSULATED},
+		Ctrl:           Ctrl,
+		WirelessNodeId: WirelessNodeId,
+		Message:        Message,
+	}
+}
+
+func (e *EncapsulatedMessage) MessageType() byte {
+	return ENCAPSULATED
+}
+
+func (e *EncapsulatedMessage) String() string {
+	return fmt.Sprintf("ENCAPSULATED(ctrl=%d node=%x %v)", e.Ctrl, e.WirelessNodeId, e.Message)
+}
+
+func (e *EncapsulatedMessage) MarshalJSON() ([]byte, error) {
+	type fields EncapsulatedMessage
+	return marshalMessage(e, (*fields)(e))
+}
+
+func (e *EncapsulatedMessage) UnmarshalJSON(b []byte) error {
+	type fields EncapsulatedMessage
+	v := struct {
+		*fields
+		Message json.RawMessage
+	}{fields: (*fields)(e)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	e.Message = nil
+	if len(v.Message) == 0 || string(v.Message) == "null" {
+		return nil
+	}
+	var err error
+	e.Message, err = UnmarshalMessage(v.Message)
+	return err
+}
+
+func (e *EncapsulatedMessage) Validate() error {
+	if len(e.WirelessNodeId)+3 > 0xFF || e.Message == nil {
+		return ErrBadEncapsulation
+	}
+	return e.Message.Validate()
+}
+
+// Size includes the message being carried, though the length in the
+// header only covers the encapsulation.
+func (e *EncapsulatedMessage) Size() int {
+	if e.Message == nil {
+		return len(e.WirelessNodeId) + 3
+	}
+	return len(e.WirelessNodeId) + 3 + e.Message.Size()
+}
+
+// AppendTo leaves b as it is when there is no message to carry.
+func (e *EncapsulatedMessage) AppendTo(b []byte) []byte {
+	if e.Message == nil {
+		return b
+	}
+	b = append(b, byte(len(e.WirelessNodeId)+3), ENCAPSULATED, e.Ctrl)
+	b = append(b, e.WirelessNodeId...)
+	return e.Message.AppendTo(b)
+}
+
+func (e *EncapsulatedMessage) Write(w io.Writer) error {
+	if len(e.WirelessNodeId)+3 > 0xFF || e.Message == nil {
+		return ErrBadEncapsulation
+	}
+	e.Header.Length = uint16(len(e.WirelessNodeId) + 3)
+	return writePacket(w, e)
+}
+
+func (e *EncapsulatedMessage) Decode(body []byte) error {
+	// the length in the header only covers the encapsulation, body
+	// runs on to the end of the message it carries
+	if e.Header.Length < 3 {
+		return ErrBadLength
+	}
+	f := fields{buf: body}
+	e.Ctrl = f.readByte()
+	e.WirelessNodeId = f.readBytes(int(e.Header.Length) - 3)
+	if f.err != nil {
+		return f.err
+	}
+	var err error
+	e.Message, err = DecodePacket(f.rest())
+	return err
+}
+
+func (e *EncapsulatedMessage) Unpack(b io.Reader) error {
+	return unpack(b, e)
+}
+
+// Encapsulate wraps packet, an encoded message, for a forwarder to
+// pass to or from the wireless node nodeId.
+func Encapsulate(ctrl byte, nodeId []byte, packet []byte) ([]byte, error) {
+	if len(nodeId)+3 > 0xFF {
+		return nil, ErrBadEncapsulation
+	}
+	b := make([]byte, 0, len(nodeId)+3+len(packet))
+	b = append(b, byte(len(nodeId)+3), ENCAPSULATED, ctrl)
+	b = append(b, nodeId...)
+	return append(b, packet...), nil
+}
+
+// Decapsulate is the reverse of Encapsulate, the returned slices
+// share packet's memory.
+func Decapsulate(packet []byte) (ctrl byte, nodeId []byte, inner []byte, err error) {
+	if len(packet) < 3 || packet[1] != ENCAPSULATED {
+		return 0, nil, nil, ErrBadEncapsulation
+	}
+	length := int(packet[0])
+	if length < 3 || length > len(packet) {
+		return 0, nil, nil, ErrBadEncapsulation
+	}
+	return packet[2], packet[3:length], packet[length:], nil
+}
@@ -0,0 +1,67 @@
+package packets
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+func TestEncapsulatedStruct(t *testing.T) {
+	msg := NewMessage(ENCAPSULATED).(*EncapsulatedMessage)
+
+	if assert.NotNil(t, msg, "New message should not be nil") {
+		assert.Equal(t, "*packets.EncapsulatedMessage", reflect.TypeOf(msg).String(), "Type should be EncapsulatedMessage")
+		assert.Equal(t, byte(0), msg.Ctrl, "Default Ctrl should be 0")
+		assert.Equal(t, []byte(nil), msg.WirelessNodeId, "Default WirelessNodeId should be blank")
+		assert.Nil(t, msg.Message, "Default Message should be nil")
+
+		assert.Equal(t, byte(ENCAPSULATED), msg.MessageType(), "MessageType() should return ENCAPSULATED")
+	}
+}
+
+func TestEncapsulatedRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	inner := NewRegisterMessage(3, 4, []byte("a/b"))
+	assert.NoError(t, NewEncapsulatedMessage(0x01, []byte{0xAA, 0xBB}, inner).Write(&b))
+	assert.Equal(t, []byte{0x05, ENCAPSULATED, 0x01, 0xAA, 0xBB, 0x09, REGISTER}, b.Bytes()[:7])
+
+	m, err := ReadPacket(&b)
+	if assert.NoError(t, err) {
+		e := m.(*EncapsulatedMessage)
+		assert.Equal(t, byte(0x01), e.Ctrl)
+		assert.Equal(t, []byte{0xAA, 0xBB}, e.WirelessNodeId)
+		r := e.Message.(*RegisterMessage)
+		assert.Equal(t, uint16(3), r.TopicId)
+		assert.Equal(t, uint16(4), r.MessageId)
+		assert.Equal(t, []byte("a/b"), r.TopicName)
+	}
+}
+
+func TestDecapsulate(t *testing.T) {
+	packet, err := Encapsulate(0x00, []byte("node1"), []byte{0x02, PINGREQ})
+	assert.NoError(t, err)
+
+	ctrl, node, inner, err := Decapsulate(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x00), ctrl)
+	assert.Equal(t, []byte("node1"), node)
+	assert.Equal(t, []byte{0x02, PINGREQ}, inner)
+
+	_, _, _, err = Decapsulate([]byte{0x02, PINGREQ})
+	assert.Equal(t, ErrBadEncapsulation, err, "Only encapsulated messages can be decapsulated")
+	_, _, _, err = Decapsulate([]byte{0x09, ENCAPSULATED, 0x00, 0x01})
+	assert.Equal(t, ErrBadEncapsulation, err, "Length beyond the packet should fail")
+	_, err = Encapsulate(0x00, make([]byte, 253), nil)
+	assert.Equal(t, ErrBadEncapsulation, err, "Node id must fit a 1 byte length")
+}
+
+func TestEncapsulatedWriteNoMessage(t *testing.T) {
+	var b bytes.Buffer
+	e := NewEncapsulatedMessage(0x00, []byte{0x01}, nil)
+	err := e.Write(&b)
+	assert.Equal(t, ErrBadEncapsulation, err, "There must be a message to encapsulate")
+	assert.Equal(t, 0, b.Len(), "Nothing should be written without a message")
+	assert.Equal(t, 4, e.Size(), "Size should only cover the encapsulation")
+	assert.Empty(t, e.AppendTo(nil), "Nothing should be appended without a message")
+}
@@ -0,0 +1,45 @@
+package packets
+
+import (
+	"fmt"
+)
+
+// flag is appended to a message's fields when set, as " name".
+func flag(set bool, name string) string {
+	if set {
+		return " " + name
+	}
+	return ""
+}
+
+func returnCode(rc byte) string {
+	if name, ok := ReturnCodeNames[rc]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", rc)
+}
+
+// topicId describes the topic of a PUBLISH by the kind of id it has.
+func topicId(idType byte, id uint16) string {
+	switch idType {
+	case 0x00:
+		return fmt.Sprintf("tid=%d", id)
+	case 0x01:
+		return fmt.Sprintf("predefined=%d", id)
+	case 0x02:
+		return fmt.Sprintf("short=%q", []byte{byte(id >> 8), byte(id)})
+	}
+	return fmt.Sprintf("tid=%d type=%d", id, idType)
+}
+
+// topic describes the topic of a SUBSCRIBE or UNSUBSCRIBE, which has
+// either a name or a predefined id.
+func topic(idType byte, id uint16, name []byte) string {
+	switch idType {
+	case 0x00:
+		return fmt.Sprintf("topic=%q", name)
+	case 0x02:
+		return fmt.Sprintf("short=%q", name)
+	}
+	return topicId(idType, id)
+}
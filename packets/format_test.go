@@ -0,0 +1,28 @@
+package packets
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMessageStrings(t *testing.T) {
+	for expected, m := range map[string]Message{
+		"PUBLISH(tid=5 qos=1 mid=12 retain dup len=20)":    NewPublishMessage(5, 0x00, make([]byte, 20), 1, 12, true, true),
+		"PUBLISH(predefined=7 qos=0 mid=0 len=0)":          NewPublishMessage(7, 0x01, nil, 0, 0, false, false),
+		`PUBLISH(short="ab" qos=0 mid=0 len=1)`:            NewPublishMessage(0x6162, 0x02, []byte{0}, 0, 0, false, false),
+		`CONNECT(clientid="c1" proto=1 duration=30 clean)`: &ConnectMessage{ClientId: []byte("c1"), ProtocolId: 1, Duration: 30, CleanSession: true},
+		"CONNACK(rc=REJ_CONGESTION)":                       &ConnackMessage{ReturnCode: REJ_CONGESTION},
+		"REGACK(tid=1 mid=2 rc=0x07)":                      &RegackMessage{TopicId: 1, MessageId: 2, ReturnCode: 0x07},
+		`REGISTER(tid=3 mid=4 topic="a/b")`:                NewRegisterMessage(3, 4, []byte("a/b")),
+		`SUBSCRIBE(topic="a/#" qos=2 mid=9 dup)`:           &SubscribeMessage{Dup: true, Qos: 2, MessageId: 9, TopicName: []byte("a/#")},
+		"UNSUBSCRIBE(predefined=3 mid=1)":                  &UnsubscribeMessage{TopicIdType: 0x01, TopicId: 3, MessageId: 1},
+		"GWINFO(gwid=1 addr=0a0b)":                         &GwInfoMessage{GatewayId: 1, GatewayAddress: []byte{0x0A, 0x0B}},
+		"DISCONNECT":                                       &DisconnectMessage{},
+		"DISCONNECT(duration=60)":                          &DisconnectMessage{Duration: 60},
+		"WILLTOPIC(empty)":                                 &WillTopicMessage{},
+		"PINGRESP":                                         NewMessage(PINGRESP),
+		"ENCAPSULATED(ctrl=0 node=aabb PINGREQ)":           NewEncapsulatedMessage(0x00, []byte{0xAA, 0xBB}, &PingreqMessage{}),
+	} {
+		assert.Equal(t, expected, m.String())
+	}
+}
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -14,20 +15,44 @@ func (g *GwInfoMessage) MessageType() byte {
 	return GWINFO
 }
 
+func (g *GwInfoMessage) String() string {
+	if len(g.GatewayAddress) == 0 {
+		return fmt.Sprintf("GWINFO(gwid=%d)", g.GatewayId)
+	}
+	return fmt.Sprintf("GWINFO(gwid=%d addr=%x)", g.GatewayId, g.GatewayAddress)
+}
+
+func (g *GwInfoMessage) MarshalJSON() ([]byte, error) {
+	type fields GwInfoMessage
+	return marshalMessage(g, (*fields)(g))
+}
+
+func (g *GwInfoMessage) Validate() error {
+	return nil
+}
+
+func (g *GwInfoMessage) Size() int {
+	return packetLength(len(g.GatewayAddress) + 3)
+}
+
+func (g *GwInfoMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, g.Size(), GWINFO)
+	b = append(b, g.GatewayId)
+	return append(b, g.GatewayAddress...)
+}
+
 func (g *GwInfoMessage) Write(w io.Writer) error {
-	g.Header.Length = uint16(len(g.GatewayAddress) + 3)
-	packet := g.Header.pack()
-	packet.WriteByte(GWINFO)
-	packet.WriteByte(g.GatewayId)
-	packet.Write(g.GatewayAddress)
-	_, err := packet.WriteTo(w)
+	g.Header.Length = uint16(g.Size())
+	return writePacket(w, g)
+}
 
-	return err
+func (g *GwInfoMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	g.GatewayId = f.readByte()
+	g.GatewayAddress = f.rest()
+	return f.end()
 }
 
-func (g *GwInfoMessage) Unpack(b io.Reader) {
-	g.GatewayId = readByte(b)
-	if g.Header.Length > 3 {
-		b.Read(g.GatewayAddress)
-	}
+func (g *GwInfoMessage) Unpack(b io.Reader) error {
+	return unpack(b, g)
 }
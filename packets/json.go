@@ -0,0 +1,68 @@
+package packets
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Messages marshal to JSON objects holding their fields along with
+// "Type", the name of the message type, and "Length", the size of the
+// encoded packet. Client ids and topic names are strings, payloads
+// and other binary fields are base64 as usual for []byte.
+
+// text is a []byte field that is shown as a string.
+type text []byte
+
+func (t text) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(t))
+}
+
+func (t *text) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*t = []byte(s)
+	return nil
+}
+
+// marshalMessage marshals fields, which is m without its methods so
+// that it marshals as a plain struct, and puts m's type in front.
+func marshalMessage(m Message, fields interface{}) ([]byte, error) {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	packet := []byte(fmt.Sprintf(`{"Type":%q,"Length":%d`, MessageNames[m.MessageType()], m.Size()))
+	if len(b) > 2 {
+		packet = append(packet, ',')
+	}
+	return append(packet, b[1:]...), nil
+}
+
+// UnmarshalMessage is the reverse of marshalling a message to JSON,
+// the message's type is taken from its "Type".
+func UnmarshalMessage(b []byte) (Message, error) {
+	var t struct {
+		Type string
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	for msgType, name := range MessageNames {
+		if name != t.Type {
+			continue
+		}
+		m := NewMessage(msgType)
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+		if e, ok := m.(*EncapsulatedMessage); ok {
+			e.Header.Length = uint16(len(e.WirelessNodeId) + 3)
+		} else {
+			headerOf(m).Length = uint16(m.Size())
+		}
+		return m, nil
+	}
+	return nil, ErrUnknownType
+}
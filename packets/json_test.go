@@ -0,0 +1,44 @@
+package packets
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(NewRegisterMessage(3, 4, []byte("a/b")))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Type":"REGISTER","Length":9,"TopicId":3,"MessageId":4,"TopicName":"a/b"}`, string(b))
+
+	b, err = json.Marshal(NewMessage(PINGRESP))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Type":"PINGRESP","Length":2}`, string(b))
+
+	b, err = json.Marshal(NewPublishMessage(5, 0x00, []byte("hi"), 1, 12, false, false))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Type":"PUBLISH","Length":9,"Dup":false,"Retain":false,"Qos":1,"TopicIdType":0,"TopicId":5,"MessageId":12,"Data":"aGk="}`, string(b))
+}
+
+func TestUnmarshalMessage(t *testing.T) {
+	messages := []Message{
+		&ConnectMessage{ClientId: []byte("c1"), ProtocolId: 1, Duration: 30, CleanSession: true},
+		NewPublishMessage(5, 0x00, []byte("hi"), 1, 12, true, false),
+		&SubscribeMessage{Qos: 1, MessageId: 9, TopicName: []byte("a/#")},
+		&WillTopicMessage{Qos: 1, WillTopic: []byte("will")},
+		NewEncapsulatedMessage(0x01, []byte{0xAA}, NewRegisterMessage(3, 4, []byte("a/b"))),
+	}
+	for _, m := range messages {
+		b, err := json.Marshal(m)
+		assert.NoError(t, err)
+		u, err := UnmarshalMessage(b)
+		if assert.NoError(t, err, string(b)) {
+			assert.Equal(t, m.String(), u.String())
+			assert.Equal(t, m.MessageType(), u.MessageType())
+			assert.Equal(t, m.Size(), u.Size())
+		}
+	}
+
+	_, err := UnmarshalMessage([]byte(`{"Type":"NOTATYPE"}`))
+	assert.Equal(t, ErrUnknownType, err)
+}
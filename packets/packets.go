@@ -5,60 +5,269 @@ Package gnatt/packets provides de/serialisation of MQTTSN packets
 package packets
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
+	"sync"
 )
 
+// Errors returned when a packet can't be decoded.
+var (
+	ErrTruncated    = errors.New("Packet truncated")
+	ErrBadLength    = errors.New("Bad packet length")
+	ErrUnknownType  = errors.New("Unknown message type")
+	ErrInvalidFlags = errors.New("Invalid flags")
+)
+
+// ErrPacketTooLarge is returned for a message that can't be sent in a
+// single packet, either because it is over the MTU or because it is
+// longer than a 3 byte header can describe.
+var ErrPacketTooLarge = errors.New("Packet too large")
+
+// MaxPacketSize is the longest packet a 3 byte header can describe.
+const MaxPacketSize = 0xFFFF
+
 type Message interface {
 	MessageType() byte
+	// Size is the length of the encoded message, header included.
+	Size() int
+	// AppendTo appends the encoded message to b and returns the
+	// extended slice, it allocates only when b is short of room.
+	AppendTo(b []byte) []byte
 	Write(io.Writer) error
-	Unpack(io.Reader)
-	//String() string
+	// Decode decodes the fields that follow the header from body,
+	// which is exactly the rest of the packet. Variable length
+	// fields share body's memory rather than being copied.
+	Decode(body []byte) error
+	// Unpack decodes the fields that follow the header, b holds
+	// exactly the rest of the packet.
+	Unpack(io.Reader) error
+	// String describes the message and its fields, for logging.
+	String() string
+	// Validate checks the message against the rules of MQTT-SN
+	// beyond what is needed to decode it: field ranges, flag
+	// combinations and the constraints of each topic id type.
+	Validate() error
 	//Details() Details
 	//UUID() uuid.UUID
 }
 
 type Header struct {
-	Length      uint16
-	MessageType byte
+	Length      uint16 `json:"-"`
+	MessageType byte   `json:"-"`
 }
 
-func ReadPacket(r io.Reader) (m Message, err error) {
-	var h Header
+func (h *Header) header() *Header {
+	return h
+}
+
+// headerOf returns the Header embedded in m.
+func headerOf(m Message) *Header {
+	return m.(interface {
+		header() *Header
+	}).header()
+}
+
+// ReadPacket reads and decodes one packet, which must be everything
+// a single Read of r returns, as it is when r is a datagram socket.
+func ReadPacket(r io.Reader) (Message, error) {
 	packet := make([]byte, 1500)
-	r.Read(packet)
-	packetBuf := bytes.NewBuffer(packet)
-	h.unpack(packetBuf)
-	m = NewMessageWithHeader(h)
+	n, err := r.Read(packet)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	return DecodePacket(packet[:n])
+}
+
+// DecodePacket decodes the single packet held by packet. The message
+// returned refers to packet's memory, which must not be reused while
+// the message is in use.
+func DecodePacket(packet []byte) (Message, error) {
+	var h Header
+	body, err := h.unpack(packet)
+	if err != nil {
+		return nil, err
+	}
+	m := NewMessageWithHeader(h)
+	if m == nil {
+		return nil, ErrUnknownType
+	}
+	if err = m.Decode(body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// A Decoder decodes packets into messages it keeps and reuses, one of
+// each type, so that decoding doesn't allocate once every type has
+// been seen. A message returned by Decode is only good until the next
+// call to Decode, and like DecodePacket refers to the packet's memory.
+// A Decoder is not safe for concurrent use.
+type Decoder struct {
+	messages [256]Message
+}
+
+func (d *Decoder) Decode(packet []byte) (Message, error) {
+	var h Header
+	body, err := h.unpack(packet)
+	if err != nil {
+		return nil, err
+	}
+	m := d.messages[h.MessageType]
 	if m == nil {
-		return nil, errors.New("Bad data from client")
+		if m = NewMessageWithHeader(h); m == nil {
+			return nil, ErrUnknownType
+		}
+		d.messages[h.MessageType] = m
+	}
+	*headerOf(m) = h
+	if err = m.Decode(body); err != nil {
+		return nil, err
 	}
-	m.Unpack(packetBuf)
 	return m, nil
 }
 
-func (h *Header) unpack(b io.Reader) {
-	lengthCheck := readByte(b)
-	if lengthCheck == 0x01 {
-		h.Length = readUint16(b)
+// Decode the header at the start of packet and return the body that
+// follows it, checking that the length it gives matches packet.
+func (h *Header) unpack(packet []byte) ([]byte, error) {
+	if len(packet) < 2 {
+		return nil, ErrTruncated
+	}
+	size := 2
+	if packet[0] == 0x01 {
+		if len(packet) < 4 {
+			return nil, ErrTruncated
+		}
+		h.Length = binary.BigEndian.Uint16(packet[1:])
+		size = 4
 	} else {
-		h.Length = uint16(lengthCheck)
+		h.Length = uint16(packet[0])
+	}
+	if int(h.Length) < size {
+		return nil, ErrBadLength
+	}
+	if int(h.Length) > len(packet) {
+		return nil, ErrTruncated
+	}
+	h.MessageType = packet[size-1]
+	// the length of an encapsulated message doesn't include the
+	// message it carries
+	if h.MessageType != ENCAPSULATED && int(h.Length) != len(packet) {
+		return nil, ErrBadLength
+	}
+	return packet[size:], nil
+}
+
+// packetLength is the length of a packet that would be n bytes long
+// with a 1 byte length, allowing for the long form of the header when
+// n doesn't fit in a byte.
+func packetLength(n int) int {
+	if n > 0xFF {
+		return n + 2
 	}
-	h.MessageType = readByte(b)
+	return n
 }
 
-func (h *Header) pack() bytes.Buffer {
-	var header bytes.Buffer
-	if h.Length > 256 {
-		h.Length += 2
-		header.WriteByte(0x01)
-		header.Write(encodeUint16(h.Length))
+func appendHeader(b []byte, length int, msgType byte) []byte {
+	if length > 0xFF {
+		b = append(b, 0x01, byte(length>>8), byte(length))
 	} else {
-		header.WriteByte(byte(h.Length))
+		b = append(b, byte(length))
 	}
-	return header
+	return append(b, msgType)
+}
+
+func appendUint16(b []byte, num uint16) []byte {
+	return append(b, byte(num>>8), byte(num))
+}
+
+func appendUint32(b []byte, num uint32) []byte {
+	return append(b, byte(num>>24), byte(num>>16), byte(num>>8), byte(num))
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1500)
+		return &b
+	},
+}
+
+// writePacket encodes m into a pooled buffer and writes it to w in a
+// single Write.
+func writePacket(w io.Writer, m Message) error {
+	if m.Size() > MaxPacketSize {
+		return ErrPacketTooLarge
+	}
+	bp := bufferPool.Get().(*[]byte)
+	b := m.AppendTo((*bp)[:0])
+	_, err := w.Write(b)
+	*bp = b[:0]
+	bufferPool.Put(bp)
+	return err
+}
+
+func unpack(b io.Reader, m Message) error {
+	body, err := ioutil.ReadAll(b)
+	if err != nil {
+		return err
+	}
+	return m.Decode(body)
+}
+
+// fields reads a message's fields from its body. The first read that
+// runs off the end sets err, and every read after it returns zero.
+type fields struct {
+	buf []byte
+	err error
+}
+
+func (f *fields) readBytes(n int) []byte {
+	if f.err != nil {
+		return nil
+	}
+	if n > len(f.buf) {
+		f.err = ErrTruncated
+		return nil
+	}
+	b := f.buf[:n:n]
+	f.buf = f.buf[n:]
+	return b
+}
+
+func (f *fields) readByte() byte {
+	if b := f.readBytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (f *fields) readUint16() uint16 {
+	if b := f.readBytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (f *fields) readUint32() uint32 {
+	if b := f.readBytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// Variable length fields run to the end of the packet.
+func (f *fields) rest() []byte {
+	return f.readBytes(len(f.buf))
+}
+
+// end returns the first error met, or ErrBadLength if any of the body
+// was left unread.
+func (f fields) end() error {
+	if f.err == nil && len(f.buf) != 0 {
+		return ErrBadLength
+	}
+	return f.err
 }
 
 func NewMessage(msgType byte) (m Message) {
@@ -69,6 +278,8 @@ func NewMessage(msgType byte) (m Message) {
 		m = &SearchGwMessage{Header: Header{MessageType: SEARCHGW, Length: 3}}
 	case GWINFO:
 		m = &GwInfoMessage{Header: Header{MessageType: GWINFO}}
+	case AUTH:
+		m = &AuthMessage{Header: Header{MessageType: AUTH}}
 	case CONNECT:
 		m = &ConnectMessage{Header: Header{MessageType: CONNECT}, ProtocolId: 0x01}
 	case CONNACK:
@@ -117,6 +328,8 @@ func NewMessage(msgType byte) (m Message) {
 		m = &WillMsgUpdateMessage{Header: Header{MessageType: WILLMSGUPD}}
 	case WILLMSGRESP:
 		m = &WillMsgRespMessage{Header: Header{MessageType: WILLMSGRESP, Length: 3}}
+	case ENCAPSULATED:
+		m = &EncapsulatedMessage{Header: Header{MessageType: ENCAPSULATED, Length: 3}}
 	}
 	return
 }
@@ -129,6 +342,8 @@ func NewMessageWithHeader(h Header) (m Message) {
 		m = &SearchGwMessage{Header: h}
 	case GWINFO:
 		m = &GwInfoMessage{Header: h}
+	case AUTH:
+		m = &AuthMessage{Header: h}
 	case CONNECT:
 		m = &ConnectMessage{Header: h}
 	case CONNACK:
@@ -177,28 +392,12 @@ func NewMessageWithHeader(h Header) (m Message) {
 		m = &WillMsgUpdateMessage{Header: h}
 	case WILLMSGRESP:
 		m = &WillMsgRespMessage{Header: h}
+	case ENCAPSULATED:
+		m = &EncapsulatedMessage{Header: h}
 	}
 	return
 }
 
-func readByte(b io.Reader) byte {
-	num := make([]byte, 1)
-	b.Read(num)
-	return num[0]
-}
-
-func readUint16(b io.Reader) uint16 {
-	num := make([]byte, 2)
-	b.Read(num)
-	return binary.BigEndian.Uint16(num)
-}
-
-func encodeUint16(num uint16) []byte {
-	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, num)
-	return bytes
-}
-
 // Flags
 const (
 	TOPICIDTYPE  = 0x03
@@ -209,6 +408,23 @@ const (
 	DUPFLAG      = 0x80
 )
 
+// QoS -1 is sent as 3, it is only allowed for PUBLISH, which may then
+// come from a client that hasn't connected.
+const QOS_MINUS_ONE = 0x03
+
+// CONNECT flags as MQTT-SN v2.0 lays them out
+const (
+	V2_CLEANSTART = 0x02
+	V2_WILLFLAG   = 0x04
+	V2_AUTHFLAG   = 0x08
+)
+
+// Protocol versions, as sent in the ProtocolId of a CONNECT
+const (
+	VERSION_1_2 = 0x01
+	VERSION_2_0 = 0x02
+)
+
 // Errors
 const (
 	ACCEPTED         = 0x00
@@ -217,11 +433,28 @@ const (
 	REJ_NOT_SUPORTED = 0x03
 )
 
+// Reason codes added by MQTT-SN v2.0, which keeps the v1.2 return
+// codes above
+const (
+	RC_CONTINUE_AUTH       = 0x18
+	RC_REAUTHENTICATE      = 0x19
+	RC_UNSPECIFIED_ERROR   = 0x80
+	RC_PROTOCOL_ERROR      = 0x82
+	RC_UNSUPPORTED_VERSION = 0x84
+	RC_INVALID_CLIENTID    = 0x85
+	RC_NOT_AUTHORIZED      = 0x87
+	RC_SERVER_UNAVAILABLE  = 0x88
+	RC_BAD_AUTH_METHOD     = 0x8C
+	RC_PACKET_TOO_LARGE    = 0x95
+	RC_ADMINISTRATIVE      = 0x98
+)
+
 // Message Types
 const (
 	ADVERTISE     = 0x00
 	SEARCHGW      = 0x01
 	GWINFO        = 0x02
+	AUTH          = 0x03
 	CONNECT       = 0x04
 	CONNACK       = 0x05
 	WILLTOPICREQ  = 0x06
@@ -246,18 +479,37 @@ const (
 	WILLTOPICRESP = 0x1B
 	WILLMSGUPD    = 0x1C
 	WILLMSGRESP   = 0x1D
-	// 0x03 is reserved
+	ENCAPSULATED  = 0xFE
 	// 0x11 is reserved
 	// 0x19 is reserved
 	// 0x1E - 0xFD is reserved
-	// 0xFE - Encapsulated message
 	// 0xFF is reserved
 )
 
+var ReturnCodeNames = map[byte]string{
+	ACCEPTED:         "ACCEPTED",
+	REJ_CONGESTION:   "REJ_CONGESTION",
+	REJ_INVALID_TID:  "REJ_INVALID_TID",
+	REJ_NOT_SUPORTED: "REJ_NOT_SUPORTED",
+
+	RC_CONTINUE_AUTH:       "CONTINUE_AUTH",
+	RC_REAUTHENTICATE:      "REAUTHENTICATE",
+	RC_UNSPECIFIED_ERROR:   "UNSPECIFIED_ERROR",
+	RC_PROTOCOL_ERROR:      "PROTOCOL_ERROR",
+	RC_UNSUPPORTED_VERSION: "UNSUPPORTED_VERSION",
+	RC_INVALID_CLIENTID:    "INVALID_CLIENTID",
+	RC_NOT_AUTHORIZED:      "NOT_AUTHORIZED",
+	RC_SERVER_UNAVAILABLE:  "SERVER_UNAVAILABLE",
+	RC_BAD_AUTH_METHOD:     "BAD_AUTH_METHOD",
+	RC_PACKET_TOO_LARGE:    "PACKET_TOO_LARGE",
+	RC_ADMINISTRATIVE:      "ADMINISTRATIVE_ACTION",
+}
+
 var MessageNames = map[byte]string{
 	ADVERTISE:     "ADVERTISE",
 	SEARCHGW:      "SEARCHGW",
 	GWINFO:        "GWINFO",
+	AUTH:          "AUTH",
 	CONNECT:       "CONNECT",
 	CONNACK:       "CONNACK",
 	WILLTOPICREQ:  "WILLTOPICREQ",
@@ -282,4 +534,5 @@ var MessageNames = map[byte]string{
 	WILLTOPICRESP: "WILLTOPICRESP",
 	WILLMSGUPD:    "WILLMSGUPD",
 	WILLMSGRESP:   "WILLMSGRESP",
+	ENCAPSULATED:  "ENCAPSULATED",
 }
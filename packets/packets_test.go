@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -9,6 +10,7 @@ func TestMessageTypeValues(t *testing.T) {
 	assert.Equal(t, 0x00, ADVERTISE, "ADVERTISE should be 0x00")
 	assert.Equal(t, 0x01, SEARCHGW, "SEARCHGW should be 0x01")
 	assert.Equal(t, 0x02, GWINFO, "GWINFO should be 0x02")
+	assert.Equal(t, 0x03, AUTH, "AUTH should be 0x03")
 	assert.Equal(t, 0x04, CONNECT, "CONNECT should be 0x04")
 	assert.Equal(t, 0x05, CONNACK, "CONNACK should be 0x05")
 	assert.Equal(t, 0x06, WILLTOPICREQ, "WILLTOPICREQ should be 0x06")
@@ -34,3 +36,214 @@ func TestMessageTypeValues(t *testing.T) {
 	assert.Equal(t, 0x1C, WILLMSGUPD, "WILLMSGUPDshould be 0x1C")
 	assert.Equal(t, 0x1D, WILLMSGRESP, "WILLMSGRESPshould be 0x1D")
 }
+
+func TestReadPacketRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	NewPublishMessage(7, 0x00, []byte("22.5"), 1, 3, true, false).Write(&b)
+
+	m, err := ReadPacket(&b)
+	if assert.NoError(t, err) {
+		p := m.(*PublishMessage)
+		assert.Equal(t, uint16(7), p.TopicId)
+		assert.Equal(t, uint16(3), p.MessageId)
+		assert.Equal(t, byte(1), p.Qos)
+		assert.Equal(t, true, p.Retain)
+		assert.Equal(t, []byte("22.5"), p.Data)
+	}
+}
+
+func TestReadPacketMalformed(t *testing.T) {
+	malformed := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"one byte", []byte{0x07}, ErrTruncated},
+		{"length beyond the datagram", []byte{0x0B, PUBLISH, 0x00, 0x00, 0x01}, ErrTruncated},
+		{"length before the body ends", []byte{0x03, PUBCOMP, 0x00, 0x01}, ErrBadLength},
+		{"length shorter than the header", []byte{0x01, 0x00, 0x02, PUBLISH}, ErrBadLength},
+		{"zero length", []byte{0x00, PINGREQ}, ErrBadLength},
+		{"truncated long header", []byte{0x01, 0x00}, ErrTruncated},
+		{"field cut short", []byte{0x03, PUBCOMP, 0x00}, ErrTruncated},
+		{"PUBLISH without its ids", []byte{0x05, PUBLISH, 0x00, 0x00, 0x01}, ErrTruncated},
+		{"REGACK with extra bytes", []byte{0x08, REGACK, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00}, ErrBadLength},
+		{"DISCONNECT with half a session expiry", []byte{0x05, DISCONNECT, 0x00, 0x00, 0x00}, ErrBadLength},
+		{"reserved type", []byte{0x02, 0x11}, ErrUnknownType},
+		{"full topic name cut short", []byte{0x07, PUBLISH, 0x03, 0x00, 0x01, 0x00, 0x01}, ErrTruncated},
+		{"reserved topic id type", []byte{0x05, UNSUBSCRIBE, 0x03, 0x00, 0x01}, ErrInvalidFlags},
+		{"AUTH method cut short", []byte{0x05, AUTH, 0x00, 0x05, 'P'}, ErrTruncated},
+		{"SUBSCRIBE at QoS 3", []byte{0x06, SUBSCRIBE, 0x60, 0x00, 0x01, 'a'}, ErrInvalidFlags},
+		{"bad message inside ENCAPSULATED", []byte{0x03, ENCAPSULATED, 0x00, 0x05, PUBLISH}, ErrTruncated},
+	}
+	for _, m := range malformed {
+		_, err := ReadPacket(bytes.NewReader(m.packet))
+		assert.Equal(t, m.err, err, m.name)
+	}
+}
+
+func TestReadPacketLongHeader(t *testing.T) {
+	packet := append([]byte{0x01, 0x01, 0x0A, PUBLISH, 0x00, 0x00, 0x01, 0x00, 0x02}, make([]byte, 257)...)
+
+	m, err := ReadPacket(bytes.NewReader(packet))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 257, len(m.(*PublishMessage).Data))
+	}
+}
+
+func TestLongHeaderBoundary(t *testing.T) {
+	// 7 bytes of PUBLISH header and fields, the rest is payload
+	for _, c := range []struct {
+		payload int
+		header  []byte
+	}{
+		{248, []byte{0xFF, PUBLISH}},
+		{249, []byte{0x01, 0x01, 0x02, PUBLISH}},
+		{250, []byte{0x01, 0x01, 0x03, PUBLISH}},
+	} {
+		m := NewPublishMessage(1, 0x00, make([]byte, c.payload), 0, 2, false, false)
+		var b bytes.Buffer
+		assert.NoError(t, m.Write(&b))
+		assert.Equal(t, c.header, b.Bytes()[:len(c.header)], "payload of %d", c.payload)
+		assert.Equal(t, b.Len(), m.Size(), "payload of %d", c.payload)
+
+		d, err := ReadPacket(&b)
+		if assert.NoError(t, err, "payload of %d", c.payload) {
+			assert.Equal(t, c.payload, len(d.(*PublishMessage).Data))
+		}
+	}
+
+	variable := []Message{
+		&GwInfoMessage{GatewayAddress: make([]byte, 300)},
+		&ConnectMessage{ClientId: make([]byte, 250)},
+		&WillTopicMessage{WillTopic: make([]byte, 253)},
+		&WillMsgMessage{WillMsg: make([]byte, 254)},
+		&RegisterMessage{TopicName: make([]byte, 250)},
+		&SubscribeMessage{TopicName: make([]byte, 251)},
+		&UnsubscribeMessage{TopicName: make([]byte, 251)},
+		&PingreqMessage{ClientId: make([]byte, 254)},
+		&WillTopicUpdateMessage{WillTopic: make([]byte, 253)},
+		&WillMsgUpdateMessage{WillMsg: make([]byte, 254)},
+	}
+	for _, m := range variable {
+		var b bytes.Buffer
+		assert.NoError(t, m.Write(&b))
+		assert.Equal(t, byte(0x01), b.Bytes()[0], "%s should use the long header", MessageNames[m.MessageType()])
+		_, err := ReadPacket(&b)
+		assert.NoError(t, err, MessageNames[m.MessageType()])
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	m := NewPublishMessage(1, 0x00, make([]byte, MaxPacketSize), 0, 2, false, false)
+	var b bytes.Buffer
+	assert.Equal(t, ErrPacketTooLarge, m.Write(&b))
+	assert.Equal(t, 0, b.Len(), "Nothing should be written")
+}
+
+func TestAppendToMatchesWrite(t *testing.T) {
+	messages := []Message{
+		&ConnectMessage{CleanSession: true, ProtocolId: 0x01, Duration: 30, ClientId: []byte("client")},
+		NewRegisterMessage(3, 4, []byte("a/b")),
+		NewPublishMessage(1, 0x00, []byte("data"), 1, 2, false, false),
+		&SubscribeMessage{Qos: 1, TopicIdType: 0x01, MessageId: 5, TopicId: 7},
+		&DisconnectMessage{Duration: 60},
+		NewMessage(PINGRESP),
+		NewMessage(WILLTOPIC),
+	}
+	for _, m := range messages {
+		var b bytes.Buffer
+		assert.NoError(t, m.Write(&b))
+		packet := m.AppendTo([]byte{0xFF})
+		assert.Equal(t, b.Bytes(), packet[1:], MessageNames[m.MessageType()])
+		assert.Equal(t, m.Size(), b.Len(), MessageNames[m.MessageType()])
+	}
+}
+
+func TestDecodePacketSharesMemory(t *testing.T) {
+	packet := []byte{0x09, REGISTER, 0x00, 0x03, 0x00, 0x04, 'a', '/', 'b'}
+
+	m, err := DecodePacket(packet)
+	if assert.NoError(t, err) {
+		packet[6] = 'c'
+		assert.Equal(t, []byte("c/b"), m.(*RegisterMessage).TopicName)
+	}
+}
+
+func TestDecoderReusesMessages(t *testing.T) {
+	var d Decoder
+	first, err := d.Decode([]byte{0x09, REGISTER, 0x00, 0x03, 0x00, 0x04, 'a', '/', 'b'})
+	assert.NoError(t, err)
+	second, err := d.Decode([]byte{0x07, REGISTER, 0x00, 0x05, 0x00, 0x06, 'c'})
+	if assert.NoError(t, err) {
+		assert.True(t, first == second, "Decoder should reuse the message")
+		r := second.(*RegisterMessage)
+		assert.Equal(t, uint16(7), r.Header.Length)
+		assert.Equal(t, uint16(5), r.TopicId)
+		assert.Equal(t, []byte("c"), r.TopicName)
+	}
+
+	packet := []byte{0x0A, PUBLISH, 0x20, 0x00, 0x01, 0x00, 0x02, 'd', 'a', 't'}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := d.Decode(packet); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, float64(0), allocs, "Decoding into a reused message should not allocate")
+}
+
+func TestAppendToDoesNotAllocate(t *testing.T) {
+	m := NewPublishMessage(1, 0x00, []byte("data"), 1, 2, false, false)
+	b := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		b = m.AppendTo(b[:0])
+	})
+	assert.Equal(t, float64(0), allocs, "Appending to a buffer with room should not allocate")
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	var d Decoder
+	packet := []byte{0x0A, PUBLISH, 0x20, 0x00, 0x01, 0x00, 0x02, 'd', 'a', 't'}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.Decode(packet)
+	}
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	m := NewPublishMessage(1, 0x00, []byte("data"), 1, 2, false, false)
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = m.AppendTo(buf[:0])
+	}
+}
+
+func TestVersion2Layouts(t *testing.T) {
+	for _, c := range []struct {
+		m      Message
+		packet []byte
+	}{
+		{&ConnectMessage{ProtocolId: VERSION_2_0, CleanSession: true, Auth: true, Duration: 30, SessionExpiry: 3600, MaxPacketSize: 512, ClientId: []byte("c1")},
+			[]byte{0x0E, CONNECT, V2_AUTHFLAG | V2_CLEANSTART, 0x02, 0x00, 0x1E, 0x00, 0x00, 0x0E, 0x10, 0x02, 0x00, 'c', '1'}},
+		{&ConnectMessage{ProtocolId: VERSION_1_2, CleanSession: true, Will: true, Duration: 30, ClientId: []byte("c1")},
+			[]byte{0x08, CONNECT, WILLFLAG | CLEANSESSION, 0x01, 0x00, 0x1E, 'c', '1'}},
+		{&ConnackMessage{Version: VERSION_2_0, ReturnCode: ACCEPTED, SessionExpiry: 60, AssignedClientId: []byte("x")},
+			[]byte{0x08, CONNACK, 0x00, 0x00, 0x00, 0x00, 0x3C, 'x'}},
+		{&ConnackMessage{Version: VERSION_1_2, ReturnCode: REJ_CONGESTION},
+			[]byte{0x03, CONNACK, 0x01}},
+		{&DisconnectMessage{Version: VERSION_2_0, ReasonCode: RC_PROTOCOL_ERROR},
+			[]byte{0x03, DISCONNECT, 0x82}},
+		{&DisconnectMessage{Version: VERSION_2_0, SessionExpiry: 10, ReasonString: []byte("bye")},
+			[]byte{0x0A, DISCONNECT, 0x00, 0x00, 0x00, 0x00, 0x0A, 'b', 'y', 'e'}},
+		{&DisconnectMessage{Version: VERSION_1_2, Duration: 300},
+			[]byte{0x04, DISCONNECT, 0x01, 0x2C}},
+		{&PublishMessage{TopicIdType: 0x03, Qos: 1, MessageId: 2, TopicName: []byte("a/b"), Data: []byte("hi")},
+			[]byte{0x0C, PUBLISH, 0x23, 0x00, 0x03, 0x00, 0x02, 'a', '/', 'b', 'h', 'i'}},
+	} {
+		assert.Equal(t, c.packet, c.m.AppendTo(nil), c.m.String())
+		m, err := DecodePacket(c.packet)
+		if assert.NoError(t, err, c.m.String()) {
+			assert.Equal(t, c.m.String(), m.String())
+		}
+	}
+}
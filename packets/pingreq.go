@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -13,20 +15,53 @@ func (p *PingreqMessage) MessageType() byte {
 	return PINGREQ
 }
 
-func (p *PingreqMessage) Write(w io.Writer) error {
-	p.Header.Length = uint16(len(p.ClientId) + 2)
-	packet := p.Header.pack()
-	packet.WriteByte(PINGREQ)
-	if len(p.ClientId) > 0 {
-		packet.Write(p.ClientId)
+func (p *PingreqMessage) String() string {
+	if len(p.ClientId) == 0 {
+		return "PINGREQ"
 	}
-	_, err := packet.WriteTo(w)
+	return fmt.Sprintf("PINGREQ(clientid=%q)", p.ClientId)
+}
 
-	return err
+func (p *PingreqMessage) MarshalJSON() ([]byte, error) {
+	type fields PingreqMessage
+	return marshalMessage(p, struct {
+		*fields
+		ClientId text
+	}{(*fields)(p), p.ClientId})
 }
 
-func (p *PingreqMessage) Unpack(b io.Reader) {
-	if p.Header.Length > 2 {
-		b.Read(p.ClientId)
-	}
+func (p *PingreqMessage) UnmarshalJSON(b []byte) error {
+	type fields PingreqMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		ClientId *text
+	}{(*fields)(p), (*text)(&p.ClientId)})
+}
+
+func (p *PingreqMessage) Validate() error {
+	return validClientId(p.ClientId)
+}
+
+func (p *PingreqMessage) Size() int {
+	return packetLength(len(p.ClientId) + 2)
+}
+
+func (p *PingreqMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, p.Size(), PINGREQ)
+	return append(b, p.ClientId...)
+}
+
+func (p *PingreqMessage) Write(w io.Writer) error {
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
+
+func (p *PingreqMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	p.ClientId = f.rest()
+	return f.end()
+}
+
+func (p *PingreqMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
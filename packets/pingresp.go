@@ -12,13 +12,36 @@ func (p *PingrespMessage) MessageType() byte {
 	return PINGRESP
 }
 
+func (p *PingrespMessage) String() string {
+	return "PINGRESP"
+}
+
+func (p *PingrespMessage) MarshalJSON() ([]byte, error) {
+	type fields PingrespMessage
+	return marshalMessage(p, (*fields)(p))
+}
+
+func (p *PingrespMessage) Validate() error {
+	return nil
+}
+
+func (p *PingrespMessage) Size() int {
+	return 2
+}
+
+func (p *PingrespMessage) AppendTo(b []byte) []byte {
+	return appendHeader(b, p.Size(), PINGRESP)
+}
+
 func (p *PingrespMessage) Write(w io.Writer) error {
-	packet := p.Header.pack()
-	packet.WriteByte(PINGRESP)
-	_, err := packet.WriteTo(w)
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
 
-	return err
+func (p *PingrespMessage) Decode(body []byte) error {
+	return fields{buf: body}.end()
 }
 
-func (p *PingrespMessage) Unpack(b io.Reader) {
+func (p *PingrespMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -15,19 +16,43 @@ func (p *PubackMessage) MessageType() byte {
 	return PUBACK
 }
 
+func (p *PubackMessage) String() string {
+	return fmt.Sprintf("PUBACK(tid=%d mid=%d rc=%s)", p.TopicId, p.MessageId, returnCode(p.ReturnCode))
+}
+
+func (p *PubackMessage) MarshalJSON() ([]byte, error) {
+	type fields PubackMessage
+	return marshalMessage(p, (*fields)(p))
+}
+
+func (p *PubackMessage) Validate() error {
+	return validReturnCode(p.ReturnCode)
+}
+
+func (p *PubackMessage) Size() int {
+	return 7
+}
+
+func (p *PubackMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, p.Size(), PUBACK)
+	b = appendUint16(b, p.TopicId)
+	b = appendUint16(b, p.MessageId)
+	return append(b, p.ReturnCode)
+}
+
 func (p *PubackMessage) Write(w io.Writer) error {
-	packet := p.Header.pack()
-	packet.WriteByte(PUBACK)
-	packet.Write(encodeUint16(p.TopicId))
-	packet.Write(encodeUint16(p.MessageId))
-	packet.WriteByte(p.ReturnCode)
-	_, err := packet.WriteTo(w)
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
 
-	return err
+func (p *PubackMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	p.TopicId = f.readUint16()
+	p.MessageId = f.readUint16()
+	p.ReturnCode = f.readByte()
+	return f.end()
 }
 
-func (p *PubackMessage) Unpack(b io.Reader) {
-	p.TopicId = readUint16(b)
-	p.MessageId = readUint16(b)
-	p.ReturnCode = readByte(b)
+func (p *PubackMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (p *PubcompMessage) MessageType() byte {
 	return PUBCOMP
 }
 
+func (p *PubcompMessage) String() string {
+	return fmt.Sprintf("PUBCOMP(mid=%d)", p.MessageId)
+}
+
+func (p *PubcompMessage) MarshalJSON() ([]byte, error) {
+	type fields PubcompMessage
+	return marshalMessage(p, (*fields)(p))
+}
+
+func (p *PubcompMessage) Validate() error {
+	return validMessageId(p.MessageId)
+}
+
+func (p *PubcompMessage) Size() int {
+	return 4
+}
+
+func (p *PubcompMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, p.Size(), PUBCOMP)
+	return appendUint16(b, p.MessageId)
+}
+
 func (p *PubcompMessage) Write(w io.Writer) error {
-	packet := p.Header.pack()
-	packet.WriteByte(PUBCOMP)
-	packet.Write(encodeUint16(p.MessageId))
-	_, err := packet.WriteTo(w)
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
 
-	return err
+func (p *PubcompMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	p.MessageId = f.readUint16()
+	return f.end()
 }
 
-func (p *PubcompMessage) Unpack(b io.Reader) {
-	p.MessageId = readUint16(b)
+func (p *PubcompMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
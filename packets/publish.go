@@ -1,9 +1,16 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
+// PublishMessage names its topic according to its TopicIdType: 0x00
+// is a topic alias, an id that was registered for this session, 0x01
+// a predefined id and 0x02 a short topic name held in the TopicId.
+// MQTT-SN v2.0 adds 0x03, where the full TopicName is carried in the
+// message and the TopicId isn't used.
 type PublishMessage struct {
 	Header
 	Dup         bool
@@ -12,6 +19,7 @@ type PublishMessage struct {
 	TopicIdType byte
 	TopicId     uint16
 	MessageId   uint16
+	TopicName   []byte
 	Data        []byte
 }
 
@@ -31,6 +39,31 @@ func (p *PublishMessage) MessageType() byte {
 	return PUBLISH
 }
 
+func (p *PublishMessage) String() string {
+	if p.TopicIdType == 0x03 {
+		return fmt.Sprintf("PUBLISH(topic=%q qos=%d mid=%d%s%s len=%d)", p.TopicName, p.Qos, p.MessageId,
+			flag(p.Retain, "retain"), flag(p.Dup, "dup"), len(p.Data))
+	}
+	return fmt.Sprintf("PUBLISH(%s qos=%d mid=%d%s%s len=%d)", topicId(p.TopicIdType, p.TopicId), p.Qos, p.MessageId,
+		flag(p.Retain, "retain"), flag(p.Dup, "dup"), len(p.Data))
+}
+
+func (p *PublishMessage) MarshalJSON() ([]byte, error) {
+	type fields PublishMessage
+	return marshalMessage(p, struct {
+		*fields
+		TopicName text `json:",omitempty"`
+	}{(*fields)(p), p.TopicName})
+}
+
+func (p *PublishMessage) UnmarshalJSON(b []byte) error {
+	type fields PublishMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		TopicName *text
+	}{(*fields)(p), (*text)(&p.TopicName)})
+}
+
 func (p *PublishMessage) encodeFlags() byte {
 	var b byte
 	if p.Dup {
@@ -51,23 +84,74 @@ func (p *PublishMessage) decodeFlags(b byte) {
 	p.TopicIdType = b & TOPICIDTYPE
 }
 
+// Validate allows a full topic name, type 0x03, from any sender. v1.2
+// reserves it, and only the gateway knows which version a client
+// connected with.
+func (p *PublishMessage) Validate() error {
+	switch p.TopicIdType {
+	case 0x00, 0x01:
+		if err := validTopicId(p.TopicId); err != nil {
+			return err
+		}
+	case 0x02:
+	case 0x03:
+		if err := validTopicName(p.TopicName); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidTopicIdType
+	}
+	switch p.Qos {
+	case 1, 2:
+		if p.MessageId == 0 {
+			return ErrInvalidMessageId
+		}
+	case QOS_MINUS_ONE:
+		// there's no connection to register a topic on
+		if p.TopicIdType == 0x00 {
+			return ErrInvalidTopicIdType
+		}
+	}
+	return nil
+}
+
+func (p *PublishMessage) Size() int {
+	return packetLength(len(p.TopicName) + len(p.Data) + 7)
+}
+
+func (p *PublishMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, p.Size(), PUBLISH)
+	b = append(b, p.encodeFlags())
+	if p.TopicIdType == 0x03 {
+		b = appendUint16(b, uint16(len(p.TopicName)))
+	} else {
+		b = appendUint16(b, p.TopicId)
+	}
+	b = appendUint16(b, p.MessageId)
+	b = append(b, p.TopicName...)
+	return append(b, p.Data...)
+}
+
 func (p *PublishMessage) Write(w io.Writer) error {
-	p.Header.Length = uint16(len(p.Data) + 7)
-	packet := p.Header.pack()
-	packet.WriteByte(PUBLISH)
-	packet.WriteByte(p.encodeFlags())
-	packet.Write(encodeUint16(p.TopicId))
-	packet.Write(encodeUint16(p.MessageId))
-	packet.Write(p.Data)
-	_, err := packet.WriteTo(w)
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
 
-	return err
+func (p *PublishMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	p.decodeFlags(f.readByte())
+	p.TopicId = f.readUint16()
+	p.MessageId = f.readUint16()
+	p.TopicName = nil
+	if p.TopicIdType == 0x03 {
+		// the topic id is the length of the topic name
+		p.TopicName = f.readBytes(int(p.TopicId))
+		p.TopicId = 0
+	}
+	p.Data = f.rest()
+	return f.end()
 }
 
-func (p *PublishMessage) Unpack(b io.Reader) {
-	p.decodeFlags(readByte(b))
-	p.TopicId = readUint16(b)
-	p.MessageId = readUint16(b)
-	p.Data = make([]byte, p.Header.Length-7)
-	b.Read(p.Data)
+func (p *PublishMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
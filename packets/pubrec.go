@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (p *PubrecMessage) MessageType() byte {
 	return PUBREC
 }
 
+func (p *PubrecMessage) String() string {
+	return fmt.Sprintf("PUBREC(mid=%d)", p.MessageId)
+}
+
+func (p *PubrecMessage) MarshalJSON() ([]byte, error) {
+	type fields PubrecMessage
+	return marshalMessage(p, (*fields)(p))
+}
+
+func (p *PubrecMessage) Validate() error {
+	return validMessageId(p.MessageId)
+}
+
+func (p *PubrecMessage) Size() int {
+	return 4
+}
+
+func (p *PubrecMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, p.Size(), PUBREC)
+	return appendUint16(b, p.MessageId)
+}
+
 func (p *PubrecMessage) Write(w io.Writer) error {
-	packet := p.Header.pack()
-	packet.WriteByte(PUBREC)
-	packet.Write(encodeUint16(p.MessageId))
-	_, err := packet.WriteTo(w)
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
 
-	return err
+func (p *PubrecMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	p.MessageId = f.readUint16()
+	return f.end()
 }
 
-func (p *PubrecMessage) Unpack(b io.Reader) {
-	p.MessageId = readUint16(b)
+func (p *PubrecMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
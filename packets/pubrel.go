@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (p *PubrelMessage) MessageType() byte {
 	return PUBREL
 }
 
+func (p *PubrelMessage) String() string {
+	return fmt.Sprintf("PUBREL(mid=%d)", p.MessageId)
+}
+
+func (p *PubrelMessage) MarshalJSON() ([]byte, error) {
+	type fields PubrelMessage
+	return marshalMessage(p, (*fields)(p))
+}
+
+func (p *PubrelMessage) Validate() error {
+	return validMessageId(p.MessageId)
+}
+
+func (p *PubrelMessage) Size() int {
+	return 4
+}
+
+func (p *PubrelMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, p.Size(), PUBREL)
+	return appendUint16(b, p.MessageId)
+}
+
 func (p *PubrelMessage) Write(w io.Writer) error {
-	packet := p.Header.pack()
-	packet.WriteByte(PUBREL)
-	packet.Write(encodeUint16(p.MessageId))
-	_, err := packet.WriteTo(w)
+	p.Header.Length = uint16(p.Size())
+	return writePacket(w, p)
+}
 
-	return err
+func (p *PubrelMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	p.MessageId = f.readUint16()
+	return f.end()
 }
 
-func (p *PubrelMessage) Unpack(b io.Reader) {
-	p.MessageId = readUint16(b)
+func (p *PubrelMessage) Unpack(b io.Reader) error {
+	return unpack(b, p)
 }
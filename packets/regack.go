@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -23,19 +24,43 @@ func (r *RegackMessage) MessageType() byte {
 	return REGACK
 }
 
+func (r *RegackMessage) String() string {
+	return fmt.Sprintf("REGACK(tid=%d mid=%d rc=%s)", r.TopicId, r.MessageId, returnCode(r.ReturnCode))
+}
+
+func (r *RegackMessage) MarshalJSON() ([]byte, error) {
+	type fields RegackMessage
+	return marshalMessage(r, (*fields)(r))
+}
+
+func (r *RegackMessage) Validate() error {
+	return validReturnCode(r.ReturnCode)
+}
+
+func (r *RegackMessage) Size() int {
+	return 7
+}
+
+func (r *RegackMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, r.Size(), REGACK)
+	b = appendUint16(b, r.TopicId)
+	b = appendUint16(b, r.MessageId)
+	return append(b, r.ReturnCode)
+}
+
 func (r *RegackMessage) Write(w io.Writer) error {
-	packet := r.Header.pack()
-	packet.WriteByte(REGACK)
-	packet.Write(encodeUint16(r.TopicId))
-	packet.Write(encodeUint16(r.MessageId))
-	packet.WriteByte(r.ReturnCode)
-	_, err := packet.WriteTo(w)
+	r.Header.Length = uint16(r.Size())
+	return writePacket(w, r)
+}
 
-	return err
+func (r *RegackMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	r.TopicId = f.readUint16()
+	r.MessageId = f.readUint16()
+	r.ReturnCode = f.readByte()
+	return f.end()
 }
 
-func (r *RegackMessage) Unpack(b io.Reader) {
-	r.TopicId = readUint16(b)
-	r.MessageId = readUint16(b)
-	r.ReturnCode = readByte(b)
+func (r *RegackMessage) Unpack(b io.Reader) error {
+	return unpack(b, r)
 }
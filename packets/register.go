@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -23,21 +25,57 @@ func (r *RegisterMessage) MessageType() byte {
 	return REGISTER
 }
 
+func (r *RegisterMessage) String() string {
+	return fmt.Sprintf("REGISTER(tid=%d mid=%d topic=%q)", r.TopicId, r.MessageId, r.TopicName)
+}
+
+func (r *RegisterMessage) MarshalJSON() ([]byte, error) {
+	type fields RegisterMessage
+	return marshalMessage(r, struct {
+		*fields
+		TopicName text
+	}{(*fields)(r), r.TopicName})
+}
+
+func (r *RegisterMessage) UnmarshalJSON(b []byte) error {
+	type fields RegisterMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		TopicName *text
+	}{(*fields)(r), (*text)(&r.TopicName)})
+}
+
+func (r *RegisterMessage) Validate() error {
+	if r.TopicId == 0xFFFF {
+		return ErrInvalidTopicId
+	}
+	return validTopicName(r.TopicName)
+}
+
+func (r *RegisterMessage) Size() int {
+	return packetLength(len(r.TopicName) + 6)
+}
+
+func (r *RegisterMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, r.Size(), REGISTER)
+	b = appendUint16(b, r.TopicId)
+	b = appendUint16(b, r.MessageId)
+	return append(b, r.TopicName...)
+}
+
 func (r *RegisterMessage) Write(w io.Writer) error {
-	r.Header.Length = uint16(len(r.TopicName) + 6)
-	packet := r.Header.pack()
-	packet.WriteByte(REGISTER)
-	packet.Write(encodeUint16(r.TopicId))
-	packet.Write(encodeUint16(r.MessageId))
-	packet.Write(r.TopicName)
-	_, err := packet.WriteTo(w)
-
-	return err
-}
-
-func (r *RegisterMessage) Unpack(b io.Reader) {
-	r.TopicId = readUint16(b)
-	r.MessageId = readUint16(b)
-	r.TopicName = make([]byte, r.Header.Length-6)
-	b.Read(r.TopicName)
+	r.Header.Length = uint16(r.Size())
+	return writePacket(w, r)
+}
+
+func (r *RegisterMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	r.TopicId = f.readUint16()
+	r.MessageId = f.readUint16()
+	r.TopicName = f.rest()
+	return f.end()
+}
+
+func (r *RegisterMessage) Unpack(b io.Reader) error {
+	return unpack(b, r)
 }
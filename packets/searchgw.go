@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (s *SearchGwMessage) MessageType() byte {
 	return SEARCHGW
 }
 
+func (s *SearchGwMessage) String() string {
+	return fmt.Sprintf("SEARCHGW(radius=%d)", s.Radius)
+}
+
+func (s *SearchGwMessage) MarshalJSON() ([]byte, error) {
+	type fields SearchGwMessage
+	return marshalMessage(s, (*fields)(s))
+}
+
+func (s *SearchGwMessage) Validate() error {
+	return nil
+}
+
+func (s *SearchGwMessage) Size() int {
+	return 3
+}
+
+func (s *SearchGwMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, s.Size(), SEARCHGW)
+	return append(b, s.Radius)
+}
+
 func (s *SearchGwMessage) Write(w io.Writer) error {
-	packet := s.Header.pack()
-	packet.WriteByte(SEARCHGW)
-	packet.WriteByte(s.Radius)
-	_, err := packet.WriteTo(w)
+	s.Header.Length = uint16(s.Size())
+	return writePacket(w, s)
+}
 
-	return err
+func (s *SearchGwMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	s.Radius = f.readByte()
+	return f.end()
 }
 
-func (s *SearchGwMessage) Unpack(b io.Reader) {
-	s.Radius = readByte(b)
+func (s *SearchGwMessage) Unpack(b io.Reader) error {
+	return unpack(b, s)
 }
@@ -0,0 +1,58 @@
+package packets
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ErrBadFrameLength is ErrBadLength, found while reading a stream.
+var ErrBadFrameLength = ErrBadLength
+
+// ReadFrame reads exactly one packet from a byte stream such as a
+// serial line or a TCP connection, where packets are not delimited
+// by the transport. The packet's length header, in either its 1 or
+// 3 byte form, says where it ends. The returned slice holds the
+// whole packet, header included.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var lengthByte [1]byte
+	if _, err := io.ReadFull(r, lengthByte[:]); err != nil {
+		return nil, err
+	}
+	var frame []byte
+	var read int
+	if lengthByte[0] == 0x01 {
+		var long [2]byte
+		if _, err := io.ReadFull(r, long[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(long[:]))
+		if length < 4 {
+			return nil, ErrBadFrameLength
+		}
+		frame = make([]byte, length)
+		frame[0] = 0x01
+		copy(frame[1:], long[:])
+		read = 3
+	} else {
+		length := int(lengthByte[0])
+		if length < 2 {
+			return nil, ErrBadFrameLength
+		}
+		frame = make([]byte, length)
+		frame[0] = lengthByte[0]
+		read = 1
+	}
+	if _, err := io.ReadFull(r, frame[read:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ReadStreamPacket reads and decodes the next packet from a byte stream.
+func ReadStreamPacket(r io.Reader) (Message, error) {
+	frame, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePacket(frame)
+}
@@ -0,0 +1,72 @@
+package packets
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFrameShortHeader(t *testing.T) {
+	var stream bytes.Buffer
+	NewMessage(PINGRESP).Write(&stream)
+	p := NewPublishMessage(5, 0x00, []byte("hello"), 1, 12, false, false)
+	p.Write(&stream)
+
+	frame, err := ReadFrame(&stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x02, PINGRESP}, frame, "First frame should be the PINGRESP")
+
+	frame, err = ReadFrame(&stream)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, len(frame), "Second frame should be the whole PUBLISH")
+	assert.Equal(t, byte(PUBLISH), frame[1])
+
+	_, err = ReadFrame(&stream)
+	assert.Equal(t, io.EOF, err, "Empty stream should be EOF")
+}
+
+func TestReadFrameLongHeader(t *testing.T) {
+	frame := append([]byte{0x01, 0x01, 0x2C, PUBLISH}, make([]byte, 296)...)
+
+	read, err := ReadFrame(bytes.NewReader(frame))
+	assert.NoError(t, err)
+	assert.Equal(t, frame, read)
+}
+
+func TestReadFrameBadLength(t *testing.T) {
+	_, err := ReadFrame(bytes.NewReader([]byte{0x01, 0x00, 0x02}))
+	assert.Equal(t, ErrBadFrameLength, err)
+
+	_, err = ReadFrame(bytes.NewReader([]byte{0x00}))
+	assert.Equal(t, ErrBadFrameLength, err)
+
+	_, err = ReadFrame(bytes.NewReader([]byte{0x05, PUBACK}))
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "Truncated stream should be ErrUnexpectedEOF")
+}
+
+func TestReadStreamPacketPipe(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		r := NewRegisterMessage(1, 2, []byte("a/b"))
+		r.Write(client)
+		NewMessage(PINGREQ).Write(client)
+	}()
+
+	m, err := ReadStreamPacket(server)
+	if assert.NoError(t, err) {
+		r := m.(*RegisterMessage)
+		assert.Equal(t, uint16(1), r.TopicId)
+		assert.Equal(t, uint16(2), r.MessageId)
+		assert.Equal(t, []byte("a/b"), r.TopicName)
+	}
+	m, err = ReadStreamPacket(server)
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(PINGREQ), m.MessageType())
+	}
+}
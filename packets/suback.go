@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -25,6 +26,15 @@ func (s *SubackMessage) MessageType() byte {
 	return SUBACK
 }
 
+func (s *SubackMessage) String() string {
+	return fmt.Sprintf("SUBACK(tid=%d qos=%d mid=%d rc=%s)", s.TopicId, s.Qos, s.MessageId, returnCode(s.ReturnCode))
+}
+
+func (s *SubackMessage) MarshalJSON() ([]byte, error) {
+	type fields SubackMessage
+	return marshalMessage(s, (*fields)(s))
+}
+
 func (s *SubackMessage) encodeFlags() byte {
 	var b byte
 	b |= (s.Qos << 5) & QOSBITS
@@ -35,21 +45,46 @@ func (s *SubackMessage) decodeFlags(b byte) {
 	s.Qos = (b & QOSBITS) >> 5
 }
 
+func (s *SubackMessage) Validate() error {
+	if !validQos(s.Qos) {
+		return ErrInvalidQos
+	}
+	if err := validMessageId(s.MessageId); err != nil {
+		return err
+	}
+	return validReturnCode(s.ReturnCode)
+}
+
+func (s *SubackMessage) Size() int {
+	return 8
+}
+
+func (s *SubackMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, s.Size(), SUBACK)
+	b = append(b, s.encodeFlags())
+	b = appendUint16(b, s.TopicId)
+	b = appendUint16(b, s.MessageId)
+	return append(b, s.ReturnCode)
+}
+
 func (s *SubackMessage) Write(w io.Writer) error {
-	packet := s.Header.pack()
-	packet.WriteByte(SUBACK)
-	packet.WriteByte(s.encodeFlags())
-	packet.Write(encodeUint16(s.TopicId))
-	packet.Write(encodeUint16(s.MessageId))
-	packet.WriteByte(s.ReturnCode)
-	_, err := packet.WriteTo(w)
-
-	return err
-}
-
-func (s *SubackMessage) Unpack(b io.Reader) {
-	s.decodeFlags(readByte(b))
-	s.TopicId = readUint16(b)
-	s.MessageId = readUint16(b)
-	s.ReturnCode = readByte(b)
+	s.Header.Length = uint16(s.Size())
+	return writePacket(w, s)
+}
+
+func (s *SubackMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	flags := f.readByte()
+	if flags&QOSBITS == QOSBITS {
+		return ErrInvalidFlags
+	}
+	s.decodeFlags(flags)
+	s.TopicId = f.readUint16()
+	s.MessageId = f.readUint16()
+	s.ReturnCode = f.readByte()
+	return f.end()
+}
+
+func (s *SubackMessage) Unpack(b io.Reader) error {
+	return unpack(b, s)
 }
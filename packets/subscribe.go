@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -18,6 +20,27 @@ func (s *SubscribeMessage) MessageType() byte {
 	return SUBSCRIBE
 }
 
+func (s *SubscribeMessage) String() string {
+	return fmt.Sprintf("SUBSCRIBE(%s qos=%d mid=%d%s)", topic(s.TopicIdType, s.TopicId, s.TopicName), s.Qos, s.MessageId,
+		flag(s.Dup, "dup"))
+}
+
+func (s *SubscribeMessage) MarshalJSON() ([]byte, error) {
+	type fields SubscribeMessage
+	return marshalMessage(s, struct {
+		*fields
+		TopicName text
+	}{(*fields)(s), s.TopicName})
+}
+
+func (s *SubscribeMessage) UnmarshalJSON(b []byte) error {
+	type fields SubscribeMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		TopicName *text
+	}{(*fields)(s), (*text)(&s.TopicName)})
+}
+
 func (s *SubscribeMessage) encodeFlags() byte {
 	var b byte
 	if s.Dup {
@@ -34,36 +57,55 @@ func (s *SubscribeMessage) decodeFlags(b byte) {
 	s.TopicIdType = b & TOPICIDTYPE
 }
 
-func (s *SubscribeMessage) Write(w io.Writer) error {
-	switch s.TopicIdType {
-	case 0x00, 0x02:
-		s.Header.Length = uint16(len(s.TopicName) + 5)
-	case 0x01:
-		s.Header.Length = 7
+func (s *SubscribeMessage) Validate() error {
+	if !validQos(s.Qos) {
+		return ErrInvalidQos
+	}
+	if err := validMessageId(s.MessageId); err != nil {
+		return err
+	}
+	return validTopic(s.TopicIdType, s.TopicId, s.TopicName)
+}
+
+func (s *SubscribeMessage) Size() int {
+	if s.TopicIdType == 0x01 {
+		return 7
 	}
-	packet := s.Header.pack()
-	packet.WriteByte(SUBSCRIBE)
-	packet.WriteByte(s.encodeFlags())
-	packet.Write(encodeUint16(s.MessageId))
-	switch s.TopicIdType {
-	case 0x00, 0x02:
-		packet.Write(s.TopicName)
-	case 0x01:
-		packet.Write(encodeUint16(s.TopicId))
+	return packetLength(len(s.TopicName) + 5)
+}
+
+func (s *SubscribeMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, s.Size(), SUBSCRIBE)
+	b = append(b, s.encodeFlags())
+	b = appendUint16(b, s.MessageId)
+	if s.TopicIdType == 0x01 {
+		return appendUint16(b, s.TopicId)
 	}
-	_, err := packet.WriteTo(w)
+	return append(b, s.TopicName...)
+}
 
-	return err
+func (s *SubscribeMessage) Write(w io.Writer) error {
+	s.Header.Length = uint16(s.Size())
+	return writePacket(w, s)
 }
 
-func (s *SubscribeMessage) Unpack(b io.Reader) {
-	s.decodeFlags(readByte(b))
-	s.MessageId = readUint16(b)
-	switch s.TopicIdType {
-	case 0x00, 0x02:
-		s.TopicName = make([]byte, s.Header.Length-5)
-		b.Read(s.TopicName)
-	case 0x01:
-		s.TopicId = readUint16(b)
+func (s *SubscribeMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	flags := f.readByte()
+	if flags&TOPICIDTYPE == 0x03 || flags&QOSBITS == QOSBITS {
+		return ErrInvalidFlags
+	}
+	s.decodeFlags(flags)
+	s.MessageId = f.readUint16()
+	s.TopicId, s.TopicName = 0, nil
+	if s.TopicIdType == 0x01 {
+		s.TopicId = f.readUint16()
+	} else {
+		s.TopicName = f.rest()
 	}
+	return f.end()
+}
+
+func (s *SubscribeMessage) Unpack(b io.Reader) error {
+	return unpack(b, s)
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (u *UnsubackMessage) MessageType() byte {
 	return UNSUBACK
 }
 
+func (u *UnsubackMessage) String() string {
+	return fmt.Sprintf("UNSUBACK(mid=%d)", u.MessageId)
+}
+
+func (u *UnsubackMessage) MarshalJSON() ([]byte, error) {
+	type fields UnsubackMessage
+	return marshalMessage(u, (*fields)(u))
+}
+
+func (u *UnsubackMessage) Validate() error {
+	return validMessageId(u.MessageId)
+}
+
+func (u *UnsubackMessage) Size() int {
+	return 4
+}
+
+func (u *UnsubackMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, u.Size(), UNSUBACK)
+	return appendUint16(b, u.MessageId)
+}
+
 func (u *UnsubackMessage) Write(w io.Writer) error {
-	packet := u.Header.pack()
-	packet.WriteByte(UNSUBACK)
-	packet.Write(encodeUint16(u.MessageId))
-	_, err := packet.WriteTo(w)
+	u.Header.Length = uint16(u.Size())
+	return writePacket(w, u)
+}
 
-	return err
+func (u *UnsubackMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	u.MessageId = f.readUint16()
+	return f.end()
 }
 
-func (u *UnsubackMessage) Unpack(b io.Reader) {
-	u.MessageId = readUint16(b)
+func (u *UnsubackMessage) Unpack(b io.Reader) error {
+	return unpack(b, u)
 }
@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -16,6 +18,26 @@ func (u *UnsubscribeMessage) MessageType() byte {
 	return UNSUBSCRIBE
 }
 
+func (u *UnsubscribeMessage) String() string {
+	return fmt.Sprintf("UNSUBSCRIBE(%s mid=%d)", topic(u.TopicIdType, u.TopicId, u.TopicName), u.MessageId)
+}
+
+func (u *UnsubscribeMessage) MarshalJSON() ([]byte, error) {
+	type fields UnsubscribeMessage
+	return marshalMessage(u, struct {
+		*fields
+		TopicName text
+	}{(*fields)(u), u.TopicName})
+}
+
+func (u *UnsubscribeMessage) UnmarshalJSON(b []byte) error {
+	type fields UnsubscribeMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		TopicName *text
+	}{(*fields)(u), (*text)(&u.TopicName)})
+}
+
 func (s *UnsubscribeMessage) encodeFlags() byte {
 	var b byte
 	b |= s.TopicIdType & TOPICIDTYPE
@@ -26,35 +48,52 @@ func (s *UnsubscribeMessage) decodeFlags(b byte) {
 	s.TopicIdType = b & TOPICIDTYPE
 }
 
-func (u *UnsubscribeMessage) Write(w io.Writer) error {
-	switch u.TopicIdType {
-	case 0x00, 0x02:
-		u.Header.Length = uint16(len(u.TopicName) + 5)
-	case 0x01:
-		u.Header.Length = 7
+func (u *UnsubscribeMessage) Validate() error {
+	if err := validMessageId(u.MessageId); err != nil {
+		return err
 	}
-	packet := u.Header.pack()
-	packet.WriteByte(UNSUBSCRIBE)
-	packet.WriteByte(u.encodeFlags())
-	packet.Write(encodeUint16(u.MessageId))
-	switch u.TopicIdType {
-	case 0x00, 0x02:
-		packet.Write(u.TopicName)
-	case 0x01:
-		packet.Write(encodeUint16(u.TopicId))
+	return validTopic(u.TopicIdType, u.TopicId, u.TopicName)
+}
+
+func (u *UnsubscribeMessage) Size() int {
+	if u.TopicIdType == 0x01 {
+		return 7
 	}
-	_, err := packet.WriteTo(w)
+	return packetLength(len(u.TopicName) + 5)
+}
+
+func (u *UnsubscribeMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, u.Size(), UNSUBSCRIBE)
+	b = append(b, u.encodeFlags())
+	b = appendUint16(b, u.MessageId)
+	if u.TopicIdType == 0x01 {
+		return appendUint16(b, u.TopicId)
+	}
+	return append(b, u.TopicName...)
+}
 
-	return err
+func (u *UnsubscribeMessage) Write(w io.Writer) error {
+	u.Header.Length = uint16(u.Size())
+	return writePacket(w, u)
 }
 
-func (u *UnsubscribeMessage) Unpack(b io.Reader) {
-	u.decodeFlags(readByte(b))
-	u.MessageId = readUint16(b)
-	switch u.TopicIdType {
-	case 0x00, 0x02:
-		b.Read(u.TopicName)
-	case 0x01:
-		u.TopicId = readUint16(b)
+func (u *UnsubscribeMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	flags := f.readByte()
+	if flags&TOPICIDTYPE == 0x03 {
+		return ErrInvalidFlags
+	}
+	u.decodeFlags(flags)
+	u.MessageId = f.readUint16()
+	u.TopicId, u.TopicName = 0, nil
+	if u.TopicIdType == 0x01 {
+		u.TopicId = f.readUint16()
+	} else {
+		u.TopicName = f.rest()
 	}
+	return f.end()
+}
+
+func (u *UnsubscribeMessage) Unpack(b io.Reader) error {
+	return unpack(b, u)
 }
@@ -0,0 +1,117 @@
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// Errors returned by Validate, for messages that decode but break the
+// rules of MQTT-SN.
+var (
+	ErrInvalidQos         = errors.New("Invalid QoS")
+	ErrInvalidTopicIdType = errors.New("Invalid topic id type")
+	ErrInvalidTopicId     = errors.New("Invalid topic id")
+	ErrInvalidTopicName   = errors.New("Invalid topic name")
+	ErrInvalidTopicFilter = errors.New("Invalid topic filter")
+	ErrInvalidMessageId   = errors.New("Invalid message id")
+	ErrInvalidReturnCode  = errors.New("Invalid return code")
+	ErrInvalidProtocolId  = errors.New("Invalid protocol id")
+	ErrInvalidClientId    = errors.New("Invalid client id")
+	ErrInvalidAuthMethod  = errors.New("Invalid auth method")
+)
+
+// MaxClientIdLength is the longest ClientId MQTT-SN allows.
+const MaxClientIdLength = 23
+
+func validQos(qos byte) bool {
+	return qos <= 2
+}
+
+func validReturnCode(rc byte) error {
+	if _, ok := ReturnCodeNames[rc]; !ok {
+		return ErrInvalidReturnCode
+	}
+	return nil
+}
+
+// Topic ids 0x0000 and 0xFFFF are reserved.
+func validTopicId(id uint16) error {
+	if id == 0x0000 || id == 0xFFFF {
+		return ErrInvalidTopicId
+	}
+	return nil
+}
+
+// Message id 0x0000 is never used by a message that needs one.
+func validMessageId(id uint16) error {
+	if id == 0x0000 {
+		return ErrInvalidMessageId
+	}
+	return nil
+}
+
+func validClientId(clientId []byte) error {
+	if len(clientId) > MaxClientIdLength {
+		return ErrInvalidClientId
+	}
+	return nil
+}
+
+// A topic name has at least 1 byte, is UTF-8 and has no wildcards.
+func validTopicName(topic []byte) error {
+	if len(topic) == 0 || !utf8.Valid(topic) || bytes.ContainsAny(topic, "#+\x00") {
+		return ErrInvalidTopicName
+	}
+	return nil
+}
+
+// A topic filter may have wildcards, but only as a whole level, and
+// only the last level may be #.
+func validTopicFilter(topic []byte) error {
+	if len(topic) == 0 || !utf8.Valid(topic) || bytes.IndexByte(topic, 0x00) >= 0 {
+		return ErrInvalidTopicFilter
+	}
+	levels := bytes.Split(topic, []byte("/"))
+	for i, level := range levels {
+		if len(level) > 1 && bytes.ContainsAny(level, "#+") {
+			return ErrInvalidTopicFilter
+		}
+		if string(level) == "#" && i != len(levels)-1 {
+			return ErrInvalidTopicFilter
+		}
+	}
+	return nil
+}
+
+// validTopic checks the topic of a SUBSCRIBE or UNSUBSCRIBE, which is a
+// topic filter, a predefined topic id or a 2 byte short topic name.
+func validTopic(idType byte, id uint16, name []byte) error {
+	switch idType {
+	case 0x00:
+		return validTopicFilter(name)
+	case 0x01:
+		return validTopicId(id)
+	case 0x02:
+		if len(name) != 2 {
+			return ErrInvalidTopicName
+		}
+		return nil
+	}
+	return ErrInvalidTopicIdType
+}
+
+// validWillTopic checks a WILLTOPIC or WILLTOPICUPD, where an empty
+// topic removes the will and so must have no flags.
+func validWillTopic(qos byte, retain bool, topic []byte) error {
+	if len(topic) == 0 {
+		if qos != 0 || retain {
+			return ErrInvalidFlags
+		}
+		return nil
+	}
+	if !validQos(qos) {
+		return ErrInvalidQos
+	}
+	return validTopicName(topic)
+}
@@ -0,0 +1,58 @@
+package packets
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		m   Message
+		err error
+	}{
+		{NewPublishMessage(5, 0x00, nil, 1, 12, false, false), nil},
+		{NewPublishMessage(5, 0x00, nil, 1, 0, false, false), ErrInvalidMessageId},
+		{NewPublishMessage(0, 0x00, nil, 0, 0, false, false), ErrInvalidTopicId},
+		{NewPublishMessage(0xFFFF, 0x01, nil, 0, 0, false, false), ErrInvalidTopicId},
+		{NewPublishMessage(5, 0x00, nil, 3, 0, false, false), ErrInvalidTopicIdType},
+		{NewPublishMessage(5, 0x01, nil, 3, 0, false, false), nil},
+		{NewPublishMessage(0x6162, 0x02, nil, 3, 0, false, false), nil},
+		{&PublishMessage{TopicIdType: 0x03, TopicName: []byte("a/b")}, nil},
+		{&PublishMessage{TopicIdType: 0x03, TopicName: []byte("a/+")}, ErrInvalidTopicName},
+		{&SubscribeMessage{Qos: 1, MessageId: 1, TopicName: []byte("a/+/b/#")}, nil},
+		{&SubscribeMessage{Qos: 1, MessageId: 1, TopicName: []byte("a/#/b")}, ErrInvalidTopicFilter},
+		{&SubscribeMessage{Qos: 1, MessageId: 1, TopicName: []byte("a/b#")}, ErrInvalidTopicFilter},
+		{&SubscribeMessage{Qos: 1, MessageId: 1, TopicName: []byte("")}, ErrInvalidTopicFilter},
+		{&SubscribeMessage{Qos: 3, MessageId: 1, TopicName: []byte("a")}, ErrInvalidQos},
+		{&SubscribeMessage{Qos: 1, MessageId: 0, TopicName: []byte("a")}, ErrInvalidMessageId},
+		{&SubscribeMessage{TopicIdType: 0x02, MessageId: 1, TopicName: []byte("abc")}, ErrInvalidTopicName},
+		{&SubscribeMessage{TopicIdType: 0x01, MessageId: 1, TopicId: 0}, ErrInvalidTopicId},
+		{&UnsubscribeMessage{MessageId: 1, TopicName: []byte("a/#")}, nil},
+		{&UnsubscribeMessage{TopicIdType: 0x03, MessageId: 1}, ErrInvalidTopicIdType},
+		{NewRegisterMessage(0, 1, []byte("a/b")), nil},
+		{NewRegisterMessage(0, 1, []byte("a/+")), ErrInvalidTopicName},
+		{NewRegisterMessage(0, 1, []byte{0xFF, 0xFE}), ErrInvalidTopicName},
+		{&WillTopicMessage{}, nil},
+		{&WillTopicMessage{Qos: 1}, ErrInvalidFlags},
+		{&WillTopicMessage{Retain: true}, ErrInvalidFlags},
+		{&WillTopicMessage{Qos: 1, WillTopic: []byte("a/#")}, ErrInvalidTopicName},
+		{&WillTopicUpdateMessage{Qos: 3, WillTopic: []byte("a")}, ErrInvalidQos},
+		{&ConnectMessage{ProtocolId: 0x01, ClientId: []byte("c1")}, nil},
+		{&ConnectMessage{ProtocolId: 0x02, ClientId: []byte("c1")}, nil},
+		{&ConnectMessage{ProtocolId: 0x00, ClientId: []byte("c1")}, ErrInvalidProtocolId},
+		{&ConnectMessage{ProtocolId: 0x01, ClientId: make([]byte, 24)}, ErrInvalidClientId},
+		{&ConnackMessage{ReturnCode: 0x04}, ErrInvalidReturnCode},
+		{&ConnackMessage{Version: VERSION_2_0, ReturnCode: RC_NOT_AUTHORIZED}, nil},
+		{&DisconnectMessage{Version: VERSION_2_0, ReasonCode: 0x81}, ErrInvalidReturnCode},
+		{NewAuthMessage(RC_CONTINUE_AUTH, []byte("PLAIN"), nil), nil},
+		{NewAuthMessage(RC_NOT_AUTHORIZED, []byte("PLAIN"), nil), ErrInvalidReturnCode},
+		{NewAuthMessage(RC_CONTINUE_AUTH, nil, []byte{0x00}), ErrInvalidAuthMethod},
+		{&SubackMessage{MessageId: 1, ReturnCode: REJ_INVALID_TID}, nil},
+		{&PubrelMessage{}, ErrInvalidMessageId},
+		{&PingreqMessage{ClientId: make([]byte, 24)}, ErrInvalidClientId},
+		{NewEncapsulatedMessage(0x00, []byte{0x01}, &ConnackMessage{ReturnCode: 0x09}), ErrInvalidReturnCode},
+		{NewEncapsulatedMessage(0x00, []byte{0x01}, nil), ErrBadEncapsulation},
+	} {
+		assert.Equal(t, c.err, c.m.Validate(), c.m.String())
+	}
+}
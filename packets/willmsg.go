@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,16 +14,39 @@ func (wm *WillMsgMessage) MessageType() byte {
 	return WILLMSG
 }
 
+func (wm *WillMsgMessage) String() string {
+	return fmt.Sprintf("WILLMSG(len=%d)", len(wm.WillMsg))
+}
+
+func (wm *WillMsgMessage) MarshalJSON() ([]byte, error) {
+	type fields WillMsgMessage
+	return marshalMessage(wm, (*fields)(wm))
+}
+
+func (wm *WillMsgMessage) Validate() error {
+	return nil
+}
+
+func (wm *WillMsgMessage) Size() int {
+	return packetLength(len(wm.WillMsg) + 2)
+}
+
+func (wm *WillMsgMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, wm.Size(), WILLMSG)
+	return append(b, wm.WillMsg...)
+}
+
 func (wm *WillMsgMessage) Write(w io.Writer) error {
-	wm.Header.Length = uint16(len(wm.WillMsg) + 2)
-	packet := wm.Header.pack()
-	packet.WriteByte(WILLMSG)
-	packet.Write(wm.WillMsg)
-	_, err := packet.WriteTo(w)
+	wm.Header.Length = uint16(wm.Size())
+	return writePacket(w, wm)
+}
 
-	return err
+func (wm *WillMsgMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	wm.WillMsg = f.rest()
+	return f.end()
 }
 
-func (wm *WillMsgMessage) Unpack(b io.Reader) {
-	b.Read(wm.WillMsg)
+func (wm *WillMsgMessage) Unpack(b io.Reader) error {
+	return unpack(b, wm)
 }
@@ -12,14 +12,36 @@ func (wm *WillMsgReqMessage) MessageType() byte {
 	return WILLMSGREQ
 }
 
-func (wm *WillMsgReqMessage) Write(w io.Writer) error {
-	packet := wm.Header.pack()
-	packet.WriteByte(wm.Header.MessageType)
-	_, err := packet.WriteTo(w)
+func (wm *WillMsgReqMessage) String() string {
+	return "WILLMSGREQ"
+}
+
+func (wm *WillMsgReqMessage) MarshalJSON() ([]byte, error) {
+	type fields WillMsgReqMessage
+	return marshalMessage(wm, (*fields)(wm))
+}
+
+func (wm *WillMsgReqMessage) Validate() error {
+	return nil
+}
 
-	return err
+func (wm *WillMsgReqMessage) Size() int {
+	return 2
 }
 
-func (wm *WillMsgReqMessage) Unpack(b io.Reader) {
+func (wm *WillMsgReqMessage) AppendTo(b []byte) []byte {
+	return appendHeader(b, wm.Size(), WILLMSGREQ)
+}
+
+func (wm *WillMsgReqMessage) Write(w io.Writer) error {
+	wm.Header.Length = uint16(wm.Size())
+	return writePacket(w, wm)
+}
+
+func (wm *WillMsgReqMessage) Decode(body []byte) error {
+	return fields{buf: body}.end()
+}
 
+func (wm *WillMsgReqMessage) Unpack(b io.Reader) error {
+	return unpack(b, wm)
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (wm *WillMsgRespMessage) MessageType() byte {
 	return WILLMSGRESP
 }
 
+func (wm *WillMsgRespMessage) String() string {
+	return fmt.Sprintf("WILLMSGRESP(rc=%s)", returnCode(wm.ReturnCode))
+}
+
+func (wm *WillMsgRespMessage) MarshalJSON() ([]byte, error) {
+	type fields WillMsgRespMessage
+	return marshalMessage(wm, (*fields)(wm))
+}
+
+func (wm *WillMsgRespMessage) Validate() error {
+	return validReturnCode(wm.ReturnCode)
+}
+
+func (wm *WillMsgRespMessage) Size() int {
+	return 3
+}
+
+func (wm *WillMsgRespMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, wm.Size(), WILLMSGRESP)
+	return append(b, wm.ReturnCode)
+}
+
 func (wm *WillMsgRespMessage) Write(w io.Writer) error {
-	packet := wm.Header.pack()
-	packet.WriteByte(WILLMSGRESP)
-	packet.WriteByte(wm.ReturnCode)
-	_, err := packet.WriteTo(w)
+	wm.Header.Length = uint16(wm.Size())
+	return writePacket(w, wm)
+}
 
-	return err
+func (wm *WillMsgRespMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	wm.ReturnCode = f.readByte()
+	return f.end()
 }
 
-func (wm *WillMsgRespMessage) Unpack(b io.Reader) {
-	wm.ReturnCode = readByte(b)
+func (wm *WillMsgRespMessage) Unpack(b io.Reader) error {
+	return unpack(b, wm)
 }
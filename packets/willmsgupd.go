@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,16 +14,39 @@ func (wm *WillMsgUpdateMessage) MessageType() byte {
 	return WILLMSGUPD
 }
 
+func (wm *WillMsgUpdateMessage) String() string {
+	return fmt.Sprintf("WILLMSGUPD(len=%d)", len(wm.WillMsg))
+}
+
+func (wm *WillMsgUpdateMessage) MarshalJSON() ([]byte, error) {
+	type fields WillMsgUpdateMessage
+	return marshalMessage(wm, (*fields)(wm))
+}
+
+func (wm *WillMsgUpdateMessage) Validate() error {
+	return nil
+}
+
+func (wm *WillMsgUpdateMessage) Size() int {
+	return packetLength(len(wm.WillMsg) + 2)
+}
+
+func (wm *WillMsgUpdateMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, wm.Size(), WILLMSGUPD)
+	return append(b, wm.WillMsg...)
+}
+
 func (wm *WillMsgUpdateMessage) Write(w io.Writer) error {
-	wm.Header.Length = uint16(len(wm.WillMsg) + 2)
-	packet := wm.Header.pack()
-	packet.WriteByte(WILLMSGUPD)
-	packet.Write(wm.WillMsg)
-	_, err := packet.WriteTo(w)
+	wm.Header.Length = uint16(wm.Size())
+	return writePacket(w, wm)
+}
 
-	return err
+func (wm *WillMsgUpdateMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	wm.WillMsg = f.rest()
+	return f.end()
 }
 
-func (wm *WillMsgUpdateMessage) Unpack(b io.Reader) {
-	b.Read(wm.WillMsg)
+func (wm *WillMsgUpdateMessage) Unpack(b io.Reader) error {
+	return unpack(b, wm)
 }
@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -12,7 +14,30 @@ type WillTopicMessage struct {
 }
 
 func (wt *WillTopicMessage) MessageType() byte {
-	return wt.Header.MessageType
+	return WILLTOPIC
+}
+
+func (wt *WillTopicMessage) String() string {
+	if len(wt.WillTopic) == 0 {
+		return "WILLTOPIC(empty)"
+	}
+	return fmt.Sprintf("WILLTOPIC(topic=%q qos=%d%s)", wt.WillTopic, wt.Qos, flag(wt.Retain, "retain"))
+}
+
+func (wt *WillTopicMessage) MarshalJSON() ([]byte, error) {
+	type fields WillTopicMessage
+	return marshalMessage(wt, struct {
+		*fields
+		WillTopic text
+	}{(*fields)(wt), wt.WillTopic})
+}
+
+func (wt *WillTopicMessage) UnmarshalJSON(b []byte) error {
+	type fields WillTopicMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		WillTopic *text
+	}{(*fields)(wt), (*text)(&wt.WillTopic)})
 }
 
 func (wt *WillTopicMessage) encodeFlags() byte {
@@ -30,26 +55,45 @@ func (wt *WillTopicMessage) decodeFlags(b byte) {
 	wt.Retain = (b & RETAINFLAG) == RETAINFLAG
 }
 
-func (wt *WillTopicMessage) Write(w io.Writer) error {
+func (wt *WillTopicMessage) Validate() error {
+	return validWillTopic(wt.Qos, wt.Retain, wt.WillTopic)
+}
+
+func (wt *WillTopicMessage) Size() int {
+	// an empty WILLTOPIC, without flags, deletes the will
 	if len(wt.WillTopic) == 0 {
-		wt.Header.Length = 2
-	} else {
-		wt.Header.Length = uint16(len(wt.WillTopic) + 3)
+		return 2
 	}
-	packet := wt.Header.pack()
-	packet.WriteByte(wt.Header.MessageType)
-	if wt.Header.Length > 2 {
-		packet.WriteByte(wt.encodeFlags())
-		packet.Write(wt.WillTopic)
+	return packetLength(len(wt.WillTopic) + 3)
+}
+
+func (wt *WillTopicMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, wt.Size(), WILLTOPIC)
+	if len(wt.WillTopic) == 0 {
+		return b
 	}
-	_, err := packet.WriteTo(w)
+	b = append(b, wt.encodeFlags())
+	return append(b, wt.WillTopic...)
+}
 
-	return err
+func (wt *WillTopicMessage) Write(w io.Writer) error {
+	wt.Header.Length = uint16(wt.Size())
+	return writePacket(w, wt)
 }
 
-func (wt *WillTopicMessage) Unpack(b io.Reader) {
-	if wt.Header.Length > 2 {
-		wt.decodeFlags(readByte(b))
-		b.Read(wt.WillTopic)
+func (wt *WillTopicMessage) Decode(body []byte) error {
+	wt.Qos, wt.Retain, wt.WillTopic = 0, false, nil
+	if len(body) == 0 {
+		return nil
+	}
+	if body[0]&QOSBITS == QOSBITS {
+		return ErrInvalidFlags
 	}
+	wt.decodeFlags(body[0])
+	wt.WillTopic = body[1:]
+	return nil
+}
+
+func (wt *WillTopicMessage) Unpack(b io.Reader) error {
+	return unpack(b, wt)
 }
@@ -12,14 +12,36 @@ func (wt *WillTopicReqMessage) MessageType() byte {
 	return WILLTOPICREQ
 }
 
-func (wt *WillTopicReqMessage) Write(w io.Writer) error {
-	packet := wt.Header.pack()
-	packet.WriteByte(WILLTOPICREQ)
-	_, err := packet.WriteTo(w)
+func (wt *WillTopicReqMessage) String() string {
+	return "WILLTOPICREQ"
+}
+
+func (wt *WillTopicReqMessage) MarshalJSON() ([]byte, error) {
+	type fields WillTopicReqMessage
+	return marshalMessage(wt, (*fields)(wt))
+}
+
+func (wt *WillTopicReqMessage) Validate() error {
+	return nil
+}
 
-	return err
+func (wt *WillTopicReqMessage) Size() int {
+	return 2
 }
 
-func (wt *WillTopicReqMessage) Unpack(b io.Reader) {
+func (wt *WillTopicReqMessage) AppendTo(b []byte) []byte {
+	return appendHeader(b, wt.Size(), WILLTOPICREQ)
+}
+
+func (wt *WillTopicReqMessage) Write(w io.Writer) error {
+	wt.Header.Length = uint16(wt.Size())
+	return writePacket(w, wt)
+}
+
+func (wt *WillTopicReqMessage) Decode(body []byte) error {
+	return fields{buf: body}.end()
+}
 
+func (wt *WillTopicReqMessage) Unpack(b io.Reader) error {
+	return unpack(b, wt)
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -13,15 +14,39 @@ func (wt *WillTopicRespMessage) MessageType() byte {
 	return WILLTOPICRESP
 }
 
+func (wt *WillTopicRespMessage) String() string {
+	return fmt.Sprintf("WILLTOPICRESP(rc=%s)", returnCode(wt.ReturnCode))
+}
+
+func (wt *WillTopicRespMessage) MarshalJSON() ([]byte, error) {
+	type fields WillTopicRespMessage
+	return marshalMessage(wt, (*fields)(wt))
+}
+
+func (wt *WillTopicRespMessage) Validate() error {
+	return validReturnCode(wt.ReturnCode)
+}
+
+func (wt *WillTopicRespMessage) Size() int {
+	return 3
+}
+
+func (wt *WillTopicRespMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, wt.Size(), WILLTOPICRESP)
+	return append(b, wt.ReturnCode)
+}
+
 func (wt *WillTopicRespMessage) Write(w io.Writer) error {
-	packet := wt.Header.pack()
-	packet.WriteByte(WILLTOPICRESP)
-	packet.WriteByte(wt.ReturnCode)
-	_, err := packet.WriteTo(w)
+	wt.Header.Length = uint16(wt.Size())
+	return writePacket(w, wt)
+}
 
-	return err
+func (wt *WillTopicRespMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	wt.ReturnCode = f.readByte()
+	return f.end()
 }
 
-func (wt *WillTopicRespMessage) Unpack(b io.Reader) {
-	wt.ReturnCode = readByte(b)
+func (wt *WillTopicRespMessage) Unpack(b io.Reader) error {
+	return unpack(b, wt)
 }
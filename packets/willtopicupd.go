@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
@@ -15,6 +17,26 @@ func (wt *WillTopicUpdateMessage) MessageType() byte {
 	return WILLTOPICUPD
 }
 
+func (wt *WillTopicUpdateMessage) String() string {
+	return fmt.Sprintf("WILLTOPICUPD(topic=%q qos=%d%s)", wt.WillTopic, wt.Qos, flag(wt.Retain, "retain"))
+}
+
+func (wt *WillTopicUpdateMessage) MarshalJSON() ([]byte, error) {
+	type fields WillTopicUpdateMessage
+	return marshalMessage(wt, struct {
+		*fields
+		WillTopic text
+	}{(*fields)(wt), wt.WillTopic})
+}
+
+func (wt *WillTopicUpdateMessage) UnmarshalJSON(b []byte) error {
+	type fields WillTopicUpdateMessage
+	return json.Unmarshal(b, &struct {
+		*fields
+		WillTopic *text
+	}{(*fields)(wt), (*text)(&wt.WillTopic)})
+}
+
 func (wt *WillTopicUpdateMessage) encodeFlags() byte {
 	var b byte
 	b |= (wt.Qos << 5) & QOSBITS
@@ -29,18 +51,36 @@ func (wt *WillTopicUpdateMessage) decodeFlags(b byte) {
 	wt.Retain = (b & RETAINFLAG) == RETAINFLAG
 }
 
+func (wt *WillTopicUpdateMessage) Validate() error {
+	return validWillTopic(wt.Qos, wt.Retain, wt.WillTopic)
+}
+
+func (wt *WillTopicUpdateMessage) Size() int {
+	return packetLength(len(wt.WillTopic) + 3)
+}
+
+func (wt *WillTopicUpdateMessage) AppendTo(b []byte) []byte {
+	b = appendHeader(b, wt.Size(), WILLTOPICUPD)
+	b = append(b, wt.encodeFlags())
+	return append(b, wt.WillTopic...)
+}
+
 func (wt *WillTopicUpdateMessage) Write(w io.Writer) error {
-	wt.Header.Length = uint16(len(wt.WillTopic) + 3)
-	packet := wt.Header.pack()
-	packet.WriteByte(WILLTOPICUPD)
-	packet.WriteByte(wt.encodeFlags())
-	packet.Write(wt.WillTopic)
-	_, err := packet.WriteTo(w)
+	wt.Header.Length = uint16(wt.Size())
+	return writePacket(w, wt)
+}
 
-	return err
+func (wt *WillTopicUpdateMessage) Decode(body []byte) error {
+	f := fields{buf: body}
+	flags := f.readByte()
+	if flags&QOSBITS == QOSBITS {
+		return ErrInvalidFlags
+	}
+	wt.decodeFlags(flags)
+	wt.WillTopic = f.rest()
+	return f.end()
 }
 
-func (wt *WillTopicUpdateMessage) Unpack(b io.Reader) {
-	wt.decodeFlags(readByte(b))
-	b.Read(wt.WillTopic)
+func (wt *WillTopicUpdateMessage) Unpack(b io.Reader) error {
+	return unpack(b, wt)
 }